@@ -4,23 +4,16 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"time"
 
 	"github.com/PeterLee0620/GoIM/api/clients/tui/ui"
 	"github.com/PeterLee0620/GoIM/api/clients/tui/ui/client"
 	"github.com/PeterLee0620/GoIM/api/clients/tui/ui/client/storage/dbfile"
-	"github.com/PeterLee0620/GoIM/app/sdk/auth"
 	"github.com/PeterLee0620/GoIM/foundation/agents/ollamallm"
-	"github.com/PeterLee0620/GoIM/foundation/keystore"
-	"github.com/golang-jwt/jwt/v4"
 )
 
 const (
 	url            = "localhost:3000"
 	configFilePath = "zarf/client"
-	keysFolder     = "zarf/client/id/"
-	activeKID      = "key"
-	issuer         = "usdl project"
 )
 
 func main() {
@@ -38,39 +31,7 @@ func run() error {
 
 	// -------------------------------------------------------------------------
 
-	ks := keystore.New()
-
-	if _, err := ks.LoadByFileSystem(os.DirFS(keysFolder)); err != nil {
-		return fmt.Errorf("loading keys by fs: %w", err)
-	}
-	authCfg := auth.Config{
-		Log:       nil,
-		KeyLookup: ks,
-		Issuer:    issuer,
-	}
-
-	ath, err := auth.New(authCfg)
-	if err != nil {
-		return fmt.Errorf("constructing auth: %w", err)
-	}
-
-	tkn, err := ath.GenerateToken(activeKID, auth.Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   id.MyAccountID.Hex(),
-			Issuer:    issuer,
-			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(8760 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("generating token: %w", err)
-	}
-
-	fmt.Println("JWT:", tkn)
-
-	// -------------------------------------------------------------------------
-
-	db, err := dbfile.NewDB(configFilePath, id, tkn)
+	db, err := dbfile.NewDB(configFilePath, id)
 	if err != nil {
 		return fmt.Errorf("config: %w", err)
 	}
@@ -92,16 +53,16 @@ func run() error {
 
 	ui := ui.New(id.MyAccountID, agent)
 
-	app := client.NewApp(db, id, url, ui, tkn)
+	app := client.NewApp(db, id, url, ui)
 	defer app.Close()
 
 	ui.SetApp(app)
 
 	// -------------------------------------------------------------------------
 
-	if err := app.Handshake(db.MyAccount()); err != nil {
-		return fmt.Errorf("handshake: %w", err)
-	}
+	// The connection to the CAP is kept open in the background so the local
+	// history is available even when the CAP can't be reached.
+	app.Connect(db.MyAccount())
 
 	if err := app.Run(); err != nil {
 		return fmt.Errorf("run: %w", err)
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/app/sdk/errs"
+	"github.com/PeterLee0620/GoIM/foundation/signature"
+)
+
+// tokenRefreshWindow is how close to expiring a token can get before a new
+// one is requested.
+const tokenRefreshWindow = time.Minute
+
+// token returns a token for calling the CAP, logging in again when the
+// current token is about to expire.
+func (app *App) token(ctx context.Context) (string, error) {
+	app.jwtMu.Lock()
+	defer app.jwtMu.Unlock()
+
+	if app.jwt != "" && time.Until(app.jwtExpiresAt) > tokenRefreshWindow {
+		return app.jwt, nil
+	}
+
+	tkn, expiresAt, err := app.login(ctx)
+	if err != nil {
+		return "", fmt.Errorf("login: %w", err)
+	}
+
+	app.jwt = tkn
+	app.jwtExpiresAt = expiresAt
+
+	return tkn, nil
+}
+
+// login proves to the CAP we own the key for our account by signing the
+// challenge it provides and receives a token in exchange.
+func (app *App) login(ctx context.Context) (string, time.Time, error) {
+	chlReq := struct {
+		Address string `json:"address"`
+	}{
+		Address: app.id.MyAccountID.Hex(),
+	}
+
+	var chlResp struct {
+		Challenge string `json:"challenge"`
+	}
+
+	if err := app.authPost(ctx, "/auth/challenge", chlReq, &chlResp); err != nil {
+		return "", time.Time{}, fmt.Errorf("challenge: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+
+	v, r, s, err := signature.Sign(chlResp.Challenge, app.id.PrivKeyECDSA)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("sign challenge: %w", err)
+	}
+
+	tknReq := struct {
+		Address   string   `json:"address"`
+		Challenge string   `json:"challenge"`
+		V         *big.Int `json:"v"`
+		R         *big.Int `json:"r"`
+		S         *big.Int `json:"s"`
+	}{
+		Address:   app.id.MyAccountID.Hex(),
+		Challenge: chlResp.Challenge,
+		V:         v,
+		R:         r,
+		S:         s,
+	}
+
+	var tknResp struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	if err := app.authPost(ctx, "/auth/token", tknReq, &tknResp); err != nil {
+		return "", time.Time{}, fmt.Errorf("token: %w", err)
+	}
+
+	return tknResp.Token, tknResp.ExpiresAt, nil
+}
+
+func (app *App) authPost(ctx context.Context, path string, body any, v any) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(body); err != nil {
+		return fmt.Errorf("encoding error: %w", err)
+	}
+
+	url := fmt.Sprintf("http://%s%s", app.url, path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &b)
+	if err != nil {
+		return fmt.Errorf("create request error: %s: %w", url, err)
+	}
+
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := defaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("do: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("copy error: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errs *errs.Error
+		if err := json.Unmarshal(data, &errs); err != nil {
+			return fmt.Errorf("failed: response: %s, decoding error: %w ", string(data), err)
+		}
+
+		return errs
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed: response: %s, decoding error: %w ", string(data), err)
+	}
+
+	return nil
+}
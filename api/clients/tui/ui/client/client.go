@@ -16,105 +16,328 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PeterLee0620/GoIM/app/sdk/errs"
 	"github.com/PeterLee0620/GoIM/foundation/signature"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 var ErrConnectionDropped = errors.New("connection dropped")
 
+// MyAccount represents the account on this device. Device identifies this
+// install when the same account is used from several devices at once.
+// DownloadPath is where accepted files are saved.
 type MyAccount struct {
-	ID          common.Address
-	Name        string
-	ProfilePath string
-	JWT         string
+	ID           common.Address
+	Name         string
+	ProfilePath  string
+	Device       string
+	DownloadPath string
 }
 
+// MessageStatus represents how far a message has got to the recipient.
+type MessageStatus int
+
+// Set of message states reported by the recipient through receipts.
+const (
+	StatusSent MessageStatus = iota
+	StatusDelivered
+	StatusRead
+)
+
+// Message is a message in a conversation. ReplyTo is the ID of the message
+// this one replies to. Revisions holds what the message said before each
+// edit, oldest first. A deleted message has no content. Reactions holds who
+// reacted to the message with each emoji. File is set when the message
+// offers a file.
 type Message struct {
+	ID          uuid.UUID
+	ReplyTo     uuid.UUID
 	From        common.Address
 	To          common.Address
+	GroupID     common.Address
 	Name        string
 	Content     [][]byte
 	DateCreated time.Time
 	Encrypted   bool
+	Nonce       uint64
+	Device      string
+	Status      MessageStatus
+	Revisions   [][][]byte
+	Deleted     bool
+	Reactions   map[string][]common.Address
+	File        *FileOffer
+}
+
+// Ref returns the short form of the message ID used to refer to a message
+// in the edit and delete commands.
+func (m Message) Ref() string {
+	if m.ID == uuid.Nil {
+		return ""
+	}
+
+	return m.ID.String()[:8]
+}
+
+// FileOffer is a file offered in a conversation. Hash is the hex encoded
+// SHA-256 of the file. Key is the key the file was encrypted with, encrypted
+// with our own key, and is only known for files offered to us.
+type FileOffer struct {
+	ID   uuid.UUID
+	Name string
+	Size int64
+	Hash string
+	Key  []byte
+}
+
+// OutboxMessage is a signed message waiting for a connection to the CAP.
+type OutboxMessage struct {
+	ID    uuid.UUID
+	To    common.Address
+	Nonce uint64
+	Data  []byte
+}
+
+// Upload is a file being uploaded to the CAP. It's kept until the file is
+// offered to the contact so the upload can be resumed after a restart. Hash
+// is the hex encoded SHA-256 of the file when the upload started. Key is the
+// key the file is encrypted with, encrypted with our own key.
+type Upload struct {
+	ID        uuid.UUID
+	To        common.Address
+	Path      string
+	Size      int64
+	Hash      string
+	Key       []byte
+	ChunkSize int64
+	Chunks    int
 }
 
+// User represents a contact or a group. Each device of a contact has its own
+// nonce sequence, so the last nonce seen is tracked by device.
 type User struct {
 	ID           common.Address
 	Name         string
 	AppLastNonce uint64
-	LastNonce    uint64
+	LastNonces   map[string]uint64
 	Key          string
 	TCPHost      string
+	Group        bool
+	Members      []common.Address
+	MemberNonces map[string]uint64
 	Messages     []Message
 }
 
+// MemberNonceKey returns the key for a group member's device in the set of
+// member nonces.
+func MemberNonceKey(memberID common.Address, device string) string {
+	return memberID.Hex() + "/" + device
+}
+
 type Storage interface {
 	Contacts() []User
 	QueryContactByID(id common.Address) (User, error)
 	InsertContact(id common.Address, name string) (User, error)
 	InsertMessage(id common.Address, msg Message) error
 	UpdateAppNonce(id common.Address, nonce uint64) error
-	UpdateContactNonce(id common.Address, nonce uint64) error
+	UpdateContactNonce(id common.Address, device string, nonce uint64) error
 	UpdateContactKey(id common.Address, key string) error
+	DeleteContact(id common.Address) error
+	InsertGroup(id common.Address, name string, members []common.Address) (User, error)
+	UpdateGroupMembers(id common.Address, members []common.Address) error
+	UpdateGroupMemberNonce(id common.Address, memberID common.Address, device string, nonce uint64) error
+	UpdateMessageStatus(id common.Address, from common.Address, device string, nonces []uint64, status MessageStatus) error
+	EditMessage(id common.Address, from common.Address, msgID uuid.UUID, content [][]byte) error
+	DeleteMessage(id common.Address, from common.Address, msgID uuid.UUID) error
+	UpdateReaction(id common.Address, from common.Address, msgID uuid.UUID, emoji string, add bool) error
+	QueryReplies(id common.Address, msgID uuid.UUID) ([]Message, error)
+	LastSeq() uint64
+	UpdateLastSeq(seq uint64) error
+	InsertOutbox(msg OutboxMessage) error
+	QueryOutbox() ([]OutboxMessage, error)
+	DeleteOutbox(id uuid.UUID) error
+	InsertUpload(upload Upload) error
+	QueryUploads() ([]Upload, error)
+	DeleteUpload(id uuid.UUID) error
 }
 
 type UI interface {
 	Run() error // Must be non-blocking
 	WriteText(msg Message)
 	AddContact(id common.Address, name string)
+	AddGroup(id common.Address, name string)
+	RemoveContact(id common.Address)
+	RefreshContact(id common.Address)
 	ApplyContactPrefix(id common.Address, option string, add bool)
 }
 
 // =============================================================================
 
+// protocolVersion is the version of the message envelope spoken with the CAP.
+const protocolVersion = 7
+
+// tcpGrantTTL is how long the CAP can speak for us on a TCP connection we
+// asked it to dial. The CAP accepts grants for up to an hour.
+const tcpGrantTTL = 30 * time.Minute
+
+// msgType identifies what a message carries.
+type msgType string
+
+// Set of message types carried in the envelope.
+const (
+	msgTypeChat     msgType = "chat"
+	msgTypeEvent    msgType = "event"
+	msgTypeCommand  msgType = "command"
+	msgTypeReceipt  msgType = "receipt"
+	msgTypeGroup    msgType = "group"
+	msgTypeEdit     msgType = "edit"
+	msgTypeDelete   msgType = "delete"
+	msgTypeReaction msgType = "reaction"
+	msgTypeFile     msgType = "file"
+)
+
+// envelope is the header every message on the wire carries. The ID is signed
+// with the message, so it identifies the message on every device. ReplyTo is
+// the ID of the message this one is a reply to.
+type envelope struct {
+	Version int       `json:"version"`
+	Type    msgType   `json:"type"`
+	ID      uuid.UUID `json:"id"`
+	ReplyTo uuid.UUID `json:"replyTo,omitzero"`
+}
+
+func newEnvelope(typ msgType) envelope {
+	return envelope{
+		Version: protocolVersion,
+		Type:    typ,
+		ID:      uuid.New(),
+	}
+}
+
+// outgoingMessage is a message sent to the CAP. Mirror is a copy of an
+// encrypted message our other devices can decrypt.
 type outgoingMessage struct {
+	envelope
+	ToID       common.Address `json:"toID"`
+	GroupID    common.Address `json:"groupID,omitempty"`
+	Encrypted  bool           `json:"encrypted"`
+	Msg        [][]byte       `json:"msg"`
+	Mirror     [][]byte       `json:"mirror,omitempty"`
+	FromNonce  uint64         `json:"fromNonce"`
+	FromDevice string         `json:"fromDevice"`
+	V          *big.Int       `json:"v"`
+	R          *big.Int       `json:"r"`
+	S          *big.Int       `json:"s"`
+}
+
+type usr struct {
+	ID     common.Address `json:"id"`
+	Name   string         `json:"name"`
+	Nonce  uint64         `json:"nonce"`
+	Device string         `json:"device"`
+}
+
+// incomingMessage is a message from the CAP. Seq is the delivery sequence
+// the CAP assigned to the message, events don't have one. A message from one
+// of our other devices carries a mirror we can decrypt.
+type incomingMessage struct {
+	envelope
+	Seq       uint64         `json:"seq"`
+	From      usr            `json:"from"`
 	ToID      common.Address `json:"toID"`
+	GroupID   common.Address `json:"groupID"`
 	Encrypted bool           `json:"encrypted"`
 	Msg       [][]byte       `json:"msg"`
-	FromNonce uint64         `json:"fromNonce"`
+	Mirror    [][]byte       `json:"mirror"`
 	V         *big.Int       `json:"v"`
 	R         *big.Int       `json:"r"`
 	S         *big.Int       `json:"s"`
 }
 
-type usr struct {
-	ID    common.Address `json:"id"`
-	Name  string         `json:"name"`
-	Nonce uint64         `json:"nonce"`
+// signedData returns the data the sender signed for this message. A group
+// message is signed for the group.
+func (m incomingMessage) signedData() any {
+	toID := m.ToID
+	if m.GroupID != (common.Address{}) {
+		toID = m.GroupID
+	}
+
+	return signedData(m.envelope, toID, m.GroupID, m.Msg, m.From.Nonce, m.From.Device)
 }
 
-type incomingMessage struct {
-	From      usr      `json:"from"`
-	Encrypted bool     `json:"encrypted"`
-	Msg       [][]byte `json:"msg"`
+// signedData returns the data signed for a message. A message to a group is
+// signed with the group as its ID so the CAP can only fan it out to the
+// members.
+func signedData(env envelope, toID common.Address, groupID common.Address, msg [][]byte, nonce uint64, device string) any {
+	dataToSign := struct {
+		Version    int
+		Type       msgType
+		ID         uuid.UUID
+		ReplyTo    uuid.UUID
+		ToID       common.Address
+		GroupID    common.Address
+		Msg        [][]byte
+		FromNonce  uint64
+		FromDevice string
+	}{
+		Version:    env.Version,
+		Type:       env.Type,
+		ID:         env.ID,
+		ReplyTo:    env.ReplyTo,
+		ToID:       toID,
+		GroupID:    groupID,
+		Msg:        msg,
+		FromNonce:  nonce,
+		FromDevice: device,
+	}
+
+	return dataToSign
 }
 
 // =============================================================================
 
 type App struct {
-	db   Storage
-	ui   UI
-	id   ID
-	url  string
-	jwt  string
-	conn *websocket.Conn
+	db           Storage
+	ui           UI
+	id           ID
+	url          string
+	jwt          string
+	jwtExpiresAt time.Time
+	jwtMu        sync.Mutex
+	device       string
+	downloads    string
+	conn         *websocket.Conn
+	outbox       bool
+	sendMu       sync.Mutex
+	uploading    map[uuid.UUID]bool
+	uploadMu     sync.Mutex
+	shut         chan struct{}
+	shutOnce     sync.Once
 }
 
-func NewApp(db Storage, id ID, url string, ui UI, jwt string) *App {
+func NewApp(db Storage, id ID, url string, ui UI) *App {
 	return &App{
-		db:  db,
-		ui:  ui,
-		id:  id,
-		jwt: jwt,
-		url: url,
+		db:        db,
+		ui:        ui,
+		id:        id,
+		url:       url,
+		uploading: make(map[uuid.UUID]bool),
+		shut:      make(chan struct{}),
 	}
 }
 
 func (app *App) Close() error {
+	app.shutOnce.Do(func() {
+		close(app.shut)
+	})
+
+	app.sendMu.Lock()
+	defer app.sendMu.Unlock()
+
 	if app.conn == nil {
 		return nil
 	}
@@ -130,19 +353,41 @@ func (app *App) Run() error {
 	return app.ui.Run()
 }
 
+// Handshake opens a connection to the CAP and proves who we are. Messages
+// can be sent once the handshake is complete.
 func (app *App) Handshake(acct MyAccount) error {
 	url := fmt.Sprintf("ws://%s/connect", app.url)
 
+	tkn, err := app.token(context.Background())
+	if err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+
 	requestHeader := http.Header{}
-	requestHeader.Add("Authorization", "Bearer "+app.jwt)
+	requestHeader.Add("Authorization", "Bearer "+tkn)
 
 	conn, resp, err := websocket.DefaultDialer.Dial(url, requestHeader)
 	if err != nil {
-		return fmt.Errorf("dial: %w: %s", err, resp.Status)
+		if resp != nil {
+			return fmt.Errorf("dial: %w: %s", err, resp.Status)
+		}
+		return fmt.Errorf("dial: %w", err)
+	}
+
+	if err := app.handshake(conn, acct); err != nil {
+		conn.Close()
+		return err
 	}
 
+	app.sendMu.Lock()
+	defer app.sendMu.Unlock()
+
 	app.conn = conn
 
+	return nil
+}
+
+func (app *App) handshake(conn *websocket.Conn, acct MyAccount) error {
 	// -------------------------------------------------------------------------
 
 	_, msg, err := conn.ReadMessage()
@@ -150,18 +395,36 @@ func (app *App) Handshake(acct MyAccount) error {
 		return fmt.Errorf("read: %w", err)
 	}
 
-	if string(msg) != "HELLO" {
+	challenge, found := strings.CutPrefix(string(msg), "CHALLENGE ")
+	if !found {
 		return fmt.Errorf("unexpected message: %s", msg)
 	}
 
 	// -------------------------------------------------------------------------
 
+	v, r, s, err := signature.Sign(challenge, app.id.PrivKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("sign challenge: %w", err)
+	}
+
 	user := struct {
-		ID   common.Address
-		Name string
+		Version int            `json:"version"`
+		ID      common.Address `json:"id"`
+		Name    string         `json:"name"`
+		Device  string         `json:"device"`
+		Cursor  uint64         `json:"cursor"`
+		V       *big.Int       `json:"v"`
+		R       *big.Int       `json:"r"`
+		S       *big.Int       `json:"s"`
 	}{
-		ID:   app.id.MyAccountID,
-		Name: acct.Name,
+		Version: protocolVersion,
+		ID:      app.id.MyAccountID,
+		Name:    acct.Name,
+		Device:  acct.Device,
+		Cursor:  app.db.LastSeq(),
+		V:       v,
+		R:       r,
+		S:       s,
 	}
 
 	data, err := json.Marshal(user)
@@ -175,21 +438,23 @@ func (app *App) Handshake(acct MyAccount) error {
 
 	// -------------------------------------------------------------------------
 
-	if _, _, err = conn.ReadMessage(); err != nil {
+	_, msg, err = conn.ReadMessage()
+	if err != nil {
 		return fmt.Errorf("read: %w", err)
 	}
 
-	// -------------------------------------------------------------------------
-
-	go func() {
-		app.ReceiveCapMessage(conn)
-	}()
+	if !strings.HasPrefix(string(msg), "WELCOME") {
+		return fmt.Errorf("handshake rejected: %s", msg)
+	}
 
 	return nil
 }
 
 // =============================================================================
 
+// ReceiveCapMessage processes the messages from the CAP until the connection
+// fails. A message that can't be processed is reported and skipped so it
+// doesn't stop the messages after it.
 func (app *App) ReceiveCapMessage(conn *websocket.Conn) {
 	for {
 		_, rawMsg, err := conn.ReadMessage()
@@ -201,7 +466,36 @@ func (app *App) ReceiveCapMessage(conn *websocket.Conn) {
 		var inMsg incomingMessage
 		if err := json.Unmarshal(rawMsg, &inMsg); err != nil {
 			app.ui.WriteText(errorMessage("unmarshal: %s", err))
-			return
+			continue
+		}
+
+		if inMsg.Version != protocolVersion {
+			app.ui.WriteText(errorMessage("unsupported protocol version: %d", inMsg.Version))
+			continue
+		}
+
+		// The cursor moves before the message is processed. A message that
+		// fails is not replayed since the nonce checks would reject it.
+		if inMsg.Seq > app.db.LastSeq() {
+			if err := app.db.UpdateLastSeq(inMsg.Seq); err != nil {
+				app.ui.WriteText(errorMessage("update last seq: %s", err))
+			}
+		}
+
+		// Group messages are tracked against the group and not the sender.
+		if inMsg.GroupID != (common.Address{}) {
+			if err := app.receiveGroupMessage(inMsg); err != nil {
+				app.ui.WriteText(errorMessage("group message: %s", err))
+			}
+			continue
+		}
+
+		// A message from us was sent from one of our other devices.
+		if inMsg.From.ID == app.id.MyAccountID && inMsg.Type != msgTypeEvent {
+			if err := app.receiveMirror(inMsg); err != nil {
+				app.ui.WriteText(errorMessage("mirror message: %s", err))
+			}
+			continue
 		}
 
 		user, err := app.db.QueryContactByID(inMsg.From.ID)
@@ -210,7 +504,7 @@ func (app *App) ReceiveCapMessage(conn *websocket.Conn) {
 			user, err = app.db.InsertContact(inMsg.From.ID, inMsg.From.Name)
 			if err != nil {
 				app.ui.WriteText(errorMessage("add contact: %s", err))
-				return
+				continue
 			}
 
 			app.ui.AddContact(inMsg.From.ID, inMsg.From.Name)
@@ -223,21 +517,21 @@ func (app *App) ReceiveCapMessage(conn *websocket.Conn) {
 
 		if len(inMsg.Msg) == 0 {
 			app.ui.WriteText(errorMessage("no message"))
-			return
+			continue
 		}
 
 		// -----------------------------------------------------------------
 
-		if string(inMsg.Msg[0]) != "EVENT" {
-			expNonce := user.LastNonce + 1
+		if inMsg.Type != msgTypeEvent {
+			expNonce := user.LastNonces[inMsg.From.Device] + 1
 			if inMsg.From.Nonce < expNonce {
 				app.ui.WriteText(errorMessage("invalid nonce: possible security issue with contact: got: %d, exp: %d", inMsg.From.Nonce, expNonce))
-				return
+				continue
 			}
 
-			if err := app.db.UpdateContactNonce(inMsg.From.ID, expNonce); err != nil {
+			if err := app.db.UpdateContactNonce(inMsg.From.ID, inMsg.From.Device, expNonce); err != nil {
 				app.ui.WriteText(errorMessage("update app nonce: %s", err))
-				return
+				continue
 			}
 		}
 
@@ -245,102 +539,106 @@ func (app *App) ReceiveCapMessage(conn *websocket.Conn) {
 
 		if err := app.preprocessRecvMessage(inMsg); err != nil {
 			app.ui.WriteText(errorMessage("preprocess message: %s", err))
-			return
 		}
 	}
 }
 
 func (app *App) SendMessageHandler(to common.Address, msg []byte) error {
-	if app.conn == nil {
-		return fmt.Errorf("no connection")
+	return app.sendMessage(to, uuid.Nil, msg)
+}
+
+// SendReplyHandler sends a message as a reply to an earlier message in the
+// conversation.
+func (app *App) SendReplyHandler(to common.Address, replyTo uuid.UUID, msg []byte) error {
+	usr, err := app.db.QueryContactByID(to)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
 	}
 
+	if _, err := findMessage(usr, replyTo); err != nil {
+		return err
+	}
+
+	return app.sendMessage(to, replyTo, msg)
+}
+
+func (app *App) sendMessage(to common.Address, replyTo uuid.UUID, msg []byte) error {
 	if len(msg) == 0 {
 		return fmt.Errorf("message cannot be empty")
 	}
 
+	// File transfers run in the background and aren't sent as a message.
+	if ok, err := app.fileCommand(to, msg); ok {
+		return err
+	}
+
 	usr, err := app.db.QueryContactByID(to)
 	if err != nil {
 		return fmt.Errorf("query contact: %w", err)
 	}
 
-	// -------------------------------------------------------------------------
-	// Split message into chunks of 240 bytes so they can be encrypted.
+	msgs := chunkMessage(msg)
 
-	const maxBytes = 240
-	var msgs [][]byte
-	chunks := (len(msg) / maxBytes) + 1 // Calculate the number of chunks.
-	var start int
-
-	for range chunks {
-		end := min(start+maxBytes, len(msg))
-		msgs = append(msgs, msg[start:end])
-		start = start + maxBytes
-	}
-
-	onWire, onScreen, err := app.preprocessSendMessage(usr, msgs)
+	// The destination can change from the selected contact, like when a
+	// command creates a new group.
+	dest, typ, onWire, onScreen, err := app.preprocessSendMessage(usr, msgs)
 	if err != nil {
 		return fmt.Errorf("preprocess message: %w", err)
 	}
 
-	// -------------------------------------------------------------------------
-
-	nonce := usr.AppLastNonce + 1
+	to = dest.ID
 
-	dataToSign := struct {
-		ToID      common.Address
-		Msg       [][]byte
-		FromNonce uint64
-	}{
-		ToID:      to,
-		Msg:       onWire,
-		FromNonce: nonce,
-	}
-
-	v, r, s, err := signature.Sign(dataToSign, app.id.PrivKeyECDSA)
-	if err != nil {
-		return fmt.Errorf("signing: %w", err)
+	if replyTo != uuid.Nil && typ != msgTypeChat {
+		return fmt.Errorf("only messages can be sent as a reply")
 	}
 
 	var encrypted bool
-	if usr.Key != "" {
+	if dest.Key != "" {
 		encrypted = true
 	}
 
-	outMsg := outgoingMessage{
-		ToID:      to,
-		Encrypted: encrypted,
-		Msg:       onWire,
-		FromNonce: nonce,
-		V:         v,
-		R:         r,
-		S:         s,
-	}
+	// Our other devices can't decrypt what was encrypted for the contact, so
+	// they get a copy encrypted with our own key.
+	var mirror [][]byte
+	if encrypted {
+		switch typ {
+		case msgTypeChat:
+			mirror, err = encryptMessages(&app.id.PrivKeyRSA.PublicKey, onScreen)
+		case msgTypeEdit:
+			mirror, err = encryptEdit(&app.id.PrivKeyRSA.PublicKey, onScreen)
+		}
 
-	data, err := json.Marshal(outMsg)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+		if err != nil {
+			return fmt.Errorf("encrypt mirror: %w", err)
+		}
 	}
 
-	if err := app.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-		return fmt.Errorf("write: %w", err)
-	}
+	env := newEnvelope(typ)
+	env.ReplyTo = replyTo
 
-	// -------------------------------------------------------------------------
+	nonce, queued, err := app.sendSigned(env, to, encrypted, onWire, mirror)
+	if err != nil {
+		return err
+	}
 
-	if err := app.db.UpdateAppNonce(to, nonce); err != nil {
-		return fmt.Errorf("update app nonce: %w", err)
+	if queued {
+		app.ui.WriteText(systemMessage("not connected, message queued for delivery"))
 	}
 
 	// -------------------------------------------------------------------------
 
-	if msg[0] != '/' {
+	if typ == msgTypeChat {
 		msg := Message{
+			ID:        env.ID,
+			ReplyTo:   env.ReplyTo,
 			From:      app.id.MyAccountID,
 			To:        to,
 			Name:      "You",
 			Content:   onScreen,
 			Encrypted: encrypted,
+			Nonce:     nonce,
+			Device:    app.device,
+			Status:    StatusSent,
 		}
 
 		if err := app.db.InsertMessage(to, msg); err != nil {
@@ -348,11 +646,102 @@ func (app *App) SendMessageHandler(to common.Address, msg []byte) error {
 		}
 
 		app.ui.WriteText(msg)
+
+		return nil
+	}
+
+	if typ == msgTypeEdit || typ == msgTypeDelete {
+		return app.applyEdit(app.id.MyAccountID, to, typ, onScreen)
+	}
+
+	if typ == msgTypeGroup {
+		desc, err := app.applyGroupOperation(app.id.MyAccountID, to, onWire)
+		if err != nil {
+			return fmt.Errorf("group operation: %w", err)
+		}
+
+		app.ui.WriteText(Message{
+			Name:    "system",
+			Content: [][]byte{[]byte(desc)},
+		})
 	}
 
 	return nil
 }
 
+// sendSigned signs the message with the next nonce for the destination and
+// writes it to the CAP. Messages are sent one at a time so the nonces stay in
+// order and the connection only has one writer. When we are not connected,
+// or there are older messages still waiting, the message is queued in the
+// outbox.
+func (app *App) sendSigned(env envelope, to common.Address, encrypted bool, onWire [][]byte, mirror [][]byte) (uint64, bool, error) {
+	app.sendMu.Lock()
+	defer app.sendMu.Unlock()
+
+	dest, err := app.db.QueryContactByID(to)
+	if err != nil {
+		return 0, false, fmt.Errorf("query contact: %w", err)
+	}
+
+	nonce := dest.AppLastNonce + 1
+
+	var groupID common.Address
+	if dest.Group {
+		groupID = to
+	}
+
+	dataToSign := signedData(env, to, groupID, onWire, nonce, app.device)
+
+	v, r, s, err := signature.Sign(dataToSign, app.id.PrivKeyECDSA)
+	if err != nil {
+		return 0, false, fmt.Errorf("signing: %w", err)
+	}
+
+	outMsg := outgoingMessage{
+		envelope:   env,
+		ToID:       to,
+		GroupID:    groupID,
+		Encrypted:  encrypted,
+		Msg:        onWire,
+		Mirror:     mirror,
+		FromNonce:  nonce,
+		FromDevice: app.device,
+		V:          v,
+		R:          r,
+		S:          s,
+	}
+
+	data, err := json.Marshal(outMsg)
+	if err != nil {
+		return 0, false, fmt.Errorf("marshal: %w", err)
+	}
+
+	if err := app.db.UpdateAppNonce(to, nonce); err != nil {
+		return 0, false, fmt.Errorf("update app nonce: %w", err)
+	}
+
+	if app.conn == nil || app.outbox {
+		if err := app.queueOutbox(env.ID, to, nonce, data); err != nil {
+			return 0, false, err
+		}
+
+		return nonce, true, nil
+	}
+
+	if err := app.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		app.conn.Close()
+		app.conn = nil
+
+		if err := app.queueOutbox(env.ID, to, nonce, data); err != nil {
+			return 0, false, err
+		}
+
+		return nonce, true, nil
+	}
+
+	return nonce, false, nil
+}
+
 func (app *App) Contacts() []User {
 	return app.db.Contacts()
 }
@@ -396,7 +785,12 @@ func (app *App) GetState(ctx context.Context) (StateResponse, error) {
 
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Add("Authorization", "Bearer "+app.jwt)
+	tkn, err := app.token(ctx)
+	if err != nil {
+		return StateResponse{}, fmt.Errorf("token: %w", err)
+	}
+
+	req.Header.Add("Authorization", "Bearer "+tkn)
 
 	resp, err := defaultClient.Do(req)
 	if err != nil {
@@ -426,14 +820,43 @@ func (app *App) EstablishTCPConnection(ctx context.Context, tuiUserID common.Add
 		return fmt.Errorf("no TCP host found for contact: %s", clientUserID)
 	}
 
+	// The CAP can only speak for us on the connection with a grant we
+	// signed.
+	grant := struct {
+		UserID  common.Address
+		Expires int64
+	}{
+		UserID:  tuiUserID,
+		Expires: time.Now().Add(tcpGrantTTL).Unix(),
+	}
+
+	v, r, s, err := signature.Sign(grant, app.id.PrivKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("signing grant: %w", err)
+	}
+
+	type tcpGrant struct {
+		Expires int64    `json:"expires"`
+		V       *big.Int `json:"v"`
+		R       *big.Int `json:"r"`
+		S       *big.Int `json:"s"`
+	}
+
 	tcpConnRequest := struct {
-		TUIUserID    string `json:"tui_user_id"`
-		ClientUserID string `json:"client_user_id"`
-		TCPHost      string `json:"tcp_host"`
+		TUIUserID    string   `json:"tui_user_id"`
+		ClientUserID string   `json:"client_user_id"`
+		TCPHost      string   `json:"tcp_host"`
+		Grant        tcpGrant `json:"grant"`
 	}{
 		TUIUserID:    tuiUserID.String(),
 		ClientUserID: clientUserID.String(),
 		TCPHost:      usr.TCPHost,
+		Grant: tcpGrant{
+			Expires: grant.Expires,
+			V:       v,
+			R:       r,
+			S:       s,
+		},
 	}
 
 	var b bytes.Buffer
@@ -450,7 +873,12 @@ func (app *App) EstablishTCPConnection(ctx context.Context, tuiUserID common.Add
 
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Add("Authorization", "Bearer "+app.jwt)
+	tkn, err := app.token(ctx)
+	if err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+
+	req.Header.Add("Authorization", "Bearer "+tkn)
 
 	resp, err := defaultClient.Do(req)
 	if err != nil {
@@ -496,11 +924,13 @@ func (app *App) preprocessRecvMessage(inMsg incomingMessage) error {
 		return fmt.Errorf("no message")
 	}
 
+	switch inMsg.Type {
+
 	// -------------------------------------------------------------------------
 	// Process Event Message
 
-	if string(msgs[0]) == "EVENT" {
-		switch string(msgs[1]) {
+	case msgTypeEvent:
+		switch string(msgs[0]) {
 		case "TCP-CONN":
 			app.ui.WriteText(Message{
 				From:    inMsg.From.ID,
@@ -521,30 +951,49 @@ func (app *App) preprocessRecvMessage(inMsg incomingMessage) error {
 
 			app.ui.ApplyContactPrefix(inMsg.From.ID, "->", false)
 
+		case "QUEUED":
+			app.ui.WriteText(Message{
+				From:    inMsg.From.ID,
+				To:      app.id.MyAccountID,
+				Name:    "system",
+				Content: [][]byte{[]byte("User is offline, message queued for delivery: " + inMsg.From.ID.String())},
+			})
+
 		default:
 			return fmt.Errorf("unknown event: %s", string(inMsg.Msg[0]))
 		}
 
 		return nil
-	}
+
+	// -------------------------------------------------------------------------
+	// Process Receipt Message
+
+	case msgTypeReceipt:
+		return app.receiveReceipt(inMsg)
 
 	// -------------------------------------------------------------------------
 	// Process Normal Message
 
-	if msgs[0][0] != '/' {
+	case msgTypeChat:
 		if !inMsg.Encrypted {
 			msg := Message{
+				ID:        inMsg.ID,
+				ReplyTo:   inMsg.ReplyTo,
 				From:      inMsg.From.ID,
 				To:        app.id.MyAccountID,
 				Name:      inMsg.From.Name,
 				Content:   msgs,
 				Encrypted: false,
+				Nonce:     inMsg.From.Nonce,
+				Device:    inMsg.From.Device,
 			}
 
 			if err := app.db.InsertMessage(inMsg.From.ID, msg); err != nil {
 				return fmt.Errorf("add message: %w", err)
 			}
 
+			app.sendReceipt(inMsg.From.ID, StatusDelivered, msg.Device, msg.Nonce)
+
 			app.ui.WriteText(msg)
 			return nil
 		}
@@ -561,34 +1010,64 @@ func (app *App) preprocessRecvMessage(inMsg incomingMessage) error {
 		}
 
 		msg := Message{
+			ID:        inMsg.ID,
+			ReplyTo:   inMsg.ReplyTo,
 			From:      inMsg.From.ID,
 			To:        app.id.MyAccountID,
 			Name:      inMsg.From.Name,
 			Content:   decryptedData,
 			Encrypted: true,
+			Nonce:     inMsg.From.Nonce,
+			Device:    inMsg.From.Device,
 		}
 
 		if err := app.db.InsertMessage(inMsg.From.ID, msg); err != nil {
 			return fmt.Errorf("add message: %w", err)
 		}
 
+		app.sendReceipt(inMsg.From.ID, StatusDelivered, msg.Device, msg.Nonce)
+
 		app.ui.WriteText(msg)
 		return nil
-	}
+
+	// -------------------------------------------------------------------------
+	// Process Edits
+
+	case msgTypeEdit, msgTypeDelete:
+		return app.receiveEdit(inMsg, inMsg.From.ID)
+
+	// -------------------------------------------------------------------------
+	// Process Reactions
+
+	case msgTypeReaction:
+		return app.receiveReaction(inMsg, inMsg.From.ID)
+
+	// -------------------------------------------------------------------------
+	// Process Files
+
+	case msgTypeFile:
+		return app.receiveFile(inMsg)
 
 	// -------------------------------------------------------------------------
 	// Process Commands
 
-	msgStr := string(msgs[0])
+	case msgTypeCommand:
+		return app.receiveCommand(inMsg)
+	}
 
-	parts := strings.Split(msgStr[1:], " ")
-	if len(parts) < 2 {
-		return fmt.Errorf("invalid command format: parts: %d", len(parts))
+	return fmt.Errorf("unknown message type: %q", inMsg.Type)
+}
+
+func (app *App) receiveCommand(inMsg incomingMessage) error {
+	msgs := inMsg.Msg
+
+	if len(msgs) < 2 {
+		return fmt.Errorf("invalid command format: parts: %d", len(msgs))
 	}
 
-	switch parts[0] {
+	switch string(msgs[0]) {
 	case "key":
-		if err := app.db.UpdateContactKey(inMsg.From.ID, msgStr[5:]); err != nil {
+		if err := app.db.UpdateContactKey(inMsg.From.ID, string(msgs[1])); err != nil {
 			return fmt.Errorf("updating key: %w", err)
 		}
 
@@ -612,66 +1091,118 @@ func (app *App) preprocessRecvMessage(inMsg incomingMessage) error {
 	return fmt.Errorf("unknown command")
 }
 
-func (app *App) preprocessSendMessage(usr User, msgs [][]byte) (onWire [][]byte, onScreen [][]byte, err error) {
+func (app *App) preprocessSendMessage(usr User, msgs [][]byte) (dest User, typ msgType, onWire [][]byte, onScreen [][]byte, err error) {
 
 	// -------------------------------------------------------------------------
 	// Process Normal Message
 
-	if msgs[0][0] != '/' {
+	// A message starting with // is sent as a normal message starting with /.
+	isCommand := msgs[0][0] == '/'
+	if bytes.HasPrefix(msgs[0], []byte("//")) {
+		msgs[0] = msgs[0][1:]
+		isCommand = false
+	}
+
+	if !isCommand {
 		if usr.Key == "" {
-			return msgs, msgs, nil
+			return usr, msgTypeChat, msgs, msgs, nil
 		}
 
 		publicKey, err := getPublicKey(usr.Key)
 		if err != nil {
-			return nil, nil, fmt.Errorf("unable to read public key: %w", err)
+			return User{}, "", nil, nil, fmt.Errorf("unable to read public key: %w", err)
 		}
 
-		encryptedData := make([][]byte, len(msgs))
-
-		for i, msg := range msgs {
-			ed, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, msg)
-			if err != nil {
-				return nil, nil, fmt.Errorf("encrypting message: %w", err)
-			}
-
-			encryptedData[i] = ed
+		encryptedData, err := encryptMessages(publicKey, msgs)
+		if err != nil {
+			return User{}, "", nil, nil, err
 		}
 
-		return encryptedData, msgs, nil
+		return usr, msgTypeChat, encryptedData, msgs, nil
 	}
 
 	// -------------------------------------------------------------------------
 	// Process Commands
 
-	msgStr := string(msgs[0])
+	msgStr := string(bytes.Join(msgs, nil))
 	msgStr = strings.TrimSpace(msgStr)
-	msgStr = strings.ToLower(msgStr)
 
-	parts := strings.Split(msgStr[1:], " ")
-	if len(parts) != 2 {
-		return nil, nil, fmt.Errorf("invalid command format")
+	parts := strings.Fields(msgStr[1:])
+	if len(parts) < 2 {
+		return User{}, "", nil, nil, fmt.Errorf("invalid command format")
 	}
 
-	switch parts[0] {
+	switch strings.ToLower(parts[0]) {
 	case "share":
-		switch parts[1] {
+		if len(parts) != 2 {
+			return User{}, "", nil, nil, fmt.Errorf("invalid command format")
+		}
+
+		switch strings.ToLower(parts[1]) {
 		case "key":
 			if app.id.PubKeyRSA == "" {
-				return nil, nil, fmt.Errorf("no key to share")
+				return User{}, "", nil, nil, fmt.Errorf("no key to share")
 			}
 
-			errMsg := fmt.Appendf(nil, "/key %s", app.id.PubKeyRSA)
+			cmd := [][]byte{[]byte("key"), []byte(app.id.PubKeyRSA)}
+
+			return usr, msgTypeCommand, cmd, cmd, nil
+		}
+
+	case "group":
+		dest, onWire, err := app.preprocessGroupCommand(usr, parts[1:])
+		if err != nil {
+			return User{}, "", nil, nil, err
+		}
 
-			return [][]byte{errMsg}, [][]byte{errMsg}, nil
+		return dest, msgTypeGroup, onWire, onWire, nil
+
+	case "edit", "delete":
+		typ, onWire, onScreen, err := app.preprocessEditCommand(usr, strings.ToLower(parts[0]), parts[1:])
+		if err != nil {
+			return User{}, "", nil, nil, err
 		}
+
+		return usr, typ, onWire, onScreen, nil
 	}
 
-	return nil, nil, fmt.Errorf("unknown command")
+	return User{}, "", nil, nil, fmt.Errorf("unknown command")
 }
 
 // =============================================================================
 
+// chunkMessage splits a message into chunks of 240 bytes so they can be
+// encrypted.
+func chunkMessage(msg []byte) [][]byte {
+	const maxBytes = 240
+	var msgs [][]byte
+	chunks := (len(msg) / maxBytes) + 1 // Calculate the number of chunks.
+	var start int
+
+	for range chunks {
+		end := min(start+maxBytes, len(msg))
+		msgs = append(msgs, msg[start:end])
+		start = start + maxBytes
+	}
+
+	return msgs
+}
+
+func encryptMessages(publicKey *rsa.PublicKey, msgs [][]byte) ([][]byte, error) {
+	encryptedData := make([][]byte, len(msgs))
+
+	for i, msg := range msgs {
+		ed, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, msg)
+		if err != nil {
+			return nil, fmt.Errorf("encrypting message: %w", err)
+		}
+
+		encryptedData[i] = ed
+	}
+
+	return encryptedData, nil
+}
+
 func getPublicKey(pemBlock string) (*rsa.PublicKey, error) {
 	block, _ := pem.Decode([]byte(pemBlock))
 	if block == nil {
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Set of values that control how often we try to connect to the CAP.
+const (
+	reconnectMinWait = time.Second
+	reconnectMaxWait = 30 * time.Second
+)
+
+// Connect keeps a connection to the CAP open in the background. A connection
+// that can't be opened or drops is retried with exponential backoff. Anything
+// sent while we are not connected is held in the outbox until the connection
+// is back, and files we didn't finish uploading are picked up again.
+func (app *App) Connect(acct MyAccount) {
+	app.device = acct.Device
+	app.downloads = acct.DownloadPath
+
+	if outbox, err := app.db.QueryOutbox(); err == nil && len(outbox) > 0 {
+		app.outbox = true
+	}
+
+	go app.connectLoop(acct)
+}
+
+func (app *App) connectLoop(acct MyAccount) {
+	wait := reconnectMinWait
+
+	for {
+		if err := app.Handshake(acct); err != nil {
+			app.ui.WriteText(errorMessage("connect: %s: retry in %s", err, wait))
+
+			if !app.sleep(wait) {
+				return
+			}
+
+			wait = min(wait*2, reconnectMaxWait)
+			continue
+		}
+
+		wait = reconnectMinWait
+
+		app.ui.WriteText(systemMessage("connected to %s", app.url))
+
+		if err := app.flushOutbox(); err != nil {
+			app.ui.WriteText(errorMessage("flush outbox: %s", err))
+		}
+
+		app.resumeUploads()
+
+		if conn := app.currentConn(); conn != nil {
+			app.ReceiveCapMessage(conn)
+		}
+
+		app.disconnect()
+
+		select {
+		case <-app.shut:
+			return
+		default:
+		}
+
+		app.ui.WriteText(systemMessage("connection lost, reconnecting"))
+
+		if !app.sleep(wait) {
+			return
+		}
+	}
+}
+
+// =============================================================================
+
+// queueOutbox holds a signed message until we are connected again. The
+// caller must hold the send lock.
+func (app *App) queueOutbox(id uuid.UUID, to common.Address, nonce uint64, data []byte) error {
+	msg := OutboxMessage{
+		ID:    id,
+		To:    to,
+		Nonce: nonce,
+		Data:  data,
+	}
+
+	if err := app.db.InsertOutbox(msg); err != nil {
+		return fmt.Errorf("insert outbox: %w", err)
+	}
+
+	app.outbox = true
+
+	return nil
+}
+
+// flushOutbox sends the messages held in the outbox in the order they were
+// signed, which keeps the nonces for each destination in order.
+func (app *App) flushOutbox() error {
+	app.sendMu.Lock()
+	defer app.sendMu.Unlock()
+
+	if !app.outbox {
+		return nil
+	}
+
+	msgs, err := app.db.QueryOutbox()
+	if err != nil {
+		return fmt.Errorf("query outbox: %w", err)
+	}
+
+	for _, msg := range msgs {
+		if app.conn == nil {
+			return fmt.Errorf("no connection")
+		}
+
+		if err := app.conn.WriteMessage(websocket.TextMessage, msg.Data); err != nil {
+			app.conn.Close()
+			app.conn = nil
+			return fmt.Errorf("write: %w", err)
+		}
+
+		if err := app.db.DeleteOutbox(msg.ID); err != nil {
+			return fmt.Errorf("delete outbox: %w", err)
+		}
+	}
+
+	app.outbox = false
+
+	if len(msgs) > 0 {
+		app.ui.WriteText(systemMessage("sent %d queued messages", len(msgs)))
+	}
+
+	return nil
+}
+
+func (app *App) currentConn() *websocket.Conn {
+	app.sendMu.Lock()
+	defer app.sendMu.Unlock()
+
+	return app.conn
+}
+
+func (app *App) disconnect() {
+	app.sendMu.Lock()
+	defer app.sendMu.Unlock()
+
+	if app.conn == nil {
+		return
+	}
+
+	app.conn.Close()
+	app.conn = nil
+}
+
+// sleep waits for the duration and reports false if the app is shutting down.
+func (app *App) sleep(d time.Duration) bool {
+	select {
+	case <-app.shut:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/PeterLee0620/GoIM/foundation/signature"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// msgRefLast refers to the last message we sent in a conversation.
+const msgRefLast = "last"
+
+// minMsgRef is the shortest part of a message ID accepted as a reference.
+const minMsgRef = 4
+
+// preprocessEditCommand converts an /edit or /delete command into the
+// operation that is sent on the wire. Edits are sent as a signed message of
+// type edit in the format <id> <content...> and deletes as a signed message
+// of type delete in the format <id>. The supported commands are:
+//
+//	/edit <ref> <text>
+//	/delete <ref>
+//
+// A message is referenced by the start of the ID shown next to it or by last
+// for the last message we sent.
+func (app *App) preprocessEditCommand(usr User, op string, args []string) (msgType, [][]byte, [][]byte, error) {
+	msg, err := findOwnMessage(usr, app.id.MyAccountID, args[0])
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	id := []byte(msg.ID.String())
+
+	if op == "delete" {
+		if len(args) != 1 {
+			return "", nil, nil, errors.New("invalid command format")
+		}
+
+		return msgTypeDelete, [][]byte{id}, [][]byte{id}, nil
+	}
+
+	if len(args) < 2 {
+		return "", nil, nil, errors.New("missing message text")
+	}
+
+	onScreen := append([][]byte{id}, chunkMessage([]byte(strings.Join(args[1:], " ")))...)
+
+	if usr.Key == "" {
+		return msgTypeEdit, onScreen, onScreen, nil
+	}
+
+	publicKey, err := getPublicKey(usr.Key)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("unable to read public key: %w", err)
+	}
+
+	onWire, err := encryptEdit(publicKey, onScreen)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return msgTypeEdit, onWire, onScreen, nil
+}
+
+// receiveEdit applies an edit or delete to a message in the conversation.
+// Only the author of a message can change it, which is checked against the
+// address recovered from the signature of the edit.
+func (app *App) receiveEdit(inMsg incomingMessage, conversationID common.Address) error {
+	if len(inMsg.Msg) == 0 {
+		return errors.New("missing message id")
+	}
+
+	msgID, err := uuid.ParseBytes(inMsg.Msg[0])
+	if err != nil {
+		return fmt.Errorf("invalid message id: %w", err)
+	}
+
+	usr, err := app.db.QueryContactByID(conversationID)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
+	}
+
+	msg, err := findMessage(usr, msgID)
+	if err != nil {
+		return err
+	}
+
+	authorID, err := signature.FromAddress(inMsg.signedData(), inMsg.V, inMsg.R, inMsg.S)
+	if err != nil {
+		return fmt.Errorf("from address: %w", err)
+	}
+
+	if authorID != msg.From.Hex() {
+		return fmt.Errorf("not the author of message %s: %s", msg.Ref(), authorID)
+	}
+
+	// -------------------------------------------------------------------------
+
+	content := inMsg.Msg
+	if inMsg.From.ID == app.id.MyAccountID && len(inMsg.Mirror) > 0 {
+		content = inMsg.Mirror
+	}
+
+	if inMsg.Type == msgTypeEdit && inMsg.Encrypted {
+		content, err = app.decryptEdit(content)
+		if err != nil {
+			if inMsg.From.ID != app.id.MyAccountID {
+				return err
+			}
+
+			// A device with a different key can't read what our other
+			// device sent.
+			content = [][]byte{content[0], []byte("** encrypted on another device **")}
+		}
+	}
+
+	return app.applyEdit(msg.From, conversationID, inMsg.Type, content)
+}
+
+// =============================================================================
+
+// applyEdit stores the edit or delete for the message identified by the
+// first part of the content and redraws the conversation.
+func (app *App) applyEdit(authorID common.Address, conversationID common.Address, typ msgType, content [][]byte) error {
+	msgID, err := uuid.ParseBytes(content[0])
+	if err != nil {
+		return fmt.Errorf("invalid message id: %w", err)
+	}
+
+	switch typ {
+	case msgTypeEdit:
+		if err := app.db.EditMessage(conversationID, authorID, msgID, content[1:]); err != nil {
+			return fmt.Errorf("edit message: %w", err)
+		}
+
+	case msgTypeDelete:
+		if err := app.db.DeleteMessage(conversationID, authorID, msgID); err != nil {
+			return fmt.Errorf("delete message: %w", err)
+		}
+	}
+
+	app.ui.RefreshContact(conversationID)
+
+	return nil
+}
+
+func (app *App) decryptEdit(content [][]byte) ([][]byte, error) {
+	decrypted := [][]byte{content[0]}
+
+	for _, msg := range content[1:] {
+		dd, err := rsa.DecryptPKCS1v15(rand.Reader, app.id.PrivKeyRSA, msg)
+		if err != nil {
+			return content, fmt.Errorf("decrypting message: %w", err)
+		}
+
+		decrypted = append(decrypted, dd)
+	}
+
+	return decrypted, nil
+}
+
+// encryptEdit encrypts the new content of an edit. The message ID is left
+// as is so the CAP can route the edit like any other message.
+func encryptEdit(publicKey *rsa.PublicKey, msgs [][]byte) ([][]byte, error) {
+	encryptedData, err := encryptMessages(publicKey, msgs[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return append([][]byte{msgs[0]}, encryptedData...), nil
+}
+
+func findMessage(usr User, msgID uuid.UUID) (Message, error) {
+	for _, msg := range usr.Messages {
+		if msg.ID == msgID {
+			return msg, nil
+		}
+	}
+
+	return Message{}, fmt.Errorf("message not found: %s", msgID)
+}
+
+// findOwnMessage looks for the most recent message we sent that matches the
+// reference.
+func findOwnMessage(usr User, myID common.Address, ref string) (Message, error) {
+	ref = strings.ToLower(ref)
+
+	if ref != msgRefLast && len(ref) < minMsgRef {
+		return Message{}, fmt.Errorf("message reference too short: %s", ref)
+	}
+
+	for i := len(usr.Messages) - 1; i >= 0; i-- {
+		msg := usr.Messages[i]
+
+		if msg.From != myID || msg.ID == uuid.Nil || msg.Deleted {
+			continue
+		}
+
+		if ref == msgRefLast || strings.HasPrefix(msg.ID.String(), ref) {
+			return msg, nil
+		}
+	}
+
+	return Message{}, fmt.Errorf("message not found: %s", ref)
+}
@@ -0,0 +1,924 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/app/sdk/errs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// Files are encrypted with a new AES key, uploaded to the CAP in chunks and
+// then offered to the contact with a signed message of type file. The name,
+// hash and key in the offer are encrypted with the contact's key. The
+// contact answers the offer once the file is downloaded or declined.
+//
+//	OFFER <id> <size> <name> <hash> <key>
+//	ACCEPTED <id>
+//	DECLINED <id>
+const (
+	fileOffer    = "OFFER"
+	fileAccepted = "ACCEPTED"
+	fileDeclined = "DECLINED"
+)
+
+// Set of values that control how files are uploaded and downloaded.
+const (
+	fileMaxName    = 200
+	fileRetries    = 5
+	fileReqTimeout = 30 * time.Second
+)
+
+// fileStatus is what the CAP knows about a file being transferred.
+type fileStatus struct {
+	ID       uuid.UUID `json:"id"`
+	Size     int64     `json:"size"`
+	Chunks   int       `json:"chunks"`
+	Received []int     `json:"received"`
+	Stored   int64     `json:"stored"`
+	MaxChunk int       `json:"max_chunk"`
+}
+
+// fileLimits tells us how the CAP wants the files we upload split.
+type fileLimits struct {
+	MaxSize  int64 `json:"max_size"`
+	MaxChunk int   `json:"max_chunk"`
+}
+
+// fileCommand handles the file transfer commands, which run in the
+// background instead of being sent as a single message. The supported
+// commands are:
+//
+//	/send file <path>
+//	/accept <ref>
+//	/decline <ref>
+//
+// It reports false when the message is not a file command.
+func (app *App) fileCommand(to common.Address, msg []byte) (bool, error) {
+	msgStr := strings.TrimSpace(string(msg))
+	if !strings.HasPrefix(msgStr, "/") {
+		return false, nil
+	}
+
+	parts := strings.Fields(msgStr[1:])
+	if len(parts) < 2 {
+		return false, nil
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "send":
+		if strings.ToLower(parts[1]) != "file" || len(parts) < 3 {
+			return false, nil
+		}
+
+		// The path is whatever follows the command so it can contain spaces.
+		path := strings.TrimSpace(msgStr[strings.Index(strings.ToLower(msgStr), "file")+len("file"):])
+
+		return true, app.SendFile(to, path)
+
+	case "accept", "decline":
+		if len(parts) != 2 {
+			return true, errors.New("invalid command format")
+		}
+
+		usr, err := app.db.QueryContactByID(to)
+		if err != nil {
+			return true, fmt.Errorf("query contact: %w", err)
+		}
+
+		msg, err := findFileOffer(usr, app.id.MyAccountID, parts[1])
+		if err != nil {
+			return true, err
+		}
+
+		if strings.ToLower(parts[0]) == "decline" {
+			return true, app.DeclineFile(to, msg)
+		}
+
+		return true, app.AcceptFile(to, msg)
+	}
+
+	return false, nil
+}
+
+// SendFile encrypts the file at the path and sends it to the contact. The
+// upload runs in the background and the file is offered to the contact once
+// every chunk is on the CAP.
+func (app *App) SendFile(to common.Address, path string) error {
+	usr, err := app.db.QueryContactByID(to)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
+	}
+
+	switch {
+	case usr.Group:
+		return errors.New("files can't be sent to a group")
+
+	case usr.Key == "":
+		return errors.New("files can only be sent to a contact that shared their key")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	switch {
+	case !info.Mode().IsRegular():
+		return fmt.Errorf("not a file: %s", path)
+
+	case info.Size() == 0:
+		return fmt.Errorf("file is empty: %s", path)
+
+	case len(info.Name()) > fileMaxName:
+		return fmt.Errorf("file name too long: %s", info.Name())
+	}
+
+	app.ui.WriteText(systemMessage("uploading %s (%s)", info.Name(), formatSize(info.Size())))
+
+	go func() {
+		if err := app.uploadFile(usr, path, info.Size()); err != nil {
+			app.ui.WriteText(errorMessage("send file %s: %s", info.Name(), err))
+		}
+	}()
+
+	return nil
+}
+
+// AcceptFile downloads the file offered in the message in the background.
+// The file is saved once its hash matches the one in the offer.
+func (app *App) AcceptFile(conversationID common.Address, msg Message) error {
+	if app.downloads == "" {
+		return errors.New("no download path configured")
+	}
+
+	app.ui.WriteText(systemMessage("downloading %s (%s)", msg.File.Name, formatSize(msg.File.Size)))
+
+	go func() {
+		if err := app.downloadFile(conversationID, *msg.File); err != nil {
+			app.ui.WriteText(errorMessage("accept file %s: %s", msg.File.Name, err))
+		}
+	}()
+
+	return nil
+}
+
+// DeclineFile lets the contact know we don't want the file offered in the
+// message and removes it from the CAP.
+func (app *App) DeclineFile(conversationID common.Address, msg Message) error {
+	if err := app.answerFile(conversationID, msg.File.ID, fileDeclined); err != nil {
+		return err
+	}
+
+	app.ui.WriteText(systemMessage("declined %s", msg.File.Name))
+
+	return nil
+}
+
+// receiveFile shows a file offered by the contact or the answer to a file we
+// offered.
+func (app *App) receiveFile(inMsg incomingMessage) error {
+	msgs := inMsg.Msg
+
+	if len(msgs) < 2 {
+		return errors.New("invalid file message")
+	}
+
+	fileID, err := uuid.ParseBytes(msgs[1])
+	if err != nil {
+		return fmt.Errorf("invalid file id: %w", err)
+	}
+
+	switch string(msgs[0]) {
+	case fileOffer:
+		return app.receiveFileOffer(inMsg, fileID)
+
+	case fileAccepted, fileDeclined:
+		usr, err := app.db.QueryContactByID(inMsg.From.ID)
+		if err != nil {
+			return fmt.Errorf("query contact: %w", err)
+		}
+
+		name := fileID.String()
+		for _, msg := range usr.Messages {
+			if msg.File != nil && msg.File.ID == fileID && msg.From == app.id.MyAccountID {
+				name = msg.File.Name
+				break
+			}
+		}
+
+		app.ui.WriteText(systemMessage("%s %s %s", inMsg.From.Name, strings.ToLower(string(msgs[0])), name))
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown file operation: %s", msgs[0])
+}
+
+// =============================================================================
+
+func (app *App) receiveFileOffer(inMsg incomingMessage, fileID uuid.UUID) error {
+	msgs := inMsg.Msg
+
+	if len(msgs) != 6 || !inMsg.Encrypted {
+		return errors.New("invalid file offer")
+	}
+
+	size, err := strconv.ParseInt(string(msgs[2]), 10, 64)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid file size: %s", msgs[2])
+	}
+
+	var fields [2][]byte
+	for i, msg := range msgs[3:5] {
+		dd, err := rsa.DecryptPKCS1v15(rand.Reader, app.id.PrivKeyRSA, msg)
+		if err != nil {
+			return fmt.Errorf("decrypting offer: %w", err)
+		}
+
+		fields[i] = dd
+	}
+
+	// The name comes from the contact, only the base is used so the file
+	// can't be saved outside the download path.
+	name := filepath.Base(string(fields[0]))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return fmt.Errorf("invalid file name: %q", fields[0])
+	}
+
+	msg := Message{
+		ID:        inMsg.ID,
+		From:      inMsg.From.ID,
+		To:        app.id.MyAccountID,
+		Name:      inMsg.From.Name,
+		Encrypted: true,
+		Nonce:     inMsg.From.Nonce,
+		Device:    inMsg.From.Device,
+		File: &FileOffer{
+			ID:   fileID,
+			Name: name,
+			Size: size,
+			Hash: string(fields[1]),
+			Key:  msgs[5],
+		},
+	}
+
+	ref := msg.Ref()
+	msg.Content = [][]byte{fmt.Appendf(nil, "offered file %s (%s), /accept %s or /decline %s", name, formatSize(size), ref, ref)}
+
+	if err := app.db.InsertMessage(inMsg.From.ID, msg); err != nil {
+		return fmt.Errorf("add message: %w", err)
+	}
+
+	app.sendReceipt(inMsg.From.ID, StatusDelivered, msg.Device, msg.Nonce)
+
+	app.ui.WriteText(msg)
+
+	return nil
+}
+
+func (app *App) uploadFile(usr User, path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("hash: %w", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("generate key: %w", err)
+	}
+
+	gcm, err := newFileCipher(key)
+	if err != nil {
+		return err
+	}
+
+	// The key is kept with the upload until the file is offered. It's
+	// encrypted with our own key like the keys of the files offered to us.
+	ownKey, err := rsa.EncryptPKCS1v15(rand.Reader, &app.id.PrivKeyRSA.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("encrypting key: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+	// Register the file.
+
+	limits, err := app.fileLimits()
+	if err != nil {
+		return err
+	}
+
+	// Each chunk is sealed on its own. The CAP wants every sealed chunk but
+	// the last to be the max chunk size.
+	overhead := int64(gcm.NonceSize() + gcm.Overhead())
+	chunkSize := int64(limits.MaxChunk) - overhead
+
+	if chunkSize <= 0 {
+		return fmt.Errorf("max chunk too small: %d", limits.MaxChunk)
+	}
+
+	up := Upload{
+		ID:        uuid.New(),
+		To:        usr.ID,
+		Path:      path,
+		Size:      size,
+		Hash:      hex.EncodeToString(h.Sum(nil)),
+		Key:       ownKey,
+		ChunkSize: chunkSize,
+		Chunks:    int((size + chunkSize - 1) / chunkSize),
+	}
+
+	// The upload is marked as running before it's stored so a reconnect
+	// doesn't resume it at the same time.
+	app.startUpload(up.ID)
+	defer app.endUpload(up.ID)
+
+	fileReq := struct {
+		ID     uuid.UUID `json:"id"`
+		ToID   string    `json:"to_id"`
+		Size   int64     `json:"size"`
+		Chunks int       `json:"chunks"`
+	}{
+		ID:     up.ID,
+		ToID:   usr.ID.Hex(),
+		Size:   size + int64(up.Chunks)*overhead,
+		Chunks: up.Chunks,
+	}
+
+	body, err := json.Marshal(fileReq)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fileReqTimeout)
+	defer cancel()
+
+	if _, err := app.fileRequest(ctx, http.MethodPost, "/files", "application/json", bytes.NewReader(body)); err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	if err := app.db.InsertUpload(up); err != nil {
+		return fmt.Errorf("insert upload: %w", err)
+	}
+
+	return app.sendUpload(usr, up, f, gcm)
+}
+
+// resumeUploads picks up the uploads that were not finished when we lost the
+// connection or the app was closed. Uploads that are still running are left
+// alone.
+func (app *App) resumeUploads() {
+	uploads, err := app.db.QueryUploads()
+	if err != nil {
+		app.ui.WriteText(errorMessage("query uploads: %s", err))
+		return
+	}
+
+	for _, up := range uploads {
+		go func() {
+			if err := app.resumeUpload(up); err != nil {
+				app.ui.WriteText(errorMessage("send file %s: %s", filepath.Base(up.Path), err))
+			}
+		}()
+	}
+}
+
+// resumeUpload uploads the chunks of the file the CAP doesn't have yet and
+// offers the file. The file has to be the one the upload started with.
+func (app *App) resumeUpload(up Upload) error {
+	if !app.startUpload(up.ID) {
+		return nil
+	}
+	defer app.endUpload(up.ID)
+
+	usr, err := app.db.QueryContactByID(up.To)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
+	}
+
+	key, err := rsa.DecryptPKCS1v15(rand.Reader, app.id.PrivKeyRSA, up.Key)
+	if err != nil {
+		return fmt.Errorf("decrypting key: %w", err)
+	}
+
+	gcm, err := newFileCipher(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(up.Path)
+	if err != nil {
+		app.dropUpload(up)
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("hash: %w", err)
+	}
+
+	if size != up.Size || hex.EncodeToString(h.Sum(nil)) != up.Hash {
+		app.dropUpload(up)
+		return errors.New("file changed since the upload started")
+	}
+
+	app.ui.WriteText(systemMessage("resuming upload of %s", filepath.Base(up.Path)))
+
+	return app.sendUpload(usr, up, f, gcm)
+}
+
+// sendUpload uploads the chunks of the file and offers it to the contact.
+// The upload is forgotten once the file is offered or the CAP rejects it.
+func (app *App) sendUpload(usr User, up Upload, f *os.File, gcm cipher.AEAD) error {
+	publicKey, err := getPublicKey(usr.Key)
+	if err != nil {
+		return fmt.Errorf("unable to read public key: %w", err)
+	}
+
+	err = app.retryFile(up.ID, "upload", func() error {
+		return app.uploadChunks(f, up.ID, up.Chunks, up.ChunkSize, gcm)
+	})
+	if err != nil {
+		// The CAP won't change its mind about a request it rejected, the
+		// file is gone or the chunks don't fit it.
+		var errResp *errs.Error
+		if errors.As(err, &errResp) {
+			app.dropUpload(up)
+		}
+		return err
+	}
+
+	// -------------------------------------------------------------------------
+	// Offer the file to the contact.
+
+	key, err := rsa.DecryptPKCS1v15(rand.Reader, app.id.PrivKeyRSA, up.Key)
+	if err != nil {
+		return fmt.Errorf("decrypting key: %w", err)
+	}
+
+	name := filepath.Base(up.Path)
+
+	encrypted, err := encryptMessages(publicKey, [][]byte{[]byte(name), []byte(up.Hash), key})
+	if err != nil {
+		return err
+	}
+
+	onWire := append([][]byte{[]byte(fileOffer), []byte(up.ID.String()), []byte(strconv.FormatInt(up.Size, 10))}, encrypted...)
+
+	env := newEnvelope(msgTypeFile)
+
+	nonce, queued, err := app.sendSigned(env, usr.ID, true, onWire, nil)
+	if err != nil {
+		return err
+	}
+
+	// The offer is sent or held in the outbox, either way the upload is done.
+	if err := app.db.DeleteUpload(up.ID); err != nil {
+		app.ui.WriteText(errorMessage("delete upload: %s", err))
+	}
+
+	if queued {
+		app.ui.WriteText(systemMessage("not connected, file offer queued for delivery"))
+	}
+
+	msg := Message{
+		ID:        env.ID,
+		From:      app.id.MyAccountID,
+		To:        usr.ID,
+		Name:      "You",
+		Content:   [][]byte{fmt.Appendf(nil, "offered file %s (%s)", name, formatSize(up.Size))},
+		Encrypted: true,
+		Nonce:     nonce,
+		Device:    app.device,
+		Status:    StatusSent,
+		File: &FileOffer{
+			ID:   up.ID,
+			Name: name,
+			Size: up.Size,
+			Hash: up.Hash,
+		},
+	}
+
+	if err := app.db.InsertMessage(usr.ID, msg); err != nil {
+		return fmt.Errorf("add message: %w", err)
+	}
+
+	app.ui.WriteText(msg)
+
+	return nil
+}
+
+// dropUpload gives up on an upload and removes what was uploaded from the
+// CAP.
+func (app *App) dropUpload(up Upload) {
+	if err := app.db.DeleteUpload(up.ID); err != nil {
+		app.ui.WriteText(errorMessage("delete upload: %s", err))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fileReqTimeout)
+	defer cancel()
+
+	app.fileRequest(ctx, http.MethodDelete, "/files/"+up.ID.String(), "", nil)
+}
+
+// startUpload reports false when the upload is already running.
+func (app *App) startUpload(fileID uuid.UUID) bool {
+	app.uploadMu.Lock()
+	defer app.uploadMu.Unlock()
+
+	if app.uploading[fileID] {
+		return false
+	}
+
+	app.uploading[fileID] = true
+
+	return true
+}
+
+func (app *App) endUpload(fileID uuid.UUID) {
+	app.uploadMu.Lock()
+	defer app.uploadMu.Unlock()
+
+	delete(app.uploading, fileID)
+}
+
+// uploadChunks uploads the chunks the CAP doesn't have yet, so an upload
+// that failed part way picks up where it stopped.
+func (app *App) uploadChunks(f *os.File, fileID uuid.UUID, chunks int, chunkSize int64, gcm cipher.AEAD) error {
+	status, err := app.fileStatus(fileID)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, chunkSize)
+
+	for chunk := range chunks {
+		if slices.Contains(status.Received, chunk) {
+			continue
+		}
+
+		n, err := f.ReadAt(buf, int64(chunk)*chunkSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read chunk %d: %w", chunk, err)
+		}
+
+		sealed, err := sealChunk(gcm, fileID, chunk, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), fileReqTimeout)
+		path := fmt.Sprintf("/files/%s/chunks/%d", fileID, chunk)
+		_, err = app.fileRequest(ctx, http.MethodPut, path, "application/octet-stream", bytes.NewReader(sealed))
+		cancel()
+
+		if err != nil {
+			return fmt.Errorf("put chunk %d: %w", chunk, err)
+		}
+	}
+
+	return nil
+}
+
+func (app *App) downloadFile(conversationID common.Address, offer FileOffer) error {
+	key, err := rsa.DecryptPKCS1v15(rand.Reader, app.id.PrivKeyRSA, offer.Key)
+	if err != nil {
+		return fmt.Errorf("decrypting key: %w", err)
+	}
+
+	gcm, err := newFileCipher(key)
+	if err != nil {
+		return err
+	}
+
+	status, err := app.fileStatus(offer.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(status.Received) != status.Chunks || status.Stored != status.Size {
+		return fmt.Errorf("upload incomplete: %d of %d chunks, %d of %d bytes", len(status.Received), status.Chunks, status.Stored, status.Size)
+	}
+
+	if err := os.MkdirAll(app.downloads, 0700); err != nil {
+		return fmt.Errorf("download path: %w", err)
+	}
+
+	// The file is written to a temporary file and only moved into place once
+	// the hash checks out.
+	f, err := os.CreateTemp(app.downloads, ".download-*")
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+
+	var size int64
+	for chunk := range status.Chunks {
+		var data []byte
+		err := app.retryFile(offer.ID, "download", func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), fileReqTimeout)
+			defer cancel()
+
+			var err error
+			data, err = app.fileRequest(ctx, http.MethodGet, fmt.Sprintf("/files/%s/chunks/%d", offer.ID, chunk), "", nil)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("get chunk %d: %w", chunk, err)
+		}
+
+		plain, err := openChunk(gcm, offer.ID, chunk, data)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(plain); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+
+		size += int64(len(plain))
+	}
+
+	if size != offer.Size {
+		return fmt.Errorf("size mismatch: got: %d exp: %d", size, offer.Size)
+	}
+
+	if hash := hex.EncodeToString(h.Sum(nil)); hash != offer.Hash {
+		return fmt.Errorf("hash mismatch: got: %s exp: %s", hash, offer.Hash)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	path, err := downloadPath(app.downloads, offer.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+
+	app.ui.WriteText(systemMessage("saved %s", path))
+
+	return app.answerFile(conversationID, offer.ID, fileAccepted)
+}
+
+// answerFile lets the contact know what we did with the file and removes it
+// from the CAP.
+func (app *App) answerFile(conversationID common.Address, fileID uuid.UUID, op string) error {
+	msgs := [][]byte{[]byte(op), []byte(fileID.String())}
+
+	if _, _, err := app.sendSigned(newEnvelope(msgTypeFile), conversationID, false, msgs, nil); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fileReqTimeout)
+	defer cancel()
+
+	if _, err := app.fileRequest(ctx, http.MethodDelete, "/files/"+fileID.String(), "", nil); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	return nil
+}
+
+// retryFile calls the function until it succeeds, waiting longer after each
+// failure.
+func (app *App) retryFile(fileID uuid.UUID, op string, fn func() error) error {
+	wait := reconnectMinWait
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		// The CAP won't change its mind about a request it rejected.
+		var errResp *errs.Error
+		if attempt == fileRetries || errors.As(err, &errResp) {
+			return err
+		}
+
+		app.ui.WriteText(errorMessage("%s %s: %s: retry in %s", op, fileID, err, wait))
+
+		if !app.sleep(wait) {
+			return errors.New("shutting down")
+		}
+
+		wait = min(wait*2, reconnectMaxWait)
+	}
+}
+
+func (app *App) fileLimits() (fileLimits, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fileReqTimeout)
+	defer cancel()
+
+	data, err := app.fileRequest(ctx, http.MethodGet, "/files/limits", "", nil)
+	if err != nil {
+		return fileLimits{}, fmt.Errorf("limits: %w", err)
+	}
+
+	var limits fileLimits
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return fileLimits{}, fmt.Errorf("failed: response: %s, decoding error: %w ", string(data), err)
+	}
+
+	return limits, nil
+}
+
+func (app *App) fileStatus(fileID uuid.UUID) (fileStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fileReqTimeout)
+	defer cancel()
+
+	data, err := app.fileRequest(ctx, http.MethodGet, "/files/"+fileID.String(), "", nil)
+	if err != nil {
+		return fileStatus{}, fmt.Errorf("status: %w", err)
+	}
+
+	var status fileStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fileStatus{}, fmt.Errorf("failed: response: %s, decoding error: %w ", string(data), err)
+	}
+
+	return status, nil
+}
+
+func (app *App) fileRequest(ctx context.Context, method string, path string, contentType string, body io.Reader) ([]byte, error) {
+	url := fmt.Sprintf("http://%s%s", app.url, path)
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("create request error: %s: %w", url, err)
+	}
+
+	req.Header.Set("Cache-Control", "no-cache")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	tkn, err := app.token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("token: %w", err)
+	}
+
+	req.Header.Add("Authorization", "Bearer "+tkn)
+
+	resp, err := defaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("copy error: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return data, nil
+	}
+
+	var errs *errs.Error
+	if err := json.Unmarshal(data, &errs); err != nil {
+		return nil, fmt.Errorf("failed: response: %s, decoding error: %w ", string(data), err)
+	}
+
+	return nil, errs
+}
+
+// =============================================================================
+
+func newFileCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("gcm: %w", err)
+	}
+
+	return gcm, nil
+}
+
+// sealChunk encrypts a chunk with a new nonce in front of it. The file ID and
+// chunk number are authenticated so chunks can't be swapped around.
+func sealChunk(gcm cipher.AEAD, fileID uuid.UUID, chunk int, data []byte) ([]byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+
+	return gcm.Seal(nonce, nonce, data, chunkAAD(fileID, chunk)), nil
+}
+
+func openChunk(gcm cipher.AEAD, fileID uuid.UUID, chunk int, data []byte) ([]byte, error) {
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("chunk %d too short", chunk)
+	}
+
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, sealed, chunkAAD(fileID, chunk))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting chunk %d: %w", chunk, err)
+	}
+
+	return plain, nil
+}
+
+func chunkAAD(fileID uuid.UUID, chunk int) []byte {
+	return fmt.Appendf(nil, "%s/%d", fileID, chunk)
+}
+
+// downloadPath returns a path in the directory for the file that doesn't
+// overwrite an earlier download with the same name.
+func downloadPath(dir string, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	path := filepath.Join(dir, name)
+	for i := 1; i < 1000; i++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return path, nil
+		}
+
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+
+	return "", fmt.Errorf("too many downloads named %s", name)
+}
+
+// findFileOffer looks for the most recent file offered by the contact that
+// matches the reference.
+func findFileOffer(usr User, myID common.Address, ref string) (Message, error) {
+	ref = strings.ToLower(ref)
+
+	if ref != msgRefLast && len(ref) < minMsgRef {
+		return Message{}, fmt.Errorf("message reference too short: %s", ref)
+	}
+
+	for i := len(usr.Messages) - 1; i >= 0; i-- {
+		msg := usr.Messages[i]
+
+		if msg.File == nil || msg.From == myID {
+			continue
+		}
+
+		if ref == msgRefLast || strings.HasPrefix(msg.ID.String(), ref) {
+			return msg, nil
+		}
+	}
+
+	return Message{}, fmt.Errorf("file offer not found: %s", ref)
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -20,3 +20,10 @@ func errorMessage(format string, a ...any) Message {
 		Content: [][]byte{fmt.Appendf(nil, format, a...)},
 	}
 }
+
+func systemMessage(format string, a ...any) Message {
+	return Message{
+		Name:    "system",
+		Content: [][]byte{fmt.Appendf(nil, format, a...)},
+	}
+}
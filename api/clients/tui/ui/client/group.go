@@ -0,0 +1,323 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Set of group operations understood by the CAP. They are sent to the group
+// as a signed message of type group in the format <operation> <args...>.
+const (
+	groupOpCreate = "CREATE"
+	groupOpInvite = "INVITE"
+	groupOpLeave  = "LEAVE"
+	groupOpKick   = "KICK"
+)
+
+// preprocessGroupCommand converts a /group command into the group operation
+// that is sent on the wire. The supported commands are:
+//
+//	/group create <name>
+//	/group invite <id>
+//	/group kick <id>
+//	/group leave
+func (app *App) preprocessGroupCommand(usr User, args []string) (User, [][]byte, error) {
+	switch strings.ToLower(args[0]) {
+	case "create":
+		if len(args) < 2 {
+			return User{}, nil, errors.New("missing group name")
+		}
+
+		name := strings.Join(args[1:], " ")
+
+		groupID, nonce, err := newGroupID(app.id.MyAccountID)
+		if err != nil {
+			return User{}, nil, fmt.Errorf("group id: %w", err)
+		}
+
+		grp, err := app.db.InsertGroup(groupID, name, []common.Address{app.id.MyAccountID})
+		if err != nil {
+			return User{}, nil, fmt.Errorf("insert group: %w", err)
+		}
+
+		app.ui.AddGroup(groupID, name)
+
+		// The CAP checks the group ID was derived from our address and
+		// the nonce.
+		return grp, groupMessage(groupOpCreate, name, strconv.FormatUint(nonce, 10)), nil
+
+	case "invite":
+		if !usr.Group {
+			return User{}, nil, errors.New("select a group to invite to")
+		}
+
+		if len(args) != 2 || !common.IsHexAddress(args[1]) {
+			return User{}, nil, errors.New("invalid member id")
+		}
+
+		memberID := common.HexToAddress(args[1])
+		if slices.Contains(usr.Members, memberID) {
+			return User{}, nil, errors.New("already a member")
+		}
+
+		// The new member needs the name and current members of the group.
+		inviteArgs := []string{memberID.Hex(), usr.Name}
+		for _, id := range usr.Members {
+			inviteArgs = append(inviteArgs, id.Hex())
+		}
+
+		return usr, groupMessage(groupOpInvite, inviteArgs...), nil
+
+	case "kick":
+		if !usr.Group {
+			return User{}, nil, errors.New("select a group to kick from")
+		}
+
+		if len(args) != 2 || !common.IsHexAddress(args[1]) {
+			return User{}, nil, errors.New("invalid member id")
+		}
+
+		return usr, groupMessage(groupOpKick, common.HexToAddress(args[1]).Hex()), nil
+
+	case "leave":
+		if !usr.Group {
+			return User{}, nil, errors.New("select a group to leave")
+		}
+
+		return usr, groupMessage(groupOpLeave), nil
+	}
+
+	return User{}, nil, fmt.Errorf("unknown group command: %s", args[0])
+}
+
+// receiveGroupMessage processes a message that was sent to a group we are
+// a member of, or an invite to a new group. A message from us was sent from
+// one of our other devices.
+func (app *App) receiveGroupMessage(inMsg incomingMessage) error {
+	if len(inMsg.Msg) == 0 {
+		return errors.New("no message")
+	}
+
+	mirror := inMsg.From.ID == app.id.MyAccountID
+
+	grp, err := app.db.QueryContactByID(inMsg.GroupID)
+	switch {
+	case err != nil && mirror:
+
+		// One of our other devices created the group.
+		if inMsg.Type != msgTypeGroup || string(inMsg.Msg[0]) != groupOpCreate || len(inMsg.Msg) < 2 {
+			return fmt.Errorf("unknown group: %s", inMsg.GroupID)
+		}
+
+		grp, err = app.db.InsertGroup(inMsg.GroupID, string(inMsg.Msg[1]), []common.Address{app.id.MyAccountID})
+		if err != nil {
+			return fmt.Errorf("insert group: %w", err)
+		}
+
+		app.ui.AddGroup(grp.ID, grp.Name)
+
+	case err != nil:
+
+		// Only an invite for us can introduce a group we don't know about.
+		if inMsg.Type != msgTypeGroup || string(inMsg.Msg[0]) != groupOpInvite || len(inMsg.Msg) < 3 {
+			return fmt.Errorf("unknown group: %s", inMsg.GroupID)
+		}
+
+		if common.HexToAddress(string(inMsg.Msg[1])) != app.id.MyAccountID {
+			return fmt.Errorf("unknown group: %s", inMsg.GroupID)
+		}
+
+		members := []common.Address{app.id.MyAccountID}
+		for _, id := range inMsg.Msg[3:] {
+			members = append(members, common.HexToAddress(string(id)))
+		}
+
+		grp, err = app.db.InsertGroup(inMsg.GroupID, string(inMsg.Msg[2]), members)
+		if err != nil {
+			return fmt.Errorf("insert group: %w", err)
+		}
+
+		app.ui.AddGroup(grp.ID, grp.Name)
+	}
+
+	// -------------------------------------------------------------------------
+	// Each device of a member has its own nonce sequence for the group.
+
+	expNonce := grp.MemberNonces[MemberNonceKey(inMsg.From.ID, inMsg.From.Device)] + 1
+	if inMsg.From.Nonce < expNonce {
+		return fmt.Errorf("invalid nonce: possible security issue with member: got: %d, exp: %d", inMsg.From.Nonce, expNonce)
+	}
+
+	if err := app.db.UpdateGroupMemberNonce(grp.ID, inMsg.From.ID, inMsg.From.Device, inMsg.From.Nonce); err != nil {
+		return fmt.Errorf("update member nonce: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+
+	name := inMsg.From.Name
+	if usr, err := app.db.QueryContactByID(inMsg.From.ID); err == nil {
+		name = usr.Name
+	}
+
+	to := app.id.MyAccountID
+	if mirror {
+		name = "You"
+		to = grp.ID
+	}
+
+	if inMsg.Type == msgTypeEdit || inMsg.Type == msgTypeDelete {
+		return app.receiveEdit(inMsg, grp.ID)
+	}
+
+	if inMsg.Type == msgTypeReaction {
+		return app.receiveReaction(inMsg, grp.ID)
+	}
+
+	if inMsg.Type == msgTypeGroup {
+		desc, err := app.applyGroupOperation(inMsg.From.ID, grp.ID, inMsg.Msg)
+		if err != nil {
+			return fmt.Errorf("group operation: %w", err)
+		}
+
+		app.ui.WriteText(Message{
+			Name:    "system",
+			Content: [][]byte{fmt.Appendf(nil, "%s: %s", name, desc)},
+		})
+
+		return nil
+	}
+
+	msg := Message{
+		ID:      inMsg.ID,
+		ReplyTo: inMsg.ReplyTo,
+		From:    inMsg.From.ID,
+		To:      to,
+		GroupID: grp.ID,
+		Name:    name,
+		Content: inMsg.Msg,
+		Nonce:   inMsg.From.Nonce,
+		Device:  inMsg.From.Device,
+	}
+
+	if err := app.db.InsertMessage(grp.ID, msg); err != nil {
+		return fmt.Errorf("add message: %w", err)
+	}
+
+	app.ui.WriteText(msg)
+
+	return nil
+}
+
+// applyGroupOperation updates our copy of the group for an operation that was
+// performed by the actor and returns a description of what happened.
+func (app *App) applyGroupOperation(actorID common.Address, groupID common.Address, msgs [][]byte) (string, error) {
+	grp, err := app.db.QueryContactByID(groupID)
+	if err != nil {
+		return "", fmt.Errorf("query group: %w", err)
+	}
+
+	if len(msgs) == 0 {
+		return "", errors.New("missing group operation")
+	}
+
+	switch string(msgs[0]) {
+	case groupOpCreate:
+		return fmt.Sprintf("group %q created: %s", grp.Name, grp.ID), nil
+
+	case groupOpInvite:
+		if len(msgs) < 2 {
+			return "", errors.New("missing member id")
+		}
+
+		memberID := common.HexToAddress(string(msgs[1]))
+		if !slices.Contains(grp.Members, memberID) {
+			members := append(slices.Clone(grp.Members), memberID)
+			if err := app.db.UpdateGroupMembers(groupID, members); err != nil {
+				return "", fmt.Errorf("update members: %w", err)
+			}
+		}
+
+		return fmt.Sprintf("invited %s to %q", memberID, grp.Name), nil
+
+	case groupOpLeave:
+		if actorID == app.id.MyAccountID {
+			return app.removeGroup(grp)
+		}
+
+		if err := app.db.UpdateGroupMembers(groupID, removeMember(grp.Members, actorID)); err != nil {
+			return "", fmt.Errorf("update members: %w", err)
+		}
+
+		return fmt.Sprintf("left %q", grp.Name), nil
+
+	case groupOpKick:
+		if len(msgs) < 2 {
+			return "", errors.New("missing member id")
+		}
+
+		memberID := common.HexToAddress(string(msgs[1]))
+		if memberID == app.id.MyAccountID {
+			if _, err := app.removeGroup(grp); err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("removed you from %q", grp.Name), nil
+		}
+
+		if err := app.db.UpdateGroupMembers(groupID, removeMember(grp.Members, memberID)); err != nil {
+			return "", fmt.Errorf("update members: %w", err)
+		}
+
+		return fmt.Sprintf("removed %s from %q", memberID, grp.Name), nil
+	}
+
+	return "", fmt.Errorf("unknown group operation: %s", msgs[0])
+}
+
+// =============================================================================
+
+func (app *App) removeGroup(grp User) (string, error) {
+	if err := app.db.DeleteContact(grp.ID); err != nil {
+		return "", fmt.Errorf("delete group: %w", err)
+	}
+
+	app.ui.RemoveContact(grp.ID)
+
+	return fmt.Sprintf("left %q", grp.Name), nil
+}
+
+func groupMessage(op string, args ...string) [][]byte {
+	msgs := [][]byte{[]byte(op)}
+	for _, arg := range args {
+		msgs = append(msgs, []byte(arg))
+	}
+
+	return msgs
+}
+
+func removeMember(members []common.Address, memberID common.Address) []common.Address {
+	return slices.DeleteFunc(slices.Clone(members), func(id common.Address) bool {
+		return id == memberID
+	})
+}
+
+// newGroupID generates a new address for a group the same way contract
+// addresses are derived, from the creator's address and a random nonce.
+func newGroupID(creatorID common.Address) (common.Address, uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return common.Address{}, 0, err
+	}
+
+	nonce := binary.BigEndian.Uint64(b[:])
+
+	return crypto.CreateAddress(creatorID, nonce), nonce, nil
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+)
+
+// receiveMirror stores a message we sent to a contact from one of our other
+// devices so the conversation is the same on every device.
+func (app *App) receiveMirror(inMsg incomingMessage) error {
+	switch inMsg.Type {
+	case msgTypeChat, msgTypeEdit, msgTypeDelete, msgTypeReaction:
+	default:
+		return nil
+	}
+
+	if _, err := app.db.QueryContactByID(inMsg.ToID); err != nil {
+		if _, err := app.db.InsertContact(inMsg.ToID, inMsg.ToID.Hex()); err != nil {
+			return fmt.Errorf("add contact: %w", err)
+		}
+
+		app.ui.AddContact(inMsg.ToID, inMsg.ToID.Hex())
+	}
+
+	switch inMsg.Type {
+	case msgTypeEdit, msgTypeDelete:
+		return app.receiveEdit(inMsg, inMsg.ToID)
+
+	case msgTypeReaction:
+		return app.receiveReaction(inMsg, inMsg.ToID)
+	}
+
+	// An encrypted message is mirrored encrypted with our own key. A device
+	// with a different key can't read it.
+	content := inMsg.Msg
+	if len(inMsg.Mirror) > 0 {
+		content = inMsg.Mirror
+	}
+
+	if inMsg.Encrypted {
+		mirror := content
+		content = make([][]byte, len(mirror))
+
+		for i, msg := range mirror {
+			dd, err := rsa.DecryptPKCS1v15(rand.Reader, app.id.PrivKeyRSA, msg)
+			if err != nil {
+				content = [][]byte{[]byte("** encrypted on another device **")}
+				break
+			}
+
+			content[i] = dd
+		}
+	}
+
+	msg := Message{
+		ID:        inMsg.ID,
+		ReplyTo:   inMsg.ReplyTo,
+		From:      app.id.MyAccountID,
+		To:        inMsg.ToID,
+		Name:      "You",
+		Content:   content,
+		Encrypted: inMsg.Encrypted,
+		Nonce:     inMsg.From.Nonce,
+		Device:    inMsg.From.Device,
+		Status:    StatusSent,
+	}
+
+	if err := app.db.InsertMessage(inMsg.ToID, msg); err != nil {
+		return fmt.Errorf("add message: %w", err)
+	}
+
+	app.ui.WriteText(msg)
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// Reactions are signed messages of type reaction sent to the conversation in
+// the format <operation> <id> <emoji>. They change the reactions on the
+// message and are never shown as a message of their own.
+const (
+	reactionAdd    = "ADD"
+	reactionRemove = "REMOVE"
+)
+
+// maxReactionLen is the longest emoji accepted as a reaction in runes. Some
+// emoji are made of several code points.
+const maxReactionLen = 8
+
+// React adds our reaction to a message in the conversation, or removes it if
+// we already reacted with the same emoji.
+func (app *App) React(conversationID common.Address, msgID uuid.UUID, emoji string) error {
+	if err := validateReaction(emoji); err != nil {
+		return err
+	}
+
+	usr, err := app.db.QueryContactByID(conversationID)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
+	}
+
+	msg, err := findMessage(usr, msgID)
+	if err != nil {
+		return err
+	}
+
+	if msg.Deleted {
+		return errors.New("message deleted")
+	}
+
+	op := reactionAdd
+	if slices.Contains(msg.Reactions[emoji], app.id.MyAccountID) {
+		op = reactionRemove
+	}
+
+	msgs := [][]byte{[]byte(op), []byte(msgID.String()), []byte(emoji)}
+
+	_, queued, err := app.sendSigned(newEnvelope(msgTypeReaction), conversationID, false, msgs, nil)
+	if err != nil {
+		return err
+	}
+
+	if queued {
+		app.ui.WriteText(systemMessage("not connected, reaction queued for delivery"))
+	}
+
+	return app.applyReaction(app.id.MyAccountID, conversationID, msgs)
+}
+
+// receiveReaction applies a reaction from the sender to a message in the
+// conversation.
+func (app *App) receiveReaction(inMsg incomingMessage, conversationID common.Address) error {
+	return app.applyReaction(inMsg.From.ID, conversationID, inMsg.Msg)
+}
+
+// =============================================================================
+
+func (app *App) applyReaction(from common.Address, conversationID common.Address, msgs [][]byte) error {
+	if len(msgs) != 3 {
+		return errors.New("invalid reaction")
+	}
+
+	var add bool
+	switch string(msgs[0]) {
+	case reactionAdd:
+		add = true
+	case reactionRemove:
+	default:
+		return fmt.Errorf("unknown reaction operation: %s", msgs[0])
+	}
+
+	msgID, err := uuid.ParseBytes(msgs[1])
+	if err != nil {
+		return fmt.Errorf("invalid message id: %w", err)
+	}
+
+	emoji := string(msgs[2])
+	if err := validateReaction(emoji); err != nil {
+		return err
+	}
+
+	if err := app.db.UpdateReaction(conversationID, from, msgID, emoji, add); err != nil {
+		return fmt.Errorf("update reaction: %w", err)
+	}
+
+	app.ui.RefreshContact(conversationID)
+
+	return nil
+}
+
+func validateReaction(emoji string) error {
+	switch {
+	case emoji == "":
+		return errors.New("missing reaction")
+
+	case strings.ContainsFunc(emoji, unicode.IsSpace):
+		return errors.New("reaction can't contain spaces")
+
+	case utf8.RuneCountInString(emoji) > maxReactionLen:
+		return fmt.Errorf("reaction too long: %s", emoji)
+	}
+
+	return nil
+}
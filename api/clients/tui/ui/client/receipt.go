@@ -0,0 +1,103 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Receipts are signed messages of type receipt sent back to the sender of a
+// message in the format <status> <device> <nonce>... where the device and
+// each nonce identify a message.
+const (
+	receiptDelivered = "DELIVERED"
+	receiptRead      = "READ"
+)
+
+// MarkRead lets the contact know we have read the messages they sent us.
+func (app *App) MarkRead(id common.Address) error {
+	usr, err := app.db.QueryContactByID(id)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
+	}
+
+	// Receipts are only exchanged for direct conversations.
+	if usr.Group {
+		return nil
+	}
+
+	// Each of the contact's devices has its own nonces.
+	devices := make(map[string][]uint64)
+	for _, msg := range usr.Messages {
+		if msg.From == id && msg.Nonce != 0 && msg.Status < StatusRead {
+			devices[msg.Device] = append(devices[msg.Device], msg.Nonce)
+		}
+	}
+
+	for device, nonces := range devices {
+		if err := app.db.UpdateMessageStatus(id, id, device, nonces, StatusRead); err != nil {
+			return fmt.Errorf("update status: %w", err)
+		}
+
+		app.sendReceipt(id, StatusRead, device, nonces...)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// sendReceipt lets the sender know how far their messages have got. A receipt
+// that can't be sent is reported and otherwise ignored.
+func (app *App) sendReceipt(to common.Address, status MessageStatus, device string, nonces ...uint64) {
+	op := receiptDelivered
+	if status == StatusRead {
+		op = receiptRead
+	}
+
+	msgs := [][]byte{[]byte(op), []byte(device)}
+	for _, nonce := range nonces {
+		msgs = append(msgs, strconv.AppendUint(nil, nonce, 10))
+	}
+
+	if _, _, err := app.sendSigned(newEnvelope(msgTypeReceipt), to, false, msgs, nil); err != nil {
+		app.ui.WriteText(errorMessage("send receipt: %s", err))
+	}
+}
+
+func (app *App) receiveReceipt(inMsg incomingMessage) error {
+	if len(inMsg.Msg) < 3 {
+		return fmt.Errorf("invalid receipt")
+	}
+
+	var status MessageStatus
+	switch string(inMsg.Msg[0]) {
+	case receiptDelivered:
+		status = StatusDelivered
+	case receiptRead:
+		status = StatusRead
+	default:
+		return fmt.Errorf("unknown receipt: %s", inMsg.Msg[0])
+	}
+
+	device := string(inMsg.Msg[1])
+
+	nonces := make([]uint64, 0, len(inMsg.Msg)-2)
+	for _, v := range inMsg.Msg[2:] {
+		nonce, err := strconv.ParseUint(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid receipt nonce: %w", err)
+		}
+
+		nonces = append(nonces, nonce)
+	}
+
+	if err := app.db.UpdateMessageStatus(inMsg.From.ID, app.id.MyAccountID, device, nonces, status); err != nil {
+		return fmt.Errorf("update status: %w", err)
+	}
+
+	app.ui.RefreshContact(inMsg.From.ID)
+
+	return nil
+}
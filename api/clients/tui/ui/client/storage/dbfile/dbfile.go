@@ -5,23 +5,26 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
+	"slices"
 	"sort"
 	"sync"
 	"time"
 
 	"github.com/PeterLee0620/GoIM/api/clients/tui/ui/client"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
 )
 
 type DB struct {
 	myAccount  client.MyAccount
+	lastSeq    uint64
 	privKeyRSA *rsa.PrivateKey
 	contacts   map[common.Address]client.User
 	mu         sync.RWMutex
 }
 
-func NewDB(filePath string, id client.ID, jwt string) (*DB, error) {
-	df, err := newDB(filePath, id.MyAccountID, jwt)
+func NewDB(filePath string, id client.ID) (*DB, error) {
+	df, err := newDB(filePath, id.MyAccountID)
 	if err != nil {
 		return nil, fmt.Errorf("newDB: %w", err)
 	}
@@ -32,19 +35,24 @@ func NewDB(filePath string, id client.ID, jwt string) (*DB, error) {
 			ID:           usr.ID,
 			Name:         usr.Name,
 			AppLastNonce: usr.AppLastNonce,
-			LastNonce:    usr.LastNonce,
+			LastNonces:   usr.LastNonces,
 			Key:          usr.Key,
 			TCPHost:      usr.TCPHost,
+			Group:        usr.Group,
+			Members:      usr.Members,
+			MemberNonces: usr.MemberNonces,
 		}
 	}
 
 	db := DB{
 		myAccount: client.MyAccount{
-			ID:          df.MyAccount.ID,
-			Name:        df.MyAccount.Name,
-			ProfilePath: df.MyAccount.ProfilePath,
-			JWT:         df.MyAccount.JWT,
+			ID:           df.MyAccount.ID,
+			Name:         df.MyAccount.Name,
+			ProfilePath:  df.MyAccount.ProfilePath,
+			Device:       df.MyAccount.Device,
+			DownloadPath: df.MyAccount.DownloadPath,
 		},
+		lastSeq:    df.MyAccount.LastSeq,
 		privKeyRSA: id.PrivKeyRSA,
 		contacts:   contacts,
 	}
@@ -59,6 +67,39 @@ func (db *DB) MyAccount() client.MyAccount {
 	return db.myAccount
 }
 
+// LastSeq returns the last delivery sequence received from the CAP.
+func (db *DB) LastSeq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.lastSeq
+}
+
+// UpdateLastSeq records the last delivery sequence received from the CAP.
+func (db *DB) UpdateLastSeq(seq uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache.
+
+	db.lastSeq = seq
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	df, err := readDBFromDisk()
+	if err != nil {
+		return fmt.Errorf("config read: %w", err)
+	}
+
+	df.MyAccount.LastSeq = seq
+
+	flushDBToDisk(df)
+
+	return nil
+}
+
 func (db *DB) Contacts() []client.User {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -103,8 +144,27 @@ func (db *DB) QueryContactByID(id common.Address) (client.User, error) {
 		return client.User{}, fmt.Errorf("read messages: %w", err)
 	}
 
-	messages := make([]client.Message, len(msgs))
-	for i, msg := range msgs {
+	messages := make([]client.Message, 0, len(msgs))
+	for _, msg := range msgs {
+
+		// A receipt record updates the status of a message stored earlier.
+		if msg.Receipt {
+			applyStatus(messages, msg.ID, msg.Device, []uint64{msg.Nonce}, client.MessageStatus(msg.Status))
+			continue
+		}
+
+		// A tombstone record deletes a message stored earlier.
+		if msg.Tombstone {
+			applyTombstone(messages, msg.ID, msg.MsgID)
+			continue
+		}
+
+		// A reaction record adds or removes a reaction from the sender.
+		if msg.Reaction != "" {
+			applyReaction(messages, msg.ID, msg.MsgID, msg.Reaction, !msg.Remove)
+			continue
+		}
+
 		decryptedData := make([][]byte, len(msg.Content))
 
 		for i, msg := range msg.Content {
@@ -116,11 +176,25 @@ func (db *DB) QueryContactByID(id common.Address) (client.User, error) {
 			decryptedData[i] = dd
 		}
 
-		messages[i] = client.Message{
+		// An edit record replaces the content of a message stored earlier.
+		if msg.Edit {
+			applyEdit(messages, msg.ID, msg.MsgID, decryptedData)
+			continue
+		}
+
+		messages = append(messages, client.Message{
+			ID:          msg.MsgID,
+			ReplyTo:     msg.ReplyTo,
+			From:        msg.ID,
 			Name:        msg.Name,
 			Content:     decryptedData,
 			DateCreated: msg.DateCreated.Local(),
-		}
+			Encrypted:   msg.Encrypted,
+			Nonce:       msg.Nonce,
+			Device:      msg.Device,
+			Status:      client.MessageStatus(msg.Status),
+			File:        toClientFileOffer(msg.File),
+		})
 	}
 
 	// -------------------------------------------------------------------------
@@ -201,10 +275,16 @@ func (db *DB) InsertMessage(id common.Address, msg client.Message) error {
 
 	m := message{
 		ID:          msg.From,
+		MsgID:       msg.ID,
+		ReplyTo:     msg.ReplyTo,
 		Name:        msg.Name,
 		Content:     encryptedData,
 		DateCreated: time.Now().UTC(),
 		Encrypted:   msg.Encrypted,
+		Nonce:       msg.Nonce,
+		Device:      msg.Device,
+		Status:      int(msg.Status),
+		File:        toFileOffer(msg.File),
 	}
 
 	if err := flushMsgToDisk(id, m); err != nil {
@@ -250,7 +330,7 @@ func (db *DB) UpdateAppNonce(id common.Address, nonce uint64) error {
 	return nil
 }
 
-func (db *DB) UpdateContactNonce(id common.Address, nonce uint64) error {
+func (db *DB) UpdateContactNonce(id common.Address, device string, nonce uint64) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -262,7 +342,11 @@ func (db *DB) UpdateContactNonce(id common.Address, nonce uint64) error {
 		return fmt.Errorf("contact not found")
 	}
 
-	u.LastNonce = nonce
+	if u.LastNonces == nil {
+		u.LastNonces = make(map[string]uint64)
+	}
+
+	u.LastNonces[device] = nonce
 
 	db.contacts[id] = u
 
@@ -276,7 +360,10 @@ func (db *DB) UpdateContactNonce(id common.Address, nonce uint64) error {
 
 	for i, contact := range df.Contacts {
 		if contact.ID == id {
-			df.Contacts[i].LastNonce = nonce
+			if df.Contacts[i].LastNonces == nil {
+				df.Contacts[i].LastNonces = make(map[string]uint64)
+			}
+			df.Contacts[i].LastNonces[device] = nonce
 			break
 		}
 	}
@@ -321,3 +408,586 @@ func (db *DB) UpdateContactKey(id common.Address, key string) error {
 
 	return nil
 }
+
+func (db *DB) DeleteContact(id common.Address) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache of contacts.
+
+	if _, exists := db.contacts[id]; !exists {
+		return fmt.Errorf("contact not found")
+	}
+
+	delete(db.contacts, id)
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	df, err := readDBFromDisk()
+	if err != nil {
+		return fmt.Errorf("config read: %w", err)
+	}
+
+	df.Contacts = slices.DeleteFunc(df.Contacts, func(contact dataFileUser) bool {
+		return contact.ID == id
+	})
+
+	flushDBToDisk(df)
+
+	return nil
+}
+
+func (db *DB) InsertGroup(id common.Address, name string, members []common.Address) (client.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache of contacts.
+
+	u := client.User{
+		ID:           id,
+		Name:         name,
+		Group:        true,
+		Members:      members,
+		MemberNonces: make(map[string]uint64),
+	}
+
+	db.contacts[id] = u
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	df, err := readDBFromDisk()
+	if err != nil {
+		return client.User{}, fmt.Errorf("config read: %w", err)
+	}
+
+	dfu := dataFileUser{
+		ID:      id,
+		Name:    name,
+		Group:   true,
+		Members: members,
+	}
+
+	df.Contacts = append(df.Contacts, dfu)
+
+	flushDBToDisk(df)
+
+	return u, nil
+}
+
+func (db *DB) UpdateGroupMembers(id common.Address, members []common.Address) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache of contacts.
+
+	u, exists := db.contacts[id]
+	if !exists || !u.Group {
+		return fmt.Errorf("group not found")
+	}
+
+	u.Members = members
+
+	db.contacts[id] = u
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	df, err := readDBFromDisk()
+	if err != nil {
+		return fmt.Errorf("config read: %w", err)
+	}
+
+	for i, contact := range df.Contacts {
+		if contact.ID == id {
+			df.Contacts[i].Members = members
+			break
+		}
+	}
+
+	flushDBToDisk(df)
+
+	return nil
+}
+
+func (db *DB) UpdateGroupMemberNonce(id common.Address, memberID common.Address, device string, nonce uint64) error {
+	key := client.MemberNonceKey(memberID, device)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache of contacts.
+
+	u, exists := db.contacts[id]
+	if !exists || !u.Group {
+		return fmt.Errorf("group not found")
+	}
+
+	if u.MemberNonces == nil {
+		u.MemberNonces = make(map[string]uint64)
+	}
+
+	u.MemberNonces[key] = nonce
+
+	db.contacts[id] = u
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	df, err := readDBFromDisk()
+	if err != nil {
+		return fmt.Errorf("config read: %w", err)
+	}
+
+	for i, contact := range df.Contacts {
+		if contact.ID == id {
+			if df.Contacts[i].MemberNonces == nil {
+				df.Contacts[i].MemberNonces = make(map[string]uint64)
+			}
+			df.Contacts[i].MemberNonces[key] = nonce
+			break
+		}
+	}
+
+	flushDBToDisk(df)
+
+	return nil
+}
+
+func (db *DB) UpdateMessageStatus(id common.Address, from common.Address, device string, nonces []uint64, status client.MessageStatus) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache of contacts.
+
+	u, exists := db.contacts[id]
+	if !exists {
+		return fmt.Errorf("contact not found")
+	}
+
+	applyStatus(u.Messages, from, device, nonces, status)
+
+	db.contacts[id] = u
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	for _, nonce := range nonces {
+		m := message{
+			ID:          from,
+			DateCreated: time.Now().UTC(),
+			Nonce:       nonce,
+			Device:      device,
+			Status:      int(status),
+			Receipt:     true,
+		}
+
+		if err := flushMsgToDisk(id, m); err != nil {
+			return fmt.Errorf("write receipt: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// QueryReplies returns the direct replies to the message in the order they
+// were received.
+func (db *DB) QueryReplies(id common.Address, msgID uuid.UUID) ([]client.Message, error) {
+	u, err := db.QueryContactByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var replies []client.Message
+	for _, msg := range u.Messages {
+		if msgID != uuid.Nil && msg.ReplyTo == msgID {
+			replies = append(replies, msg)
+		}
+	}
+
+	return replies, nil
+}
+
+// EditMessage replaces the content of a message sent by the author. The
+// earlier content is kept as a revision.
+func (db *DB) EditMessage(id common.Address, from common.Address, msgID uuid.UUID, content [][]byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache of contacts.
+
+	u, exists := db.contacts[id]
+	if !exists {
+		return fmt.Errorf("contact not found")
+	}
+
+	if err := applyEdit(u.Messages, from, msgID, content); err != nil {
+		return err
+	}
+
+	db.contacts[id] = u
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	encryptedData := make([][]byte, len(content))
+
+	for i, msg := range content {
+		ed, err := rsa.EncryptPKCS1v15(rand.Reader, &db.privKeyRSA.PublicKey, msg)
+		if err != nil {
+			return fmt.Errorf("encrypting message: %w", err)
+		}
+
+		encryptedData[i] = ed
+	}
+
+	m := message{
+		ID:          from,
+		MsgID:       msgID,
+		Content:     encryptedData,
+		DateCreated: time.Now().UTC(),
+		Edit:        true,
+	}
+
+	if err := flushMsgToDisk(id, m); err != nil {
+		return fmt.Errorf("write edit: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteMessage replaces a message sent by the author with a tombstone.
+func (db *DB) DeleteMessage(id common.Address, from common.Address, msgID uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache of contacts.
+
+	u, exists := db.contacts[id]
+	if !exists {
+		return fmt.Errorf("contact not found")
+	}
+
+	if err := applyTombstone(u.Messages, from, msgID); err != nil {
+		return err
+	}
+
+	db.contacts[id] = u
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	m := message{
+		ID:          from,
+		MsgID:       msgID,
+		DateCreated: time.Now().UTC(),
+		Tombstone:   true,
+	}
+
+	if err := flushMsgToDisk(id, m); err != nil {
+		return fmt.Errorf("write tombstone: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateReaction adds or removes the sender's reaction to a message.
+func (db *DB) UpdateReaction(id common.Address, from common.Address, msgID uuid.UUID, emoji string, add bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache of contacts.
+
+	u, exists := db.contacts[id]
+	if !exists {
+		return fmt.Errorf("contact not found")
+	}
+
+	if err := applyReaction(u.Messages, from, msgID, emoji, add); err != nil {
+		return err
+	}
+
+	db.contacts[id] = u
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	m := message{
+		ID:          from,
+		MsgID:       msgID,
+		DateCreated: time.Now().UTC(),
+		Reaction:    emoji,
+		Remove:      !add,
+	}
+
+	if err := flushMsgToDisk(id, m); err != nil {
+		return fmt.Errorf("write reaction: %w", err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// applyStatus moves the matching messages forward to the status. A status is
+// never moved backwards since receipts can arrive out of order.
+func applyStatus(msgs []client.Message, from common.Address, device string, nonces []uint64, status client.MessageStatus) {
+	for i := range msgs {
+		if msgs[i].From != from || msgs[i].Device != device || msgs[i].Status >= status {
+			continue
+		}
+
+		if slices.Contains(nonces, msgs[i].Nonce) {
+			msgs[i].Status = status
+		}
+	}
+}
+
+// applyEdit replaces the content of the message if it was sent by the author.
+func applyEdit(msgs []client.Message, from common.Address, msgID uuid.UUID, content [][]byte) error {
+	i, err := findMessage(msgs, from, msgID)
+	if err != nil {
+		return err
+	}
+
+	msgs[i].Revisions = append(msgs[i].Revisions, msgs[i].Content)
+	msgs[i].Content = content
+
+	return nil
+}
+
+// applyTombstone removes the content and revisions of the message if it was
+// sent by the author.
+func applyTombstone(msgs []client.Message, from common.Address, msgID uuid.UUID) error {
+	i, err := findMessage(msgs, from, msgID)
+	if err != nil {
+		return err
+	}
+
+	msgs[i].Content = nil
+	msgs[i].Revisions = nil
+	msgs[i].Deleted = true
+
+	return nil
+}
+
+// applyReaction adds or removes the sender's reaction to the message. The
+// reactions are copied since the message may be shared with the UI.
+func applyReaction(msgs []client.Message, from common.Address, msgID uuid.UUID, emoji string, add bool) error {
+	i := slices.IndexFunc(msgs, func(msg client.Message) bool {
+		return msg.ID == msgID
+	})
+
+	if msgID == uuid.Nil || i == -1 {
+		return fmt.Errorf("message %s: not found", msgID)
+	}
+
+	if msgs[i].Deleted {
+		return fmt.Errorf("message %s: deleted", msgID)
+	}
+
+	reactions := make(map[string][]common.Address, len(msgs[i].Reactions)+1)
+	for k, v := range msgs[i].Reactions {
+		reactions[k] = slices.Clone(v)
+	}
+
+	switch {
+	case add && !slices.Contains(reactions[emoji], from):
+		reactions[emoji] = append(reactions[emoji], from)
+
+	case !add:
+		reactions[emoji] = slices.DeleteFunc(reactions[emoji], func(id common.Address) bool {
+			return id == from
+		})
+
+		if len(reactions[emoji]) == 0 {
+			delete(reactions, emoji)
+		}
+	}
+
+	msgs[i].Reactions = reactions
+
+	return nil
+}
+
+// findMessage returns the index of the message if it was sent by the author
+// and wasn't deleted.
+func findMessage(msgs []client.Message, from common.Address, msgID uuid.UUID) (int, error) {
+	if msgID == uuid.Nil {
+		return 0, fmt.Errorf("message id missing")
+	}
+
+	for i := range msgs {
+		if msgs[i].ID != msgID {
+			continue
+		}
+
+		switch {
+		case msgs[i].From != from:
+			return 0, fmt.Errorf("message %s: not the author: %s", msgID, from)
+
+		case msgs[i].Deleted:
+			return 0, fmt.Errorf("message %s: deleted", msgID)
+		}
+
+		return i, nil
+	}
+
+	return 0, fmt.Errorf("message %s: not found", msgID)
+}
+
+// InsertOutbox holds a signed message until it can be sent to the CAP.
+func (db *DB) InsertOutbox(msg client.OutboxMessage) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	outMsg := outboxMessage{
+		ID:    msg.ID,
+		To:    msg.To,
+		Nonce: msg.Nonce,
+		Data:  msg.Data,
+	}
+
+	if err := appendOutboxToDisk(outMsg); err != nil {
+		return fmt.Errorf("append outbox: %w", err)
+	}
+
+	return nil
+}
+
+// QueryOutbox returns the messages waiting to be sent in the order they
+// were queued.
+func (db *DB) QueryOutbox() ([]client.OutboxMessage, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	outMsgs, err := readOutboxFromDisk()
+	if err != nil {
+		return nil, fmt.Errorf("read outbox: %w", err)
+	}
+
+	msgs := make([]client.OutboxMessage, len(outMsgs))
+	for i, msg := range outMsgs {
+		msgs[i] = client.OutboxMessage{
+			ID:    msg.ID,
+			To:    msg.To,
+			Nonce: msg.Nonce,
+			Data:  msg.Data,
+		}
+	}
+
+	return msgs, nil
+}
+
+// DeleteOutbox removes a message from the outbox once it was sent.
+func (db *DB) DeleteOutbox(id uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	msgs, err := readOutboxFromDisk()
+	if err != nil {
+		return fmt.Errorf("read outbox: %w", err)
+	}
+
+	msgs = slices.DeleteFunc(msgs, func(msg outboxMessage) bool {
+		return msg.ID == id
+	})
+
+	if err := flushOutboxToDisk(msgs); err != nil {
+		return fmt.Errorf("flush outbox: %w", err)
+	}
+
+	return nil
+}
+
+// InsertUpload keeps track of a file being uploaded until it's offered.
+func (db *DB) InsertUpload(up client.Upload) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := appendUploadToDisk(upload(up)); err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+
+	return nil
+}
+
+// QueryUploads returns the files that haven't been offered yet in the order
+// the uploads started.
+func (db *DB) QueryUploads() ([]client.Upload, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ups, err := readUploadsFromDisk()
+	if err != nil {
+		return nil, fmt.Errorf("read uploads: %w", err)
+	}
+
+	uploads := make([]client.Upload, len(ups))
+	for i, up := range ups {
+		uploads[i] = client.Upload(up)
+	}
+
+	return uploads, nil
+}
+
+// DeleteUpload stops tracking an upload once the file is offered or the
+// upload is given up.
+func (db *DB) DeleteUpload(id uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ups, err := readUploadsFromDisk()
+	if err != nil {
+		return fmt.Errorf("read uploads: %w", err)
+	}
+
+	ups = slices.DeleteFunc(ups, func(up upload) bool {
+		return up.ID == id
+	})
+
+	if err := flushUploadsToDisk(ups); err != nil {
+		return fmt.Errorf("flush uploads: %w", err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+func toFileOffer(file *client.FileOffer) *fileOffer {
+	if file == nil {
+		return nil
+	}
+
+	return &fileOffer{
+		ID:   file.ID,
+		Name: file.Name,
+		Size: file.Size,
+		Hash: file.Hash,
+		Key:  file.Key,
+	}
+}
+
+func toClientFileOffer(file *fileOffer) *client.FileOffer {
+	if file == nil {
+		return nil
+	}
+
+	return &client.FileOffer{
+		ID:   file.ID,
+		Name: file.Name,
+		Size: file.Size,
+		Hash: file.Hash,
+		Key:  file.Key,
+	}
+}
@@ -0,0 +1,721 @@
+package dbfile_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/PeterLee0620/GoIM/api/clients/tui/ui/client"
+	"github.com/PeterLee0620/GoIM/api/clients/tui/ui/client/storage/dbfile"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// TestOutbox provides a test of holding signed messages on disk until they
+// are sent.
+func TestOutbox(t *testing.T) {
+	t.Log("Given the need to hold messages until they can be sent.")
+	{
+		path := t.TempDir()
+		id := newTestID(t)
+
+		db := openDB(t, path, id)
+
+		if msgs, err := db.QueryOutbox(); err != nil || len(msgs) != 0 {
+			t.Fatal("\tShould start with an empty outbox.", "X", msgs, err)
+		}
+		t.Log("\tShould start with an empty outbox.", "OK")
+
+		to := common.HexToAddress("0x0000000000000000000000000000000000000001")
+
+		var queued []client.OutboxMessage
+		for i, data := range []string{"m1", "m2\nwith a new line", "m3"} {
+			msg := client.OutboxMessage{
+				ID:    uuid.New(),
+				To:    to,
+				Nonce: uint64(i + 1),
+				Data:  []byte(data),
+			}
+
+			if err := db.InsertOutbox(msg); err != nil {
+				t.Fatal("\tShould be able to queue a message.", "X", err)
+			}
+
+			queued = append(queued, msg)
+		}
+		t.Log("\tShould be able to queue a message.", "OK")
+
+		tests := []struct {
+			name   string
+			change func() error
+			exp    []client.OutboxMessage
+		}{
+			{
+				name:   "every message in the order queued",
+				change: func() error { return nil },
+				exp:    queued,
+			},
+			{
+				name:   "the messages left once one is sent",
+				change: func() error { return db.DeleteOutbox(queued[1].ID) },
+				exp:    []client.OutboxMessage{queued[0], queued[2]},
+			},
+			{
+				name:   "the same messages when sending an unknown one",
+				change: func() error { return db.DeleteOutbox(uuid.New()) },
+				exp:    []client.OutboxMessage{queued[0], queued[2]},
+			},
+			{
+				name: "the same messages after a restart",
+				change: func() error {
+					db = openDB(t, path, id)
+					return nil
+				},
+				exp: []client.OutboxMessage{queued[0], queued[2]},
+			},
+		}
+
+		for _, tt := range tests {
+			if err := tt.change(); err != nil {
+				t.Fatalf("\tShould be able to change the outbox. %s %v", "X", err)
+			}
+
+			msgs, err := db.QueryOutbox()
+			if err != nil {
+				t.Fatalf("\tShould be able to read the outbox. %s %v", "X", err)
+			}
+
+			if !equalOutbox(msgs, tt.exp) {
+				t.Errorf("\tShould receive %s. %s %v", tt.name, "X", msgs)
+				continue
+			}
+			t.Logf("\tShould receive %s. %s", tt.name, "OK")
+		}
+	}
+}
+
+// TestUploads provides a test of keeping track of the files being uploaded
+// so the uploads can be resumed after a restart.
+func TestUploads(t *testing.T) {
+	t.Log("Given the need to resume the files being uploaded.")
+	{
+		path := t.TempDir()
+		id := newTestID(t)
+
+		db := openDB(t, path, id)
+
+		if uploads, err := db.QueryUploads(); err != nil || len(uploads) != 0 {
+			t.Fatal("\tShould start with no uploads.", "X", uploads, err)
+		}
+		t.Log("\tShould start with no uploads.", "OK")
+
+		to := common.HexToAddress("0x0000000000000000000000000000000000000001")
+
+		var started []client.Upload
+		for i, name := range []string{"a.txt", "b file.txt", "c.txt"} {
+			up := client.Upload{
+				ID:        uuid.New(),
+				To:        to,
+				Path:      "/tmp/" + name,
+				Size:      int64(100 * (i + 1)),
+				Hash:      "hash-" + name,
+				Key:       []byte("key-" + name),
+				ChunkSize: 64,
+				Chunks:    2*i + 2,
+			}
+
+			if err := db.InsertUpload(up); err != nil {
+				t.Fatal("\tShould be able to store an upload.", "X", err)
+			}
+
+			started = append(started, up)
+		}
+		t.Log("\tShould be able to store an upload.", "OK")
+
+		tests := []struct {
+			name   string
+			change func() error
+			exp    []client.Upload
+		}{
+			{
+				name:   "every upload in the order started",
+				change: func() error { return nil },
+				exp:    started,
+			},
+			{
+				name:   "the uploads left once one is offered",
+				change: func() error { return db.DeleteUpload(started[0].ID) },
+				exp:    []client.Upload{started[1], started[2]},
+			},
+			{
+				name:   "the same uploads when deleting an unknown one",
+				change: func() error { return db.DeleteUpload(uuid.New()) },
+				exp:    []client.Upload{started[1], started[2]},
+			},
+			{
+				name: "the same uploads after a restart",
+				change: func() error {
+					db = openDB(t, path, id)
+					return nil
+				},
+				exp: []client.Upload{started[1], started[2]},
+			},
+		}
+
+		for _, tt := range tests {
+			if err := tt.change(); err != nil {
+				t.Fatalf("\tShould be able to change the uploads. %s %v", "X", err)
+			}
+
+			uploads, err := db.QueryUploads()
+			if err != nil {
+				t.Fatalf("\tShould be able to read the uploads. %s %v", "X", err)
+			}
+
+			if !equalUploads(uploads, tt.exp) {
+				t.Errorf("\tShould receive %s. %s %v", tt.name, "X", uploads)
+				continue
+			}
+			t.Logf("\tShould receive %s. %s", tt.name, "OK")
+		}
+	}
+}
+
+// TestMessageStatus provides a test of moving our messages forward as the
+// delivery and read receipts for them arrive.
+func TestMessageStatus(t *testing.T) {
+	t.Log("Given the need to show how far our messages have got.")
+	{
+		path := t.TempDir()
+		id := newTestID(t)
+		me := id.MyAccountID
+
+		db := openDB(t, path, id)
+
+		contactID := common.HexToAddress("0x0000000000000000000000000000000000000001")
+		if _, err := db.InsertContact(contactID, "contact"); err != nil {
+			t.Fatal("\tShould be able to add a contact.", "X", err)
+		}
+
+		msgs := []client.Message{
+			{ID: uuid.New(), From: me, Device: "d1", Nonce: 1, Content: [][]byte{[]byte("m1")}},
+			{ID: uuid.New(), From: me, Device: "d1", Nonce: 2, Content: [][]byte{[]byte("m2")}},
+			{ID: uuid.New(), From: me, Device: "d2", Nonce: 1, Content: [][]byte{[]byte("m3")}},
+			{ID: uuid.New(), From: contactID, Device: "d1", Nonce: 1, Content: [][]byte{[]byte("m4")}},
+		}
+
+		for _, msg := range msgs {
+			if err := db.InsertMessage(contactID, msg); err != nil {
+				t.Fatal("\tShould be able to store a message.", "X", err)
+			}
+		}
+		t.Log("\tShould be able to store a message.", "OK")
+
+		t.Log("\tWhen receipts arrive.")
+		{
+			// The steps are run in order since each one changes the status.
+			tests := []struct {
+				name   string
+				device string
+				nonces []uint64
+				status client.MessageStatus
+				exp    []client.MessageStatus
+			}{
+				{
+					name:   "mark the messages from the device delivered",
+					device: "d1",
+					nonces: []uint64{1, 2},
+					status: client.StatusDelivered,
+					exp:    []client.MessageStatus{client.StatusDelivered, client.StatusDelivered, client.StatusSent, client.StatusSent},
+				},
+				{
+					name:   "mark a message read",
+					device: "d1",
+					nonces: []uint64{1},
+					status: client.StatusRead,
+					exp:    []client.MessageStatus{client.StatusRead, client.StatusDelivered, client.StatusSent, client.StatusSent},
+				},
+				{
+					name:   "keep a read message read when a late delivery arrives",
+					device: "d1",
+					nonces: []uint64{1},
+					status: client.StatusDelivered,
+					exp:    []client.MessageStatus{client.StatusRead, client.StatusDelivered, client.StatusSent, client.StatusSent},
+				},
+				{
+					name:   "only mark the message from the device with the nonce",
+					device: "d2",
+					nonces: []uint64{1},
+					status: client.StatusRead,
+					exp:    []client.MessageStatus{client.StatusRead, client.StatusDelivered, client.StatusRead, client.StatusSent},
+				},
+				{
+					name:   "ignore an unknown nonce",
+					device: "d1",
+					nonces: []uint64{9},
+					status: client.StatusRead,
+					exp:    []client.MessageStatus{client.StatusRead, client.StatusDelivered, client.StatusRead, client.StatusSent},
+				},
+			}
+
+			for _, tt := range tests {
+				if err := db.UpdateMessageStatus(contactID, me, tt.device, tt.nonces, tt.status); err != nil {
+					t.Fatalf("\t\tShould be able to %s. %s %v", tt.name, "X", err)
+				}
+
+				if got := queryStatus(t, db, contactID); !slices.Equal(got, tt.exp) {
+					t.Errorf("\t\tShould %s. %s %v", tt.name, "X", got)
+					continue
+				}
+				t.Logf("\t\tShould %s. %s", tt.name, "OK")
+			}
+		}
+
+		t.Log("\tWhen reading the messages after a restart.")
+		{
+			db = openDB(t, path, id)
+
+			exp := []client.MessageStatus{client.StatusRead, client.StatusDelivered, client.StatusRead, client.StatusSent}
+			if got := queryStatus(t, db, contactID); !slices.Equal(got, exp) {
+				t.Errorf("\t\tShould have the receipts applied. %s %v", "X", got)
+			} else {
+				t.Logf("\t\tShould have the receipts applied. %s", "OK")
+			}
+		}
+	}
+}
+
+// TestReactions provides a test of keeping the reactions on each message
+// aggregated by emoji.
+func TestReactions(t *testing.T) {
+	t.Log("Given the need to store the reactions on messages.")
+	{
+		path := t.TempDir()
+		id := newTestID(t)
+		me := id.MyAccountID
+
+		db := openDB(t, path, id)
+
+		contactID := common.HexToAddress("0x0000000000000000000000000000000000000001")
+		if _, err := db.InsertContact(contactID, "contact"); err != nil {
+			t.Fatal("\tShould be able to add a contact.", "X", err)
+		}
+
+		msgs := []client.Message{
+			{ID: uuid.New(), From: contactID, Content: [][]byte{[]byte("m1")}},
+			{ID: uuid.New(), From: contactID, Content: [][]byte{[]byte("m2")}},
+		}
+
+		for _, msg := range msgs {
+			if err := db.InsertMessage(contactID, msg); err != nil {
+				t.Fatal("\tShould be able to store a message.", "X", err)
+			}
+		}
+
+		if err := db.DeleteMessage(contactID, contactID, msgs[1].ID); err != nil {
+			t.Fatal("\tShould be able to delete a message.", "X", err)
+		}
+		t.Log("\tShould be able to store a message.", "OK")
+
+		t.Log("\tWhen reacting to the messages.")
+		{
+			// The steps are run in order since each one changes the reactions.
+			tests := []struct {
+				name  string
+				from  common.Address
+				msgID uuid.UUID
+				emoji string
+				add   bool
+				fail  bool
+				exp   map[string][]common.Address
+			}{
+				{
+					name:  "add a reaction",
+					from:  contactID,
+					msgID: msgs[0].ID,
+					emoji: "👍",
+					add:   true,
+					exp:   map[string][]common.Address{"👍": {contactID}},
+				},
+				{
+					name:  "add the same reaction twice",
+					from:  contactID,
+					msgID: msgs[0].ID,
+					emoji: "👍",
+					add:   true,
+					exp:   map[string][]common.Address{"👍": {contactID}},
+				},
+				{
+					name:  "add the reaction of another user",
+					from:  me,
+					msgID: msgs[0].ID,
+					emoji: "👍",
+					add:   true,
+					exp:   map[string][]common.Address{"👍": {contactID, me}},
+				},
+				{
+					name:  "add another emoji",
+					from:  me,
+					msgID: msgs[0].ID,
+					emoji: "🎉",
+					add:   true,
+					exp:   map[string][]common.Address{"👍": {contactID, me}, "🎉": {me}},
+				},
+				{
+					name:  "remove a reaction",
+					from:  contactID,
+					msgID: msgs[0].ID,
+					emoji: "👍",
+					exp:   map[string][]common.Address{"👍": {me}, "🎉": {me}},
+				},
+				{
+					name:  "remove the last reaction with an emoji",
+					from:  me,
+					msgID: msgs[0].ID,
+					emoji: "🎉",
+					exp:   map[string][]common.Address{"👍": {me}},
+				},
+				{
+					name:  "ignore a reaction to a message that doesn't exist",
+					from:  me,
+					msgID: uuid.New(),
+					emoji: "👍",
+					add:   true,
+					fail:  true,
+					exp:   map[string][]common.Address{"👍": {me}},
+				},
+				{
+					name:  "ignore a reaction to a deleted message",
+					from:  me,
+					msgID: msgs[1].ID,
+					emoji: "👍",
+					add:   true,
+					fail:  true,
+					exp:   map[string][]common.Address{"👍": {me}},
+				},
+			}
+
+			for _, tt := range tests {
+				err := db.UpdateReaction(contactID, tt.from, tt.msgID, tt.emoji, tt.add)
+
+				switch {
+				case tt.fail && err == nil:
+					t.Errorf("\t\tShould %s. %s", tt.name, "X")
+					continue
+				case !tt.fail && err != nil:
+					t.Errorf("\t\tShould be able to %s. %s %v", tt.name, "X", err)
+					continue
+				}
+
+				if got := queryReactions(t, db, contactID, msgs[0].ID); !equalReactions(got, tt.exp) {
+					t.Errorf("\t\tShould %s. %s %v", tt.name, "X", got)
+					continue
+				}
+				t.Logf("\t\tShould %s. %s", tt.name, "OK")
+			}
+		}
+
+		t.Log("\tWhen reading the messages after a restart.")
+		{
+			db = openDB(t, path, id)
+
+			exp := map[string][]common.Address{"👍": {me}}
+			if got := queryReactions(t, db, contactID, msgs[0].ID); !equalReactions(got, exp) {
+				t.Errorf("\t\tShould have the reactions applied. %s %v", "X", got)
+			} else {
+				t.Logf("\t\tShould have the reactions applied. %s", "OK")
+			}
+		}
+	}
+}
+
+// TestReplies provides a test of finding the replies to a message so a
+// thread can be expanded.
+func TestReplies(t *testing.T) {
+	t.Log("Given the need to expand the thread of a message.")
+	{
+		path := t.TempDir()
+		id := newTestID(t)
+
+		db := openDB(t, path, id)
+
+		contactID := common.HexToAddress("0x0000000000000000000000000000000000000001")
+		if _, err := db.InsertContact(contactID, "contact"); err != nil {
+			t.Fatal("\tShould be able to add a contact.", "X", err)
+		}
+
+		root := uuid.New()
+		reply := uuid.New()
+
+		msgs := []client.Message{
+			{ID: root, From: contactID, Content: [][]byte{[]byte("root")}},
+			{ID: reply, ReplyTo: root, From: id.MyAccountID, Content: [][]byte{[]byte("reply")}},
+			{ID: uuid.New(), From: contactID, Content: [][]byte{[]byte("other")}},
+			{ID: uuid.New(), ReplyTo: reply, From: contactID, Content: [][]byte{[]byte("nested")}},
+			{ID: uuid.New(), ReplyTo: root, From: contactID, Content: [][]byte{[]byte("second reply")}},
+		}
+
+		for _, msg := range msgs {
+			if err := db.InsertMessage(contactID, msg); err != nil {
+				t.Fatal("\tShould be able to store a message.", "X", err)
+			}
+		}
+		t.Log("\tShould be able to store a message.", "OK")
+
+		tests := []struct {
+			name  string
+			msgID uuid.UUID
+			exp   []uuid.UUID
+		}{
+			{"the direct replies in the order received", root, []uuid.UUID{msgs[1].ID, msgs[4].ID}},
+			{"the replies to a reply", reply, []uuid.UUID{msgs[3].ID}},
+			{"no replies to a message without any", msgs[2].ID, nil},
+			{"no replies without a message id", uuid.Nil, nil},
+		}
+
+		for _, when := range []string{"in memory", "after a restart"} {
+			t.Logf("\tWhen reading the replies %s.", when)
+			{
+				if when == "after a restart" {
+					db = openDB(t, path, id)
+				}
+
+				for _, tt := range tests {
+					replies, err := db.QueryReplies(contactID, tt.msgID)
+					if err != nil {
+						t.Fatalf("\t\tShould be able to read the replies. %s %v", "X", err)
+					}
+
+					got := make([]uuid.UUID, len(replies))
+					for i, msg := range replies {
+						got[i] = msg.ID
+					}
+
+					if !slices.Equal(got, tt.exp) {
+						t.Errorf("\t\tShould receive %s. %s %v", tt.name, "X", got)
+						continue
+					}
+					t.Logf("\t\tShould receive %s. %s", tt.name, "OK")
+				}
+			}
+		}
+	}
+}
+
+// TestEditMessage provides a test of storing the edits and deletes made to
+// messages so they survive a restart.
+func TestEditMessage(t *testing.T) {
+	t.Log("Given the need to store the edits and deletes made to messages.")
+	{
+		path := t.TempDir()
+		id := newTestID(t)
+
+		db := openDB(t, path, id)
+
+		contactID := common.HexToAddress("0x0000000000000000000000000000000000000001")
+		if _, err := db.InsertContact(contactID, "contact"); err != nil {
+			t.Fatal("\tShould be able to add a contact.", "X", err)
+		}
+
+		msgs := []client.Message{
+			{ID: uuid.New(), From: contactID, Content: [][]byte{[]byte("m1")}},
+			{ID: uuid.New(), From: id.MyAccountID, Content: [][]byte{[]byte("m2")}},
+			{ID: uuid.New(), From: contactID, Content: [][]byte{[]byte("m3")}},
+		}
+
+		for _, msg := range msgs {
+			if err := db.InsertMessage(contactID, msg); err != nil {
+				t.Fatal("\tShould be able to store a message.", "X", err)
+			}
+		}
+		t.Log("\tShould be able to store a message.", "OK")
+
+		t.Log("\tWhen changing the messages.")
+		{
+			edited := [][]byte{[]byte("m1 edited")}
+
+			tests := []struct {
+				name   string
+				change func() error
+				fail   bool
+			}{
+				{
+					name:   "edit a message as the author",
+					change: func() error { return db.EditMessage(contactID, contactID, msgs[0].ID, edited) },
+				},
+				{
+					name:   "edit a message sent by someone else",
+					change: func() error { return db.EditMessage(contactID, id.MyAccountID, msgs[0].ID, edited) },
+					fail:   true,
+				},
+				{
+					name:   "edit a message that doesn't exist",
+					change: func() error { return db.EditMessage(contactID, contactID, uuid.New(), edited) },
+					fail:   true,
+				},
+				{
+					name:   "delete a message sent by someone else",
+					change: func() error { return db.DeleteMessage(contactID, contactID, msgs[1].ID) },
+					fail:   true,
+				},
+				{
+					name:   "delete a message as the author",
+					change: func() error { return db.DeleteMessage(contactID, contactID, msgs[2].ID) },
+				},
+				{
+					name:   "edit a deleted message",
+					change: func() error { return db.EditMessage(contactID, contactID, msgs[2].ID, edited) },
+					fail:   true,
+				},
+			}
+
+			for _, tt := range tests {
+				err := tt.change()
+
+				switch {
+				case tt.fail && err == nil:
+					t.Errorf("\t\tShould fail to %s. %s", tt.name, "X")
+				case tt.fail:
+					t.Logf("\t\tShould fail to %s. %s", tt.name, "OK")
+				case err != nil:
+					t.Errorf("\t\tShould be able to %s. %s %v", tt.name, "X", err)
+				default:
+					t.Logf("\t\tShould be able to %s. %s", tt.name, "OK")
+				}
+			}
+		}
+
+		exp := []client.Message{
+			{ID: msgs[0].ID, Content: [][]byte{[]byte("m1 edited")}, Revisions: [][][]byte{{[]byte("m1")}}},
+			{ID: msgs[1].ID, Content: [][]byte{[]byte("m2")}},
+			{ID: msgs[2].ID, Deleted: true},
+		}
+
+		for _, when := range []string{"in memory", "after a restart"} {
+			t.Logf("\tWhen reading the messages %s.", when)
+			{
+				if when == "after a restart" {
+					db = openDB(t, path, id)
+				}
+
+				usr, err := db.QueryContactByID(contactID)
+				if err != nil {
+					t.Fatalf("\t\tShould be able to read the messages. %s %v", "X", err)
+				}
+
+				if !equalMessages(usr.Messages, exp) {
+					t.Errorf("\t\tShould have the edits and deletes applied. %s %v", "X", usr.Messages)
+					continue
+				}
+				t.Logf("\t\tShould have the edits and deletes applied. %s", "OK")
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+func newTestID(t *testing.T) client.ID {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("\tShould be able to generate a key.", "X", err)
+	}
+
+	return client.ID{
+		MyAccountID: common.HexToAddress("0x00000000000000000000000000000000000000a1"),
+		PrivKeyRSA:  key,
+	}
+}
+
+// openDB opens the database in the path. Opening it again reads everything
+// back from disk, like the client does when it starts.
+func openDB(t *testing.T, path string, id client.ID) *dbfile.DB {
+	db, err := dbfile.NewDB(path, id)
+	if err != nil {
+		t.Fatal("\tShould be able to open the database.", "X", err)
+	}
+
+	return db
+}
+
+// queryStatus returns the status of each message in the conversation.
+func queryStatus(t *testing.T, db *dbfile.DB, id common.Address) []client.MessageStatus {
+	usr, err := db.QueryContactByID(id)
+	if err != nil {
+		t.Fatalf("\tShould be able to read the messages. %s %v", "X", err)
+	}
+
+	status := make([]client.MessageStatus, len(usr.Messages))
+	for i, msg := range usr.Messages {
+		status[i] = msg.Status
+	}
+
+	return status
+}
+
+// queryReactions returns the reactions on the message.
+func queryReactions(t *testing.T, db *dbfile.DB, id common.Address, msgID uuid.UUID) map[string][]common.Address {
+	usr, err := db.QueryContactByID(id)
+	if err != nil {
+		t.Fatalf("\tShould be able to read the messages. %s %v", "X", err)
+	}
+
+	for _, msg := range usr.Messages {
+		if msg.ID == msgID {
+			return msg.Reactions
+		}
+	}
+
+	t.Fatalf("\tShould be able to find the message. %s %s", "X", msgID)
+
+	return nil
+}
+
+func equalReactions(got, exp map[string][]common.Address) bool {
+	return maps.EqualFunc(got, exp, slices.Equal)
+}
+
+func equalOutbox(got, exp []client.OutboxMessage) bool {
+	if len(got) != len(exp) {
+		return false
+	}
+
+	for i := range got {
+		if got[i].ID != exp[i].ID || got[i].To != exp[i].To || got[i].Nonce != exp[i].Nonce || !bytes.Equal(got[i].Data, exp[i].Data) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalUploads(got, exp []client.Upload) bool {
+	return slices.EqualFunc(got, exp, func(g, e client.Upload) bool {
+		return g.ID == e.ID &&
+			g.To == e.To &&
+			g.Path == e.Path &&
+			g.Size == e.Size &&
+			g.Hash == e.Hash &&
+			bytes.Equal(g.Key, e.Key) &&
+			g.ChunkSize == e.ChunkSize &&
+			g.Chunks == e.Chunks
+	})
+}
+
+// equalMessages compares the id, content, revisions and deleted state of the
+// messages.
+func equalMessages(got, exp []client.Message) bool {
+	equal := func(a, b [][]byte) bool {
+		return slices.EqualFunc(a, b, bytes.Equal)
+	}
+
+	return slices.EqualFunc(got, exp, func(g, e client.Message) bool {
+		return g.ID == e.ID &&
+			g.Deleted == e.Deleted &&
+			equal(g.Content, e.Content) &&
+			slices.EqualFunc(g.Revisions, e.Revisions, equal)
+	})
+}
@@ -9,42 +9,80 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
 )
 
+// defaultDownloadPath is where accepted files are saved unless the data file
+// says otherwise.
+const defaultDownloadPath = "zarf/client/downloads"
+
 const (
 	dbDirName     = "db"
 	dbMsgsDirName = "msgs"
 	dbFileName    = "data.json"
+	dbOutboxName  = "outbox.msg"
+	dbUploadsName = "uploads.msg"
 )
 
 var (
-	dbFileDir string
-	dbMsgsDir string
-	dbFile    string
+	dbFileDir    string
+	dbMsgsDir    string
+	dbFile       string
+	dbOutboxFile string
+	dbUploadFile string
 )
 
+// message is a record in a conversation file. A receipt, edit, tombstone or
+// reaction record changes a message stored earlier in the file. File is set
+// on a message that offers a file.
 type message struct {
 	ID          common.Address `json:"id"`
+	MsgID       uuid.UUID      `json:"msg_id,omitzero"`
+	ReplyTo     uuid.UUID      `json:"reply_to,omitzero"`
 	Name        string         `json:"name"`
 	Encrypted   bool           `json:"encrypted"`
 	Content     [][]byte       `json:"content"`
 	DateCreated time.Time      `json:"date_created"`
+	Nonce       uint64         `json:"nonce,omitempty"`
+	Device      string         `json:"device,omitempty"`
+	Status      int            `json:"status,omitempty"`
+	Receipt     bool           `json:"receipt,omitempty"`
+	Edit        bool           `json:"edit,omitempty"`
+	Tombstone   bool           `json:"tombstone,omitempty"`
+	Reaction    string         `json:"reaction,omitempty"`
+	Remove      bool           `json:"remove,omitempty"`
+	File        *fileOffer     `json:"file,omitempty"`
 }
 
-type myAccount struct {
-	ID          common.Address `json:"id"`
-	Name        string         `json:"name"`
-	ProfilePath string         `json:"profile_path"`
-	JWT         string         `json:"jwt"`
+// fileOffer is a file offered in a message. The key is stored as received,
+// encrypted with our own key.
+type fileOffer struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+	Size int64     `json:"size"`
+	Hash string    `json:"hash"`
+	Key  []byte    `json:"key,omitempty"`
 }
 
-type dataFileUser struct {
+type myAccount struct {
 	ID           common.Address `json:"id"`
 	Name         string         `json:"name"`
-	AppLastNonce uint64         `json:"app_last_nonce"`
-	LastNonce    uint64         `json:"last_nonce"`
-	Key          string         `json:"key,omitempty"`
-	TCPHost      string         `json:"tcp_host,omitempty"`
+	ProfilePath  string         `json:"profile_path"`
+	Device       string         `json:"device"`
+	DownloadPath string         `json:"download_path,omitempty"`
+	LastSeq      uint64         `json:"last_seq,omitempty"`
+}
+
+type dataFileUser struct {
+	ID           common.Address    `json:"id"`
+	Name         string            `json:"name"`
+	AppLastNonce uint64            `json:"app_last_nonce"`
+	LastNonces   map[string]uint64 `json:"last_nonces,omitempty"`
+	Key          string            `json:"key,omitempty"`
+	TCPHost      string            `json:"tcp_host,omitempty"`
+	Group        bool              `json:"group,omitempty"`
+	Members      []common.Address  `json:"members,omitempty"`
+	MemberNonces map[string]uint64 `json:"member_nonces,omitempty"`
 }
 
 type dataFile struct {
@@ -52,10 +90,12 @@ type dataFile struct {
 	Contacts  []dataFileUser `json:"contacts"`
 }
 
-func newDB(filePath string, myAccountID common.Address, jwt string) (dataFile, error) {
+func newDB(filePath string, myAccountID common.Address) (dataFile, error) {
 	dbFileDir = filepath.Join(filePath, dbDirName)
 	dbMsgsDir = filepath.Join(filePath, dbDirName, dbMsgsDirName)
 	dbFile = filepath.Join(filePath, dbDirName, dbFileName)
+	dbOutboxFile = filepath.Join(filePath, dbDirName, dbOutboxName)
+	dbUploadFile = filepath.Join(filePath, dbDirName, dbUploadsName)
 
 	os.MkdirAll(dbFileDir, os.ModePerm)
 	os.MkdirAll(dbMsgsDir, os.ModePerm)
@@ -65,7 +105,7 @@ func newDB(filePath string, myAccountID common.Address, jwt string) (dataFile, e
 	_, err := os.Stat(dbFile)
 	switch {
 	case err != nil:
-		df, err = createDBOnDisk(myAccountID, jwt)
+		df, err = createDBOnDisk(myAccountID)
 
 	default:
 		df, err = readDBFromDisk()
@@ -78,10 +118,26 @@ func newDB(filePath string, myAccountID common.Address, jwt string) (dataFile, e
 		return dataFile{}, fmt.Errorf("config: %w", err)
 	}
 
+	// Data files from before devices or file transfers were supported get
+	// the missing settings now.
+	if df.MyAccount.Device == "" || df.MyAccount.DownloadPath == "" {
+		if df.MyAccount.Device == "" {
+			df.MyAccount.Device = uuid.NewString()
+		}
+
+		if df.MyAccount.DownloadPath == "" {
+			df.MyAccount.DownloadPath = defaultDownloadPath
+		}
+
+		if err := flushDBToDisk(df); err != nil {
+			return dataFile{}, fmt.Errorf("config: %w", err)
+		}
+	}
+
 	return df, nil
 }
 
-func createDBOnDisk(myAccountID common.Address, jwt string) (dataFile, error) {
+func createDBOnDisk(myAccountID common.Address) (dataFile, error) {
 	f, err := os.Create(dbFile)
 	if err != nil {
 		return dataFile{}, fmt.Errorf("config data file create: %w", err)
@@ -90,10 +146,11 @@ func createDBOnDisk(myAccountID common.Address, jwt string) (dataFile, error) {
 
 	df := dataFile{
 		MyAccount: myAccount{
-			ID:          myAccountID,
-			Name:        "Anonymous",
-			ProfilePath: "zarf/client/profile/lee.txt",
-			JWT:         jwt,
+			ID:           myAccountID,
+			Name:         "Anonymous",
+			ProfilePath:  "zarf/client/profile/lee.txt",
+			Device:       uuid.NewString(),
+			DownloadPath: defaultDownloadPath,
 		},
 		Contacts: []dataFileUser{
 			{
@@ -211,3 +268,152 @@ func flushMsgToDisk(id common.Address, msg message) error {
 
 	return nil
 }
+
+// =============================================================================
+
+type outboxMessage struct {
+	ID    uuid.UUID      `json:"id"`
+	To    common.Address `json:"to"`
+	Nonce uint64         `json:"nonce"`
+	Data  []byte         `json:"data"`
+}
+
+func readOutboxFromDisk() ([]outboxMessage, error) {
+	f, err := os.Open(dbOutboxFile)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	var msgs []outboxMessage
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	for scanner.Scan() {
+		var msg outboxMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+func appendOutboxToDisk(msg outboxMessage) error {
+	f, err := os.OpenFile(dbOutboxFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("outbox file open: %w", err)
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("outbox marshal: %w", err)
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("outbox file write: %w", err)
+	}
+
+	return nil
+}
+
+func flushOutboxToDisk(msgs []outboxMessage) error {
+	f, err := os.Create(dbOutboxFile)
+	if err != nil {
+		return fmt.Errorf("outbox file create: %w", err)
+	}
+	defer f.Close()
+
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("outbox marshal: %w", err)
+		}
+
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("outbox file write: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+type upload struct {
+	ID        uuid.UUID      `json:"id"`
+	To        common.Address `json:"to"`
+	Path      string         `json:"path"`
+	Size      int64          `json:"size"`
+	Hash      string         `json:"hash"`
+	Key       []byte         `json:"key"`
+	ChunkSize int64          `json:"chunk_size"`
+	Chunks    int            `json:"chunks"`
+}
+
+func readUploadsFromDisk() ([]upload, error) {
+	f, err := os.Open(dbUploadFile)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	var uploads []upload
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var up upload
+		if err := json.Unmarshal(scanner.Bytes(), &up); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+
+		uploads = append(uploads, up)
+	}
+
+	return uploads, nil
+}
+
+func appendUploadToDisk(up upload) error {
+	f, err := os.OpenFile(dbUploadFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("upload file open: %w", err)
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(up)
+	if err != nil {
+		return fmt.Errorf("upload marshal: %w", err)
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("upload file write: %w", err)
+	}
+
+	return nil
+}
+
+func flushUploadsToDisk(uploads []upload) error {
+	f, err := os.Create(dbUploadFile)
+	if err != nil {
+		return fmt.Errorf("upload file create: %w", err)
+	}
+	defer f.Close()
+
+	for _, up := range uploads {
+		data, err := json.Marshal(up)
+		if err != nil {
+			return fmt.Errorf("upload marshal: %w", err)
+		}
+
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("upload file write: %w", err)
+		}
+	}
+
+	return nil
+}
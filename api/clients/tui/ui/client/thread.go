@@ -0,0 +1,85 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// Thread returns the thread the message belongs to, starting with the first
+// message of the thread followed by the replies in the order they were
+// received.
+func (app *App) Thread(conversationID common.Address, msgID uuid.UUID) ([]Message, error) {
+	usr, err := app.db.QueryContactByID(conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("query contact: %w", err)
+	}
+
+	root, err := findMessage(usr, msgID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk up to the first message of the thread we still have. A parent can
+	// be missing when the thread started before our history did.
+	seen := map[uuid.UUID]bool{root.ID: true}
+	for root.ReplyTo != uuid.Nil && !seen[root.ReplyTo] {
+		parent, err := findMessage(usr, root.ReplyTo)
+		if err != nil {
+			break
+		}
+
+		seen[parent.ID] = true
+		root = parent
+	}
+
+	// Walk down collecting every reply in the thread.
+	inThread := map[uuid.UUID]bool{root.ID: true}
+	next := []uuid.UUID{root.ID}
+
+	for len(next) > 0 {
+		id := next[0]
+		next = next[1:]
+
+		replies, err := app.db.QueryReplies(conversationID, id)
+		if err != nil {
+			return nil, fmt.Errorf("query replies: %w", err)
+		}
+
+		for _, reply := range replies {
+			if !inThread[reply.ID] {
+				inThread[reply.ID] = true
+				next = append(next, reply.ID)
+			}
+		}
+	}
+
+	var thread []Message
+	for _, msg := range usr.Messages {
+		if inThread[msg.ID] {
+			thread = append(thread, msg)
+		}
+	}
+
+	return thread, nil
+}
+
+// Parent returns the message the message is a reply to.
+func (app *App) Parent(conversationID common.Address, msg Message) (Message, bool) {
+	if msg.ReplyTo == uuid.Nil {
+		return Message{}, false
+	}
+
+	usr, err := app.db.QueryContactByID(conversationID)
+	if err != nil {
+		return Message{}, false
+	}
+
+	parent, err := findMessage(usr, msg.ReplyTo)
+	if err != nil {
+		return Message{}, false
+	}
+
+	return parent, true
+}
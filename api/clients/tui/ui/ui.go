@@ -5,9 +5,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"math"
 	"math/rand/v2"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/PeterLee0620/GoIM/foundation/agents/ollamallm"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/gdamore/tcell/v2"
+	"github.com/google/uuid"
 	"github.com/rivo/tview"
 )
 
@@ -32,12 +35,16 @@ type TUI struct {
 	agent    *ollamallm.Agent
 	history  *history
 	aiMode   bool
+	selected int
+	thread   uuid.UUID
+	replyTo  uuid.UUID
 }
 
 func New(myAccountID common.Address, agent *ollamallm.Agent) *TUI {
 	ui := TUI{
-		agent:   agent,
-		history: NewHistory(5),
+		agent:    agent,
+		history:  NewHistory(5),
+		selected: -1,
 	}
 
 	tApp := tview.NewApplication()
@@ -82,25 +89,15 @@ func New(myAccountID common.Address, agent *ollamallm.Agent) *TUI {
 
 		addrID := common.HexToAddress(actID)
 
-		user, err := ui.app.QueryContactByID(addrID)
-		if err != nil {
-			textView.ScrollToEnd()
-			fmt.Fprintln(textView, "-----")
-			fmt.Fprintln(textView, err.Error()+":"+addrID.Hex())
-			return
-		}
-
-		for i, msg := range user.Messages {
-			fmt.Fprintf(textView, "%s: %s\n", msg.Name, client.StitchMessages(msg.Content))
-			if i < len(user.Messages)-1 {
-				fmt.Fprintln(textView, "-----")
-			}
-		}
-
-		textView.ScrollToEnd()
+		ui.selected = -1
+		ui.thread = uuid.Nil
+		ui.setReplyTo(client.Message{})
+		ui.showConversation(addrID)
 
 		name = strings.ReplaceAll(name, "* ", "")
 		ui.list.SetItemText(idx, name, id)
+
+		go ui.markRead(addrID)
 	})
 
 	// -------------------------------------------------------------------------
@@ -115,7 +112,7 @@ func New(myAccountID common.Address, agent *ollamallm.Agent) *TUI {
 
 	textArea := tview.NewTextArea()
 	textArea.SetWrap(false)
-	textArea.SetPlaceholder("Enter message here...")
+	textArea.SetPlaceholder("Enter message here... (Ctrl-P/Ctrl-N select a message, Ctrl-R react, Ctrl-Y reply, Ctrl-T thread)")
 	textArea.SetBorder(true)
 	textArea.SetBorderPadding(0, 0, 1, 0)
 
@@ -186,6 +183,26 @@ func New(myAccountID common.Address, agent *ollamallm.Agent) *TUI {
 		case tcell.KeyEnter:
 			buttonHandler()
 			return nil
+
+		case tcell.KeyCtrlP:
+			ui.moveSelection(-1)
+			return nil
+
+		case tcell.KeyCtrlN:
+			ui.moveSelection(1)
+			return nil
+
+		case tcell.KeyCtrlR:
+			ui.reactHandler()
+			return nil
+
+		case tcell.KeyCtrlY:
+			ui.replyHandler()
+			return nil
+
+		case tcell.KeyCtrlT:
+			ui.threadHandler()
+			return nil
 		}
 		return event
 	})
@@ -198,8 +215,10 @@ func (ui *TUI) SetApp(app *client.App) {
 
 	for i, user := range app.Contacts() {
 		shortcut := rune(i + 49)
-		switch user.Key {
-		case "":
+		switch {
+		case user.Group:
+			ui.list.AddItem(user.Name, "[blue]"+user.ID.Hex(), shortcut, nil)
+		case user.Key == "":
 			ui.list.AddItem(user.Name, "[red]"+user.ID.Hex(), shortcut, nil)
 		default:
 			ui.list.AddItem(user.Name, "[green]"+user.ID.Hex(), shortcut, nil)
@@ -227,7 +246,7 @@ func (ui *TUI) WriteText(msg client.Message) {
 
 		if msg.To.Hex() == currentID {
 			fmt.Fprintln(ui.textView, "-----")
-			fmt.Fprintf(ui.textView, "%s: %s\n", msg.Name, client.StitchMessages(msg.Content))
+			fmt.Fprintf(ui.textView, "%s%s\n", ui.formatQuote(msg.To, msg), formatMessage(ui.app.ID(), msg))
 		}
 
 	default:
@@ -240,16 +259,26 @@ func (ui *TUI) WriteText(msg client.Message) {
 			return
 		}
 
+		// Group messages are shown in the conversation for the group.
+		chatID := msg.From
+		if msg.GroupID != (common.Address{}) {
+			chatID = msg.GroupID
+		}
+
 		msgContent := fmt.Sprintf("%s: %s", msg.Name, client.StitchMessages(msg.Content))
 
-		ui.history.add(msg.From, msgContent)
+		ui.history.add(chatID, msgContent)
 
-		if msg.From.Hex() == currentID {
+		if chatID.Hex() == currentID {
 			fmt.Fprintln(ui.textView, "-----")
-			fmt.Fprintf(ui.textView, "%s\n", msgContent)
+			fmt.Fprintf(ui.textView, "%s%s\n", ui.formatQuote(chatID, msg), msgContent)
+
+			if msg.GroupID == (common.Address{}) {
+				go ui.markRead(chatID)
+			}
 
 			if ui.aiMode {
-				ui.agentResponse(msg.From)
+				ui.agentResponse(chatID)
 			}
 
 			return
@@ -257,14 +286,14 @@ func (ui *TUI) WriteText(msg client.Message) {
 
 		for i := range ui.list.GetItemCount() {
 			name, idStr := ui.GetItemText(i)
-			if msg.From.Hex() == idStr {
+			if chatID.Hex() == idStr {
 				if !strings.Contains(name, "*") {
 					ui.list.SetItemText(i, "* "+name, idStr)
 					ui.tviewApp.Draw()
 				}
 
 				if ui.aiMode {
-					ui.agentResponse(msg.From)
+					ui.agentResponse(chatID)
 				}
 
 				return
@@ -278,6 +307,33 @@ func (ui *TUI) AddContact(id common.Address, name string) {
 	ui.list.AddItem(name, id.Hex(), shortcut, nil)
 }
 
+func (ui *TUI) AddGroup(id common.Address, name string) {
+	shortcut := rune(ui.list.GetItemCount() + 49)
+	ui.list.AddItem(name, "[blue]"+id.Hex(), shortcut, nil)
+}
+
+func (ui *TUI) RemoveContact(id common.Address) {
+	for i := range ui.list.GetItemCount() {
+		if _, idStr := ui.GetItemText(i); id.Hex() == idStr {
+			ui.list.RemoveItem(i)
+			ui.tviewApp.Draw()
+			return
+		}
+	}
+}
+
+// RefreshContact redraws the conversation with the contact if it's the one
+// being shown, like when the status of our messages changes.
+func (ui *TUI) RefreshContact(id common.Address) {
+	_, currentID := ui.GetItemText(ui.list.GetCurrentItem())
+	if id.Hex() != currentID {
+		return
+	}
+
+	ui.showConversation(id)
+	ui.tviewApp.Draw()
+}
+
 var re = regexp.MustCompile(`\s{2,}`)
 
 func (ui *TUI) ApplyContactPrefix(id common.Address, option string, add bool) {
@@ -368,6 +424,183 @@ func (ui *TUI) updateState() {
 	}
 }
 
+func (ui *TUI) showConversation(id common.Address) {
+	ui.textView.Clear()
+
+	msgs, err := ui.conversation(id)
+	if err != nil {
+		ui.textView.ScrollToEnd()
+		fmt.Fprintln(ui.textView, "-----")
+		fmt.Fprintln(ui.textView, err.Error()+":"+id.Hex())
+		return
+	}
+
+	if ui.thread != uuid.Nil {
+		fmt.Fprintln(ui.textView, "===== thread (Ctrl-T to close) =====")
+	}
+
+	for i, msg := range msgs {
+		text := ui.formatQuote(id, msg) + formatMessage(ui.app.ID(), msg)
+		if i == ui.selected {
+			text = "> " + text
+		}
+
+		fmt.Fprintf(ui.textView, "%s\n", text)
+		if i < len(msgs)-1 {
+			fmt.Fprintln(ui.textView, "-----")
+		}
+	}
+
+	ui.textView.ScrollToEnd()
+}
+
+// conversation returns the messages being shown for the conversation, which
+// is the expanded thread if there is one.
+func (ui *TUI) conversation(id common.Address) ([]client.Message, error) {
+	if ui.thread != uuid.Nil {
+		return ui.app.Thread(id, ui.thread)
+	}
+
+	user, err := ui.app.QueryContactByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.Messages, nil
+}
+
+// selectedMessage returns the message selected in the conversation being
+// shown.
+func (ui *TUI) selectedMessage() (common.Address, client.Message, bool) {
+	_, currentID := ui.GetItemText(ui.list.GetCurrentItem())
+	id := common.HexToAddress(currentID)
+
+	msgs, err := ui.conversation(id)
+	if err != nil || ui.selected < 0 || ui.selected >= len(msgs) {
+		return id, client.Message{}, false
+	}
+
+	return id, msgs[ui.selected], true
+}
+
+// moveSelection moves the selected message in the conversation up or down.
+// The first move up selects the last message.
+func (ui *TUI) moveSelection(delta int) {
+	_, currentID := ui.GetItemText(ui.list.GetCurrentItem())
+	id := common.HexToAddress(currentID)
+
+	msgs, err := ui.conversation(id)
+	if err != nil || len(msgs) == 0 {
+		return
+	}
+
+	switch {
+	case ui.selected == -1 && delta < 0:
+		ui.selected = len(msgs) - 1
+
+	case ui.selected == -1:
+		return
+
+	default:
+		ui.selected = max(0, min(ui.selected+delta, len(msgs)-1))
+	}
+
+	ui.showConversation(id)
+}
+
+// reactHandler reacts to the selected message with the emoji entered in the
+// text area, or a thumbs up when nothing was entered. Reacting again with the
+// same emoji removes the reaction.
+func (ui *TUI) reactHandler() {
+	id, msg, ok := ui.selectedMessage()
+	if !ok {
+		fmt.Fprintln(ui.textView, "-----")
+		fmt.Fprintln(ui.textView, "select a message to react to with Ctrl-P and Ctrl-N")
+		return
+	}
+
+	emoji := strings.TrimSpace(ui.textArea.GetText())
+	if emoji == "" {
+		emoji = "👍"
+	}
+
+	if err := ui.app.React(id, msg.ID, emoji); err != nil {
+		fmt.Fprintln(ui.textView, "-----")
+		fmt.Fprintln(ui.textView, "failed to react: "+err.Error())
+		return
+	}
+
+	ui.textArea.SetText("", false)
+}
+
+// replyHandler makes the next message a reply to the selected message.
+// Pressing it again on the same message cancels the reply.
+func (ui *TUI) replyHandler() {
+	_, msg, ok := ui.selectedMessage()
+	if !ok {
+		fmt.Fprintln(ui.textView, "-----")
+		fmt.Fprintln(ui.textView, "select a message to reply to with Ctrl-P and Ctrl-N")
+		return
+	}
+
+	if msg.ID == ui.replyTo {
+		ui.setReplyTo(client.Message{})
+		return
+	}
+
+	ui.setReplyTo(msg)
+}
+
+// threadHandler expands the thread of the selected message, or goes back to
+// the whole conversation if a thread is already expanded.
+func (ui *TUI) threadHandler() {
+	id, msg, ok := ui.selectedMessage()
+
+	switch {
+	case ui.thread != uuid.Nil:
+		ui.thread = uuid.Nil
+
+	case !ok:
+		fmt.Fprintln(ui.textView, "-----")
+		fmt.Fprintln(ui.textView, "select a message to show the thread for with Ctrl-P and Ctrl-N")
+		return
+
+	default:
+		ui.thread = msg.ID
+	}
+
+	ui.selected = -1
+	ui.showConversation(id)
+}
+
+func (ui *TUI) setReplyTo(msg client.Message) {
+	ui.replyTo = msg.ID
+
+	if msg.ID == uuid.Nil {
+		ui.textArea.SetTitle("")
+		return
+	}
+
+	ui.textArea.SetTitle(fmt.Sprintf("Reply to %s: %s", msg.Name, snippet(msg)))
+}
+
+// formatQuote renders the message a reply is for above the reply.
+func (ui *TUI) formatQuote(id common.Address, msg client.Message) string {
+	parent, ok := ui.app.Parent(id, msg)
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("  | %s: %s\n", parent.Name, snippet(parent))
+}
+
+func (ui *TUI) markRead(id common.Address) {
+	if err := ui.app.MarkRead(id); err != nil {
+		fmt.Fprintln(ui.textView, "-----")
+		fmt.Fprintln(ui.textView, "failed to send read receipt: "+err.Error())
+	}
+}
+
 func (ui *TUI) agentResponse(from common.Address) {
 	ctx := context.TODO()
 
@@ -413,7 +646,15 @@ func (ui *TUI) buttonHandler(to common.Address) {
 		msg = msg[1:]
 	}
 
-	if err := ui.app.SendMessageHandler(to, []byte(msg)); err != nil {
+	send := func() error {
+		if ui.replyTo != uuid.Nil {
+			return ui.app.SendReplyHandler(to, ui.replyTo, []byte(msg))
+		}
+
+		return ui.app.SendMessageHandler(to, []byte(msg))
+	}
+
+	if err := send(); err != nil {
 		msg := client.Message{
 			Name:    "system",
 			Content: [][]byte{fmt.Appendf(nil, "Error sending message: %s", err)},
@@ -422,6 +663,8 @@ func (ui *TUI) buttonHandler(to common.Address) {
 		return
 	}
 
+	ui.setReplyTo(client.Message{})
+
 	ui.history.add(to, msg)
 
 	ui.textArea.SetText("", false)
@@ -486,3 +729,68 @@ func (ui *TUI) GetItemText(idx int) (string, string) {
 
 	return name, id[i+1:]
 }
+
+// formatMessage renders a message for the conversation, marking our own
+// messages with ✓ once delivered and ✓✓ once read. Our own messages show
+// the reference used to edit or delete them.
+func formatMessage(myID common.Address, msg client.Message) string {
+	if msg.Deleted {
+		return fmt.Sprintf("%s: ** message deleted **", msg.Name)
+	}
+
+	text := fmt.Sprintf("%s: %s", msg.Name, client.StitchMessages(msg.Content))
+
+	if len(msg.Revisions) > 0 {
+		text += " (edited)"
+	}
+
+	if len(msg.Reactions) > 0 {
+		text += " " + formatReactions(msg.Reactions)
+	}
+
+	if msg.From != myID {
+		return text
+	}
+
+	switch msg.Status {
+	case client.StatusDelivered:
+		text += " ✓"
+	case client.StatusRead:
+		text += " ✓✓"
+	}
+
+	if ref := msg.Ref(); ref != "" {
+		text += fmt.Sprintf(" #%s", ref)
+	}
+
+	return text
+}
+
+// formatReactions renders the reactions to a message as [emoji count ...]
+// in a stable order.
+func formatReactions(reactions map[string][]common.Address) string {
+	emojis := slices.Sorted(maps.Keys(reactions))
+
+	parts := make([]string, len(emojis))
+	for i, emoji := range emojis {
+		parts[i] = fmt.Sprintf("%s %d", emoji, len(reactions[emoji]))
+	}
+
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// snippet returns the start of the message for quoting it.
+func snippet(msg client.Message) string {
+	const maxLen = 40
+
+	if msg.Deleted {
+		return "message deleted"
+	}
+
+	text := []rune(strings.ReplaceAll(client.StitchMessages(msg.Content), "\n", " "))
+	if len(text) > maxLen {
+		return string(text[:maxLen]) + "..."
+	}
+
+	return string(text)
+}
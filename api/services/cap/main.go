@@ -2,6 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
@@ -16,32 +21,28 @@ import (
 	"github.com/PeterLee0620/GoIM/app/sdk/auth"
 	"github.com/PeterLee0620/GoIM/app/sdk/mux"
 	"github.com/PeterLee0620/GoIM/business/domain/chatbus"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/deliverymgr"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/filemgr"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/groupmgr"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/inboxmgr"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/presencemgr"
 	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/uicltmgr"
 	"github.com/PeterLee0620/GoIM/foundation/keystore"
 	"github.com/PeterLee0620/GoIM/foundation/logger"
 	"github.com/PeterLee0620/GoIM/foundation/tcp"
 	"github.com/PeterLee0620/GoIM/foundation/web"
 	"github.com/ardanlabs/conf/v3"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
+	"golang.org/x/time/rate"
 )
 
 /*
 	MISC
 		- Fix agents from responding to tcp connections
 
-	Datafile transfer
-		- Use HTTP Form for file uploads
-		- Need to exchange a JWT
-		- Encryption
-		- Have TUI be asked to approve the transfer
-
-	Terminate TLS Connections
-		- TCP P2P
-
-	Group Chat
-		- Allow users to create groups
-
 	Refactor client
 		- Clear history button
 
@@ -100,21 +101,83 @@ func run(ctx context.Context, log *logger.Logger) error {
 			ShutdownTimeout time.Duration `conf:"default:20s"`
 			APIHost         string        `conf:"default:0.0.0.0:3000"`
 		}
+		UI struct {
+			QueueDepth   int    `conf:"default:256"`
+			SlowConsumer string `conf:"default:drop-oldest"`
+		}
 		NATS struct {
-			Host       string `conf:"default:demo.nats.io"`
-			Subject    string `conf:"default:ardanlabs-cap"`
-			IDFilePath string `conf:"default:zarf/cap"`
+			Host        string        `conf:"default:demo.nats.io"`
+			Subject     string        `conf:"default:ardanlabs-cap"`
+			IDFilePath  string        `conf:"default:zarf/cap"`
+			MaxAge      time.Duration `conf:"default:168h"`
+			InboxMaxAge time.Duration `conf:"default:168h"`
+			PresenceTTL time.Duration `conf:"default:1m"`
+		}
+		Files struct {
+			MaxSize  int64         `conf:"default:67108864"`
+			MaxChunk int           `conf:"default:1048576"`
+			MaxOpen  int           `conf:"default:16"`
+			MaxBytes int64         `conf:"default:268435456"`
+			MaxAge   time.Duration `conf:"default:168h"`
 		}
 		TCP struct {
 			ServerName string `conf:"default:tcp-server"`
 			ClientName string `conf:"default:tcp-clientmanager"`
 			NetType    string `conf:"default:tcp4"`
 			Addr       string `conf:"default:0.0.0.0:4000"`
+			KeyFile    string `conf:"default:zarf/cap/tcp.ecdsa"`
+			Peers      []string
+			TLS        struct {
+				CertFile     string
+				KeyFile      string
+				CAFile       string
+				ServerName   string
+				Fingerprints []string
+			}
+			Heartbeat struct {
+				Interval    time.Duration `conf:"default:15s"`
+				MaxMissed   int           `conf:"default:3"`
+				IdleTimeout time.Duration `conf:"default:10m"`
+			}
+			RateLimit struct {
+				Rate  float64 `conf:"default:50"`
+				Burst int     `conf:"default:100"`
+			}
+			Timing struct {
+				Threshold time.Duration `conf:"default:500ms"`
+			}
+			Admission struct {
+				MaxClients  int     `conf:"default:1024"`
+				MaxPerIP    int     `conf:"default:16"`
+				AcceptRate  float64 `conf:"default:20"`
+				AcceptBurst int     `conf:"default:40"`
+				Allow       []string
+				Deny        []string
+				BindTimeout time.Duration `conf:"default:10s"`
+			}
+			Proxy struct {
+				Trusted []string
+			}
+			Restart struct {
+				MinDelay time.Duration `conf:"default:100ms"`
+				MaxDelay time.Duration `conf:"default:10s"`
+			}
+			Dial struct {
+				Timeout     time.Duration `conf:"default:5s"`
+				BindTimeout time.Duration `conf:"default:10s"`
+			}
+			Redial struct {
+				MaxAttempts int           `conf:"default:10"`
+				MinDelay    time.Duration `conf:"default:1s"`
+				MaxDelay    time.Duration `conf:"default:1m"`
+				Jitter      float64       `conf:"default:0.2"`
+			}
 		}
 		Auth struct {
-			KeysFolder string `conf:"default:zarf/client/id/"`
-			ActiveKID  string `conf:"default:key"`
-			Issuer     string `conf:"default:usdl project"`
+			KeysFolder    string        `conf:"default:zarf/keys/"`
+			ActiveKID     string        `conf:"default:key"`
+			Issuer        string        `conf:"default:usdl project"`
+			TokenDuration time.Duration `conf:"default:1h"`
 		}
 	}{
 		Version: conf.Version{
@@ -152,6 +215,10 @@ func run(ctx context.Context, log *logger.Logger) error {
 
 	log.Info(ctx, "startup", "status", "initializing authentication support")
 
+	if err := ensureAuthKey(cfg.Auth.KeysFolder, cfg.Auth.ActiveKID); err != nil {
+		return fmt.Errorf("auth key: %w", err)
+	}
+
 	ks := keystore.New()
 
 	if _, err := ks.LoadByFileSystem(os.DirFS(cfg.Auth.KeysFolder)); err != nil {
@@ -178,23 +245,161 @@ func run(ctx context.Context, log *logger.Logger) error {
 
 	log.Info(ctx, "startup", "status", "getting cap", "capID", capID)
 
+	// -------------------------------------------------------------------------
+	// NATS
+
+	nc, err := nats.Connect(cfg.NATS.Host)
+	if err != nil {
+		return fmt.Errorf("nats connect: %w", err)
+	}
+	defer nc.Close()
+
+	// -------------------------------------------------------------------------
+	// Presence Manager
+
+	presenceMgr, err := presencemgr.New(log, nc, cfg.NATS.Subject, capID, cfg.NATS.PresenceTTL)
+	if err != nil {
+		return fmt.Errorf("presence manager: %w", err)
+	}
+
 	// -------------------------------------------------------------------------
 	// UI Client Manager
 
-	uiCltMgr := uicltmgr.New(log)
+	uiCltMgr := uicltmgr.New(log, presenceMgr)
+
+	// -------------------------------------------------------------------------
+	// Inbox Manager
+
+	inboxMgr, err := inboxmgr.New(log, nc, cfg.NATS.Subject, cfg.NATS.InboxMaxAge)
+	if err != nil {
+		return fmt.Errorf("inbox manager: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+	// Delivery Manager
+
+	deliveryMgr, err := deliverymgr.New(log, nc, cfg.NATS.Subject, cfg.NATS.MaxAge)
+	if err != nil {
+		return fmt.Errorf("delivery manager: %w", err)
+	}
+
+	uiDeliverer := chatbus.NewUIDeliverer(log, uiCltMgr, deliveryMgr)
+
+	// -------------------------------------------------------------------------
+	// Group Manager
+
+	groupMgr, err := groupmgr.New(log, nc, cfg.NATS.Subject)
+	if err != nil {
+		return fmt.Errorf("group manager: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+	// File Manager
+
+	fileMgr, err := filemgr.New(log, nc, cfg.NATS.Subject, cfg.Files.MaxAge)
+	if err != nil {
+		return fmt.Errorf("file manager: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+	// TCP Identity
+
+	tcpKey, err := getTCPKey(cfg.TCP.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tcp key: %w", err)
+	}
+
+	tcpPeers := make([]common.Address, len(cfg.TCP.Peers))
+	for i, peer := range cfg.TCP.Peers {
+		if !common.IsHexAddress(peer) {
+			return fmt.Errorf("tcp peer: invalid address: %q", peer)
+		}
+		tcpPeers[i] = common.HexToAddress(peer)
+	}
+
+	tcpAuth := chatbus.NewTCPAuth(tcpKey, tcpPeers)
+
+	log.Info(ctx, "startup", "status", "tcp identity", "peerID", tcpAuth.ID(), "trustedPeers", len(tcpPeers))
+
+	// Peer links are refused in both directions until peers are trusted.
+	if len(tcpPeers) == 0 {
+		log.Info(ctx, "startup", "status", "no trusted tcp peers, every tcp link will be refused")
+	}
+
+	// -------------------------------------------------------------------------
+	// TCP TLS
+
+	// Peer links use mutually authenticated TLS when a certificate is
+	// configured, and then peers without TLS are refused.
+	var tcpTLS *tcp.TLSConfig
+	if cfg.TCP.TLS.CertFile != "" {
+		tcpTLS = &tcp.TLSConfig{
+			CertFile:     cfg.TCP.TLS.CertFile,
+			KeyFile:      cfg.TCP.TLS.KeyFile,
+			CAFile:       cfg.TCP.TLS.CAFile,
+			ServerName:   cfg.TCP.TLS.ServerName,
+			Fingerprints: cfg.TCP.TLS.Fingerprints,
+		}
+
+		log.Info(ctx, "startup", "status", "tcp tls enabled", "cert", cfg.TCP.TLS.CertFile, "pins", len(cfg.TCP.TLS.Fingerprints))
+	}
+
+	// -------------------------------------------------------------------------
+	// TCP Heartbeat
+
+	tcpHeartbeat := tcp.Heartbeat{
+		Interval:    cfg.TCP.Heartbeat.Interval,
+		MaxMissed:   cfg.TCP.Heartbeat.MaxMissed,
+		IdleTimeout: cfg.TCP.Heartbeat.IdleTimeout,
+	}
+
+	// -------------------------------------------------------------------------
+	// TCP Middleware
+
+	// Each peer connection is limited to the rate of requests it can make.
+	// Only the requests slower than the timing threshold are logged.
+	tcpMiddleware := []tcp.MidFunc{
+		tcp.Timing(cfg.TCP.Timing.Threshold),
+		tcp.Panics(),
+		tcp.RateLimit(rate.Limit(cfg.TCP.RateLimit.Rate), cfg.TCP.RateLimit.Burst),
+	}
 
 	// -------------------------------------------------------------------------
 	// TCP Server
 
+	// The TCP server stops accepting connections when this context is
+	// canceled on shutdown.
+	tcpCtx, tcpCancel := context.WithCancel(ctx)
+	defer tcpCancel()
+
 	tcpSrvLogger := func(ctx context.Context, name string, evt string, typ string, ipAddress string, format string, a ...any) {
 		log.Info(ctx, "Tcp Server Event", "name", name, "evt", evt, "typ", typ, "ipAddress", ipAddress, "info", fmt.Sprintf(format, a...))
 	}
 
 	tcpSrvCfg := tcp.ServerConfig{
-		NetType:  cfg.TCP.NetType,
-		Addr:     cfg.TCP.Addr,
-		Handlers: chatbus.NewServerHandlers(log, uiCltMgr),
-		Logger:   tcpSrvLogger,
+		NetType:    cfg.TCP.NetType,
+		Addr:       cfg.TCP.Addr,
+		Handlers:   chatbus.NewServerHandlers(log, uiCltMgr, uiDeliverer, inboxMgr, groupMgr, tcpAuth, tcpTLS != nil),
+		Logger:     tcpSrvLogger,
+		TLS:        tcpTLS,
+		Heartbeat:  tcpHeartbeat,
+		Middleware: tcpMiddleware,
+		Admission: tcp.Admission{
+			MaxClients:  cfg.TCP.Admission.MaxClients,
+			MaxPerIP:    cfg.TCP.Admission.MaxPerIP,
+			AcceptRate:  rate.Limit(cfg.TCP.Admission.AcceptRate),
+			AcceptBurst: cfg.TCP.Admission.AcceptBurst,
+			Allow:       cfg.TCP.Admission.Allow,
+			Deny:        cfg.TCP.Admission.Deny,
+			BindTimeout: cfg.TCP.Admission.BindTimeout,
+		},
+		Restart: tcp.Backoff{
+			Min: cfg.TCP.Restart.MinDelay,
+			Max: cfg.TCP.Restart.MaxDelay,
+		},
+		Proxy: tcp.ProxyProtocol{
+			Trusted: cfg.TCP.Proxy.Trusted,
+		},
 	}
 
 	tcpSrv, err := tcp.NewServer(cfg.TCP.ServerName, tcpSrvCfg)
@@ -210,7 +415,7 @@ func run(ctx context.Context, log *logger.Logger) error {
 
 	go func() {
 		log.Info(ctx, "TCP", "status", "starting TCP server", "addr", cfg.TCP.Addr)
-		tcpErrors <- tcpSrv.Listen()
+		tcpErrors <- tcpSrv.ListenContext(tcpCtx)
 	}()
 
 	// -------------------------------------------------------------------------
@@ -221,8 +426,21 @@ func run(ctx context.Context, log *logger.Logger) error {
 	}
 
 	cfgCltCfg := tcp.ClientConfig{
-		Handlers: chatbus.NewClientHandlers(log),
-		Logger:   tcpCltLogger,
+		Handlers:    chatbus.NewClientHandlers(log, uiDeliverer, inboxMgr, groupMgr, tcpAuth, tcpTLS != nil),
+		Logger:      tcpCltLogger,
+		TLS:         tcpTLS,
+		Heartbeat:   tcpHeartbeat,
+		Middleware:  tcpMiddleware,
+		DialTimeout: cfg.TCP.Dial.Timeout,
+		BindTimeout: cfg.TCP.Dial.BindTimeout,
+		Redial: tcp.Redial{
+			MaxAttempts: cfg.TCP.Redial.MaxAttempts,
+			Backoff: tcp.Backoff{
+				Min:    cfg.TCP.Redial.MinDelay,
+				Max:    cfg.TCP.Redial.MaxDelay,
+				Jitter: cfg.TCP.Redial.Jitter,
+			},
+		},
 	}
 
 	tcpCM, err := tcp.NewClientManager(cfg.TCP.ClientName, cfgCltCfg)
@@ -235,22 +453,33 @@ func run(ctx context.Context, log *logger.Logger) error {
 	}()
 
 	// -------------------------------------------------------------------------
-	// NATS and ChatBus
+	// ChatBus
 
-	nc, err := nats.Connect(cfg.NATS.Host)
+	slowConsumer, err := chatbus.ParseSlowConsumerPolicy(cfg.UI.SlowConsumer)
 	if err != nil {
-		return fmt.Errorf("nats connect: %w", err)
+		return fmt.Errorf("slow consumer policy: %w", err)
 	}
-	defer nc.Close()
 
 	cfgBus := chatbus.Config{
-		Log:         log,
-		NATSConn:    nc,
-		UICltMgr:    uiCltMgr,
-		TCPCltMgr:   tcpCM,
-		TCPServer:   tcpSrv,
-		NATSSubject: cfg.NATS.Subject,
-		CAPID:       capID,
+		Log:            log,
+		NATSConn:       nc,
+		UICltMgr:       uiCltMgr,
+		PresenceMgr:    presenceMgr,
+		InboxMgr:       inboxMgr,
+		GroupMgr:       groupMgr,
+		FileMgr:        fileMgr,
+		TCPCltMgr:      tcpCM,
+		TCPServer:      tcpSrv,
+		UIDeliverer:    uiDeliverer,
+		NATSSubject:    cfg.NATS.Subject,
+		NATSMaxAge:     cfg.NATS.MaxAge,
+		CAPID:          capID,
+		UIQueueDepth:   cfg.UI.QueueDepth,
+		UISlowConsumer: slowConsumer,
+		FileMaxSize:    cfg.Files.MaxSize,
+		FileMaxChunk:   cfg.Files.MaxChunk,
+		FileMaxOpen:    cfg.Files.MaxOpen,
+		FileMaxBytes:   cfg.Files.MaxBytes,
 	}
 
 	chatBus, err := chatbus.NewBusiness(cfgBus)
@@ -267,10 +496,12 @@ func run(ctx context.Context, log *logger.Logger) error {
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
 	cfgMux := mux.Config{
-		Log:        log,
-		ChatBus:    chatBus,
-		ServerAddr: cfg.TCP.Addr,
-		Auth:       ath,
+		Log:           log,
+		ChatBus:       chatBus,
+		ServerAddr:    cfg.TCP.Addr,
+		Auth:          ath,
+		ActiveKID:     cfg.Auth.ActiveKID,
+		TokenDuration: cfg.Auth.TokenDuration,
 	}
 
 	webAPI := mux.WebAPI(cfgMux)
@@ -313,9 +544,17 @@ func run(ctx context.Context, log *logger.Logger) error {
 			return fmt.Errorf("could not stop web server gracefully: %w", err)
 		}
 
+		// Canceling the context stops the TCP server from accepting new
+		// connections before the connected peers are closed.
+		tcpCancel()
+
 		if err := tcpSrv.Shutdown(ctx); err != nil {
 			return fmt.Errorf("could not stop tcp server gracefully: %w", err)
 		}
+
+		if err := tcpCM.Shutdown(ctx); err != nil {
+			return fmt.Errorf("could not stop tcp client manager gracefully: %w", err)
+		}
 	}
 
 	return nil
@@ -357,3 +596,68 @@ func getCapID(idFilePath string) (uuid.UUID, error) {
 
 	return capID, nil
 }
+
+// ensureAuthKey creates the private key used to sign tokens if the CAP doesn't
+// have one yet. The keys folder must only be readable by the CAP and is kept
+// out of git.
+func ensureAuthKey(keysFolder string, kid string) error {
+	fileName := filepath.Join(keysFolder, kid+".rsa")
+
+	if _, err := os.Stat(fileName); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(keysFolder, 0700); err != nil {
+		return fmt.Errorf("keys folder create: %w", err)
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("key file create: %w", err)
+	}
+	defer f.Close()
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("marshaling key: %w", err)
+	}
+
+	privateBlock := pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}
+
+	if err := pem.Encode(f, &privateBlock); err != nil {
+		return fmt.Errorf("encoding to key file: %w", err)
+	}
+
+	return nil
+}
+
+// getTCPKey loads the key the CAP proves its identity with on the TCP links,
+// creating it if the CAP doesn't have one yet.
+func getTCPKey(fileName string) (*ecdsa.PrivateKey, error) {
+	if _, err := os.Stat(fileName); err == nil {
+		return crypto.LoadECDSA(fileName)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return nil, fmt.Errorf("key folder create: %w", err)
+	}
+
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	if err := crypto.SaveECDSA(fileName, privateKey); err != nil {
+		return nil, fmt.Errorf("key file save: %w", err)
+	}
+
+	return privateKey, nil
+}
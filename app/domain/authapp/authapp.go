@@ -0,0 +1,154 @@
+// Package authapp provides the application layer for issuing tokens to users
+// that prove they own the key for their address.
+package authapp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/app/sdk/auth"
+	"github.com/PeterLee0620/GoIM/app/sdk/errs"
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/PeterLee0620/GoIM/foundation/signature"
+	"github.com/PeterLee0620/GoIM/foundation/web"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// challengeTTL is how long a user has to sign and return a challenge.
+const challengeTTL = time.Minute
+
+// maxChallenges caps the challenges that are outstanding at once since anyone
+// can ask for one.
+const maxChallenges = 10_000
+
+// challenge is kept by its value so asking for a challenge for an address
+// doesn't replace the ones already handed out for it.
+type challenge struct {
+	address   common.Address
+	expiresAt time.Time
+}
+
+type app struct {
+	log           *logger.Logger
+	auth          *auth.Auth
+	activeKID     string
+	tokenDuration time.Duration
+	challenges    map[string]challenge
+	mu            sync.Mutex
+}
+
+func newApp(log *logger.Logger, ath *auth.Auth, activeKID string, tokenDuration time.Duration) *app {
+	return &app{
+		log:           log,
+		auth:          ath,
+		activeKID:     activeKID,
+		tokenDuration: tokenDuration,
+		challenges:    make(map[string]challenge),
+	}
+}
+
+func (a *app) challenge(ctx context.Context, r *http.Request) web.Encoder {
+	var req challengeRequest
+	if err := web.Decode(r, &req); err != nil {
+		return errs.Newf(errs.InvalidArgument, "invalid request: %s", err)
+	}
+
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return errs.Newf(errs.Internal, "challenge: %s", err)
+	}
+
+	now := time.Now().UTC()
+
+	value := hex.EncodeToString(b[:])
+	chl := challenge{
+		address:   common.HexToAddress(req.Address),
+		expiresAt: now.Add(challengeTTL),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Expired challenges are only cleared out when there is no room left.
+	if len(a.challenges) >= maxChallenges {
+		for v, c := range a.challenges {
+			if now.After(c.expiresAt) {
+				delete(a.challenges, v)
+			}
+		}
+
+		if len(a.challenges) >= maxChallenges {
+			return errs.Newf(errs.TooManyRequests, "too many outstanding challenges")
+		}
+	}
+
+	a.challenges[value] = chl
+
+	return challengeResponse{
+		Challenge: value,
+		ExpiresAt: chl.expiresAt,
+	}
+}
+
+func (a *app) token(ctx context.Context, r *http.Request) web.Encoder {
+	var req tokenRequest
+	if err := web.Decode(r, &req); err != nil {
+		return errs.Newf(errs.InvalidArgument, "invalid request: %s", err)
+	}
+
+	address := common.HexToAddress(req.Address)
+
+	// A challenge can only be used once, even if the signature is invalid.
+	chl, exists := a.takeChallenge(req.Challenge)
+	if !exists || chl.address != address || time.Now().After(chl.expiresAt) {
+		return errs.Newf(errs.Unauthenticated, "unknown or expired challenge")
+	}
+
+	if err := signature.VerifySignature(req.V, req.R, req.S); err != nil {
+		return errs.Newf(errs.Unauthenticated, "invalid signature: %s", err)
+	}
+
+	id, err := signature.FromAddress(req.Challenge, req.V, req.R, req.S)
+	if err != nil || id != address.Hex() {
+		return errs.Newf(errs.Unauthenticated, "signature does not match address")
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(a.tokenDuration)
+
+	tkn, err := a.auth.GenerateToken(a.activeKID, auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   address.Hex(),
+			Issuer:    a.auth.Issuer(),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+	if err != nil {
+		return errs.Newf(errs.Internal, "generating token: %s", err)
+	}
+
+	a.log.Info(ctx, "auth-token", "status", "issued", "address", address, "expiresAt", expiresAt)
+
+	return tokenResponse{
+		Token:     tkn,
+		ExpiresAt: expiresAt,
+	}
+}
+
+// =============================================================================
+
+func (a *app) takeChallenge(value string) (challenge, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	chl, exists := a.challenges[value]
+	delete(a.challenges, value)
+
+	return chl, exists
+}
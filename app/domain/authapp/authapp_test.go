@@ -0,0 +1,263 @@
+package authapp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/app/sdk/auth"
+	"github.com/PeterLee0620/GoIM/app/sdk/errs"
+	"github.com/PeterLee0620/GoIM/foundation/keystore"
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/PeterLee0620/GoIM/foundation/signature"
+	"github.com/PeterLee0620/GoIM/foundation/web"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TestToken provides a test of issuing a token to a user that signs the
+// challenge handed out for their address.
+func TestToken(t *testing.T) {
+	t.Log("Given the need to issue tokens for signed challenges.")
+	{
+		a, ath := newTestApp(t)
+
+		user := newTestUser(t)
+		other := newTestUser(t)
+
+		t.Log("\tWhen the user signs the challenge for their address.")
+		{
+			chl := askChallenge(t, a, user.address)
+
+			resp := askToken(a, user, chl, user.key)
+
+			tkn, ok := resp.(tokenResponse)
+			if !ok {
+				t.Fatal("\t\tShould receive a token.", "X", resp)
+			}
+			t.Log("\t\tShould receive a token.", "OK")
+
+			claims, err := ath.Authenticate(context.Background(), "Bearer "+tkn.Token)
+			if err != nil || claims.Subject != user.address {
+				t.Error("\t\tShould have the address as the subject of the token.", "X", claims.Subject, err)
+			} else {
+				t.Log("\t\tShould have the address as the subject of the token.", "OK")
+			}
+
+			if resp := askToken(a, user, chl, user.key); !hasCode(resp, errs.Unauthenticated) {
+				t.Error("\t\tShould not accept the challenge again.", "X", resp)
+			} else {
+				t.Log("\t\tShould not accept the challenge again.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the challenge can't be used.")
+		{
+			tests := []struct {
+				name  string
+				token func() web.Encoder
+			}{
+				{
+					name: "signed with another key",
+					token: func() web.Encoder {
+						return askToken(a, user, askChallenge(t, a, user.address), other.key)
+					},
+				},
+				{
+					name: "handed out for another address",
+					token: func() web.Encoder {
+						return askToken(a, user, askChallenge(t, a, other.address), user.key)
+					},
+				},
+				{
+					name: "never handed out",
+					token: func() web.Encoder {
+						return askToken(a, user, "00", user.key)
+					},
+				},
+				{
+					name: "expired",
+					token: func() web.Encoder {
+						chl := askChallenge(t, a, user.address)
+						expire(a, chl)
+						return askToken(a, user, chl, user.key)
+					},
+				},
+			}
+
+			for _, tt := range tests {
+				if resp := tt.token(); !hasCode(resp, errs.Unauthenticated) {
+					t.Errorf("\t\tShould reject a challenge %s. %s %v", tt.name, "X", resp)
+					continue
+				}
+				t.Logf("\t\tShould reject a challenge %s. %s", tt.name, "OK")
+			}
+		}
+
+		t.Log("\tWhen the user asks for several challenges.")
+		{
+			chl1 := askChallenge(t, a, user.address)
+			chl2 := askChallenge(t, a, user.address)
+
+			_, ok1 := askToken(a, user, chl2, user.key).(tokenResponse)
+			_, ok2 := askToken(a, user, chl1, user.key).(tokenResponse)
+
+			if !ok1 || !ok2 {
+				t.Error("\t\tShould be able to use each of them.", "X", ok1, ok2)
+			} else {
+				t.Log("\t\tShould be able to use each of them.", "OK")
+			}
+		}
+	}
+}
+
+// TestChallengeLimit provides a test of the cap on outstanding challenges.
+func TestChallengeLimit(t *testing.T) {
+	t.Log("Given the need to cap the challenges anyone can ask for.")
+	{
+		a, _ := newTestApp(t)
+
+		user := newTestUser(t)
+
+		for range maxChallenges {
+			askChallenge(t, a, user.address)
+		}
+
+		t.Log("\tWhen every challenge is still outstanding.")
+		{
+			if resp := a.challenge(context.Background(), challengeRequestFor(user.address)); !hasCode(resp, errs.TooManyRequests) {
+				t.Error("\t\tShould refuse another challenge.", "X", resp)
+			} else {
+				t.Log("\t\tShould refuse another challenge.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the challenges have expired.")
+		{
+			for value := range a.challenges {
+				expire(a, value)
+			}
+
+			if _, ok := a.challenge(context.Background(), challengeRequestFor(user.address)).(challengeResponse); !ok {
+				t.Error("\t\tShould hand out a challenge.", "X")
+			} else {
+				t.Log("\t\tShould hand out a challenge.", "OK")
+			}
+
+			if len(a.challenges) != 1 {
+				t.Error("\t\tShould clear out the expired challenges.", "X", len(a.challenges))
+			} else {
+				t.Log("\t\tShould clear out the expired challenges.", "OK")
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+type testUser struct {
+	key     *ecdsa.PrivateKey
+	address string
+}
+
+func newTestUser(t *testing.T) testUser {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal("\tShould be able to generate a user key.", "X", err)
+	}
+
+	return testUser{
+		key:     key,
+		address: crypto.PubkeyToAddress(key.PublicKey).Hex(),
+	}
+}
+
+// newTestApp creates the app with a new key to sign the tokens.
+func newTestApp(t *testing.T) (*app, *auth.Auth) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("\tShould be able to generate a signing key.", "X", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal("\tShould be able to marshal the signing key.", "X", err)
+	}
+
+	ks := keystore.New()
+	if _, err := ks.LoadByFileSystem(fstest.MapFS{
+		"test.rsa": {Data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})},
+	}); err != nil {
+		t.Fatal("\tShould be able to load the signing key.", "X", err)
+	}
+
+	log := logger.New(io.Discard, logger.LevelInfo, "TEST", func(context.Context) string { return "" })
+
+	ath, err := auth.New(auth.Config{
+		Log:       log,
+		KeyLookup: ks,
+		Issuer:    "test",
+	})
+	if err != nil {
+		t.Fatal("\tShould be able to create the auth.", "X", err)
+	}
+
+	return newApp(log, ath, "test", time.Hour), ath
+}
+
+func askChallenge(t *testing.T, a *app, address string) string {
+	resp, ok := a.challenge(context.Background(), challengeRequestFor(address)).(challengeResponse)
+	if !ok {
+		t.Fatal("\tShould be able to ask for a challenge.", "X")
+	}
+
+	return resp.Challenge
+}
+
+func askToken(a *app, user testUser, chl string, key *ecdsa.PrivateKey) web.Encoder {
+	v, r, s, err := signature.Sign(chl, key)
+	if err != nil {
+		return errs.Newf(errs.Internal, "sign: %s", err)
+	}
+
+	return a.token(context.Background(), jsonRequest(tokenRequest{
+		Address:   user.address,
+		Challenge: chl,
+		V:         v,
+		R:         r,
+		S:         s,
+	}))
+}
+
+func expire(a *app, value string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	chl := a.challenges[value]
+	chl.expiresAt = time.Now().Add(-time.Second)
+	a.challenges[value] = chl
+}
+
+func challengeRequestFor(address string) *http.Request {
+	return jsonRequest(challengeRequest{Address: address})
+}
+
+func jsonRequest(v any) *http.Request {
+	data, _ := json.Marshal(v)
+	return httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+}
+
+func hasCode(resp web.Encoder, code errs.ErrCode) bool {
+	err, ok := resp.(*errs.Error)
+	return ok && err.Code == code
+}
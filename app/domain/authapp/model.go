@@ -0,0 +1,78 @@
+package authapp
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type challengeRequest struct {
+	Address string `json:"address"`
+}
+
+// Decode implements the decoder interface.
+func (app *challengeRequest) Decode(data []byte) error {
+	return json.Unmarshal(data, app)
+}
+
+// Validate checks the data in the model is considered clean.
+func (app challengeRequest) Validate() error {
+	if !common.IsHexAddress(app.Address) {
+		return errors.New("invalid address")
+	}
+
+	return nil
+}
+
+type challengeResponse struct {
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (app challengeResponse) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(app)
+	return data, "application/json", err
+}
+
+type tokenRequest struct {
+	Address   string   `json:"address"`
+	Challenge string   `json:"challenge"`
+	V         *big.Int `json:"v"`
+	R         *big.Int `json:"r"`
+	S         *big.Int `json:"s"`
+}
+
+// Decode implements the decoder interface.
+func (app *tokenRequest) Decode(data []byte) error {
+	return json.Unmarshal(data, app)
+}
+
+// Validate checks the data in the model is considered clean.
+func (app tokenRequest) Validate() error {
+	if !common.IsHexAddress(app.Address) {
+		return errors.New("invalid address")
+	}
+
+	if app.Challenge == "" {
+		return errors.New("missing challenge")
+	}
+
+	if app.V == nil || app.R == nil || app.S == nil {
+		return errors.New("missing signature")
+	}
+
+	return nil
+}
+
+type tokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (app tokenResponse) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(app)
+	return data, "application/json", err
+}
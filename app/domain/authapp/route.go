@@ -0,0 +1,18 @@
+package authapp
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/app/sdk/auth"
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/PeterLee0620/GoIM/foundation/web"
+)
+
+// Routes adds specific routes for this group.
+func Routes(app *web.App, log *logger.Logger, auth *auth.Auth, activeKID string, tokenDuration time.Duration) {
+	api := newApp(log, auth, activeKID, tokenDuration)
+
+	app.HandlerFunc(http.MethodPost, "", "/auth/challenge", api.challenge)
+	app.HandlerFunc(http.MethodPost, "", "/auth/token", api.token)
+}
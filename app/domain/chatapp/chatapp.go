@@ -4,13 +4,18 @@ package chatapp
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/PeterLee0620/GoIM/app/sdk/errs"
+	"github.com/PeterLee0620/GoIM/app/sdk/mid"
 	"github.com/PeterLee0620/GoIM/business/domain/chatbus"
 	"github.com/PeterLee0620/GoIM/foundation/logger"
 	"github.com/PeterLee0620/GoIM/foundation/web"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
 )
 
 type app struct {
@@ -28,11 +33,24 @@ func newApp(log *logger.Logger, chat *chatbus.Business, serverAddr string) *app
 }
 
 func (a *app) connect(ctx context.Context, r *http.Request) web.Encoder {
-	usr, err := a.chat.UIHandshake(ctx, web.GetWriter(ctx), r)
+	subject, err := mid.GetUserID(ctx)
+	if err != nil || !common.IsHexAddress(subject) {
+		return errs.Newf(errs.Unauthenticated, "invalid token subject: %q", subject)
+	}
+
+	usr, err := a.chat.UIHandshake(ctx, web.GetWriter(ctx), r, common.HexToAddress(subject))
 	if err != nil {
 		return errs.Newf(errs.FailedPrecondition, "handshake failed: %s", err)
 	}
-	defer usr.UIConn.Close()
+	defer usr.UIWriter.Close()
+
+	if err := a.chat.UIReplay(ctx, usr); err != nil {
+		a.log.Info(ctx, "connect: replay", "ERROR", err)
+	}
+
+	if err := a.chat.UIDrainInbox(ctx, usr); err != nil {
+		a.log.Info(ctx, "connect: drain inbox", "ERROR", err)
+	}
 
 	a.chat.UIListen(ctx, usr)
 
@@ -44,21 +62,39 @@ func (a *app) connect(ctx context.Context, r *http.Request) web.Encoder {
 func (a *app) state(ctx context.Context, r *http.Request) web.Encoder {
 	connections := a.chat.TCPConnections(ctx)
 
-	return stateResponse{
+	resp := stateResponse{
 		TCPConnections: connections,
 	}
+
+	// The caller only gets to see the queues for their own sessions.
+	if subject, err := mid.GetUserID(ctx); err == nil && common.IsHexAddress(subject) {
+		if stats, err := a.chat.UIQueueStats(ctx, common.HexToAddress(subject)); err == nil {
+			resp.Queues = stats
+		}
+	}
+
+	return resp
 }
 
 func (a *app) tcpConnectDrop(ctx context.Context, r *http.Request) web.Encoder {
+	tuiUserID, err := subjectID(ctx)
+	if err != nil {
+		return errs.New(errs.Unauthenticated, err)
+	}
+
 	var tcpConnReq tcpConnRequest
 	if err := web.Decode(r, &tcpConnReq); err != nil {
 		return errs.Newf(errs.InvalidArgument, "invalid request: %s", err)
 	}
 
-	tuiUserID := common.HexToAddress(tcpConnReq.TUIUserID)
+	// A user can only dial or drop a connection for themselves.
+	if common.HexToAddress(tcpConnReq.TUIUserID) != tuiUserID {
+		return errs.Newf(errs.PermissionDenied, "tui user id doesn't match the token subject: %s", tcpConnReq.TUIUserID)
+	}
+
 	clientUserID := common.HexToAddress(tcpConnReq.ClientUserID)
 
-	if err := a.chat.DialTCPConnection(ctx, tuiUserID, clientUserID, "tcp4", tcpConnReq.TCPHost); err != nil {
+	if err := a.chat.DialTCPConnection(ctx, tuiUserID, clientUserID, toBusTCPGrant(tcpConnReq.Grant), "tcp4", tcpConnReq.TCPHost); err != nil {
 		if errors.Is(err, chatbus.ErrClientAlreadyConnected) {
 			if err := a.chat.DropTCPConnection(ctx, tuiUserID); err != nil {
 				return errs.Newf(errs.AlreadyExists, "failed to drop tcp connection: %s", err)
@@ -66,8 +102,155 @@ func (a *app) tcpConnectDrop(ctx context.Context, r *http.Request) web.Encoder {
 			return tcpConnDropResponse{Connected: false, Message: "tcp connection dropped"}
 		}
 
+		if errors.Is(err, chatbus.ErrPeerGrant) {
+			return errs.New(errs.PermissionDenied, err)
+		}
+
 		return errs.Newf(errs.Internal, "failed to dial tcp connection: %s", err)
 	}
 
 	return tcpConnDropResponse{Connected: true, Message: "tcp connection established"}
 }
+
+func (a *app) fileCreate(ctx context.Context, r *http.Request) web.Encoder {
+	userID, err := subjectID(ctx)
+	if err != nil {
+		return errs.New(errs.Unauthenticated, err)
+	}
+
+	var req fileRequest
+	if err := web.Decode(r, &req); err != nil {
+		return errs.Newf(errs.InvalidArgument, "invalid request: %s", err)
+	}
+
+	status, err := a.chat.FileCreate(ctx, userID, toBusFile(req))
+	if err != nil {
+		return fileError(err)
+	}
+
+	return toFileStatusResponse(status)
+}
+
+func (a *app) fileLimits(ctx context.Context, r *http.Request) web.Encoder {
+	return fileLimitsResponse{
+		MaxSize:  a.chat.FileMaxSize(),
+		MaxChunk: a.chat.FileMaxChunk(),
+	}
+}
+
+func (a *app) fileStatus(ctx context.Context, r *http.Request) web.Encoder {
+	userID, fileID, err := fileParams(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	status, ferr := a.chat.FileStatus(ctx, userID, fileID)
+	if ferr != nil {
+		return fileError(ferr)
+	}
+
+	return toFileStatusResponse(status)
+}
+
+func (a *app) fileDelete(ctx context.Context, r *http.Request) web.Encoder {
+	userID, fileID, err := fileParams(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	if err := a.chat.FileDelete(ctx, userID, fileID); err != nil {
+		return fileError(err)
+	}
+
+	return nil
+}
+
+func (a *app) filePutChunk(ctx context.Context, r *http.Request) web.Encoder {
+	userID, fileID, err := fileParams(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	chunk, cerr := strconv.Atoi(web.Param(r, "chunk"))
+	if cerr != nil {
+		return errs.Newf(errs.InvalidArgument, "invalid chunk: %s", cerr)
+	}
+
+	// Read one byte more than allowed so an oversized chunk is rejected
+	// instead of silently truncated.
+	data, rerr := io.ReadAll(io.LimitReader(r.Body, int64(a.chat.FileMaxChunk())+1))
+	if rerr != nil {
+		return errs.Newf(errs.InvalidArgument, "unable to read chunk: %s", rerr)
+	}
+
+	if err := a.chat.FilePutChunk(ctx, userID, fileID, chunk, data); err != nil {
+		return fileError(err)
+	}
+
+	return nil
+}
+
+func (a *app) fileGetChunk(ctx context.Context, r *http.Request) web.Encoder {
+	userID, fileID, err := fileParams(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	chunk, cerr := strconv.Atoi(web.Param(r, "chunk"))
+	if cerr != nil {
+		return errs.Newf(errs.InvalidArgument, "invalid chunk: %s", cerr)
+	}
+
+	data, ferr := a.chat.FileGetChunk(ctx, userID, fileID, chunk)
+	if ferr != nil {
+		return fileError(ferr)
+	}
+
+	return fileChunk(data)
+}
+
+// =============================================================================
+
+func subjectID(ctx context.Context) (common.Address, error) {
+	subject, err := mid.GetUserID(ctx)
+	if err != nil || !common.IsHexAddress(subject) {
+		return common.Address{}, fmt.Errorf("invalid token subject: %q", subject)
+	}
+
+	return common.HexToAddress(subject), nil
+}
+
+func fileParams(ctx context.Context, r *http.Request) (common.Address, uuid.UUID, *errs.Error) {
+	userID, err := subjectID(ctx)
+	if err != nil {
+		return common.Address{}, uuid.UUID{}, errs.New(errs.Unauthenticated, err)
+	}
+
+	fileID, err := uuid.Parse(web.Param(r, "id"))
+	if err != nil {
+		return common.Address{}, uuid.UUID{}, errs.Newf(errs.InvalidArgument, "invalid file id: %s", err)
+	}
+
+	return userID, fileID, nil
+}
+
+func fileError(err error) *errs.Error {
+	switch {
+	case errors.Is(err, chatbus.ErrFileNotExists), errors.Is(err, chatbus.ErrNotExists):
+		return errs.New(errs.NotFound, err)
+
+	case errors.Is(err, chatbus.ErrFileExists):
+		return errs.New(errs.AlreadyExists, err)
+
+	case errors.Is(err, chatbus.ErrFileNotAllowed):
+		return errs.New(errs.PermissionDenied, err)
+
+	case errors.Is(err, chatbus.ErrFileTooLarge), errors.Is(err, chatbus.ErrFileLimit):
+		return errs.New(errs.ResourceExhausted, err)
+
+	case errors.Is(err, chatbus.ErrFileInvalidChunk):
+		return errs.New(errs.InvalidArgument, err)
+	}
+
+	return errs.Newf(errs.Internal, "file: %s", err)
+}
@@ -2,14 +2,29 @@ package chatapp
 
 import (
 	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
 
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
 )
 
+// tcpConnRequest asks the CAP to dial or drop a connection for the tui user.
+// The grant is signed by the tui user to let the CAP speak for them.
 type tcpConnRequest struct {
-	TUIUserID    string `json:"tui_user_id"`
-	ClientUserID string `json:"client_user_id"`
-	TCPHost      string `json:"tcp_host"`
+	TUIUserID    string   `json:"tui_user_id"`
+	ClientUserID string   `json:"client_user_id"`
+	TCPHost      string   `json:"tcp_host"`
+	Grant        tcpGrant `json:"grant"`
+}
+
+type tcpGrant struct {
+	Expires int64    `json:"expires"`
+	V       *big.Int `json:"v"`
+	R       *big.Int `json:"r"`
+	S       *big.Int `json:"s"`
 }
 
 // Decode implements the decoder interface.
@@ -28,10 +43,99 @@ func (app tcpConnDropResponse) Encode() ([]byte, string, error) {
 }
 
 type stateResponse struct {
-	TCPConnections []common.Address `json:"tcp_connections"`
+	TCPConnections []common.Address                    `json:"tcp_connections"`
+	Queues         map[uuid.UUID]chatbus.UIWriterStats `json:"queues,omitempty"`
 }
 
 func (app stateResponse) Encode() ([]byte, string, error) {
 	data, err := json.Marshal(app)
 	return data, "application/json", err
 }
+
+type fileRequest struct {
+	ID     uuid.UUID `json:"id"`
+	ToID   string    `json:"to_id"`
+	Size   int64     `json:"size"`
+	Chunks int       `json:"chunks"`
+}
+
+// Decode implements the decoder interface.
+func (app *fileRequest) Decode(data []byte) error {
+	return json.Unmarshal(data, app)
+}
+
+// Validate checks the data in the model is considered clean.
+func (app fileRequest) Validate() error {
+	if !common.IsHexAddress(app.ToID) {
+		return fmt.Errorf("invalid to_id: %q", app.ToID)
+	}
+
+	return nil
+}
+
+func toBusTCPGrant(app tcpGrant) chatbus.TCPGrant {
+	return chatbus.TCPGrant{
+		Expires: app.Expires,
+		V:       app.V,
+		R:       app.R,
+		S:       app.S,
+	}
+}
+
+func toBusFile(app fileRequest) chatbus.File {
+	return chatbus.File{
+		ID:     app.ID,
+		ToID:   common.HexToAddress(app.ToID),
+		Size:   app.Size,
+		Chunks: app.Chunks,
+	}
+}
+
+type fileStatusResponse struct {
+	ID          uuid.UUID      `json:"id"`
+	FromID      common.Address `json:"from_id"`
+	ToID        common.Address `json:"to_id"`
+	Size        int64          `json:"size"`
+	Chunks      int            `json:"chunks"`
+	Received    []int          `json:"received"`
+	Stored      int64          `json:"stored"`
+	MaxChunk    int            `json:"max_chunk"`
+	DateCreated time.Time      `json:"date_created"`
+}
+
+func toFileStatusResponse(status chatbus.FileStatus) fileStatusResponse {
+	return fileStatusResponse{
+		ID:          status.ID,
+		FromID:      status.FromID,
+		ToID:        status.ToID,
+		Size:        status.Size,
+		Chunks:      status.Chunks,
+		Received:    status.Received,
+		Stored:      status.Stored,
+		MaxChunk:    status.MaxChunk,
+		DateCreated: status.DateCreated,
+	}
+}
+
+func (app fileStatusResponse) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(app)
+	return data, "application/json", err
+}
+
+// fileLimitsResponse tells a client how to split the files it uploads.
+type fileLimitsResponse struct {
+	MaxSize  int64 `json:"max_size"`
+	MaxChunk int   `json:"max_chunk"`
+}
+
+func (app fileLimitsResponse) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(app)
+	return data, "application/json", err
+}
+
+// fileChunk is the raw, encrypted content of a chunk.
+type fileChunk []byte
+
+func (app fileChunk) Encode() ([]byte, string, error) {
+	return app, "application/octet-stream", nil
+}
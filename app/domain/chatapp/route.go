@@ -19,4 +19,10 @@ func Routes(app *web.App, log *logger.Logger, chatBus *chatbus.Business, serverA
 	app.HandlerFunc(http.MethodGet, "", "/connect", api.connect, bearer)
 	app.HandlerFunc(http.MethodGet, "", "/state", api.state, bearer)
 	app.HandlerFunc(http.MethodPost, "", "/tcpconnectdrop", api.tcpConnectDrop, bearer)
+	app.HandlerFunc(http.MethodPost, "", "/files", api.fileCreate, bearer)
+	app.HandlerFunc(http.MethodGet, "", "/files/limits", api.fileLimits, bearer)
+	app.HandlerFunc(http.MethodGet, "", "/files/{id}", api.fileStatus, bearer)
+	app.HandlerFunc(http.MethodDelete, "", "/files/{id}", api.fileDelete, bearer)
+	app.HandlerFunc(http.MethodPut, "", "/files/{id}/chunks/{chunk}", api.filePutChunk, bearer)
+	app.HandlerFunc(http.MethodGet, "", "/files/{id}/chunks/{chunk}", api.fileGetChunk, bearer)
 }
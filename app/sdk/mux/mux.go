@@ -4,7 +4,9 @@ package mux
 import (
 	"context"
 	"net/http"
+	"time"
 
+	"github.com/PeterLee0620/GoIM/app/domain/authapp"
 	"github.com/PeterLee0620/GoIM/app/domain/chatapp"
 	"github.com/PeterLee0620/GoIM/app/sdk/auth"
 	"github.com/PeterLee0620/GoIM/app/sdk/mid"
@@ -15,10 +17,12 @@ import (
 
 // Config contains all the mandatory systems required by handlers.
 type Config struct {
-	Log        *logger.Logger
-	ChatBus    *chatbus.Business
-	ServerAddr string
-	Auth       *auth.Auth
+	Log           *logger.Logger
+	ChatBus       *chatbus.Business
+	ServerAddr    string
+	Auth          *auth.Auth
+	ActiveKID     string
+	TokenDuration time.Duration
 }
 
 // WebAPI constructs a http.Handler with all application routes bound.
@@ -34,6 +38,7 @@ func WebAPI(cfg Config) http.Handler {
 		mid.Panics(),
 	)
 
+	authapp.Routes(app, cfg.Log, cfg.Auth, cfg.ActiveKID, cfg.TokenDuration)
 	chatapp.Routes(app, cfg.Log, cfg.ChatBus, cfg.ServerAddr, cfg.Auth)
 
 	return app
@@ -3,7 +3,6 @@ package chatbus
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
@@ -23,32 +22,105 @@ var (
 	ErrNotExists              = fmt.Errorf("user doesn't exists")
 	ErrClientAlreadyConnected = errors.New("client already connected")
 	ErrClientNotConnected     = errors.New("client not connected")
+	ErrGroupExists            = errors.New("group exists")
+	ErrGroupNotExists         = errors.New("group doesn't exists")
+	ErrInvalidGroupID         = errors.New("invalid group id")
+	ErrGroupConflict          = errors.New("group changed")
+	ErrNotGroupMember         = errors.New("not a group member")
+	ErrNotGroupOwner          = errors.New("not the group owner")
+	ErrInvalidSignature       = errors.New("invalid signature")
+	ErrPeerNotSecure          = errors.New("peer not using tls")
+	ErrFileExists             = errors.New("file exists")
+	ErrFileNotExists          = errors.New("file doesn't exist")
+	ErrFileNotAllowed         = errors.New("file not allowed")
+	ErrFileTooLarge           = errors.New("file too large")
+	ErrFileInvalidChunk       = errors.New("invalid file chunk")
+	ErrFileLimit              = errors.New("file limit reached")
+	ErrFileConflict           = errors.New("file usage changed")
 )
 
-// UIClientManager defines the set of behavior for user management.
+// UIClientManager defines the set of behavior for user management. A user
+// can have a session open for each of their devices.
 type UIClientManager interface {
 	Add(ctx context.Context, usr UIUser) error
-	UpdateLastPing(ctx context.Context, userID common.Address) error
-	UpdateLastPong(ctx context.Context, userID common.Address) (UIUser, error)
-	Remove(ctx context.Context, userID common.Address)
-	Connections() map[common.Address]UIConnection
-	Retrieve(ctx context.Context, userID common.Address) (UIUser, error)
+	UpdateLastPing(ctx context.Context, userID common.Address, sessionID uuid.UUID) error
+	UpdateLastPong(ctx context.Context, userID common.Address, sessionID uuid.UUID) (UIUser, error)
+	Remove(ctx context.Context, userID common.Address, sessionID uuid.UUID)
+	Connections() map[uuid.UUID]UIConnection
+	Retrieve(ctx context.Context, userID common.Address) ([]UIUser, error)
+}
+
+// PresenceManager defines the set of behavior for tracking which CAPs hold
+// the sessions for a user.
+type PresenceManager interface {
+	Register(ctx context.Context, userID common.Address) error
+	Unregister(ctx context.Context, userID common.Address) error
+	Lookup(ctx context.Context, userID common.Address) ([]uuid.UUID, error)
+}
+
+// InboxManager defines the set of behavior for holding messages for users
+// that are not connected to any CAP.
+type InboxManager interface {
+	Push(ctx context.Context, userID common.Address, data []byte) error
+	Drain(ctx context.Context, userID common.Address, fn func(data []byte) error) (int, error)
+}
+
+// DeliveryManager defines the set of behavior for keeping a log of the
+// messages delivered to each user.
+type DeliveryManager interface {
+	Append(ctx context.Context, userID common.Address, msgID uuid.UUID, data []byte) (uint64, error)
+	Replay(ctx context.Context, userID common.Address, after uint64, fn func(seq uint64, data []byte) error) (uint64, error)
+}
+
+// GroupManager defines the set of behavior for group management.
+type GroupManager interface {
+	Create(ctx context.Context, grp Group) error
+	Update(ctx context.Context, grp Group, rev uint64) error
+	Delete(ctx context.Context, groupID common.Address, rev uint64) error
+	Retrieve(ctx context.Context, groupID common.Address) (Group, uint64, error)
+}
+
+// FileManager defines the set of behavior for storing the files users send
+// each other until they are downloaded.
+type FileManager interface {
+	Create(ctx context.Context, file File) error
+	Usage(ctx context.Context, userID common.Address) (FileUsage, uint64, error)
+	UpdateUsage(ctx context.Context, userID common.Address, usage FileUsage, rev uint64) error
+	Retrieve(ctx context.Context, fileID uuid.UUID) (File, error)
+	PutChunk(ctx context.Context, fileID uuid.UUID, chunk int, data []byte) error
+	GetChunk(ctx context.Context, fileID uuid.UUID, chunk int) ([]byte, error)
+	Chunks(ctx context.Context, file File) ([]int, int64, error)
+	Delete(ctx context.Context, file File) error
 }
 
 // TCPClientManager defines the set of behavior for user management.
 type TCPClientManager interface {
-	Dial(ctx context.Context, userID string, network string, address string) (*tcp.Client, error)
+	DialUserContext(ctx context.Context, key string, userID string, network string, address string) (*tcp.Client, error)
 	Retrieve(ctx context.Context, userID string) (*tcp.Client, error)
+	SendTo(userID string, data []byte) error
+	CloseByUserID(userID string) error
 }
 
 type Config struct {
-	Log         *logger.Logger
-	NATSConn    *nats.Conn
-	UICltMgr    UIClientManager
-	TCPCltMgr   TCPClientManager
-	TCPServer   *tcp.Server
-	NATSSubject string
-	CAPID       uuid.UUID
+	Log            *logger.Logger
+	NATSConn       *nats.Conn
+	UICltMgr       UIClientManager
+	PresenceMgr    PresenceManager
+	InboxMgr       InboxManager
+	GroupMgr       GroupManager
+	FileMgr        FileManager
+	TCPCltMgr      TCPClientManager
+	TCPServer      *tcp.Server
+	UIDeliverer    *UIDeliverer
+	NATSSubject    string
+	NATSMaxAge     time.Duration
+	CAPID          uuid.UUID
+	UIQueueDepth   int
+	UISlowConsumer SlowConsumerPolicy
+	FileMaxSize    int64
+	FileMaxChunk   int
+	FileMaxOpen    int
+	FileMaxBytes   int64
 }
 
 // Business represents a chat support.
@@ -60,10 +132,21 @@ type Business struct {
 	capID        uuid.UUID
 	natsSubject  string
 	uiCltMgr     UIClientManager
+	presenceMgr  PresenceManager
+	inboxMgr     InboxManager
+	groupMgr     GroupManager
+	fileMgr      FileManager
 	tcpCltMgr    TCPClientManager
 	tcpServer    *tcp.Server
+	uiDeliverer  *UIDeliverer
 	tcpConnMap   map[common.Address][]common.Address
 	tcpConnMapMu sync.Mutex
+	uiQueueDepth int
+	uiSlowCons   SlowConsumerPolicy
+	fileMaxSize  int64
+	fileMaxChunk int
+	fileMaxOpen  int
+	fileMaxBytes int64
 }
 
 // NewBusiness creates a new chat support.
@@ -77,10 +160,13 @@ func NewBusiness(cfg Config) (*Business, error) {
 
 	// js.DeleteStream(ctx, subject)
 
-	s1, err := js.CreateStream(ctx, jetstream.StreamConfig{
+	// Each CAP has its own subject in the stream so it only receives the
+	// messages for users it holds sessions for according to the presence
+	// directory.
+	s1, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
 		Name:     cfg.NATSSubject,
-		Subjects: []string{cfg.NATSSubject},
-		MaxAge:   24 * time.Hour,
+		Subjects: []string{natsCAPSubject(cfg.NATSSubject, "*")},
+		MaxAge:   cfg.NATSMaxAge,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("nats create js: %w", err)
@@ -88,6 +174,7 @@ func NewBusiness(cfg Config) (*Business, error) {
 
 	c1, err := s1.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
 		Durable:       cfg.CAPID.String(),
+		FilterSubject: natsCAPSubject(cfg.NATSSubject, cfg.CAPID.String()),
 		AckPolicy:     jetstream.AckExplicitPolicy,
 		DeliverPolicy: jetstream.DeliverNewPolicy,
 	})
@@ -96,16 +183,27 @@ func NewBusiness(cfg Config) (*Business, error) {
 	}
 
 	b := Business{
-		log:         cfg.Log,
-		js:          js,
-		stream:      s1,
-		consumer:    c1,
-		capID:       cfg.CAPID,
-		natsSubject: cfg.NATSSubject,
-		uiCltMgr:    cfg.UICltMgr,
-		tcpCltMgr:   cfg.TCPCltMgr,
-		tcpServer:   cfg.TCPServer,
-		tcpConnMap:  make(map[common.Address][]common.Address),
+		log:          cfg.Log,
+		js:           js,
+		stream:       s1,
+		consumer:     c1,
+		capID:        cfg.CAPID,
+		natsSubject:  cfg.NATSSubject,
+		uiCltMgr:     cfg.UICltMgr,
+		presenceMgr:  cfg.PresenceMgr,
+		inboxMgr:     cfg.InboxMgr,
+		groupMgr:     cfg.GroupMgr,
+		fileMgr:      cfg.FileMgr,
+		tcpCltMgr:    cfg.TCPCltMgr,
+		tcpServer:    cfg.TCPServer,
+		uiDeliverer:  cfg.UIDeliverer,
+		tcpConnMap:   make(map[common.Address][]common.Address),
+		uiQueueDepth: cfg.UIQueueDepth,
+		uiSlowCons:   cfg.UISlowConsumer,
+		fileMaxSize:  cfg.FileMaxSize,
+		fileMaxChunk: cfg.FileMaxChunk,
+		fileMaxOpen:  cfg.FileMaxOpen,
+		fileMaxBytes: cfg.FileMaxBytes,
 	}
 
 	c1.Consume(b.natsReadMessage(), jetstream.PullMaxMessages(1))
@@ -117,11 +215,20 @@ func NewBusiness(cfg Config) (*Business, error) {
 }
 
 // DialTCPConnection dials a tcp connection to the given address for a client
-// tcp connection. The address should be in the format "host:port".
-func (b *Business) DialTCPConnection(ctx context.Context, tuiUserID common.Address, clientUserID common.Address, network string, address string) error {
+// tcp connection. The address should be in the format "host:port". The grant
+// signed by the tui user lets us speak for them on the connection.
+func (b *Business) DialTCPConnection(ctx context.Context, tuiUserID common.Address, clientUserID common.Address, grant TCPGrant, network string, address string) error {
 	b.log.Info(ctx, "dial-tcp-connection", "tuiUserID", tuiUserID, "clientUserID", clientUserID, "network", network, "address", address)
 
-	client, err := b.tcpCltMgr.Dial(ctx, clientUserID.String(), network, address)
+	// The peer checks the grant as well, there is no need to dial without
+	// a valid one.
+	if err := grant.verify(tuiUserID, time.Now()); err != nil {
+		return err
+	}
+
+	// The handshake on the new connection proves who we are to the peer and
+	// tells it which user we speak for.
+	_, err := b.tcpCltMgr.DialUserContext(withTCPUser(ctx, tuiUserID, grant), clientUserID.String(), clientUserID.String(), network, address)
 	if err != nil {
 		if errors.Is(err, tcp.ErrClientAlreadyConnected) {
 			return ErrClientAlreadyConnected
@@ -129,32 +236,6 @@ func (b *Business) DialTCPConnection(ctx context.Context, tuiUserID common.Addre
 		return fmt.Errorf("dial tcp connection: %w", err)
 	}
 
-	// -------------------------------------------------------------------------
-	// PERFORM HANDSHAKE TO SEND USER ID
-
-	handshake := struct {
-		User string `json:"user_id"`
-	}{
-		User: tuiUserID.String(),
-	}
-
-	data, err := json.Marshal(handshake)
-	if err != nil {
-		return fmt.Errorf("marshal handshake: %w", err)
-	}
-
-	if _, err := client.Writer.Write(data); err != nil {
-		return fmt.Errorf("write handshake: %w", err)
-	}
-
-	if _, err := client.Writer.Write([]byte("\n")); err != nil {
-		return fmt.Errorf("write newline: %w", err)
-	}
-
-	// -------------------------------------------------------------------------
-
-	client.SetUserID(clientUserID.String())
-
 	b.addTCPConnection(tuiUserID, clientUserID)
 
 	return nil
@@ -169,6 +250,22 @@ func (b *Business) DropTCPConnection(ctx context.Context, tuiUserID common.Addre
 	return nil
 }
 
+// UIQueueStats returns the state of the outbound queue for each of the user's
+// web socket sessions.
+func (b *Business) UIQueueStats(ctx context.Context, userID common.Address) (map[uuid.UUID]UIWriterStats, error) {
+	usrs, err := b.uiCltMgr.Retrieve(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[uuid.UUID]UIWriterStats, len(usrs))
+	for _, usr := range usrs {
+		m[usr.SessionID] = usr.UIWriter.Stats()
+	}
+
+	return m, nil
+}
+
 // TCPConnections returns the list of client user IDs for a given tui user ID.
 func (b *Business) TCPConnections(ctx context.Context) []common.Address {
 	users := b.tcpServer.Clients()
@@ -202,15 +299,30 @@ func (b *Business) removeTCPConnection(ctx context.Context, tuiUserID common.Add
 		b.tcpConnMapMu.Unlock()
 	}()
 
+	// The link to the user may have been dialed by us or by the peer.
 	for _, clientUserID := range b.tcpConnMap[tuiUserID] {
-		clt, err := b.tcpCltMgr.Retrieve(ctx, clientUserID.String())
-		if err != nil {
+		errClt := b.tcpCltMgr.CloseByUserID(clientUserID.String())
+		errSrv := b.tcpServer.CloseByUserID(clientUserID.String())
+
+		if errClt != nil && errSrv != nil {
 			b.log.Info(ctx, "drop-tcp-connection", "status", "NOT FOUND", "clientUserID", clientUserID)
 			continue
 		}
 
 		b.log.Info(ctx, "drop-tcp-connection", "status", "found", "clientUserID", clientUserID)
+	}
+}
+
+// knownUser reports whether the user is connected to this CAP or to any other
+// CAP according to the presence directory.
+func (b *Business) knownUser(ctx context.Context, userID common.Address) bool {
+	if _, err := b.uiCltMgr.Retrieve(ctx, userID); err == nil {
+		return true
+	}
 
-		clt.Conn.Close()
+	if _, err := b.presenceMgr.Lookup(ctx, userID); err == nil {
+		return true
 	}
+
+	return false
 }
@@ -0,0 +1,226 @@
+package chatbus
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// testUsers is a UIClientManager that only knows which users are connected.
+type testUsers struct {
+	users map[common.Address][]UIUser
+}
+
+func (tu testUsers) Add(ctx context.Context, usr UIUser) error {
+	tu.users[usr.ID] = append(tu.users[usr.ID], usr)
+	return nil
+}
+
+func (tu testUsers) UpdateLastPing(ctx context.Context, userID common.Address, sessionID uuid.UUID) error {
+	return nil
+}
+
+func (tu testUsers) UpdateLastPong(ctx context.Context, userID common.Address, sessionID uuid.UUID) (UIUser, error) {
+	return UIUser{}, nil
+}
+
+func (tu testUsers) Remove(ctx context.Context, userID common.Address, sessionID uuid.UUID) {}
+
+func (tu testUsers) Connections() map[uuid.UUID]UIConnection {
+	return nil
+}
+
+func (tu testUsers) Retrieve(ctx context.Context, userID common.Address) ([]UIUser, error) {
+	usrs, exists := tu.users[userID]
+	if !exists {
+		return nil, ErrNotExists
+	}
+
+	return usrs, nil
+}
+
+// =============================================================================
+
+// testPresence is a PresenceManager for users connected to other CAPs.
+type testPresence struct {
+	caps map[common.Address][]uuid.UUID
+}
+
+func (tp testPresence) Register(ctx context.Context, userID common.Address) error {
+	return nil
+}
+
+func (tp testPresence) Unregister(ctx context.Context, userID common.Address) error {
+	return nil
+}
+
+func (tp testPresence) Lookup(ctx context.Context, userID common.Address) ([]uuid.UUID, error) {
+	capIDs, exists := tp.caps[userID]
+	if !exists {
+		return nil, ErrNotExists
+	}
+
+	return capIDs, nil
+}
+
+// =============================================================================
+
+// testGroups is a GroupManager that keeps a revision for each group like the
+// KV bucket does. The number of conflicts set are returned by the next
+// updates before they are applied.
+type testGroups struct {
+	mu        sync.Mutex
+	groups    map[common.Address]Group
+	revs      map[common.Address]uint64
+	conflicts int
+}
+
+func newTestGroups() *testGroups {
+	return &testGroups{
+		groups: make(map[common.Address]Group),
+		revs:   make(map[common.Address]uint64),
+	}
+}
+
+func (tg *testGroups) Create(ctx context.Context, grp Group) error {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+
+	if _, exists := tg.groups[grp.ID]; exists {
+		return ErrGroupExists
+	}
+
+	tg.groups[grp.ID] = grp
+	tg.revs[grp.ID]++
+
+	return nil
+}
+
+func (tg *testGroups) Update(ctx context.Context, grp Group, rev uint64) error {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+
+	if tg.conflicts > 0 {
+		tg.conflicts--
+		tg.revs[grp.ID]++
+	}
+
+	if tg.revs[grp.ID] != rev {
+		return ErrGroupConflict
+	}
+
+	tg.groups[grp.ID] = grp
+	tg.revs[grp.ID]++
+
+	return nil
+}
+
+func (tg *testGroups) Delete(ctx context.Context, groupID common.Address, rev uint64) error {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+
+	if tg.revs[groupID] != rev {
+		return ErrGroupConflict
+	}
+
+	delete(tg.groups, groupID)
+	tg.revs[groupID]++
+
+	return nil
+}
+
+func (tg *testGroups) Retrieve(ctx context.Context, groupID common.Address) (Group, uint64, error) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+
+	grp, exists := tg.groups[groupID]
+	if !exists {
+		return Group{}, 0, ErrGroupNotExists
+	}
+
+	return grp, tg.revs[groupID], nil
+}
+
+// =============================================================================
+
+// testDeliveries is a UIClientManager that records the users a delivery was
+// tried for. None of the users are connected.
+type testDeliveries struct {
+	testUsers
+	mu  sync.Mutex
+	ids []common.Address
+}
+
+func newTestDeliveries() *testDeliveries {
+	return &testDeliveries{
+		testUsers: testUsers{users: make(map[common.Address][]UIUser)},
+	}
+}
+
+func (td *testDeliveries) Retrieve(ctx context.Context, userID common.Address) ([]UIUser, error) {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+
+	td.ids = append(td.ids, userID)
+
+	return nil, ErrNotExists
+}
+
+func (td *testDeliveries) tried() []common.Address {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+
+	return td.ids
+}
+
+// =============================================================================
+
+// testInbox is an InboxManager that records the users messages were queued
+// for.
+type testInbox struct {
+	mu  sync.Mutex
+	ids []common.Address
+}
+
+func (ti *testInbox) Push(ctx context.Context, userID common.Address, data []byte) error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	ti.ids = append(ti.ids, userID)
+
+	return nil
+}
+
+func (ti *testInbox) Drain(ctx context.Context, userID common.Address, fn func(data []byte) error) (int, error) {
+	return 0, nil
+}
+
+func (ti *testInbox) queued() []common.Address {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	return ti.ids
+}
+
+// =============================================================================
+
+// testLog is a DeliveryManager that only hands out sequence numbers.
+type testLog struct {
+	mu  sync.Mutex
+	seq uint64
+}
+
+func (tl *testLog) Append(ctx context.Context, userID common.Address, msgID uuid.UUID, data []byte) (uint64, error) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	tl.seq++
+
+	return tl.seq, nil
+}
+
+func (tl *testLog) Replay(ctx context.Context, userID common.Address, after uint64, fn func(seq uint64, data []byte) error) (uint64, error) {
+	return after, nil
+}
@@ -0,0 +1,243 @@
+package chatbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// fileUsageAttempts is how many times the files a user has sent are updated
+// when another CAP changes them at the same time.
+const fileUsageAttempts = 5
+
+// FileCreate registers a file the user is about to upload for a contact. The
+// file is offered to the contact by the sender once the upload is complete.
+// The contact must be connected, and a user can only have so many files and
+// bytes stored at a time. The file is split into chunks of the max chunk
+// size, only the last chunk can be smaller.
+func (b *Business) FileCreate(ctx context.Context, fromID common.Address, file File) (FileStatus, error) {
+	switch {
+	case file.ID == uuid.Nil:
+		return FileStatus{}, fmt.Errorf("%w: missing id", ErrFileInvalidChunk)
+
+	case file.Size <= 0:
+		return FileStatus{}, fmt.Errorf("%w: size[%d]", ErrFileInvalidChunk, file.Size)
+
+	case file.Size > b.fileMaxSize:
+		return FileStatus{}, fmt.Errorf("%w: size[%d] max[%d]", ErrFileTooLarge, file.Size, b.fileMaxSize)
+	}
+
+	if chunks := b.fileChunks(file.Size); file.Chunks != chunks {
+		return FileStatus{}, fmt.Errorf("%w: size[%d] needs chunks[%d] got[%d]", ErrFileInvalidChunk, file.Size, chunks, file.Chunks)
+	}
+
+	if file.ToID == fromID || !b.knownUser(ctx, file.ToID) {
+		return FileStatus{}, fmt.Errorf("%w: recipient[%s]", ErrNotExists, file.ToID)
+	}
+
+	file.FromID = fromID
+	file.DateCreated = time.Now().UTC()
+
+	// The file is counted against the sender before it's stored so two
+	// uploads at the same time can't both fit under the limits.
+	if err := b.fileUsageChange(ctx, fromID, func(usage FileUsage) (FileUsage, error) {
+		switch {
+		case len(usage.Files) >= b.fileMaxOpen:
+			return FileUsage{}, fmt.Errorf("%w: files[%d] max[%d]", ErrFileLimit, len(usage.Files), b.fileMaxOpen)
+
+		case usage.Bytes()+file.Size > b.fileMaxBytes:
+			return FileUsage{}, fmt.Errorf("%w: bytes[%d] max[%d]", ErrFileLimit, usage.Bytes()+file.Size, b.fileMaxBytes)
+		}
+
+		usage.Files = append(usage.Files, file)
+
+		return usage, nil
+	}); err != nil {
+		return FileStatus{}, err
+	}
+
+	if err := b.fileMgr.Create(ctx, file); err != nil {
+		b.fileRelease(ctx, file)
+		return FileStatus{}, fmt.Errorf("create: %w", err)
+	}
+
+	b.log.Info(ctx, "file-create", "id", file.ID, "from", file.FromID, "to", file.ToID, "size", file.Size, "chunks", file.Chunks)
+
+	return FileStatus{File: file, Received: []int{}, MaxChunk: b.fileMaxChunk}, nil
+}
+
+// FileStatus returns the file along with the chunks that have been uploaded
+// and the bytes they hold. Only the sender and the recipient can see a file.
+func (b *Business) FileStatus(ctx context.Context, userID common.Address, fileID uuid.UUID) (FileStatus, error) {
+	file, err := b.fileRetrieve(ctx, fileID, userID)
+	if err != nil {
+		return FileStatus{}, err
+	}
+
+	received, stored, err := b.fileMgr.Chunks(ctx, file)
+	if err != nil {
+		return FileStatus{}, fmt.Errorf("chunks: %w", err)
+	}
+
+	return FileStatus{File: file, Received: received, Stored: stored, MaxChunk: b.fileMaxChunk}, nil
+}
+
+// FilePutChunk stores a chunk of a file uploaded by the sender. Each chunk
+// has to be the size the file was split into, so the chunks that are stored
+// never add up to more than the size of the file.
+func (b *Business) FilePutChunk(ctx context.Context, fromID common.Address, fileID uuid.UUID, chunk int, data []byte) error {
+	file, err := b.fileRetrieve(ctx, fileID, fromID)
+	if err != nil {
+		return err
+	}
+
+	if file.FromID != fromID {
+		return ErrFileNotAllowed
+	}
+
+	switch {
+	case chunk < 0 || chunk >= file.Chunks:
+		return fmt.Errorf("%w: chunk[%d] chunks[%d]", ErrFileInvalidChunk, chunk, file.Chunks)
+
+	case int64(len(data)) != b.fileChunkSize(file, chunk):
+		return fmt.Errorf("%w: chunk[%d] size[%d] exp[%d]", ErrFileInvalidChunk, chunk, len(data), b.fileChunkSize(file, chunk))
+	}
+
+	if err := b.fileMgr.PutChunk(ctx, fileID, chunk, data); err != nil {
+		return fmt.Errorf("put chunk: %w", err)
+	}
+
+	return nil
+}
+
+// FileGetChunk returns a chunk of a file to the recipient.
+func (b *Business) FileGetChunk(ctx context.Context, toID common.Address, fileID uuid.UUID, chunk int) ([]byte, error) {
+	file, err := b.fileRetrieve(ctx, fileID, toID)
+	if err != nil {
+		return nil, err
+	}
+
+	if file.ToID != toID {
+		return nil, ErrFileNotAllowed
+	}
+
+	if chunk < 0 || chunk >= file.Chunks {
+		return nil, fmt.Errorf("%w: chunk[%d] chunks[%d]", ErrFileInvalidChunk, chunk, file.Chunks)
+	}
+
+	data, err := b.fileMgr.GetChunk(ctx, fileID, chunk)
+	if err != nil {
+		return nil, fmt.Errorf("get chunk: %w", err)
+	}
+
+	return data, nil
+}
+
+// FileDelete removes a file once the recipient has downloaded or declined it,
+// or the sender gives up on it.
+func (b *Business) FileDelete(ctx context.Context, userID common.Address, fileID uuid.UUID) error {
+	file, err := b.fileRetrieve(ctx, fileID, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := b.fileMgr.Delete(ctx, file); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	b.fileRelease(ctx, file)
+
+	b.log.Info(ctx, "file-delete", "id", file.ID, "by", userID)
+
+	return nil
+}
+
+// FileMaxChunk returns the largest chunk that can be uploaded.
+func (b *Business) FileMaxChunk() int {
+	return b.fileMaxChunk
+}
+
+// FileMaxSize returns the largest file that can be uploaded.
+func (b *Business) FileMaxSize() int64 {
+	return b.fileMaxSize
+}
+
+// =============================================================================
+
+// fileRetrieve returns the file if the user is the sender or the recipient.
+// Anyone else is told the file doesn't exist.
+func (b *Business) fileRetrieve(ctx context.Context, fileID uuid.UUID, userID common.Address) (File, error) {
+	file, err := b.fileMgr.Retrieve(ctx, fileID)
+	if err != nil {
+		return File{}, fmt.Errorf("retrieve: %w", err)
+	}
+
+	if !slices.Contains([]common.Address{file.FromID, file.ToID}, userID) {
+		return File{}, fmt.Errorf("retrieve: %w", ErrFileNotExists)
+	}
+
+	return file, nil
+}
+
+// fileChunks returns the number of chunks a file of the size is split into.
+func (b *Business) fileChunks(size int64) int {
+	maxChunk := int64(b.fileMaxChunk)
+
+	return int((size + maxChunk - 1) / maxChunk)
+}
+
+// fileChunkSize returns the size of the chunk of the file. Every chunk is the
+// max chunk size except the last, which holds what is left.
+func (b *Business) fileChunkSize(file File, chunk int) int64 {
+	maxChunk := int64(b.fileMaxChunk)
+
+	if chunk < file.Chunks-1 {
+		return maxChunk
+	}
+
+	return file.Size - int64(file.Chunks-1)*maxChunk
+}
+
+// fileRelease stops counting the file against the sender.
+func (b *Business) fileRelease(ctx context.Context, file File) {
+	if err := b.fileUsageChange(ctx, file.FromID, func(usage FileUsage) (FileUsage, error) {
+		return usage.removeFile(file.ID), nil
+	}); err != nil {
+		b.log.Info(ctx, "file-release", "id", file.ID, "from", file.FromID, "ERROR", err)
+	}
+}
+
+// fileUsageChange applies the change to the files the user has sent. The
+// record is written back only if it hasn't changed since it was retrieved,
+// otherwise the change is applied to the latest copy.
+func (b *Business) fileUsageChange(ctx context.Context, userID common.Address, change func(usage FileUsage) (FileUsage, error)) error {
+	for range fileUsageAttempts {
+		usage, rev, err := b.fileMgr.Usage(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("usage: %w", err)
+		}
+
+		usage, err = change(usage)
+		if err != nil {
+			return err
+		}
+
+		err = b.fileMgr.UpdateUsage(ctx, userID, usage, rev)
+		switch {
+		case err == nil:
+			return nil
+
+		case !errors.Is(err, ErrFileConflict):
+			return fmt.Errorf("update usage: %w", err)
+		}
+
+		b.log.Info(ctx, "file-usage: conflict", "userID", userID)
+	}
+
+	return ErrFileConflict
+}
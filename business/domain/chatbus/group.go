@@ -0,0 +1,283 @@
+package chatbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Set of group operations a member can send to a group. A group operation is
+// a signed message of type group addressed to the group in the following
+// format:
+//
+//	CREATE <name> <nonce>
+//	INVITE <memberID>
+//	LEAVE
+//	KICK <memberID>
+//
+// The CAP only reads the arguments shown. Clients add the group name and the
+// current members after the member ID of an invite so the new member's client
+// can set up the group, these are passed on to the members untouched.
+//
+// The ID of a new group is derived from the creator's address and the nonce
+// the same way contract addresses are, so the ID can't be another user's.
+//
+// The operation is fanned out to the members like any other group message so
+// their clients can keep their copy of the group up to date.
+const (
+	groupOpCreate = "CREATE"
+	groupOpInvite = "INVITE"
+	groupOpLeave  = "LEAVE"
+	groupOpKick   = "KICK"
+)
+
+// groupUpdateAttempts is how many times an operation is applied to the latest
+// copy of a group when another CAP changes the group at the same time.
+const groupUpdateAttempts = 5
+
+// groupFor looks up the group the message is addressed to and reports whether
+// the message is for a group. A group operation is for a group even before it
+// exists, the operation looks up the group itself.
+func (b *Business) groupFor(ctx context.Context, inMsg uiIncomingMessage) (Group, bool) {
+	if inMsg.Type == msgTypeGroup {
+		return Group{}, true
+	}
+
+	grp, _, err := b.groupMgr.Retrieve(ctx, inMsg.ToID)
+	if err != nil {
+		if !errors.Is(err, ErrGroupNotExists) {
+			b.log.Info(ctx, "groupfor: retrieve", "ERROR", err)
+		}
+		return Group{}, false
+	}
+
+	return grp, true
+}
+
+// uiGroupMessage applies any group operation and then fans the message out
+// to the members of the group over the normal routes. The group is the one
+// returned by groupFor.
+func (b *Business) uiGroupMessage(ctx context.Context, from UIUser, inMsg uiIncomingMessage, grp Group) error {
+	var recipients []common.Address
+
+	switch {
+	case inMsg.Type == msgTypeGroup:
+		r, err := b.groupOperation(ctx, from.ID, inMsg)
+		if err != nil {
+			return fmt.Errorf("group operation: %w", err)
+		}
+		recipients = r
+
+	default:
+		if !grp.IsMember(from.ID) {
+			return ErrNotGroupMember
+		}
+
+		recipients = grp.Members
+	}
+
+	b.log.Info(ctx, "uigroupmessage: fan out", "from", from.ID, "groupID", inMsg.ToID, "recipients", len(recipients))
+
+	groupMsg := inMsg
+	groupMsg.GroupID = inMsg.ToID
+
+	for _, memberID := range recipients {
+		if memberID == from.ID {
+			continue
+		}
+
+		groupMsg.ToID = memberID
+		b.uiRouteMessage(ctx, from, groupMsg)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// groupOperation applies the operation to the group and returns the users
+// that need to be told about it.
+func (b *Business) groupOperation(ctx context.Context, fromID common.Address, inMsg uiIncomingMessage) ([]common.Address, error) {
+	if len(inMsg.Msg) < 1 {
+		return nil, errors.New("missing group operation")
+	}
+
+	op := string(inMsg.Msg[0])
+
+	if op == groupOpCreate {
+		if len(inMsg.Msg) < 3 || len(inMsg.Msg[1]) == 0 {
+			return nil, errors.New("missing group name or nonce")
+		}
+
+		if err := b.validateGroupID(ctx, fromID, inMsg.ToID, string(inMsg.Msg[2])); err != nil {
+			return nil, err
+		}
+
+		grp := Group{
+			ID:      inMsg.ToID,
+			Name:    string(inMsg.Msg[1]),
+			OwnerID: fromID,
+			Members: []common.Address{fromID},
+		}
+
+		if err := b.groupMgr.Create(ctx, grp); err != nil {
+			return nil, fmt.Errorf("create: %w", err)
+		}
+
+		b.log.Info(ctx, "groupoperation: created", "groupID", grp.ID, "name", grp.Name, "owner", fromID)
+
+		return nil, nil
+	}
+
+	// The group is written back only if it hasn't changed since it was
+	// retrieved, otherwise the operation is applied to the latest copy.
+	for range groupUpdateAttempts {
+		recipients, err := b.groupChange(ctx, fromID, op, inMsg)
+		if !errors.Is(err, ErrGroupConflict) {
+			return recipients, err
+		}
+
+		b.log.Info(ctx, "groupoperation: conflict", "groupID", inMsg.ToID, "op", op)
+	}
+
+	return nil, ErrGroupConflict
+}
+
+// groupChange applies an operation that changes an existing group.
+func (b *Business) groupChange(ctx context.Context, fromID common.Address, op string, inMsg uiIncomingMessage) ([]common.Address, error) {
+	grp, rev, err := b.groupMgr.Retrieve(ctx, inMsg.ToID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve: %w", err)
+	}
+
+	if !grp.IsMember(fromID) {
+		return nil, ErrNotGroupMember
+	}
+
+	switch op {
+	case groupOpInvite:
+		if len(inMsg.Msg) < 2 || !common.IsHexAddress(string(inMsg.Msg[1])) {
+			return nil, errors.New("invalid member id")
+		}
+
+		memberID := common.HexToAddress(string(inMsg.Msg[1]))
+		if grp.IsMember(memberID) {
+			return nil, ErrExists
+		}
+
+		grp.Members = append(grp.Members, memberID)
+
+		if err := b.groupMgr.Update(ctx, grp, rev); err != nil {
+			return nil, fmt.Errorf("update: %w", err)
+		}
+
+		b.log.Info(ctx, "groupoperation: invited", "groupID", grp.ID, "by", fromID, "member", memberID)
+
+		return grp.Members, nil
+
+	case groupOpLeave:
+		grp = grp.removeMember(fromID)
+
+		if len(grp.Members) == 0 {
+			if err := b.groupMgr.Delete(ctx, grp.ID, rev); err != nil {
+				return nil, fmt.Errorf("delete: %w", err)
+			}
+
+			b.log.Info(ctx, "groupoperation: deleted", "groupID", grp.ID)
+
+			return nil, nil
+		}
+
+		// The oldest remaining member takes over a group its owner left.
+		if grp.OwnerID == fromID {
+			grp.OwnerID = grp.Members[0]
+		}
+
+		if err := b.groupMgr.Update(ctx, grp, rev); err != nil {
+			return nil, fmt.Errorf("update: %w", err)
+		}
+
+		b.log.Info(ctx, "groupoperation: left", "groupID", grp.ID, "member", fromID)
+
+		return grp.Members, nil
+
+	case groupOpKick:
+		if grp.OwnerID != fromID {
+			return nil, ErrNotGroupOwner
+		}
+
+		if len(inMsg.Msg) < 2 || !common.IsHexAddress(string(inMsg.Msg[1])) {
+			return nil, errors.New("invalid member id")
+		}
+
+		memberID := common.HexToAddress(string(inMsg.Msg[1]))
+		if memberID == fromID {
+			return nil, errors.New("owner can't kick themselves")
+		}
+
+		if !grp.IsMember(memberID) {
+			return nil, ErrNotGroupMember
+		}
+
+		grp = grp.removeMember(memberID)
+
+		if err := b.groupMgr.Update(ctx, grp, rev); err != nil {
+			return nil, fmt.Errorf("update: %w", err)
+		}
+
+		b.log.Info(ctx, "groupoperation: kicked", "groupID", grp.ID, "by", fromID, "member", memberID)
+
+		// The member that was kicked needs to know as well.
+		return append(grp.Members, memberID), nil
+	}
+
+	return nil, fmt.Errorf("unknown group operation: %s", op)
+}
+
+// validateGroupID checks the ID of a new group was derived from the creator's
+// address and the nonce, and that the ID isn't used by a user.
+func (b *Business) validateGroupID(ctx context.Context, creatorID common.Address, groupID common.Address, nonce string) error {
+	n, err := strconv.ParseUint(nonce, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: nonce: %w", ErrInvalidGroupID, err)
+	}
+
+	if crypto.CreateAddress(creatorID, n) != groupID {
+		return fmt.Errorf("%w: not derived from the creator", ErrInvalidGroupID)
+	}
+
+	if b.knownUser(ctx, groupID) {
+		return fmt.Errorf("%w: used by a user", ErrInvalidGroupID)
+	}
+
+	return nil
+}
+
+// groupRecipientCheck checks the user a copy of a group message was fanned out
+// to belongs to the group. The sender only signed the message for the group.
+// A member that was kicked is still told about it.
+func groupRecipientCheck(ctx context.Context, groupMgr GroupManager, inMsg uiIncomingMessage) error {
+	if inMsg.GroupID == (common.Address{}) {
+		return nil
+	}
+
+	grp, _, err := groupMgr.Retrieve(ctx, inMsg.GroupID)
+	if err != nil {
+		return fmt.Errorf("retrieve: %w", err)
+	}
+
+	if grp.IsMember(inMsg.ToID) {
+		return nil
+	}
+
+	kicked := inMsg.Type == msgTypeGroup && len(inMsg.Msg) > 1 && string(inMsg.Msg[0]) == groupOpKick
+	if kicked && common.HexToAddress(string(inMsg.Msg[1])) == inMsg.ToID {
+		return nil
+	}
+
+	return ErrNotGroupMember
+}
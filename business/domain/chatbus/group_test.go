@@ -0,0 +1,411 @@
+package chatbus
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/managerstest"
+	"github.com/PeterLee0620/GoIM/foundation/signature"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+// TestGroupSignature provides a test that a signed group operation can only
+// be used for the group it was signed for.
+func TestGroupSignature(t *testing.T) {
+	t.Log("Given the need to verify who sent a group operation.")
+	{
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal("\tShould be able to generate a key.", "X", err)
+		}
+
+		ownerID := crypto.PubkeyToAddress(key.PublicKey)
+		groupID := crypto.CreateAddress(ownerID, 1)
+		memberID := common.HexToAddress("0x0000000000000000000000000000000000000001")
+
+		signed := groupMessage(groupID, groupOpInvite, memberID.Hex())
+
+		v, r, s, err := signature.Sign(signed.signedData(), key)
+		if err != nil {
+			t.Fatal("\tShould be able to sign the operation.", "X", err)
+		}
+		signed.V, signed.R, signed.S = v, r, s
+
+		tests := []struct {
+			name   string
+			change func(m uiIncomingMessage) uiIncomingMessage
+			sender bool
+		}{
+			{
+				name:   "the group it was signed for",
+				change: func(m uiIncomingMessage) uiIncomingMessage { return m },
+				sender: true,
+			},
+			{
+				name: "a copy fanned out to a member",
+				change: func(m uiIncomingMessage) uiIncomingMessage {
+					m.ToID = memberID
+					return m
+				},
+				sender: true,
+			},
+			{
+				name: "a copy without the group id",
+				change: func(m uiIncomingMessage) uiIncomingMessage {
+					m.ToID = memberID
+					m.GroupID = common.Address{}
+					return m
+				},
+			},
+			{
+				name: "another group",
+				change: func(m uiIncomingMessage) uiIncomingMessage {
+					m.ToID = crypto.CreateAddress(ownerID, 2)
+					m.GroupID = m.ToID
+					return m
+				},
+			},
+			{
+				name: "another operation",
+				change: func(m uiIncomingMessage) uiIncomingMessage {
+					m.Msg = [][]byte{[]byte(groupOpKick), []byte(memberID.Hex())}
+					return m
+				},
+			},
+		}
+
+		for _, tt := range tests {
+			msg := tt.change(signed)
+
+			id, err := signature.FromAddress(msg.signedData(), msg.V, msg.R, msg.S)
+			if err != nil {
+				t.Fatalf("\tShould be able to recover the address for %s. %s %v", tt.name, "X", err)
+			}
+
+			if (id == ownerID.Hex()) != tt.sender {
+				t.Errorf("\tShould match the sender[%t] for %s. %s %s", tt.sender, tt.name, "X", id)
+				continue
+			}
+			t.Logf("\tShould match the sender[%t] for %s. %s", tt.sender, tt.name, "OK")
+		}
+	}
+}
+
+// TestGroupOperation provides a test of the checks made on the operations
+// that create and change a group.
+func TestGroupOperation(t *testing.T) {
+	t.Log("Given the need to manage the members of a group.")
+	{
+		ownerID := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+		memberID := common.HexToAddress("0x00000000000000000000000000000000000000b2")
+		outsiderID := common.HexToAddress("0x00000000000000000000000000000000000000c3")
+
+		groupID := crypto.CreateAddress(ownerID, 7)
+		connectedID := crypto.CreateAddress(ownerID, 8)
+		remoteID := crypto.CreateAddress(ownerID, 9)
+
+		groups := newTestGroups()
+
+		b := Business{
+			log:      managerstest.Logger(),
+			groupMgr: groups,
+			uiCltMgr: testUsers{users: map[common.Address][]UIUser{
+				connectedID: {{ID: connectedID}},
+			}},
+			presenceMgr: testPresence{caps: map[common.Address][]uuid.UUID{
+				remoteID: {uuid.New()},
+			}},
+		}
+
+		// The steps are run in order since each one changes the group.
+		tests := []struct {
+			name       string
+			fromID     common.Address
+			msg        uiIncomingMessage
+			conflicts  int
+			fail       bool
+			expErr     error
+			recipients []common.Address
+		}{
+			{
+				name:   "create a group with an id not derived from the creator",
+				fromID: ownerID,
+				msg:    groupMessage(crypto.CreateAddress(outsiderID, 7), groupOpCreate, "team", "7"),
+				fail:   true,
+				expErr: ErrInvalidGroupID,
+			},
+			{
+				name:   "create a group with the id of a connected user",
+				fromID: ownerID,
+				msg:    groupMessage(connectedID, groupOpCreate, "team", "8"),
+				fail:   true,
+				expErr: ErrInvalidGroupID,
+			},
+			{
+				name:   "create a group with the id of a user on another CAP",
+				fromID: ownerID,
+				msg:    groupMessage(remoteID, groupOpCreate, "team", "9"),
+				fail:   true,
+				expErr: ErrInvalidGroupID,
+			},
+			{
+				name:   "create a group without a nonce",
+				fromID: ownerID,
+				msg:    groupMessage(groupID, groupOpCreate, "team"),
+				fail:   true,
+			},
+			{
+				name:   "create a group",
+				fromID: ownerID,
+				msg:    groupMessage(groupID, groupOpCreate, "team", "7"),
+			},
+			{
+				name:   "create the group again",
+				fromID: ownerID,
+				msg:    groupMessage(groupID, groupOpCreate, "team", "7"),
+				fail:   true,
+				expErr: ErrGroupExists,
+			},
+			{
+				name:   "invite from a user outside the group",
+				fromID: outsiderID,
+				msg:    groupMessage(groupID, groupOpInvite, outsiderID.Hex()),
+				fail:   true,
+				expErr: ErrNotGroupMember,
+			},
+			{
+				name:       "invite a member",
+				fromID:     ownerID,
+				msg:        groupMessage(groupID, groupOpInvite, memberID.Hex()),
+				recipients: []common.Address{ownerID, memberID},
+			},
+			{
+				name:   "invite a member twice",
+				fromID: ownerID,
+				msg:    groupMessage(groupID, groupOpInvite, memberID.Hex()),
+				fail:   true,
+				expErr: ErrExists,
+			},
+			{
+				name:   "kick a member when not the owner",
+				fromID: memberID,
+				msg:    groupMessage(groupID, groupOpKick, ownerID.Hex()),
+				fail:   true,
+				expErr: ErrNotGroupOwner,
+			},
+			{
+				name:       "kick a member",
+				fromID:     ownerID,
+				msg:        groupMessage(groupID, groupOpKick, memberID.Hex()),
+				recipients: []common.Address{ownerID, memberID},
+			},
+			{
+				name:       "invite a member while another CAP changes the group",
+				fromID:     ownerID,
+				msg:        groupMessage(groupID, groupOpInvite, memberID.Hex()),
+				conflicts:  groupUpdateAttempts - 1,
+				recipients: []common.Address{ownerID, memberID},
+			},
+			{
+				name:      "leave a group that keeps changing",
+				fromID:    memberID,
+				msg:       groupMessage(groupID, groupOpLeave),
+				conflicts: groupUpdateAttempts,
+				fail:      true,
+				expErr:    ErrGroupConflict,
+			},
+			{
+				name:       "leave as the owner",
+				fromID:     ownerID,
+				msg:        groupMessage(groupID, groupOpLeave),
+				recipients: []common.Address{memberID},
+			},
+			{
+				name:   "leave as the last member",
+				fromID: memberID,
+				msg:    groupMessage(groupID, groupOpLeave),
+			},
+		}
+
+		for _, tt := range tests {
+			groups.conflicts = tt.conflicts
+
+			recipients, err := b.groupOperation(context.Background(), tt.fromID, tt.msg)
+
+			switch {
+			case tt.fail && (err == nil || (tt.expErr != nil && !errors.Is(err, tt.expErr))):
+				t.Errorf("\tShould fail to %s. %s %v", tt.name, "X", err)
+				continue
+
+			case !tt.fail && err != nil:
+				t.Errorf("\tShould be able to %s. %s %v", tt.name, "X", err)
+				continue
+
+			case !slices.Equal(recipients, tt.recipients):
+				t.Errorf("\tShould tell the members when they %s. %s %v", tt.name, "X", recipients)
+				continue
+			}
+
+			if tt.fail {
+				t.Logf("\tShould fail to %s. %s", tt.name, "OK")
+				continue
+			}
+			t.Logf("\tShould be able to %s. %s", tt.name, "OK")
+		}
+
+		if _, _, err := groups.Retrieve(context.Background(), groupID); !errors.Is(err, ErrGroupNotExists) {
+			t.Error("\tShould remove the group when the last member leaves.", "X", err)
+		} else {
+			t.Log("\tShould remove the group when the last member leaves.", "OK")
+		}
+	}
+}
+
+// TestGroupDirectSignature provides a test that a direct message can't be
+// passed off as a copy of a group message.
+func TestGroupDirectSignature(t *testing.T) {
+	t.Log("Given the need to keep direct messages out of groups.")
+	{
+		key := newTestKey(t)
+		fromID := crypto.PubkeyToAddress(key.PublicKey)
+		toID := common.HexToAddress("0x0000000000000000000000000000000000000001")
+
+		msg := uiIncomingMessage{
+			envelope: envelope{
+				Version: ProtocolVersion,
+				Type:    msgTypeChat,
+				ID:      uuid.New(),
+			},
+			ToID: toID,
+			Msg:  [][]byte{[]byte("hello")},
+		}
+
+		var err error
+		msg.V, msg.R, msg.S, err = signature.Sign(msg.signedData(), key)
+		if err != nil {
+			t.Fatal("\tShould be able to sign the message.", "X", err)
+		}
+
+		msg.GroupID = toID
+		msg.ToID = common.HexToAddress("0x0000000000000000000000000000000000000002")
+
+		id, err := signature.FromAddress(msg.signedData(), msg.V, msg.R, msg.S)
+		if err == nil && id == fromID.Hex() {
+			t.Fatal("\tShould not match the sender of a direct message sent as a group copy.", "X", id)
+		}
+		t.Log("\tShould not match the sender of a direct message sent as a group copy.", "OK")
+	}
+}
+
+// TestGroupRecipientCheck provides a test of the check made on the copies of
+// a group message another CAP fanned out.
+func TestGroupRecipientCheck(t *testing.T) {
+	t.Log("Given the need to only deliver group messages to the members.")
+	{
+		ownerID := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+		memberID := common.HexToAddress("0x00000000000000000000000000000000000000b2")
+		outsiderID := common.HexToAddress("0x00000000000000000000000000000000000000c3")
+
+		groupID := crypto.CreateAddress(ownerID, 7)
+
+		groups := newTestGroups()
+		groups.Create(context.Background(), Group{
+			ID:      groupID,
+			OwnerID: ownerID,
+			Members: []common.Address{ownerID, memberID},
+		})
+
+		copyFor := func(msg uiIncomingMessage, toID common.Address) uiIncomingMessage {
+			msg.ToID = toID
+			return msg
+		}
+
+		chat := groupMessage(groupID, "hello")
+		chat.Type = msgTypeChat
+
+		direct := copyFor(chat, outsiderID)
+		direct.GroupID = common.Address{}
+
+		tests := []struct {
+			name   string
+			msg    uiIncomingMessage
+			fail   bool
+			expErr error
+		}{
+			{
+				name: "deliver a copy to a member",
+				msg:  copyFor(chat, memberID),
+			},
+			{
+				name: "deliver a direct message",
+				msg:  direct,
+			},
+			{
+				name: "tell a member they were kicked",
+				msg:  copyFor(groupMessage(groupID, groupOpKick, outsiderID.Hex()), outsiderID),
+			},
+			{
+				name:   "deliver a copy to a user outside the group",
+				msg:    copyFor(chat, outsiderID),
+				fail:   true,
+				expErr: ErrNotGroupMember,
+			},
+			{
+				name:   "deliver a kick to a user that wasn't kicked",
+				msg:    copyFor(groupMessage(groupID, groupOpKick, memberID.Hex()), outsiderID),
+				fail:   true,
+				expErr: ErrNotGroupMember,
+			},
+			{
+				name:   "deliver a copy for an unknown group",
+				msg:    copyFor(groupMessage(crypto.CreateAddress(ownerID, 8), "hello"), memberID),
+				fail:   true,
+				expErr: ErrGroupNotExists,
+			},
+		}
+
+		for _, tt := range tests {
+			err := groupRecipientCheck(context.Background(), groups, tt.msg)
+
+			switch {
+			case tt.fail && !errors.Is(err, tt.expErr):
+				t.Errorf("\tShould fail to %s. %s %v", tt.name, "X", err)
+				continue
+
+			case !tt.fail && err != nil:
+				t.Errorf("\tShould be able to %s. %s %v", tt.name, "X", err)
+				continue
+			}
+
+			if tt.fail {
+				t.Logf("\tShould fail to %s. %s", tt.name, "OK")
+				continue
+			}
+			t.Logf("\tShould be able to %s. %s", tt.name, "OK")
+		}
+	}
+}
+
+// =============================================================================
+
+func groupMessage(groupID common.Address, op string, args ...string) uiIncomingMessage {
+	msg := [][]byte{[]byte(op)}
+	for _, arg := range args {
+		msg = append(msg, []byte(arg))
+	}
+
+	return uiIncomingMessage{
+		envelope: envelope{
+			Version: ProtocolVersion,
+			Type:    msgTypeGroup,
+			ID:      uuid.New(),
+		},
+		ToID:    groupID,
+		GroupID: groupID,
+		Msg:     msg,
+	}
+}
@@ -0,0 +1,64 @@
+package chatbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// UIDrainInbox delivers the messages that were queued for the user while they
+// were not connected to any CAP. They are delivered to every session the user
+// has and added to the delivery log.
+func (b *Business) UIDrainInbox(ctx context.Context, usr UIUser) error {
+	deliver := func(data []byte) error {
+		var natsMsg natsInOutMessage
+		if err := json.Unmarshal(data, &natsMsg); err != nil {
+			// A message we can't decode will never be delivered, so we log
+			// it and let the inbox remove it.
+			b.log.Info(ctx, "uidraininbox: unmarshal", "ERROR", err)
+			return nil
+		}
+
+		from := UIUser{
+			ID:   natsMsg.FromID,
+			Name: natsMsg.FromName,
+		}
+
+		return b.uiDeliverer.Deliver(ctx, from, usr.ID, natsMsg.uiIncomingMessage)
+	}
+
+	n, err := b.inboxMgr.Drain(ctx, usr.ID, deliver)
+	if err != nil {
+		return fmt.Errorf("drain: %w", err)
+	}
+
+	b.log.Info(ctx, "uidraininbox", "status", "complete", "userID", usr.ID, "delivered", n)
+
+	return nil
+}
+
+// =============================================================================
+
+func (b *Business) inboxPush(ctx context.Context, from UIUser, inMsg uiIncomingMessage) error {
+	natsMsg := natsInOutMessage{
+		CapID:             b.capID,
+		FromID:            from.ID,
+		FromName:          from.Name,
+		uiIncomingMessage: inMsg,
+	}
+
+	return inboxPushMessage(ctx, b.inboxMgr, natsMsg)
+}
+
+func inboxPushMessage(ctx context.Context, inboxMgr InboxManager, natsMsg natsInOutMessage) error {
+	d, err := json.Marshal(natsMsg)
+	if err != nil {
+		return fmt.Errorf("inbox marshal message: %w", err)
+	}
+
+	if err := inboxMgr.Push(ctx, natsMsg.ToID, d); err != nil {
+		return fmt.Errorf("inbox push: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+// Package deliverymgr provides a JetStream based log of the messages delivered
+// to users so a session can replay what it missed.
+package deliverymgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// DeliveryMgr provides a delivery log for each user.
+type DeliveryMgr struct {
+	log     *logger.Logger
+	stream  jetstream.Stream
+	js      jetstream.JetStream
+	subject string
+}
+
+// New creates a new manager for the delivery log. Each user gets their own
+// subject inside a stream that keeps messages for the specified max age. The
+// stream sequence of a message is its delivery sequence, which only ever
+// increases for a user. Messages are deduplicated by their ID for as long as
+// they are kept.
+func New(log *logger.Logger, nc *nats.Conn, subject string, maxAge time.Duration) (*DeliveryMgr, error) {
+	ctx := context.TODO()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("nats new js: %w", err)
+	}
+
+	s1, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       subject + "-delivery",
+		Subjects:   []string{subject + ".delivery.*"},
+		Retention:  jetstream.LimitsPolicy,
+		Storage:    jetstream.FileStorage,
+		MaxAge:     maxAge,
+		Duplicates: maxAge,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create js: %w", err)
+	}
+
+	dm := DeliveryMgr{
+		log:     log,
+		stream:  s1,
+		js:      js,
+		subject: subject,
+	}
+
+	return &dm, nil
+}
+
+// Append adds the message to the delivery log for the specified user and
+// returns the delivery sequence assigned to it. A message with an ID that
+// was already appended for the user isn't added again, the sequence it was
+// given the first time is returned.
+func (dm *DeliveryMgr) Append(ctx context.Context, userID common.Address, msgID uuid.UUID, data []byte) (uint64, error) {
+	var opts []jetstream.PublishOpt
+	if msgID != uuid.Nil {
+		opts = append(opts, jetstream.WithMsgID(userID.Hex()+"."+msgID.String()))
+	}
+
+	ack, err := dm.js.Publish(ctx, dm.userSubject(userID), data, opts...)
+	if err != nil {
+		return 0, fmt.Errorf("delivery publish: %w", err)
+	}
+
+	return ack.Sequence, nil
+}
+
+// Replay delivers every message in the log for the specified user with a
+// delivery sequence after the one provided to the function, in order. The
+// sequence of the last message replayed is returned, or the one provided if
+// nothing was replayed.
+func (dm *DeliveryMgr) Replay(ctx context.Context, userID common.Address, after uint64, fn func(seq uint64, data []byte) error) (uint64, error) {
+	cfg := jetstream.ConsumerConfig{
+		FilterSubject:     dm.userSubject(userID),
+		AckPolicy:         jetstream.AckNonePolicy,
+		DeliverPolicy:     jetstream.DeliverAllPolicy,
+		InactiveThreshold: time.Minute,
+	}
+
+	if after > 0 {
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = after + 1
+	}
+
+	c1, err := dm.stream.CreateConsumer(ctx, cfg)
+	if err != nil {
+		return after, fmt.Errorf("delivery create consumer: %w", err)
+	}
+
+	defer func() {
+		if err := dm.stream.DeleteConsumer(ctx, c1.CachedInfo().Name); err != nil {
+			dm.log.Info(ctx, "delivery-replay: delete consumer", "ERROR", err)
+		}
+	}()
+
+	const batchSize = 100
+
+	last := after
+	var replayed int
+
+	for {
+		batch, err := c1.FetchNoWait(batchSize)
+		if err != nil {
+			return last, fmt.Errorf("delivery fetch: %w", err)
+		}
+
+		var received int
+
+		for msg := range batch.Messages() {
+			received++
+
+			meta, err := msg.Metadata()
+			if err != nil {
+				return last, fmt.Errorf("delivery metadata: %w", err)
+			}
+
+			if err := fn(meta.Sequence.Stream, msg.Data()); err != nil {
+				return last, fmt.Errorf("delivery replay: %w", err)
+			}
+
+			last = meta.Sequence.Stream
+			replayed++
+		}
+
+		if err := batch.Error(); err != nil && !errors.Is(err, jetstream.ErrNoMessages) {
+			return last, fmt.Errorf("delivery batch: %w", err)
+		}
+
+		if received == 0 {
+			break
+		}
+	}
+
+	dm.log.Info(ctx, "delivery-replay", "userID", userID, "after", after, "last", last, "replayed", replayed)
+
+	return last, nil
+}
+
+// =============================================================================
+
+func (dm *DeliveryMgr) userSubject(userID common.Address) string {
+	return fmt.Sprintf("%s.delivery.%s", dm.subject, userID.Hex())
+}
@@ -0,0 +1,116 @@
+package deliverymgr_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/deliverymgr"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/managerstest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// TestReplay provides a test of replaying the messages delivered to a user
+// after a known delivery sequence.
+func TestReplay(t *testing.T) {
+	t.Log("Given the need to replay the messages a session missed.")
+	{
+		ctx := context.Background()
+
+		dm, err := deliverymgr.New(managerstest.Logger(), managerstest.StartNATS(t), "test", time.Hour)
+		if err != nil {
+			t.Fatal("\tShould be able to create the delivery log.", "X", err)
+		}
+		t.Log("\tShould be able to create the delivery log.", "OK")
+
+		userA := common.HexToAddress("0x0000000000000000000000000000000000000001")
+		userB := common.HexToAddress("0x0000000000000000000000000000000000000002")
+
+		// The same message sent to two users is appended for each of them.
+		shared := uuid.New()
+
+		ids := map[string]uuid.UUID{
+			"a1": shared,
+			"b1": shared,
+			"a2": uuid.New(),
+			"a3": uuid.New(),
+		}
+
+		seqs := make(map[string]uint64)
+		for _, tt := range []struct {
+			userID common.Address
+			msg    string
+		}{
+			{userA, "a1"},
+			{userB, "b1"},
+			{userA, "a2"},
+			{userA, "a3"},
+		} {
+			seq, err := dm.Append(ctx, tt.userID, ids[tt.msg], []byte(tt.msg))
+			if err != nil {
+				t.Fatal("\tShould be able to append a message.", "X", tt.msg, err)
+			}
+			seqs[tt.msg] = seq
+		}
+
+		if !(seqs["a1"] < seqs["a2"] && seqs["a2"] < seqs["a3"]) {
+			t.Fatal("\tShould assign increasing delivery sequences.", "X", seqs)
+		}
+		t.Log("\tShould assign increasing delivery sequences.", "OK")
+
+		seq, err := dm.Append(ctx, userA, ids["a2"], []byte("a2"))
+		if err != nil || seq != seqs["a2"] {
+			t.Fatal("\tShould return the sequence of a message appended again.", "X", seq, err)
+		}
+		t.Log("\tShould return the sequence of a message appended again.", "OK")
+
+		t.Log("\tWhen replaying the log for a user.")
+		{
+			tests := []struct {
+				name    string
+				userID  common.Address
+				after   uint64
+				exp     []string
+				expLast uint64
+			}{
+				{"every message", userA, 0, []string{"a1", "a2", "a3"}, seqs["a3"]},
+				{"the messages after a sequence", userA, seqs["a1"], []string{"a2", "a3"}, seqs["a3"]},
+				{"nothing when caught up", userA, seqs["a3"], nil, seqs["a3"]},
+				{"only the messages for the user", userB, 0, []string{"b1"}, seqs["b1"]},
+			}
+
+			for _, tt := range tests {
+				var got []string
+				last, err := dm.Replay(ctx, tt.userID, tt.after, func(seq uint64, data []byte) error {
+					got = append(got, string(data))
+					return nil
+				})
+
+				if err != nil || last != tt.expLast || !slices.Equal(got, tt.exp) {
+					t.Errorf("\t\tShould receive %s. %s %v %d %v", tt.name, "X", got, last, err)
+					continue
+				}
+				t.Logf("\t\tShould receive %s. %s", tt.name, "OK")
+			}
+		}
+
+		t.Log("\tWhen replaying a message fails.")
+		{
+			last, err := dm.Replay(ctx, userA, 0, func(seq uint64, data []byte) error {
+				if string(data) == "a2" {
+					return errors.New("write failed")
+				}
+				return nil
+			})
+
+			if err == nil || last != seqs["a1"] {
+				t.Error("\t\tShould return the sequence of the last message replayed.", "X", last, err)
+			} else {
+				t.Log("\t\tShould return the sequence of the last message replayed.", "OK")
+			}
+		}
+	}
+}
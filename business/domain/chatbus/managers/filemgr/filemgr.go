@@ -0,0 +1,249 @@
+// Package filemgr provides a NATS object store based storage for the files
+// users send each other, so any CAP can serve a file uploaded to another.
+package filemgr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus"
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// FileMgr provides file management.
+type FileMgr struct {
+	log    *logger.Logger
+	kv     jetstream.KeyValue
+	obs    jetstream.ObjectStore
+	maxAge time.Duration
+}
+
+// New creates a new manager for files. The description of a file and the
+// files each user has sent are kept in a KV bucket so they can be written
+// conditionally, the chunks are stored as objects. Files that are never
+// downloaded are removed after the specified max age.
+func New(log *logger.Logger, nc *nats.Conn, subject string, maxAge time.Duration) (*FileMgr, error) {
+	ctx := context.TODO()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("nats new js: %w", err)
+	}
+
+	obs, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:  subject + "-files",
+		Storage: jetstream.FileStorage,
+		TTL:     maxAge,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create object store: %w", err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:  subject + "-files",
+		Storage: jetstream.FileStorage,
+		TTL:     maxAge,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create kv: %w", err)
+	}
+
+	fm := FileMgr{
+		log:    log,
+		kv:     kv,
+		obs:    obs,
+		maxAge: maxAge,
+	}
+
+	return &fm, nil
+}
+
+// Create adds the description of a new file to the storage. It returns
+// ErrFileExists when a file with the same id is already stored.
+func (fm *FileMgr) Create(ctx context.Context, file chatbus.File) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	if _, err := fm.kv.Create(ctx, metaKey(file.ID), data); err != nil {
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return chatbus.ErrFileExists
+		}
+		return fmt.Errorf("create: %w", err)
+	}
+
+	fm.log.Debug(ctx, "chat-addfile", "id", file.ID, "from", file.FromID, "to", file.ToID, "size", file.Size, "chunks", file.Chunks)
+
+	return nil
+}
+
+// Retrieve retrieves the description of a file from the storage.
+func (fm *FileMgr) Retrieve(ctx context.Context, fileID uuid.UUID) (chatbus.File, error) {
+	entry, err := fm.kv.Get(ctx, metaKey(fileID))
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return chatbus.File{}, chatbus.ErrFileNotExists
+		}
+		return chatbus.File{}, fmt.Errorf("get: %w", err)
+	}
+
+	var file chatbus.File
+	if err := json.Unmarshal(entry.Value(), &file); err != nil {
+		return chatbus.File{}, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return file, nil
+}
+
+// PutChunk stores a chunk of the file. Storing a chunk again replaces it.
+func (fm *FileMgr) PutChunk(ctx context.Context, fileID uuid.UUID, chunk int, data []byte) error {
+	if _, err := fm.obs.PutBytes(ctx, chunkName(fileID, chunk), data); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	return nil
+}
+
+// GetChunk retrieves a chunk of the file.
+func (fm *FileMgr) GetChunk(ctx context.Context, fileID uuid.UUID, chunk int) ([]byte, error) {
+	data, err := fm.obs.GetBytes(ctx, chunkName(fileID, chunk))
+	if err != nil {
+		if errors.Is(err, jetstream.ErrObjectNotFound) {
+			return nil, chatbus.ErrFileNotExists
+		}
+		return nil, fmt.Errorf("get: %w", err)
+	}
+
+	return data, nil
+}
+
+// Chunks returns the chunks of the file that have been stored and the bytes
+// they hold so an upload can be resumed. The chunks are found with a single
+// listing of the store.
+func (fm *FileMgr) Chunks(ctx context.Context, file chatbus.File) ([]int, int64, error) {
+	infos, err := fm.obs.List(ctx)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			return []int{}, 0, nil
+		}
+		return nil, 0, fmt.Errorf("list: %w", err)
+	}
+
+	prefix := file.ID.String() + "."
+
+	chunks := make([]int, 0, file.Chunks)
+	var stored int64
+
+	for _, info := range infos {
+		name, found := strings.CutPrefix(info.Name, prefix)
+		if !found {
+			continue
+		}
+
+		chunk, err := strconv.Atoi(name)
+		if err != nil || chunk < 0 || chunk >= file.Chunks {
+			continue
+		}
+
+		chunks = append(chunks, chunk)
+		stored += int64(info.Size)
+	}
+
+	slices.Sort(chunks)
+
+	return chunks, stored, nil
+}
+
+// Delete removes the file and its chunks from the storage.
+func (fm *FileMgr) Delete(ctx context.Context, file chatbus.File) error {
+	for chunk := range file.Chunks {
+		if err := fm.obs.Delete(ctx, chunkName(file.ID, chunk)); err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return fmt.Errorf("delete chunk[%d]: %w", chunk, err)
+		}
+	}
+
+	if err := fm.kv.Delete(ctx, metaKey(file.ID)); err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	fm.log.Debug(ctx, "chat-removefile", "id", file.ID)
+
+	return nil
+}
+
+// Usage retrieves the files the user has sent that are still stored along
+// with the revision of the record, which is needed to update it. Files older
+// than the max age have been removed from the storage and are left out.
+func (fm *FileMgr) Usage(ctx context.Context, userID common.Address) (chatbus.FileUsage, uint64, error) {
+	entry, err := fm.kv.Get(ctx, usageKey(userID))
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return chatbus.FileUsage{}, 0, nil
+		}
+		return chatbus.FileUsage{}, 0, fmt.Errorf("get: %w", err)
+	}
+
+	var usage chatbus.FileUsage
+	if err := json.Unmarshal(entry.Value(), &usage); err != nil {
+		return chatbus.FileUsage{}, 0, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	expired := time.Now().Add(-fm.maxAge)
+
+	usage.Files = slices.DeleteFunc(usage.Files, func(file chatbus.File) bool {
+		return file.DateCreated.Before(expired)
+	})
+
+	return usage, entry.Revision(), nil
+}
+
+// UpdateUsage replaces the files the user has sent if the record is still at
+// the revision it was retrieved at. It returns ErrFileConflict when the record
+// was changed in the meantime.
+func (fm *FileMgr) UpdateUsage(ctx context.Context, userID common.Address, usage chatbus.FileUsage, rev uint64) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	switch rev {
+	case 0:
+		_, err = fm.kv.Create(ctx, usageKey(userID), data)
+	default:
+		_, err = fm.kv.Update(ctx, usageKey(userID), data, rev)
+	}
+
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return chatbus.ErrFileConflict
+		}
+		return fmt.Errorf("update: %w", err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+func metaKey(fileID uuid.UUID) string {
+	return "meta." + fileID.String()
+}
+
+func usageKey(userID common.Address) string {
+	return "usage." + userID.Hex()
+}
+
+func chunkName(fileID uuid.UUID, chunk int) string {
+	return fileID.String() + "." + strconv.Itoa(chunk)
+}
@@ -0,0 +1,281 @@
+package filemgr_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/filemgr"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/managerstest"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/presencemgr"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/uicltmgr"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// TestStorage provides a test of storing a file and its chunks so an upload
+// can be resumed.
+func TestStorage(t *testing.T) {
+	t.Log("Given the need to store the files users send each other.")
+	{
+		ctx := context.Background()
+
+		fm, err := filemgr.New(managerstest.Logger(), managerstest.StartNATS(t), "test", time.Hour)
+		if err != nil {
+			t.Fatal("\tShould be able to create the storage.", "X", err)
+		}
+		t.Log("\tShould be able to create the storage.", "OK")
+
+		file := chatbus.File{
+			ID:     uuid.New(),
+			FromID: common.HexToAddress("0x0000000000000000000000000000000000000001"),
+			ToID:   common.HexToAddress("0x0000000000000000000000000000000000000002"),
+			Size:   10,
+			Chunks: 3,
+		}
+
+		t.Log("\tWhen creating a file.")
+		{
+			if err := fm.Create(ctx, file); err != nil {
+				t.Fatal("\t\tShould be able to create the file.", "X", err)
+			}
+			t.Log("\t\tShould be able to create the file.", "OK")
+
+			got, err := fm.Retrieve(ctx, file.ID)
+			if err != nil || got.ID != file.ID || got.Size != file.Size || got.Chunks != file.Chunks {
+				t.Error("\t\tShould be able to retrieve the file.", "X", got, err)
+			} else {
+				t.Log("\t\tShould be able to retrieve the file.", "OK")
+			}
+
+			if err := fm.Create(ctx, file); !errors.Is(err, chatbus.ErrFileExists) {
+				t.Error("\t\tShould not be able to create the file again.", "X", err)
+			} else {
+				t.Log("\t\tShould not be able to create the file again.", "OK")
+			}
+
+			if _, err := fm.Retrieve(ctx, uuid.New()); !errors.Is(err, chatbus.ErrFileNotExists) {
+				t.Error("\t\tShould not be able to retrieve an unknown file.", "X", err)
+			} else {
+				t.Log("\t\tShould not be able to retrieve an unknown file.", "OK")
+			}
+		}
+
+		t.Log("\tWhen an upload stops part way.")
+		{
+			chunks, stored, err := fm.Chunks(ctx, file)
+			if err != nil || len(chunks) != 0 || stored != 0 {
+				t.Error("\t\tShould have no chunks before the upload.", "X", chunks, stored, err)
+			} else {
+				t.Log("\t\tShould have no chunks before the upload.", "OK")
+			}
+
+			for _, tt := range []struct {
+				chunk int
+				data  string
+			}{
+				{2, "cc"},
+				{0, "aaaa"},
+				{3, "out of range"},
+			} {
+				if err := fm.PutChunk(ctx, file.ID, tt.chunk, []byte(tt.data)); err != nil {
+					t.Fatal("\t\tShould be able to put a chunk.", "X", tt.chunk, err)
+				}
+			}
+			t.Log("\t\tShould be able to put a chunk.", "OK")
+
+			chunks, stored, err = fm.Chunks(ctx, file)
+			if err != nil || !slices.Equal(chunks, []int{0, 2}) || stored != 6 {
+				t.Error("\t\tShould report the chunks stored and their bytes in order.", "X", chunks, stored, err)
+			} else {
+				t.Log("\t\tShould report the chunks stored and their bytes in order.", "OK")
+			}
+
+			if _, err := fm.GetChunk(ctx, file.ID, 1); !errors.Is(err, chatbus.ErrFileNotExists) {
+				t.Error("\t\tShould not be able to get a missing chunk.", "X", err)
+			} else {
+				t.Log("\t\tShould not be able to get a missing chunk.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the upload is resumed.")
+		{
+			if err := fm.PutChunk(ctx, file.ID, 1, []byte("bbbb")); err != nil {
+				t.Fatal("\t\tShould be able to put the missing chunk.", "X", err)
+			}
+			t.Log("\t\tShould be able to put the missing chunk.", "OK")
+
+			chunks, stored, err := fm.Chunks(ctx, file)
+			if err != nil || !slices.Equal(chunks, []int{0, 1, 2}) || stored != file.Size {
+				t.Error("\t\tShould have every chunk and the size of the file stored.", "X", chunks, stored, err)
+			} else {
+				t.Log("\t\tShould have every chunk and the size of the file stored.", "OK")
+			}
+
+			var data []byte
+			for chunk := range file.Chunks {
+				b, err := fm.GetChunk(ctx, file.ID, chunk)
+				if err != nil {
+					t.Fatal("\t\tShould be able to get a chunk.", "X", chunk, err)
+				}
+				data = append(data, b...)
+			}
+
+			if !bytes.Equal(data, []byte("aaaabbbbcc")) {
+				t.Error("\t\tShould get the file back.", "X", string(data))
+			} else {
+				t.Log("\t\tShould get the file back.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the file is deleted.")
+		{
+			if err := fm.Delete(ctx, file); err != nil {
+				t.Fatal("\t\tShould be able to delete the file.", "X", err)
+			}
+			t.Log("\t\tShould be able to delete the file.", "OK")
+
+			if _, err := fm.Retrieve(ctx, file.ID); !errors.Is(err, chatbus.ErrFileNotExists) {
+				t.Error("\t\tShould not be able to retrieve the file.", "X", err)
+			} else {
+				t.Log("\t\tShould not be able to retrieve the file.", "OK")
+			}
+
+			chunks, stored, err := fm.Chunks(ctx, file)
+			if err != nil || len(chunks) != 0 || stored != 0 {
+				t.Error("\t\tShould have no chunks left.", "X", chunks, stored, err)
+			} else {
+				t.Log("\t\tShould have no chunks left.", "OK")
+			}
+		}
+	}
+}
+
+// TestUpload provides a test of the rules for uploading a file through the
+// business layer with the files stored in NATS.
+func TestUpload(t *testing.T) {
+	t.Log("Given the need to check the files users upload.")
+	{
+		const maxChunk = 4
+
+		ctx := context.Background()
+		log := managerstest.Logger()
+		nc := managerstest.StartNATS(t)
+		capID := uuid.New()
+
+		fromID := common.HexToAddress("0x0000000000000000000000000000000000000001")
+		toID := common.HexToAddress("0x0000000000000000000000000000000000000002")
+
+		presenceMgr, err := presencemgr.New(log, nc, "test", capID, time.Minute)
+		if err != nil {
+			t.Fatal("\tShould be able to create the presence.", "X", err)
+		}
+
+		if err := presenceMgr.Register(ctx, toID); err != nil {
+			t.Fatal("\tShould be able to register the recipient.", "X", err)
+		}
+
+		fileMgr, err := filemgr.New(log, nc, "test", time.Hour)
+		if err != nil {
+			t.Fatal("\tShould be able to create the storage.", "X", err)
+		}
+
+		b, err := chatbus.NewBusiness(chatbus.Config{
+			Log:          log,
+			NATSConn:     nc,
+			UICltMgr:     uicltmgr.New(log, presenceMgr),
+			PresenceMgr:  presenceMgr,
+			FileMgr:      fileMgr,
+			NATSSubject:  "test",
+			NATSMaxAge:   time.Hour,
+			CAPID:        capID,
+			FileMaxSize:  20,
+			FileMaxChunk: maxChunk,
+			FileMaxOpen:  5,
+			FileMaxBytes: 100,
+		})
+		if err != nil {
+			t.Fatal("\tShould be able to create the business.", "X", err)
+		}
+		t.Log("\tShould be able to create the business.", "OK")
+
+		t.Log("\tWhen creating a file.")
+		{
+			tests := []struct {
+				name   string
+				size   int64
+				chunks int
+				exp    error
+			}{
+				{"an empty file", 0, 0, chatbus.ErrFileInvalidChunk},
+				{"a file larger than the max size", 21, 6, chatbus.ErrFileTooLarge},
+				{"too few chunks for the size", 10, 2, chatbus.ErrFileInvalidChunk},
+				{"too many chunks for the size", 10, 4, chatbus.ErrFileInvalidChunk},
+				{"the chunks the size needs", 10, 3, nil},
+			}
+
+			for _, tt := range tests {
+				_, err := b.FileCreate(ctx, fromID, chatbus.File{ID: uuid.New(), ToID: toID, Size: tt.size, Chunks: tt.chunks})
+				if !errors.Is(err, tt.exp) {
+					t.Errorf("\t\tShould handle %s: %s: %v", tt.name, "X", err)
+				} else {
+					t.Logf("\t\tShould handle %s: %s", tt.name, "OK")
+				}
+			}
+		}
+
+		t.Log("\tWhen uploading the chunks of a file.")
+		{
+			status, err := b.FileCreate(ctx, fromID, chatbus.File{ID: uuid.New(), ToID: toID, Size: 10, Chunks: 3})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create the file.", "X", err)
+			}
+			fileID := status.ID
+
+			tests := []struct {
+				name  string
+				chunk int
+				data  string
+				exp   error
+			}{
+				{"a chunk out of range", 3, "dd", chatbus.ErrFileInvalidChunk},
+				{"a chunk smaller than the max chunk", 0, "aaa", chatbus.ErrFileInvalidChunk},
+				{"a chunk larger than the max chunk", 0, "aaaaa", chatbus.ErrFileInvalidChunk},
+				{"a last chunk larger than what is left", 2, "cccc", chatbus.ErrFileInvalidChunk},
+				{"the first chunk", 0, "aaaa", nil},
+				{"the last chunk", 2, "cc", nil},
+			}
+
+			for _, tt := range tests {
+				err := b.FilePutChunk(ctx, fromID, fileID, tt.chunk, []byte(tt.data))
+				if !errors.Is(err, tt.exp) {
+					t.Errorf("\t\tShould handle %s: %s: %v", tt.name, "X", err)
+				} else {
+					t.Logf("\t\tShould handle %s: %s", tt.name, "OK")
+				}
+			}
+
+			status, err = b.FileStatus(ctx, fromID, fileID)
+			if err != nil || !slices.Equal(status.Received, []int{0, 2}) || status.Stored != 6 || status.MaxChunk != maxChunk {
+				t.Error("\t\tShould report what is left to resume the upload.", "X", status, err)
+			} else {
+				t.Log("\t\tShould report what is left to resume the upload.", "OK")
+			}
+
+			if err := b.FilePutChunk(ctx, fromID, fileID, 1, []byte("bbbb")); err != nil {
+				t.Fatal("\t\tShould be able to resume the upload.", "X", err)
+			}
+
+			status, err = b.FileStatus(ctx, toID, fileID)
+			if err != nil || len(status.Received) != status.Chunks || status.Stored != status.Size {
+				t.Error("\t\tShould have the whole file for the recipient.", "X", status, err)
+			} else {
+				t.Log("\t\tShould have the whole file for the recipient.", "OK")
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Package groupmgr provides a NATS KV based group storage for the chatbus
+// service so every CAP sees the same group membership.
+package groupmgr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus"
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// GroupMgr provides group management.
+type GroupMgr struct {
+	log *logger.Logger
+	kv  jetstream.KeyValue
+}
+
+// New creates a new manager for groups.
+func New(log *logger.Logger, nc *nats.Conn, subject string) (*GroupMgr, error) {
+	ctx := context.TODO()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("nats new js: %w", err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:  subject + "-groups",
+		Storage: jetstream.FileStorage,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create kv: %w", err)
+	}
+
+	gm := GroupMgr{
+		log: log,
+		kv:  kv,
+	}
+
+	return &gm, nil
+}
+
+// Create adds a new group to the storage.
+func (gm *GroupMgr) Create(ctx context.Context, grp chatbus.Group) error {
+	data, err := json.Marshal(grp)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	if _, err := gm.kv.Create(ctx, grp.ID.Hex(), data); err != nil {
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return chatbus.ErrGroupExists
+		}
+		return fmt.Errorf("create: %w", err)
+	}
+
+	gm.log.Debug(ctx, "chat-addgroup", "name", grp.Name, "id", grp.ID)
+
+	return nil
+}
+
+// Update replaces the group in the storage if it's still at the revision it
+// was retrieved at. It returns ErrGroupConflict when the group was changed
+// in the meantime.
+func (gm *GroupMgr) Update(ctx context.Context, grp chatbus.Group, rev uint64) error {
+	data, err := json.Marshal(grp)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	if _, err := gm.kv.Update(ctx, grp.ID.Hex(), data, rev); err != nil {
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return chatbus.ErrGroupConflict
+		}
+		return fmt.Errorf("update: %w", err)
+	}
+
+	gm.log.Debug(ctx, "chat-updgroup", "name", grp.Name, "id", grp.ID, "members", len(grp.Members))
+
+	return nil
+}
+
+// Delete removes the group from the storage if it's still at the revision it
+// was retrieved at. It returns ErrGroupConflict when the group was changed
+// in the meantime.
+func (gm *GroupMgr) Delete(ctx context.Context, groupID common.Address, rev uint64) error {
+	if err := gm.kv.Delete(ctx, groupID.Hex(), jetstream.LastRevision(rev)); err != nil {
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return chatbus.ErrGroupConflict
+		}
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	gm.log.Debug(ctx, "chat-removegroup", "id", groupID)
+
+	return nil
+}
+
+// Retrieve retrieves a group from the storage along with its revision, which
+// is needed to update or delete the group.
+func (gm *GroupMgr) Retrieve(ctx context.Context, groupID common.Address) (chatbus.Group, uint64, error) {
+	entry, err := gm.kv.Get(ctx, groupID.Hex())
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return chatbus.Group{}, 0, chatbus.ErrGroupNotExists
+		}
+		return chatbus.Group{}, 0, fmt.Errorf("get: %w", err)
+	}
+
+	var grp chatbus.Group
+	if err := json.Unmarshal(entry.Value(), &grp); err != nil {
+		return chatbus.Group{}, 0, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return grp, entry.Revision(), nil
+}
@@ -0,0 +1,136 @@
+// Package inboxmgr provides a JetStream based inbox for holding messages for
+// users that are not connected to any CAP.
+package inboxmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// InboxMgr provides store-and-forward support for undelivered messages.
+type InboxMgr struct {
+	log     *logger.Logger
+	stream  jetstream.Stream
+	js      jetstream.JetStream
+	subject string
+}
+
+// New creates a new manager for holding undelivered messages. Each recipient
+// gets its own subject inside a work queue stream, so a message is removed
+// once it has been acknowledged as delivered.
+func New(log *logger.Logger, nc *nats.Conn, subject string, maxAge time.Duration) (*InboxMgr, error) {
+	ctx := context.TODO()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("nats new js: %w", err)
+	}
+
+	s1, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      subject + "-inbox",
+		Subjects:  []string{subject + ".inbox.*"},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+		MaxAge:    maxAge,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create js: %w", err)
+	}
+
+	im := InboxMgr{
+		log:     log,
+		stream:  s1,
+		js:      js,
+		subject: subject,
+	}
+
+	return &im, nil
+}
+
+// Push stores the message in the inbox for the specified user.
+func (im *InboxMgr) Push(ctx context.Context, userID common.Address, data []byte) error {
+	if _, err := im.js.Publish(ctx, im.userSubject(userID), data); err != nil {
+		return fmt.Errorf("inbox publish: %w", err)
+	}
+
+	im.log.Info(ctx, "inbox-push", "userID", userID)
+
+	return nil
+}
+
+// Drain delivers every message held for the specified user to the provided
+// function in the order they were stored. A message is only removed from the
+// inbox when the function returns without an error. The number of messages
+// delivered is returned.
+func (im *InboxMgr) Drain(ctx context.Context, userID common.Address, fn func(data []byte) error) (int, error) {
+	c1, err := im.stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:           userID.Hex(),
+		FilterSubject:     im.userSubject(userID),
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		DeliverPolicy:     jetstream.DeliverAllPolicy,
+		InactiveThreshold: time.Hour,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("inbox create consumer: %w", err)
+	}
+
+	const batchSize = 100
+
+	var delivered int
+
+	for {
+		batch, err := c1.FetchNoWait(batchSize)
+		if err != nil {
+			return delivered, fmt.Errorf("inbox fetch: %w", err)
+		}
+
+		var received int
+
+		for msg := range batch.Messages() {
+			received++
+
+			if err := fn(msg.Data()); err != nil {
+				msg.Nak()
+
+				// The rest of the batch is handed back as well so it's
+				// delivered on the next drain and not after the ack wait.
+				for msg := range batch.Messages() {
+					msg.Nak()
+				}
+
+				return delivered, fmt.Errorf("inbox deliver: %w", err)
+			}
+
+			if err := msg.Ack(); err != nil {
+				return delivered, fmt.Errorf("inbox ack: %w", err)
+			}
+
+			delivered++
+		}
+
+		if err := batch.Error(); err != nil && !errors.Is(err, jetstream.ErrNoMessages) {
+			return delivered, fmt.Errorf("inbox batch: %w", err)
+		}
+
+		if received == 0 {
+			break
+		}
+	}
+
+	im.log.Info(ctx, "inbox-drain", "userID", userID, "delivered", delivered)
+
+	return delivered, nil
+}
+
+// =============================================================================
+
+func (im *InboxMgr) userSubject(userID common.Address) string {
+	return fmt.Sprintf("%s.inbox.%s", im.subject, userID.Hex())
+}
@@ -0,0 +1,91 @@
+package inboxmgr_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/inboxmgr"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/managerstest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TestInbox provides a test of holding messages for users that are not
+// connected until they are drained.
+func TestInbox(t *testing.T) {
+	t.Log("Given the need to hold messages for users that are not connected.")
+	{
+		ctx := context.Background()
+
+		im, err := inboxmgr.New(managerstest.Logger(), managerstest.StartNATS(t), "test", time.Hour)
+		if err != nil {
+			t.Fatal("\tShould be able to create the inbox.", "X", err)
+		}
+		t.Log("\tShould be able to create the inbox.", "OK")
+
+		userA := common.HexToAddress("0x0000000000000000000000000000000000000001")
+		userB := common.HexToAddress("0x0000000000000000000000000000000000000002")
+
+		for _, tt := range []struct {
+			userID common.Address
+			msg    string
+		}{
+			{userA, "a1"},
+			{userB, "b1"},
+			{userA, "a2"},
+			{userA, "a3"},
+		} {
+			if err := im.Push(ctx, tt.userID, []byte(tt.msg)); err != nil {
+				t.Fatal("\tShould be able to push a message.", "X", tt.msg, err)
+			}
+		}
+		t.Log("\tShould be able to push a message.", "OK")
+
+		t.Log("\tWhen delivering a message fails.")
+		{
+			var got []string
+			n, err := im.Drain(ctx, userA, func(data []byte) error {
+				if string(data) == "a2" {
+					return errors.New("write failed")
+				}
+				got = append(got, string(data))
+				return nil
+			})
+
+			if err == nil || n != 1 || !slices.Equal(got, []string{"a1"}) {
+				t.Error("\t\tShould stop at the message that failed.", "X", n, got, err)
+			} else {
+				t.Log("\t\tShould stop at the message that failed.", "OK")
+			}
+		}
+
+		t.Log("\tWhen draining the inbox for a user.")
+		{
+			tests := []struct {
+				name   string
+				userID common.Address
+				exp    []string
+			}{
+				{"messages left from the failure in order", userA, []string{"a2", "a3"}},
+				{"nothing once drained", userA, nil},
+				{"only the messages for the user", userB, []string{"b1"}},
+			}
+
+			for _, tt := range tests {
+				var got []string
+				n, err := im.Drain(ctx, tt.userID, func(data []byte) error {
+					got = append(got, string(data))
+					return nil
+				})
+
+				if err != nil || n != len(tt.exp) || !slices.Equal(got, tt.exp) {
+					t.Errorf("\t\tShould receive %s. %s %v %v", tt.name, "X", got, err)
+					continue
+				}
+				t.Logf("\t\tShould receive %s. %s", tt.name, "OK")
+			}
+		}
+	}
+}
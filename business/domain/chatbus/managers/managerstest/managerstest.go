@@ -0,0 +1,50 @@
+// Package managerstest provides support for testing the managers against an
+// embedded NATS server.
+package managerstest
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// StartNATS starts a JetStream enabled server for the test and connects to
+// it. The server and connection are closed when the test finishes.
+func StartNATS(t *testing.T) *nats.Conn {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal("\tShould be able to create a NATS server.", "X", err)
+	}
+
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("\tShould be able to start a NATS server.", "X")
+	}
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal("\tShould be able to connect to the NATS server.", "X", err)
+	}
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+// Logger returns a logger that discards the logs.
+func Logger() *logger.Logger {
+	return logger.New(io.Discard, logger.LevelInfo, "TEST", func(context.Context) string { return "" })
+}
@@ -0,0 +1,111 @@
+// Package presencemgr provides a NATS KV based directory of which CAPs hold
+// the web socket sessions for a user.
+package presencemgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus"
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// PresenceMgr provides the cluster wide presence directory.
+type PresenceMgr struct {
+	log   *logger.Logger
+	kv    jetstream.KeyValue
+	capID uuid.UUID
+}
+
+// New creates a new presence directory backed by a KV bucket. Each CAP has
+// its own entry for a user so the sessions of a user can be spread across
+// CAPs. Entries expire after the ttl unless they are registered again, so
+// users on a CAP that goes away without cleaning up don't linger in the
+// directory.
+func New(log *logger.Logger, nc *nats.Conn, subject string, capID uuid.UUID, ttl time.Duration) (*PresenceMgr, error) {
+	ctx := context.TODO()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("nats new js: %w", err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: subject + "-presence",
+		TTL:    ttl,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create kv: %w", err)
+	}
+
+	pm := PresenceMgr{
+		log:   log,
+		kv:    kv,
+		capID: capID,
+	}
+
+	return &pm, nil
+}
+
+// Register records that this CAP holds sessions for the user.
+func (pm *PresenceMgr) Register(ctx context.Context, userID common.Address) error {
+	if _, err := pm.kv.PutString(ctx, presenceKey(userID, pm.capID), pm.capID.String()); err != nil {
+		return fmt.Errorf("presence put: %w", err)
+	}
+
+	return nil
+}
+
+// Unregister removes the entry this CAP has for the user. The entries other
+// CAPs have for the user are left alone.
+func (pm *PresenceMgr) Unregister(ctx context.Context, userID common.Address) error {
+	if err := pm.kv.Delete(ctx, presenceKey(userID, pm.capID)); err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return fmt.Errorf("presence delete: %w", err)
+	}
+
+	return nil
+}
+
+// Lookup returns the IDs of the CAPs that hold sessions for the user, this
+// CAP included. The ErrNotExists error is returned when no CAP does.
+func (pm *PresenceMgr) Lookup(ctx context.Context, userID common.Address) ([]uuid.UUID, error) {
+	lister, err := pm.kv.ListKeysFiltered(ctx, userID.Hex()+".*")
+	if err != nil {
+		return nil, fmt.Errorf("presence list: %w", err)
+	}
+	defer lister.Stop()
+
+	var capIDs []uuid.UUID
+	for key := range lister.Keys() {
+		capID, err := uuid.Parse(key[strings.LastIndex(key, ".")+1:])
+		if err != nil {
+			return nil, fmt.Errorf("presence parse: %w", err)
+		}
+
+		capIDs = append(capIDs, capID)
+	}
+
+	if len(capIDs) == 0 {
+		return nil, chatbus.ErrNotExists
+	}
+
+	slices.SortFunc(capIDs, func(a, b uuid.UUID) int {
+		return strings.Compare(a.String(), b.String())
+	})
+
+	return capIDs, nil
+}
+
+// =============================================================================
+
+func presenceKey(userID common.Address, capID uuid.UUID) string {
+	return userID.Hex() + "." + capID.String()
+}
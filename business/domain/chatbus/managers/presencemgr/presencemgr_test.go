@@ -0,0 +1,127 @@
+package presencemgr_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/managerstest"
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/presencemgr"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// TestPresence provides a test of tracking the CAPs that hold the sessions
+// of a user.
+func TestPresence(t *testing.T) {
+	t.Log("Given the need to find every CAP a user has sessions on.")
+	{
+		ctx := context.Background()
+		log := managerstest.Logger()
+		nc := managerstest.StartNATS(t)
+
+		capA, capB := uuid.New(), uuid.New()
+
+		pmA, err := presencemgr.New(log, nc, "test", capA, time.Hour)
+		if err != nil {
+			t.Fatal("\tShould be able to create the directory for a CAP.", "X", err)
+		}
+
+		pmB, err := presencemgr.New(log, nc, "test", capB, time.Hour)
+		if err != nil {
+			t.Fatal("\tShould be able to create the directory for a CAP.", "X", err)
+		}
+		t.Log("\tShould be able to create the directory for a CAP.", "OK")
+
+		userA := common.HexToAddress("0x0000000000000000000000000000000000000001")
+		userB := common.HexToAddress("0x0000000000000000000000000000000000000002")
+
+		tests := []struct {
+			name   string
+			change func() error
+			userID common.Address
+			exp    []uuid.UUID
+		}{
+			{
+				name:   "no CAP for a user without sessions",
+				change: func() error { return nil },
+				userID: userA,
+			},
+			{
+				name:   "the CAP the user registered on",
+				change: func() error { return pmA.Register(ctx, userA) },
+				userID: userA,
+				exp:    []uuid.UUID{capA},
+			},
+			{
+				name:   "both CAPs once the user registers on another",
+				change: func() error { return pmB.Register(ctx, userA) },
+				userID: userA,
+				exp:    []uuid.UUID{capA, capB},
+			},
+			{
+				name:   "both CAPs when registering again",
+				change: func() error { return pmA.Register(ctx, userA) },
+				userID: userA,
+				exp:    []uuid.UUID{capA, capB},
+			},
+			{
+				name:   "only the CAPs of the user",
+				change: func() error { return pmB.Register(ctx, userB) },
+				userID: userB,
+				exp:    []uuid.UUID{capB},
+			},
+			{
+				name:   "the other CAP once one unregisters",
+				change: func() error { return pmA.Unregister(ctx, userA) },
+				userID: userA,
+				exp:    []uuid.UUID{capB},
+			},
+			{
+				name:   "the other CAP when unregistering again",
+				change: func() error { return pmA.Unregister(ctx, userA) },
+				userID: userA,
+				exp:    []uuid.UUID{capB},
+			},
+			{
+				name:   "no CAP once both unregister",
+				change: func() error { return pmB.Unregister(ctx, userA) },
+				userID: userA,
+			},
+		}
+
+		for _, tt := range tests {
+			if err := tt.change(); err != nil {
+				t.Fatalf("\tShould be able to change the directory. %s %v", "X", err)
+			}
+
+			capIDs, err := pmA.Lookup(ctx, tt.userID)
+
+			switch {
+			case len(tt.exp) == 0 && !errors.Is(err, chatbus.ErrNotExists):
+				t.Errorf("\tShould find %s. %s %v %v", tt.name, "X", capIDs, err)
+				continue
+
+			case len(tt.exp) > 0 && (err != nil || !equalCAPs(capIDs, tt.exp)):
+				t.Errorf("\tShould find %s. %s %v %v", tt.name, "X", capIDs, err)
+				continue
+			}
+			t.Logf("\tShould find %s. %s", tt.name, "OK")
+		}
+	}
+}
+
+// =============================================================================
+
+func equalCAPs(got, exp []uuid.UUID) bool {
+	exp = slices.Clone(exp)
+	slices.SortFunc(exp, func(a, b uuid.UUID) int {
+		return strings.Compare(a.String(), b.String())
+	})
+
+	return slices.Equal(got, exp)
+}
@@ -3,126 +3,215 @@ package uicltmgr
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/PeterLee0620/GoIM/business/domain/chatbus"
 	"github.com/PeterLee0620/GoIM/foundation/logger"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
 )
 
-// UICltMgr provides user management for UI connections.
+// UICltMgr provides user management for UI connections. A user can have
+// several sessions open at the same time, one for each of their devices.
 type UICltMgr struct {
-	log     *logger.Logger
-	users   map[common.Address]chatbus.UIUser
-	muUsers sync.RWMutex
+	log         *logger.Logger
+	presenceMgr chatbus.PresenceManager
+	users       map[common.Address]map[uuid.UUID]chatbus.UIUser
+	muUsers     sync.RWMutex
 }
 
-// New creates a new manager for UI connections.
-func New(log *logger.Logger) *UICltMgr {
+// New creates a new manager for UI connections. Users are registered in the
+// presence directory so other CAPs know this CAP holds their sessions.
+func New(log *logger.Logger, presenceMgr chatbus.PresenceManager) *UICltMgr {
 	u := UICltMgr{
-		log:   log,
-		users: make(map[common.Address]chatbus.UIUser),
+		log:         log,
+		presenceMgr: presenceMgr,
+		users:       make(map[common.Address]map[uuid.UUID]chatbus.UIUser),
 	}
 
 	return &u
 }
 
-// Add adds a new user to the storage.
+// Add adds a new session for a user to the storage. A device can only have
+// one session open at a time. The session is removed again if the user can't
+// be registered in the presence directory.
 func (u *UICltMgr) Add(ctx context.Context, usr chatbus.UIUser) error {
-	u.muUsers.Lock()
-	defer u.muUsers.Unlock()
-
-	if _, exists := u.users[usr.ID]; exists {
-		return chatbus.ErrExists
+	sessions, err := u.add(usr)
+	if err != nil {
+		return err
 	}
 
-	u.users[usr.ID] = usr
+	// The presence directory is a NATS round trip so it's not called while
+	// holding the lock.
+	if err := u.presenceMgr.Register(ctx, usr.ID); err != nil {
+		u.Remove(ctx, usr.ID, usr.SessionID)
+		return fmt.Errorf("presence register: %w", err)
+	}
 
-	u.log.Debug(ctx, "chat-adduser", "name", usr.Name, "id", usr.ID)
+	u.log.Debug(ctx, "chat-adduser", "name", usr.Name, "id", usr.ID, "sessionID", usr.SessionID, "device", usr.Device, "sessions", sessions)
 
 	return nil
 }
 
-// UpdateLastPing updates a user value's ping date/time.
-func (u *UICltMgr) UpdateLastPing(ctx context.Context, userID common.Address) error {
+// UpdateLastPing updates a session's ping date/time.
+func (u *UICltMgr) UpdateLastPing(ctx context.Context, userID common.Address, sessionID uuid.UUID) error {
 	u.muUsers.Lock()
-	defer u.muUsers.Unlock()
 
-	usr, exists := u.users[userID]
+	usr, exists := u.users[userID][sessionID]
 	if !exists {
+		u.muUsers.Unlock()
 		return chatbus.ErrNotExists
 	}
 
 	usr.LastPing = time.Now()
-	u.users[usr.ID] = usr
+	u.users[usr.ID][sessionID] = usr
+	u.muUsers.Unlock()
+
+	// Registering again keeps the presence entry from expiring.
+	if err := u.presenceMgr.Register(ctx, usr.ID); err != nil {
+		u.log.Info(ctx, "chat-updping", "id", usr.ID, "ERROR", err)
+	}
 
-	u.log.Debug(ctx, "chat-updping", "name", usr.Name, "id", usr.ID, "lastPing", usr.LastPing)
+	u.log.Debug(ctx, "chat-updping", "name", usr.Name, "id", usr.ID, "sessionID", sessionID, "lastPing", usr.LastPing)
 
 	return nil
 }
 
-// UpdateLastPong updates a user value's pong date/time.
-func (u *UICltMgr) UpdateLastPong(ctx context.Context, userID common.Address) (chatbus.UIUser, error) {
+// UpdateLastPong updates a session's pong date/time.
+func (u *UICltMgr) UpdateLastPong(ctx context.Context, userID common.Address, sessionID uuid.UUID) (chatbus.UIUser, error) {
 	u.muUsers.Lock()
 	defer u.muUsers.Unlock()
 
-	usr, exists := u.users[userID]
+	usr, exists := u.users[userID][sessionID]
 	if !exists {
 		return chatbus.UIUser{}, chatbus.ErrNotExists
 	}
 
 	usr.LastPong = time.Now()
-	u.users[usr.ID] = usr
+	u.users[usr.ID][sessionID] = usr
 
-	u.log.Debug(ctx, "chat-updpong", "name", usr.Name, "id", usr.ID, "lastPong", usr.LastPong)
+	u.log.Debug(ctx, "chat-updpong", "name", usr.Name, "id", usr.ID, "sessionID", sessionID, "lastPong", usr.LastPong)
 
 	return usr, nil
 }
 
-// Remove removes a user from the storage.
-func (u *UICltMgr) Remove(ctx context.Context, userID common.Address) {
-	u.muUsers.Lock()
-	defer u.muUsers.Unlock()
-
-	usr, exists := u.users[userID]
+// Remove removes a session from the storage. The user is removed from the
+// presence directory when their last session is removed.
+func (u *UICltMgr) Remove(ctx context.Context, userID common.Address, sessionID uuid.UUID) {
+	usr, sessions, exists := u.remove(userID, sessionID)
 	if !exists {
-		u.log.Debug(ctx, "chat-removeuser", "userID", userID, "status", "does not exists")
+		u.log.Debug(ctx, "chat-removeuser", "userID", userID, "sessionID", sessionID, "status", "does not exists")
 		return
 	}
 
-	delete(u.users, userID)
+	if sessions == 0 {
+		if err := u.presenceMgr.Unregister(ctx, userID); err != nil {
+			u.log.Info(ctx, "chat-removeuser", "id", userID, "ERROR", err)
+		}
+
+		// A new session may have been added while the user was being
+		// removed from the presence directory.
+		if u.connected(userID) {
+			if err := u.presenceMgr.Register(ctx, userID); err != nil {
+				u.log.Info(ctx, "chat-removeuser", "id", userID, "ERROR", err)
+			}
+		}
+	}
 
-	u.log.Debug(ctx, "chat-removeuser", "name", usr.Name, "id", usr.ID)
+	u.log.Debug(ctx, "chat-removeuser", "name", usr.Name, "id", usr.ID, "sessionID", sessionID, "sessions", sessions)
 }
 
-// Connections returns all the know users with their connections. A connection
-// that is not valid shouldn't be used.
-func (u *UICltMgr) Connections() map[common.Address]chatbus.UIConnection {
+// Connections returns all the know sessions with their connections. A
+// connection that is not valid shouldn't be used.
+func (u *UICltMgr) Connections() map[uuid.UUID]chatbus.UIConnection {
 	u.muUsers.RLock()
 	defer u.muUsers.RUnlock()
 
-	m := make(map[common.Address]chatbus.UIConnection)
-	for id, usr := range u.users {
-		m[id] = chatbus.UIConnection{
-			Conn:     usr.UIConn,
-			LastPing: usr.LastPing,
-			LastPong: usr.LastPong,
+	m := make(map[uuid.UUID]chatbus.UIConnection)
+	for id, sessions := range u.users {
+		for sessionID, usr := range sessions {
+			m[sessionID] = chatbus.UIConnection{
+				ID:       id,
+				Conn:     usr.UIConn,
+				Writer:   usr.UIWriter,
+				LastPing: usr.LastPing,
+				LastPong: usr.LastPong,
+			}
 		}
 	}
 
 	return m
 }
 
-// Retrieve retrieves a user from the storage.
-func (u *UICltMgr) Retrieve(ctx context.Context, userID common.Address) (chatbus.UIUser, error) {
+// Retrieve retrieves all the sessions for a user from the storage.
+func (u *UICltMgr) Retrieve(ctx context.Context, userID common.Address) ([]chatbus.UIUser, error) {
 	u.muUsers.RLock()
 	defer u.muUsers.RUnlock()
 
-	usr, exists := u.users[userID]
+	sessions, exists := u.users[userID]
 	if !exists {
-		return chatbus.UIUser{}, chatbus.ErrNotExists
+		return nil, chatbus.ErrNotExists
 	}
 
-	return usr, nil
+	usrs := make([]chatbus.UIUser, 0, len(sessions))
+	for _, usr := range sessions {
+		usrs = append(usrs, usr)
+	}
+
+	return usrs, nil
+}
+
+// =============================================================================
+
+// add adds the session and returns the number of sessions for the user.
+func (u *UICltMgr) add(usr chatbus.UIUser) (int, error) {
+	u.muUsers.Lock()
+	defer u.muUsers.Unlock()
+
+	sessions := u.users[usr.ID]
+	for _, s := range sessions {
+		if s.Device == usr.Device {
+			return 0, chatbus.ErrExists
+		}
+	}
+
+	if sessions == nil {
+		sessions = make(map[uuid.UUID]chatbus.UIUser)
+		u.users[usr.ID] = sessions
+	}
+
+	sessions[usr.SessionID] = usr
+
+	return len(sessions), nil
+}
+
+// remove removes the session and returns it with the number of sessions left
+// for the user.
+func (u *UICltMgr) remove(userID common.Address, sessionID uuid.UUID) (chatbus.UIUser, int, bool) {
+	u.muUsers.Lock()
+	defer u.muUsers.Unlock()
+
+	sessions := u.users[userID]
+
+	usr, exists := sessions[sessionID]
+	if !exists {
+		return chatbus.UIUser{}, 0, false
+	}
+
+	delete(sessions, sessionID)
+
+	if len(sessions) == 0 {
+		delete(u.users, userID)
+	}
+
+	return usr, len(sessions), true
+}
+
+func (u *UICltMgr) connected(userID common.Address) bool {
+	u.muUsers.RLock()
+	defer u.muUsers.RUnlock()
+
+	return len(u.users[userID]) > 0
 }
@@ -1,7 +1,10 @@
 package chatbus
 
 import (
+	"errors"
+	"fmt"
 	"math/big"
+	"slices"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -9,42 +12,275 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// UIUser represents a web socket user in the chat system.
+// UIUser represents a web socket session for a user in the chat system. A
+// user has a session for each device they are connected from.
 type UIUser struct {
-	ID       common.Address  `json:"id"`
-	Name     string          `json:"name"`
-	LastPing time.Time       `json:"lastPing"`
-	LastPong time.Time       `json:"lastPong"`
-	UIConn   *websocket.Conn `json:"-"`
+	ID        common.Address  `json:"id"`
+	Name      string          `json:"name"`
+	SessionID uuid.UUID       `json:"sessionID"`
+	Device    string          `json:"device"`
+	Cursor    uint64          `json:"cursor"`
+	LastPing  time.Time       `json:"lastPing"`
+	LastPong  time.Time       `json:"lastPong"`
+	UIConn    *websocket.Conn `json:"-"`
+	UIWriter  *UIWriter       `json:"-"`
 }
 
-// UIConnection represents a connection to a user.
+// UIConnection represents a connection to a user's session.
 type UIConnection struct {
+	ID       common.Address
 	Conn     *websocket.Conn
+	Writer   *UIWriter
 	LastPing time.Time
 	LastPong time.Time
 }
 
+// Group represents a set of users that receive every message sent to the
+// group's ID.
+type Group struct {
+	ID      common.Address   `json:"id"`
+	Name    string           `json:"name"`
+	OwnerID common.Address   `json:"ownerID"`
+	Members []common.Address `json:"members"`
+}
+
+// IsMember reports whether the user is a member of the group.
+func (g Group) IsMember(userID common.Address) bool {
+	return slices.Contains(g.Members, userID)
+}
+
+func (g Group) removeMember(userID common.Address) Group {
+	g.Members = slices.DeleteFunc(slices.Clone(g.Members), func(id common.Address) bool {
+		return id == userID
+	})
+
+	return g
+}
+
+// File represents a file a user is sending to a contact. The file is
+// encrypted by the sender and uploaded in chunks, Size is the number of bytes
+// that are uploaded.
+type File struct {
+	ID          uuid.UUID      `json:"id"`
+	FromID      common.Address `json:"fromID"`
+	ToID        common.Address `json:"toID"`
+	Size        int64          `json:"size"`
+	Chunks      int            `json:"chunks"`
+	DateCreated time.Time      `json:"dateCreated"`
+}
+
+// FileUsage represents the files a user has sent that are still stored. It's
+// used to limit how much storage a user can take up.
+type FileUsage struct {
+	Files []File `json:"files"`
+}
+
+// Bytes returns the total size of the files.
+func (fu FileUsage) Bytes() int64 {
+	var n int64
+	for _, file := range fu.Files {
+		n += file.Size
+	}
+
+	return n
+}
+
+func (fu FileUsage) removeFile(fileID uuid.UUID) FileUsage {
+	fu.Files = slices.DeleteFunc(slices.Clone(fu.Files), func(file File) bool {
+		return file.ID == fileID
+	})
+
+	return fu
+}
+
+// FileStatus represents how much of a file has been uploaded. Stored is the
+// number of bytes held by the chunks received, the upload is complete when it
+// matches the size.
+type FileStatus struct {
+	File
+	Received []int `json:"received"`
+	Stored   int64 `json:"stored"`
+	MaxChunk int   `json:"maxChunk"`
+}
+
+// ProtocolVersion is the version of the message envelope used between users
+// and CAPs. A user on a different version is rejected during the handshake.
+const ProtocolVersion = 7
+
+// msgType identifies what a message carries.
+type msgType string
+
+// Set of message types carried in the envelope.
+const (
+	msgTypeChat     msgType = "chat"
+	msgTypeEvent    msgType = "event"
+	msgTypeCommand  msgType = "command"
+	msgTypeReceipt  msgType = "receipt"
+	msgTypeGroup    msgType = "group"
+	msgTypeEdit     msgType = "edit"
+	msgTypeDelete   msgType = "delete"
+	msgTypeReaction msgType = "reaction"
+	msgTypeFile     msgType = "file"
+)
+
+// Set of events a CAP sends to a user in a message of type event.
+const (
+	eventTCPConn = "TCP-CONN"
+	eventTCPDrop = "TCP-DROP"
+	eventQueued  = "QUEUED"
+)
+
+// envelope is the header every message on the wire carries. The sender
+// picks the ID and signs it with the message, so it identifies the message
+// for every user that receives it. ReplyTo is the ID of the message this
+// one is a reply to.
+type envelope struct {
+	Version int       `json:"version"`
+	Type    msgType   `json:"type"`
+	ID      uuid.UUID `json:"id"`
+	ReplyTo uuid.UUID `json:"replyTo,omitzero"`
+}
+
+// newEventMessage constructs a message from a CAP telling the user about
+// an event.
+func newEventMessage(toID common.Address, event string) uiIncomingMessage {
+	return uiIncomingMessage{
+		envelope: envelope{
+			Version: ProtocolVersion,
+			Type:    msgTypeEvent,
+			ID:      uuid.New(),
+		},
+		ToID: toID,
+		Msg:  [][]byte{[]byte(event)},
+	}
+}
+
+// uiHandshakeMessage is the response to the challenge a CAP sends when a web
+// socket connection is opened. The challenge is signed by the user. Cursor is
+// the last delivery sequence the device has seen.
+type uiHandshakeMessage struct {
+	Version int            `json:"version"`
+	ID      common.Address `json:"id"`
+	Name    string         `json:"name"`
+	Device  string         `json:"device"`
+	Cursor  uint64         `json:"cursor"`
+	V       *big.Int       `json:"v"`
+	R       *big.Int       `json:"r"`
+	S       *big.Int       `json:"s"`
+}
+
+// uiIncomingMessage is a message sent by a user. Each device of a user has
+// its own nonce sequence. Mirror is an optional copy of an encrypted message
+// the sender's other devices can decrypt, it's only delivered to them.
 type uiIncomingMessage struct {
-	ToID      common.Address `json:"toID"`
-	Encrypted bool           `json:"encrypted"`
-	Msg       [][]byte       `json:"msg"`
-	FromNonce uint64         `json:"fromNonce"`
-	V         *big.Int       `json:"v"`
-	R         *big.Int       `json:"r"`
-	S         *big.Int       `json:"s"`
+	envelope
+	ToID       common.Address `json:"toID"`
+	GroupID    common.Address `json:"groupID"`
+	Encrypted  bool           `json:"encrypted"`
+	Msg        [][]byte       `json:"msg"`
+	Mirror     [][]byte       `json:"mirror,omitempty"`
+	FromNonce  uint64         `json:"fromNonce"`
+	FromDevice string         `json:"fromDevice"`
+	V          *big.Int       `json:"v"`
+	R          *big.Int       `json:"r"`
+	S          *big.Int       `json:"s"`
+}
+
+// validate checks the envelope of a message sent by a user.
+func (m uiIncomingMessage) validate() error {
+	if m.Version != ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version: %d", m.Version)
+	}
+
+	switch m.Type {
+	case msgTypeChat, msgTypeCommand, msgTypeReceipt, msgTypeGroup, msgTypeEdit, msgTypeDelete, msgTypeReaction, msgTypeFile:
+	default:
+		return fmt.Errorf("invalid message type: %q", m.Type)
+	}
+
+	if len(m.Msg) == 0 {
+		return errors.New("empty message")
+	}
+
+	return nil
+}
+
+// validateEvent checks the envelope of an event a CAP sent over a peer link.
+func (m uiIncomingMessage) validateEvent() error {
+	if m.Version != ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version: %d", m.Version)
+	}
+
+	if m.Type != msgTypeEvent {
+		return fmt.Errorf("invalid event type: %q", m.Type)
+	}
+
+	if len(m.Msg) == 0 {
+		return errors.New("empty event")
+	}
+
+	return nil
+}
+
+// signedData returns the data the sender signed for this message. A message
+// to a group is signed for the group along with its ID, the copies fanned out
+// to the members keep the group as the recipient. A direct message can't be
+// passed off as a copy since it was signed without a group ID.
+func (m uiIncomingMessage) signedData() any {
+	toID := m.ToID
+	if m.GroupID != (common.Address{}) {
+		toID = m.GroupID
+	}
+
+	dataThatWasSign := struct {
+		Version    int
+		Type       msgType
+		ID         uuid.UUID
+		ReplyTo    uuid.UUID
+		ToID       common.Address
+		GroupID    common.Address
+		Msg        [][]byte
+		FromNonce  uint64
+		FromDevice string
+	}{
+		Version:    m.Version,
+		Type:       m.Type,
+		ID:         m.ID,
+		ReplyTo:    m.ReplyTo,
+		ToID:       toID,
+		GroupID:    m.GroupID,
+		Msg:        m.Msg,
+		FromNonce:  m.FromNonce,
+		FromDevice: m.FromDevice,
+	}
+
+	return dataThatWasSign
 }
 
 type uiOutgoingUser struct {
-	ID    common.Address `json:"id"`
-	Name  string         `json:"name"`
-	Nonce uint64         `json:"nonce"`
+	ID     common.Address `json:"id"`
+	Name   string         `json:"name"`
+	Nonce  uint64         `json:"nonce"`
+	Device string         `json:"device"`
 }
 
+// uiOutgoingMessage is a message delivered to a user. ToID lets a device
+// know which conversation a message mirrored from another device belongs to.
+// Seq is the delivery sequence of the message, events don't have one. The
+// sender's signature is passed along so the user can check who wrote a
+// message an edit or delete refers to.
 type uiOutgoingMessage struct {
+	envelope
+	Seq       uint64         `json:"seq,omitempty"`
 	From      uiOutgoingUser `json:"from"`
+	ToID      common.Address `json:"toID"`
+	GroupID   common.Address `json:"groupID"`
 	Encrypted bool           `json:"encrypted"`
 	Msg       [][]byte       `json:"msg"`
+	Mirror    [][]byte       `json:"mirror,omitempty"`
+	V         *big.Int       `json:"v,omitempty"`
+	R         *big.Int       `json:"r,omitempty"`
+	S         *big.Int       `json:"s,omitempty"`
 }
 
 type natsInOutMessage struct {
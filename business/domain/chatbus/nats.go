@@ -8,7 +8,6 @@ import (
 
 	"github.com/PeterLee0620/GoIM/foundation/signature"
 	"github.com/PeterLee0620/GoIM/foundation/web"
-	"github.com/ethereum/go-ethereum/common"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go/jetstream"
 )
@@ -19,70 +18,78 @@ func (b *Business) natsReadMessage() func(msg jetstream.Msg) {
 	f := func(msg jetstream.Msg) {
 		defer msg.Ack()
 
-		var natsMsg natsInOutMessage
-		if err := json.Unmarshal(msg.Data(), &natsMsg); err != nil {
-			b.log.Info(ctx, "natsreadmessage: unmarshal", "ERROR", err)
-			return
-		}
-
-		if natsMsg.CapID == b.capID {
-			return
-		}
-
-		b.log.Info(ctx, "natsreadmessage: msg recv", "fromNonce", natsMsg.FromNonce, "from", natsMsg.FromID, "to", natsMsg.ToID, "encrypted", natsMsg.Encrypted, "message", natsMsg.Msg, "fromName", natsMsg.FromName)
-
-		dataThatWasSign := struct {
-			ToID      common.Address
-			Msg       [][]byte
-			FromNonce uint64
-		}{
-			ToID:      natsMsg.ToID,
-			Msg:       natsMsg.Msg,
-			FromNonce: natsMsg.FromNonce,
-		}
-
-		id, err := signature.FromAddress(dataThatWasSign, natsMsg.V, natsMsg.R, natsMsg.S)
-		if err != nil {
-			b.log.Info(ctx, "natsreadmessage: fromAddress", "ERROR", err)
-			return
-		}
-
-		if id != natsMsg.FromID.Hex() {
-			b.log.Info(ctx, "natsreadmessage: signature check", "status", "signature does not match")
-			return
-		}
-
-		// If the user is found, send the message directly to the user.
-		to, err := b.uiCltMgr.Retrieve(ctx, natsMsg.ToID)
-		if err == nil {
-			b.log.Info(ctx, "natsreadmessage: msg sent over web socket", "from", natsMsg.FromID, "to", natsMsg.ToID)
-
-			from := UIUser{
-				ID:   natsMsg.FromID,
-				Name: natsMsg.FromName,
-			}
-
-			if err := uiSendMessage(from, to, natsMsg.FromNonce, natsMsg.Encrypted, natsMsg.Msg); err != nil {
-				b.log.Info(ctx, "natsreadmessage: send", "ERROR", err)
-			}
-
-			return
-		}
-
-		if !errors.Is(err, ErrNotExists) {
-			b.log.Info(ctx, "natsreadmessage: retrieve", "ERROR", err)
-		}
-
-		// We don't have a web socket connection for the user then drop the
-		// message on the floor because we can't deliver it.
-
-		b.log.Info(ctx, "natsreadmessage: retrieve", "status", "user not found")
+		b.natsProcess(ctx, msg.Data())
 	}
 
 	return f
 }
 
-func (b *Business) natsSendMessage(ctx context.Context, from UIUser, inMsg uiIncomingMessage) error {
+// natsProcess handles a message another CAP routed to us over NATS. Only
+// messages users sent are routed this way, so the envelope is checked the
+// same way as when a user sends it.
+func (b *Business) natsProcess(ctx context.Context, data []byte) {
+	var natsMsg natsInOutMessage
+	if err := json.Unmarshal(data, &natsMsg); err != nil {
+		b.log.Info(ctx, "natsreadmessage: unmarshal", "ERROR", err)
+		return
+	}
+
+	if natsMsg.CapID == b.capID {
+		return
+	}
+
+	if err := natsMsg.validate(); err != nil {
+		b.log.Info(ctx, "natsreadmessage: validate", "ERROR", err, "from", natsMsg.FromID)
+		return
+	}
+
+	b.log.Info(ctx, "natsreadmessage: msg recv", "fromNonce", natsMsg.FromNonce, "from", natsMsg.FromID, "to", natsMsg.ToID, "encrypted", natsMsg.Encrypted, "message", natsMsg.Msg, "fromName", natsMsg.FromName)
+
+	id, err := signature.FromAddress(natsMsg.signedData(), natsMsg.V, natsMsg.R, natsMsg.S)
+	if err != nil {
+		b.log.Info(ctx, "natsreadmessage: fromAddress", "ERROR", err)
+		return
+	}
+
+	if id != natsMsg.FromID.Hex() {
+		b.log.Info(ctx, "natsreadmessage: signature check", "status", "signature does not match")
+		return
+	}
+
+	if err := groupRecipientCheck(ctx, b.groupMgr, natsMsg.uiIncomingMessage); err != nil {
+		b.log.Info(ctx, "natsreadmessage: group check", "ERROR", err, "groupID", natsMsg.GroupID, "to", natsMsg.ToID)
+		return
+	}
+
+	from := UIUser{
+		ID:   natsMsg.FromID,
+		Name: natsMsg.FromName,
+	}
+
+	// If the user is found, send the message directly to the user.
+	err = b.uiDeliverer.Deliver(ctx, from, natsMsg.ToID, natsMsg.uiIncomingMessage)
+	switch {
+	case err == nil:
+		b.log.Info(ctx, "natsreadmessage: msg sent over web socket", "from", natsMsg.FromID, "to", natsMsg.ToID)
+		return
+
+	case !errors.Is(err, ErrNotExists):
+		b.log.Info(ctx, "natsreadmessage: send", "ERROR", err)
+		return
+	}
+
+	// The presence directory said we hold a session for the user, but the
+	// user is gone.
+	// Hold the message until the user connects again.
+
+	b.log.Info(ctx, "natsreadmessage: retrieve", "status", "user not found, queuing message")
+
+	if err := inboxPushMessage(ctx, b.inboxMgr, natsMsg); err != nil {
+		b.log.Info(ctx, "natsreadmessage: inbox-push", "ERROR", err)
+	}
+}
+
+func (b *Business) natsSendMessage(ctx context.Context, capID uuid.UUID, from UIUser, inMsg uiIncomingMessage) error {
 	natsMsg := natsInOutMessage{
 		CapID:             b.capID,
 		FromID:            from.ID,
@@ -95,10 +102,14 @@ func (b *Business) natsSendMessage(ctx context.Context, from UIUser, inMsg uiInc
 		return fmt.Errorf("send nats marshal message: %w", err)
 	}
 
-	_, err = b.js.Publish(ctx, b.natsSubject, d)
+	_, err = b.js.Publish(ctx, natsCAPSubject(b.natsSubject, capID.String()), d)
 	if err != nil {
 		return fmt.Errorf("send nats publish: %w", err)
 	}
 
 	return nil
 }
+
+func natsCAPSubject(subject string, capID string) string {
+	return fmt.Sprintf("%s.cap.%s.inbox", subject, capID)
+}
@@ -0,0 +1,190 @@
+package chatbus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"testing"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/managerstest"
+	"github.com/PeterLee0620/GoIM/foundation/signature"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+// TestNATSValidate provides a test that the messages another CAP routes over
+// NATS are checked before they are processed.
+func TestNATSValidate(t *testing.T) {
+	t.Log("Given the need to reject messages with a bad envelope routed over NATS.")
+	{
+		key := newTestKey(t)
+		toID := common.HexToAddress("0x00000000000000000000000000000000000000b1")
+
+		for _, tt := range relayValidateTests(false) {
+			users := newTestDeliveries()
+			inbox := testInbox{}
+
+			b := Business{
+				log:         managerstest.Logger(),
+				capID:       uuid.New(),
+				uiDeliverer: NewUIDeliverer(managerstest.Logger(), users, nil),
+				inboxMgr:    &inbox,
+				groupMgr:    newTestGroups(),
+			}
+
+			b.natsProcess(context.Background(), relayMessage(t, key, toID, tt.change))
+
+			if got := len(inbox.queued()); got != tt.queued {
+				t.Errorf("\tShould %s. %s queued[%d]", tt.name, "X", got)
+				continue
+			}
+			t.Logf("\tShould %s. %s", tt.name, "OK")
+		}
+	}
+}
+
+// TestNATSReplyTo provides a test that the message a reply points to is
+// covered by the signature of the sender.
+func TestNATSReplyTo(t *testing.T) {
+	t.Log("Given the need to keep a reply pointed at the message it answers.")
+	{
+		key := newTestKey(t)
+		toID := common.HexToAddress("0x00000000000000000000000000000000000000b1")
+		parentID := uuid.New()
+
+		tests := []struct {
+			name   string
+			tamper func(m *natsInOutMessage)
+			queued int
+		}{
+			{
+				name:   "process a reply as it was signed",
+				tamper: func(m *natsInOutMessage) {},
+				queued: 1,
+			},
+			{
+				name:   "reject a reply pointed at another message",
+				tamper: func(m *natsInOutMessage) { m.ReplyTo = uuid.New() },
+			},
+			{
+				name:   "reject a reply with the reference removed",
+				tamper: func(m *natsInOutMessage) { m.ReplyTo = uuid.Nil },
+			},
+		}
+
+		for _, tt := range tests {
+			data := relayMessage(t, key, toID, func(m *natsInOutMessage) { m.ReplyTo = parentID })
+
+			var natsMsg natsInOutMessage
+			if err := json.Unmarshal(data, &natsMsg); err != nil {
+				t.Fatal("\tShould be able to unmarshal the message.", "X", err)
+			}
+
+			tt.tamper(&natsMsg)
+
+			data, err := json.Marshal(natsMsg)
+			if err != nil {
+				t.Fatal("\tShould be able to marshal the message.", "X", err)
+			}
+
+			inbox := testInbox{}
+
+			b := Business{
+				log:         managerstest.Logger(),
+				capID:       uuid.New(),
+				uiDeliverer: NewUIDeliverer(managerstest.Logger(), newTestDeliveries(), nil),
+				inboxMgr:    &inbox,
+				groupMgr:    newTestGroups(),
+			}
+
+			b.natsProcess(context.Background(), data)
+
+			if got := len(inbox.queued()); got != tt.queued {
+				t.Errorf("\tShould %s. %s queued[%d]", tt.name, "X", got)
+				continue
+			}
+			t.Logf("\tShould %s. %s", tt.name, "OK")
+		}
+	}
+}
+
+// =============================================================================
+
+type relayValidateTest struct {
+	name   string
+	change func(m *natsInOutMessage)
+	queued int
+}
+
+// relayValidateTests returns the envelopes a CAP must check when they are
+// relayed by another CAP. Only a peer link can relay events.
+func relayValidateTests(events bool) []relayValidateTest {
+	tests := []relayValidateTest{
+		{
+			name:   "process a valid message",
+			change: func(m *natsInOutMessage) {},
+			queued: 1,
+		},
+		{
+			name:   "reject an unknown protocol version",
+			change: func(m *natsInOutMessage) { m.Version = ProtocolVersion + 1 },
+		},
+		{
+			name:   "reject a missing protocol version",
+			change: func(m *natsInOutMessage) { m.Version = 0 },
+		},
+		{
+			name:   "reject an unknown message type",
+			change: func(m *natsInOutMessage) { m.Type = "unknown" },
+		},
+		{
+			name:   "reject an empty message",
+			change: func(m *natsInOutMessage) { m.Msg = nil },
+		},
+	}
+
+	if !events {
+		tests = append(tests, relayValidateTest{
+			name:   "reject an event",
+			change: func(m *natsInOutMessage) { m.Type = msgTypeEvent },
+		})
+	}
+
+	return tests
+}
+
+// relayMessage returns a chat message to the user changed by the test and
+// then signed by the key, like another CAP relays it.
+func relayMessage(t *testing.T, key *ecdsa.PrivateKey, toID common.Address, change func(m *natsInOutMessage)) []byte {
+	natsMsg := natsInOutMessage{
+		CapID:    uuid.New(),
+		FromID:   crypto.PubkeyToAddress(key.PublicKey),
+		FromName: "sender",
+		uiIncomingMessage: uiIncomingMessage{
+			envelope: envelope{
+				Version: ProtocolVersion,
+				Type:    msgTypeChat,
+				ID:      uuid.New(),
+			},
+			ToID:      toID,
+			Msg:       [][]byte{[]byte("hello")},
+			FromNonce: 1,
+		},
+	}
+
+	change(&natsMsg)
+
+	var err error
+	natsMsg.V, natsMsg.R, natsMsg.S, err = signature.Sign(natsMsg.signedData(), key)
+	if err != nil {
+		t.Fatal("\tShould be able to sign the message.", "X", err)
+	}
+
+	data, err := json.Marshal(natsMsg)
+	if err != nil {
+		t.Fatal("\tShould be able to marshal the message.", "X", err)
+	}
+
+	return data
+}
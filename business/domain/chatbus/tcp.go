@@ -1,11 +1,10 @@
 package chatbus
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"time"
 
 	"github.com/PeterLee0620/GoIM/foundation/logger"
 	"github.com/PeterLee0620/GoIM/foundation/signature"
@@ -13,15 +12,40 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 )
 
+// tcpMaxFrameSize is the largest frame accepted on the peer links. Messages
+// are newline delimited JSON, which never contains a raw newline.
+const tcpMaxFrameSize = 1 << 20
+
+// Heartbeat frames sent over the peer links. A peer that has gone quiet is
+// sent a ping and answers with a pong. Neither is valid JSON so they can't be
+// mistaken for a message.
+var (
+	tcpPing = []byte("PING")
+	tcpPong = []byte("PONG")
+)
+
+// =============================================================================
+
 // ClientHandlers implements the Handlers interface for the TCP client manager.
+// When TLS is required, peers that didn't connect over TLS are refused.
 type ClientHandlers struct {
-	log *logger.Logger
+	log         *logger.Logger
+	uiDeliverer *UIDeliverer
+	inboxMgr    InboxManager
+	groupMgr    GroupManager
+	auth        *TCPAuth
+	requireTLS  bool
 }
 
 // NewClientHandlers creates a new instance of ClientHandlers.
-func NewClientHandlers(log *logger.Logger) *ClientHandlers {
+func NewClientHandlers(log *logger.Logger, uiDeliverer *UIDeliverer, inboxMgr InboxManager, groupMgr GroupManager, auth *TCPAuth, requireTLS bool) *ClientHandlers {
 	return &ClientHandlers{
-		log: log,
+		log:         log,
+		uiDeliverer: uiDeliverer,
+		inboxMgr:    inboxMgr,
+		groupMgr:    groupMgr,
+		auth:        auth,
+		requireTLS:  requireTLS,
 	}
 }
 
@@ -29,26 +53,54 @@ func NewClientHandlers(log *logger.Logger) *ClientHandlers {
 func (ch ClientHandlers) Bind(clt *tcp.Client) error {
 	ch.log.Info(clt.Context(), "client-bind", "userID", clt.Key())
 
-	clt.Reader = bufio.NewReader(clt.Conn)
+	if err := checkTLS(clt, ch.requireTLS); err != nil {
+		ch.log.Info(clt.Context(), "client-bind: tls", "ERROR", err)
+		return err
+	}
+
+	clt.Framer = tcp.NewLineFramer(clt.Conn, tcpMaxFrameSize)
+
+	// -------------------------------------------------------------------------
+	// PERFORM HANDSHAKE TO PROVE WHO WE ARE AND WHO WE SPEAK FOR
+
+	usr, ok := tcpUser(clt.Context())
+	if !ok {
+		return fmt.Errorf("%w: no user to speak for", ErrPeerHandshake)
+	}
+
+	peerID, err := ch.auth.dial(clt, usr.id, usr.grant)
+	if err != nil {
+		ch.log.Info(clt.Context(), "client-bind: handshake", "ERROR", err)
+		return err
+	}
+
+	clt.SetIdentity(peerID.Hex())
+
+	ch.log.Info(clt.Context(), "client-bind: handshake", "peerID", peerID, "userID", usr.id)
 
 	return nil
 }
 
 // Read reads data from the client connection.
 func (ch ClientHandlers) Read(clt *tcp.Client) ([]byte, int, error) {
-	bufReader := clt.Reader.(*bufio.Reader)
-
-	clt.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	line, err := bufReader.ReadString('\n')
+	frame, err := clt.Framer.ReadFrame()
 	if err != nil {
 		return nil, 0, err
 	}
 
-	return []byte(line), len(line), nil
+	return frame, len(frame), nil
 }
 
-// Process processes the request from the client.
+// Process processes the request from the server. Messages are routed over
+// the link in both directions, so the server can send messages for our users
+// as well as events.
 func (ch ClientHandlers) Process(r *tcp.Request, clt *tcp.Client) {
+	tcpProcess(ch.log, ch.uiDeliverer, ch.inboxMgr, ch.groupMgr, r, clt)
+}
+
+// Heartbeat sends a ping to a server that has gone quiet.
+func (ch ClientHandlers) Heartbeat(clt *tcp.Client) error {
+	return clt.Send(tcpPing)
 }
 
 // Drop is called when a connection is dropped.
@@ -59,16 +111,27 @@ func (ch ClientHandlers) Drop(clt *tcp.Client) {
 // =============================================================================
 
 // ServerHandlers implements the Handlers interface for the TCP server.
+// When TLS is required, peers that didn't connect over TLS are refused.
 type ServerHandlers struct {
-	log      *logger.Logger
-	uiCltMgr UIClientManager
+	log         *logger.Logger
+	uiCltMgr    UIClientManager
+	uiDeliverer *UIDeliverer
+	inboxMgr    InboxManager
+	groupMgr    GroupManager
+	auth        *TCPAuth
+	requireTLS  bool
 }
 
 // NewServerHandlers creates a new instance of ServerHandlers.
-func NewServerHandlers(log *logger.Logger, uiCltMgr UIClientManager) *ServerHandlers {
+func NewServerHandlers(log *logger.Logger, uiCltMgr UIClientManager, uiDeliverer *UIDeliverer, inboxMgr InboxManager, groupMgr GroupManager, auth *TCPAuth, requireTLS bool) *ServerHandlers {
 	return &ServerHandlers{
-		log:      log,
-		uiCltMgr: uiCltMgr,
+		log:         log,
+		uiCltMgr:    uiCltMgr,
+		uiDeliverer: uiDeliverer,
+		inboxMgr:    inboxMgr,
+		groupMgr:    groupMgr,
+		auth:        auth,
+		requireTLS:  requireTLS,
 	}
 }
 
@@ -76,48 +139,42 @@ func NewServerHandlers(log *logger.Logger, uiCltMgr UIClientManager) *ServerHand
 func (sh ServerHandlers) Bind(clt *tcp.Client) error {
 	sh.log.Info(clt.Context(), "server-bind", "key", clt.Key())
 
-	bufReader := bufio.NewReader(clt.Conn)
+	if err := checkTLS(clt, sh.requireTLS); err != nil {
+		sh.log.Info(clt.Context(), "server-bind: tls", "ERROR", err)
+		return err
+	}
 
-	clt.Reader = bufReader
+	clt.Framer = tcp.NewLineFramer(clt.Conn, tcpMaxFrameSize)
 
 	// -------------------------------------------------------------------------
-	// PERFORM HANDSHAKE TO RECEIVE USER ID
-
-	clt.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// PERFORM HANDSHAKE TO VERIFY THE PEER AND RECEIVE USER ID
 
-	line, err := bufReader.ReadString('\n')
+	peerID, userID, err := sh.auth.accept(clt)
 	if err != nil {
-		sh.log.Info(clt.Context(), "server-bind: handshake-wait", "ERROR", err)
+		sh.log.Info(clt.Context(), "server-bind: handshake", "ERROR", err)
 		return err
 	}
 
-	sh.log.Info(clt.Context(), "server-bind: handshake", "json", line)
+	sh.log.Info(clt.Context(), "server-bind: handshake", "peerID", peerID, "userID", userID)
 
-	var handshake struct {
-		UserID string `json:"user_id"`
-	}
-
-	if err := json.Unmarshal([]byte(line), &handshake); err != nil {
-		sh.log.Info(clt.Context(), "server-bind: handshake-unmarshal", "ERROR", err)
-		return err
-	}
-
-	clt.SetUserID(handshake.UserID)
+	clt.SetIdentity(peerID.Hex())
+	clt.SetUserID(userID.Hex())
 
 	// -------------------------------------------------------------------------
 
-	msg := [][]byte{[]byte("EVENT"), []byte("TCP-CONN")}
-
 	from := UIUser{
 		ID: common.HexToAddress(clt.UserID()),
 	}
 
-	for _, conn := range sh.uiCltMgr.Connections() {
+	for sessionID, conn := range sh.uiCltMgr.Connections() {
 		to := UIUser{
-			UIConn: conn.Conn,
+			ID:        conn.ID,
+			SessionID: sessionID,
+			UIConn:    conn.Conn,
+			UIWriter:  conn.Writer,
 		}
 
-		if err := uiSendMessage(from, to, 0, false, msg); err != nil {
+		if err := uiSendEvent(from, to, eventTCPConn); err != nil {
 			sh.log.Info(clt.Context(), "uilisten: send", "ERROR", err)
 		}
 	}
@@ -127,121 +184,219 @@ func (sh ServerHandlers) Bind(clt *tcp.Client) error {
 
 // Read reads data from the client connection.
 func (sh ServerHandlers) Read(clt *tcp.Client) ([]byte, int, error) {
-	bufReader := clt.Reader.(*bufio.Reader)
-
-	clt.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-
-	line, err := bufReader.ReadString('\n')
+	frame, err := clt.Framer.ReadFrame()
 	if err != nil {
 		return nil, 0, err
 	}
 
-	return []byte(line), len(line), nil
+	return frame, len(frame), nil
 }
 
 // Process processes the request from the client.
 func (sh ServerHandlers) Process(r *tcp.Request, clt *tcp.Client) {
-	ctx := r.Context
+	tcpProcess(sh.log, sh.uiDeliverer, sh.inboxMgr, sh.groupMgr, r, clt)
+}
 
-	var natsMsg natsInOutMessage
-	if err := json.Unmarshal(r.Data, &natsMsg); err != nil {
-		sh.log.Info(ctx, "server-process: unmarshal", "ERROR", err)
-		return
+// Heartbeat sends a ping to a client that has gone quiet.
+func (sh ServerHandlers) Heartbeat(clt *tcp.Client) error {
+	return clt.Send(tcpPing)
+}
+
+// Drop is called when a connection is dropped.
+func (sh ServerHandlers) Drop(clt *tcp.Client) {
+	sh.log.Info(clt.Context(), "server-drop", "userID", clt.UserID())
+
+	from := UIUser{
+		ID: common.HexToAddress(clt.UserID()),
 	}
 
-	sh.log.Info(ctx, "server-process: msg recv", "fromNonce", natsMsg.FromNonce, "from", natsMsg.FromID, "to", natsMsg.ToID, "encrypted", natsMsg.Encrypted, "message", natsMsg.Msg, "fromName", natsMsg.FromName)
+	for sessionID, conn := range sh.uiCltMgr.Connections() {
+		to := UIUser{
+			ID:        conn.ID,
+			SessionID: sessionID,
+			UIConn:    conn.Conn,
+			UIWriter:  conn.Writer,
+		}
 
-	dataThatWasSign := struct {
-		ToID      common.Address
-		Msg       [][]byte
-		FromNonce uint64
-	}{
-		ToID:      natsMsg.ToID,
-		Msg:       natsMsg.Msg,
-		FromNonce: natsMsg.FromNonce,
+		if err := uiSendEvent(from, to, eventTCPDrop); err != nil {
+			sh.log.Info(clt.Context(), "uilisten: send", "ERROR", err)
+		}
+	}
+}
+
+// =============================================================================
+
+// checkTLS refuses a peer that didn't connect over TLS when TLS is required.
+func checkTLS(clt *tcp.Client, requireTLS bool) error {
+	if !requireTLS {
+		return nil
+	}
+
+	if _, ok := clt.TLS(); !ok {
+		return fmt.Errorf("%w: %s", ErrPeerNotSecure, clt.Conn.RemoteAddr())
+	}
+
+	return nil
+}
+
+// tcpSendMessage sends the message to the user over a peer link, whether we
+// dialed the link or accepted it. It returns ErrNotExists when there is no
+// link for the user.
+func (b *Business) tcpSendMessage(from UIUser, inMsg uiIncomingMessage) error {
+	natsMsg := natsInOutMessage{
+		CapID:             b.capID,
+		FromID:            from.ID,
+		FromName:          from.Name,
+		uiIncomingMessage: inMsg,
 	}
 
-	id, err := signature.FromAddress(dataThatWasSign, natsMsg.V, natsMsg.R, natsMsg.S)
+	d, err := json.Marshal(natsMsg)
 	if err != nil {
-		sh.log.Info(ctx, "server-process: fromAddress", "ERROR", err)
+		return fmt.Errorf("send tcp marshal message: %w", err)
+	}
+
+	userID := inMsg.ToID.String()
+
+	err = b.tcpCltMgr.SendTo(userID, d)
+	if errors.Is(err, tcp.ErrUserNotConnected) {
+		err = b.tcpServer.SendTo(userID, d)
+	}
+
+	switch {
+	case errors.Is(err, tcp.ErrUserNotConnected):
+		return ErrNotExists
+
+	case err != nil:
+		return fmt.Errorf("send tcp publish: %w", err)
+	}
+
+	return nil
+}
+
+// tcpProcess handles a request from either side of a peer link. The envelope
+// is checked the same way as when a user sends it. Events aren't
+// signed so they are only forwarded to the web socket user when they are from
+// the user the link is bound to. Messages must be signed by the sender and are
+// delivered to the user or held in the inbox, letting the sender know.
+func tcpProcess(log *logger.Logger, uiDeliverer *UIDeliverer, inboxMgr InboxManager, groupMgr GroupManager, r *tcp.Request, clt *tcp.Client) {
+	ctx := r.Context
+
+	if tcpHeartbeat(r, clt) {
 		return
 	}
 
-	if id != natsMsg.FromID.Hex() {
-		sh.log.Info(r.Context, "server-process: signature check", "status", "signature does not match")
+	var natsMsg natsInOutMessage
+	if err := json.Unmarshal(r.Data, &natsMsg); err != nil {
+		log.Info(ctx, "tcp-process: unmarshal", "ERROR", err)
 		return
 	}
 
-	// If the user is found, send the message directly to the user.
-	to, err := sh.uiCltMgr.Retrieve(ctx, natsMsg.ToID)
-	if err == nil {
-		sh.log.Info(ctx, "server-process: msg sent over web socket", "from", natsMsg.FromID, "to", natsMsg.ToID)
+	validate := natsMsg.validate
+	if natsMsg.Type == msgTypeEvent {
+		validate = natsMsg.validateEvent
+	}
+
+	if err := validate(); err != nil {
+		log.Info(ctx, "tcp-process: validate", "ERROR", err, "from", natsMsg.FromID)
+		return
+	}
+
+	from := UIUser{
+		ID:   natsMsg.FromID,
+		Name: natsMsg.FromName,
+	}
 
-		from := UIUser{
-			ID:   natsMsg.FromID,
-			Name: natsMsg.FromName,
+	if natsMsg.Type == msgTypeEvent {
+		if natsMsg.FromID != common.HexToAddress(clt.UserID()) {
+			log.Info(ctx, "tcp-process: event check", "status", "event not from the link user", "from", natsMsg.FromID, "userID", clt.UserID())
+			return
 		}
 
-		if err := uiSendMessage(from, to, natsMsg.FromNonce, natsMsg.Encrypted, natsMsg.Msg); err != nil {
-			sh.log.Info(ctx, "server-process: send", "ERROR", err)
+		if err := uiDeliverer.Deliver(ctx, from, natsMsg.ToID, natsMsg.uiIncomingMessage); err != nil {
+			log.Info(ctx, "tcp-process: send event", "ERROR", err, "to", natsMsg.ToID)
 		}
+		return
+	}
+
+	log.Info(ctx, "tcp-process: msg recv", "fromNonce", natsMsg.FromNonce, "from", natsMsg.FromID, "to", natsMsg.ToID, "encrypted", natsMsg.Encrypted, "message", natsMsg.Msg, "fromName", natsMsg.FromName)
+
+	id, err := signature.FromAddress(natsMsg.signedData(), natsMsg.V, natsMsg.R, natsMsg.S)
+	if err != nil {
+		log.Info(ctx, "tcp-process: fromAddress", "ERROR", err)
+		return
+	}
 
+	if id != natsMsg.FromID.Hex() {
+		log.Info(ctx, "tcp-process: signature check", "status", "signature does not match")
 		return
 	}
 
-	if !errors.Is(err, ErrNotExists) {
-		sh.log.Info(ctx, "server-process: retrieve", "ERROR", err)
+	if err := groupRecipientCheck(ctx, groupMgr, natsMsg.uiIncomingMessage); err != nil {
+		log.Info(ctx, "tcp-process: group check", "ERROR", err, "groupID", natsMsg.GroupID, "to", natsMsg.ToID)
+		return
 	}
 
-	// We don't have a web socket connection for the user then drop the
-	// message on the floor because we can't deliver it.
+	// If the user is found, send the message directly to the user.
+	err = uiDeliverer.Deliver(ctx, from, natsMsg.ToID, natsMsg.uiIncomingMessage)
+	switch {
+	case err == nil:
+		log.Info(ctx, "tcp-process: msg sent over web socket", "from", natsMsg.FromID, "to", natsMsg.ToID)
+		return
 
-	sh.log.Info(ctx, "server-process: retrieve", "status", "user not found")
-}
+	case !errors.Is(err, ErrNotExists):
+		log.Info(ctx, "tcp-process: send", "ERROR", err)
+		return
+	}
 
-// Drop is called when a connection is dropped.
-func (sh ServerHandlers) Drop(clt *tcp.Client) {
-	sh.log.Info(clt.Context(), "server-drop", "userID", clt.UserID())
+	// We don't have a web socket connection for the user then hold the
+	// message until the user connects again and let the sender know.
 
-	msg := [][]byte{[]byte("EVENT"), []byte("TCP-DROP")}
+	log.Info(ctx, "tcp-process: retrieve", "status", "user not found, queuing message")
 
-	from := UIUser{
-		ID: common.HexToAddress(clt.UserID()),
+	if err := inboxPushMessage(ctx, inboxMgr, natsMsg); err != nil {
+		log.Info(ctx, "tcp-process: inbox-push", "ERROR", err)
+		return
 	}
 
-	for _, conn := range sh.uiCltMgr.Connections() {
-		to := UIUser{
-			UIConn: conn.Conn,
-		}
-
-		if err := uiSendMessage(from, to, 0, false, msg); err != nil {
-			sh.log.Info(clt.Context(), "uilisten: send", "ERROR", err)
-		}
+	if natsMsg.Type == msgTypeReceipt {
+		return
 	}
-}
 
-// =============================================================================
+	evt := natsInOutMessage{
+		FromID:            natsMsg.ToID,
+		uiIncomingMessage: newEventMessage(natsMsg.FromID, eventQueued),
+	}
 
-func (b *Business) tcpSendMessage(clt *tcp.Client, from UIUser, inMsg uiIncomingMessage) error {
-	natsMsg := natsInOutMessage{
-		CapID:             b.capID,
-		FromID:            from.ID,
-		FromName:          from.Name,
-		uiIncomingMessage: inMsg,
+	if err := tcpWriteMessage(clt, evt); err != nil {
+		log.Info(ctx, "tcp-process: tcp-send", "ERROR", err)
 	}
+}
 
+func tcpWriteMessage(clt *tcp.Client, natsMsg natsInOutMessage) error {
 	d, err := json.Marshal(natsMsg)
 	if err != nil {
-		return fmt.Errorf("send nats marshal message: %w", err)
+		return fmt.Errorf("send tcp marshal message: %w", err)
 	}
 
-	if _, err := clt.Writer.Write(d); err != nil {
+	if err := clt.Send(d); err != nil {
 		return fmt.Errorf("send tcp publish: %w", err)
 	}
 
-	if _, err := clt.Writer.Write([]byte{'\n'}); err != nil {
-		return fmt.Errorf("send tcp publish EOL: %w", err)
+	return nil
+}
+
+// tcpHeartbeat answers a ping from the peer. It reports if the request was a
+// heartbeat so it isn't processed as a message. Reading it was enough to
+// show the peer is alive.
+func tcpHeartbeat(r *tcp.Request, clt *tcp.Client) bool {
+	switch {
+	case bytes.Equal(r.Data, tcpPing):
+		clt.Send(tcpPong)
+		return true
+
+	case bytes.Equal(r.Data, tcpPong):
+		return true
 	}
 
-	return nil
+	return false
 }
@@ -0,0 +1,109 @@
+package chatbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/managerstest"
+	"github.com/PeterLee0620/GoIM/foundation/tcp"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TestTCPValidate provides a test that the messages and events a peer sends
+// over a TCP link are checked before they are processed.
+func TestTCPValidate(t *testing.T) {
+	t.Log("Given the need to reject messages with a bad envelope sent over a TCP link.")
+	{
+		key := newTestKey(t)
+		linkID := crypto.PubkeyToAddress(key.PublicKey)
+		toID := common.HexToAddress("0x00000000000000000000000000000000000000b1")
+
+		t.Log("\tWhen the peer relays a message.")
+		{
+			for _, tt := range relayValidateTests(true) {
+				users := newTestDeliveries()
+				inbox := testInbox{}
+
+				tcpProcess(managerstest.Logger(), NewUIDeliverer(managerstest.Logger(), users, nil), &inbox, newTestGroups(), tcpRequest(relayMessage(t, key, toID, tt.change)), tcpLinkClient(linkID))
+
+				if got := len(inbox.queued()); got != tt.queued {
+					t.Errorf("\t\tShould %s. %s queued[%d]", tt.name, "X", got)
+					continue
+				}
+				t.Logf("\t\tShould %s. %s", tt.name, "OK")
+			}
+		}
+
+		t.Log("\tWhen the peer sends an event.")
+		{
+			tests := []struct {
+				name      string
+				change    func(m *natsInOutMessage)
+				delivered int
+			}{
+				{
+					name:      "deliver a valid event",
+					change:    func(m *natsInOutMessage) {},
+					delivered: 1,
+				},
+				{
+					name:   "reject an unknown protocol version",
+					change: func(m *natsInOutMessage) { m.Version = ProtocolVersion + 1 },
+				},
+				{
+					name:   "reject an empty event",
+					change: func(m *natsInOutMessage) { m.Msg = nil },
+				},
+			}
+
+			for _, tt := range tests {
+				users := newTestDeliveries()
+
+				evt := natsInOutMessage{
+					FromID:            linkID,
+					uiIncomingMessage: newEventMessage(toID, eventQueued),
+				}
+				tt.change(&evt)
+
+				data, err := json.Marshal(evt)
+				if err != nil {
+					t.Fatal("\t\tShould be able to marshal the event.", "X", err)
+				}
+
+				tcpProcess(managerstest.Logger(), NewUIDeliverer(managerstest.Logger(), users, nil), &testInbox{}, newTestGroups(), tcpRequest(data), tcpLinkClient(linkID))
+
+				if got := len(users.tried()); got != tt.delivered {
+					t.Errorf("\t\tShould %s. %s delivered[%d]", tt.name, "X", got)
+					continue
+				}
+				t.Logf("\t\tShould %s. %s", tt.name, "OK")
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+func tcpRequest(data []byte) *tcp.Request {
+	return &tcp.Request{
+		Context: context.Background(),
+		Data:    data,
+		Length:  len(data),
+	}
+}
+
+// tcpLinkClient returns a client for a link speaking for the user. What is
+// sent back to the peer is discarded.
+func tcpLinkClient(userID common.Address) *tcp.Client {
+	var buf bytes.Buffer
+
+	clt := tcp.Client{
+		Framer: tcp.NewLineFramer(&buf, tcpMaxFrameSize),
+	}
+	clt.SetUserID(userID.Hex())
+
+	return &clt
+}
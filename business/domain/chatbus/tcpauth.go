@@ -0,0 +1,371 @@
+package chatbus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/foundation/signature"
+	"github.com/PeterLee0620/GoIM/foundation/tcp"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Set of errors for the peer handshake.
+var (
+	ErrPeerNotTrusted   = errors.New("peer not trusted")
+	ErrPeerHandshake    = errors.New("peer handshake failed")
+	ErrPeerMissingProof = errors.New("peer handshake missing proof")
+	ErrPeerGrant        = errors.New("peer user grant not valid")
+)
+
+// tcpHandshakeTimeout is how long a peer has to complete each step of the
+// handshake.
+const tcpHandshakeTimeout = 5 * time.Second
+
+// TCPGrantMaxAge is the longest a user can let their CAP speak for them on
+// the TCP links with a single grant.
+const TCPGrantMaxAge = time.Hour
+
+// TCPAuth proves the identity of the CAP to the peers on the TCP links and
+// verifies theirs. Each side signs a fresh nonce from the other side with its
+// identity key. Only the trusted peers are accepted, a CAP without any
+// refuses every link.
+type TCPAuth struct {
+	key   *ecdsa.PrivateKey
+	id    common.Address
+	peers []common.Address
+}
+
+// NewTCPAuth creates a new TCPAuth for the identity key and trusted peers.
+func NewTCPAuth(key *ecdsa.PrivateKey, peers []common.Address) *TCPAuth {
+	return &TCPAuth{
+		key:   key,
+		id:    crypto.PubkeyToAddress(key.PublicKey),
+		peers: peers,
+	}
+}
+
+// ID returns the identity of the CAP on the TCP links.
+func (a *TCPAuth) ID() common.Address {
+	return a.id
+}
+
+// =============================================================================
+
+// TCPGrant is signed by a user to let their CAP speak for them on the TCP
+// links until it expires.
+type TCPGrant struct {
+	Expires int64    `json:"expires"`
+	V       *big.Int `json:"v"`
+	R       *big.Int `json:"r"`
+	S       *big.Int `json:"s"`
+}
+
+// signedData returns the data the user signed for the grant.
+func (g TCPGrant) signedData(userID common.Address) any {
+	dataThatWasSign := struct {
+		UserID  common.Address
+		Expires int64
+	}{
+		UserID:  userID,
+		Expires: g.Expires,
+	}
+
+	return dataThatWasSign
+}
+
+// verify checks the grant was signed by the user and hasn't expired.
+func (g TCPGrant) verify(userID common.Address, now time.Time) error {
+	if g.V == nil || g.R == nil || g.S == nil {
+		return fmt.Errorf("%w: missing signature", ErrPeerGrant)
+	}
+
+	expires := time.Unix(g.Expires, 0)
+
+	switch {
+	case now.After(expires):
+		return fmt.Errorf("%w: expired at %s", ErrPeerGrant, expires)
+
+	case expires.Sub(now) > TCPGrantMaxAge:
+		return fmt.Errorf("%w: expires after %s", ErrPeerGrant, TCPGrantMaxAge)
+	}
+
+	if err := signature.VerifySignature(g.V, g.R, g.S); err != nil {
+		return fmt.Errorf("%w: %w", ErrPeerGrant, err)
+	}
+
+	id, err := signature.FromAddress(g.signedData(userID), g.V, g.R, g.S)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPeerGrant, err)
+	}
+
+	if id != userID.Hex() {
+		return fmt.Errorf("%w: signature does not match: got: %s exp: %s", ErrPeerGrant, id, userID)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// tcpHello is sent by each side to start the handshake. The dialer says which
+// user it speaks for along with the user's grant. The server's hello also
+// proves its identity by signing the dialer's nonce.
+type tcpHello struct {
+	PeerID common.Address `json:"peerID"`
+	UserID common.Address `json:"userID,omitzero"`
+	Grant  *TCPGrant      `json:"grant,omitempty"`
+	Nonce  string         `json:"nonce"`
+	V      *big.Int       `json:"v,omitempty"`
+	R      *big.Int       `json:"r,omitempty"`
+	S      *big.Int       `json:"s,omitempty"`
+}
+
+// tcpProof is what each side signs to prove its identity. The proof is bound
+// to both sides of the link and the user so it can't be replayed elsewhere.
+type tcpProof struct {
+	Nonce  string
+	FromID common.Address
+	ToID   common.Address
+	UserID common.Address
+}
+
+type tcpCtxKey int
+
+const tcpUserKey tcpCtxKey = 1
+
+// tcpLinkUser is the user the dialer speaks for and the grant to do so.
+type tcpLinkUser struct {
+	id    common.Address
+	grant TCPGrant
+}
+
+// withTCPUser sets the user the dialer speaks for in the context passed to
+// the client manager.
+func withTCPUser(ctx context.Context, userID common.Address, grant TCPGrant) context.Context {
+	return context.WithValue(ctx, tcpUserKey, tcpLinkUser{id: userID, grant: grant})
+}
+
+func tcpUser(ctx context.Context) (tcpLinkUser, bool) {
+	v, ok := ctx.Value(tcpUserKey).(tcpLinkUser)
+	return v, ok
+}
+
+// =============================================================================
+
+// dial performs the dialer's side of the handshake and returns the identity
+// of the server.
+func (a *TCPAuth) dial(clt *tcp.Client, userID common.Address, grant TCPGrant) (common.Address, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	hello := tcpHello{
+		PeerID: a.id,
+		UserID: userID,
+		Grant:  &grant,
+		Nonce:  nonce,
+	}
+
+	if err := tcpWriteHandshake(clt, hello); err != nil {
+		return common.Address{}, err
+	}
+
+	var srvHello tcpHello
+	if err := tcpReadHandshake(clt, &srvHello); err != nil {
+		return common.Address{}, err
+	}
+
+	proof := tcpProof{
+		Nonce:  nonce,
+		FromID: srvHello.PeerID,
+		ToID:   a.id,
+		UserID: userID,
+	}
+
+	if err := a.verify(proof, srvHello.V, srvHello.R, srvHello.S); err != nil {
+		return common.Address{}, err
+	}
+
+	// -------------------------------------------------------------------------
+
+	proof = tcpProof{
+		Nonce:  srvHello.Nonce,
+		FromID: a.id,
+		ToID:   srvHello.PeerID,
+		UserID: userID,
+	}
+
+	v, r, s, err := signature.Sign(proof, a.key)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("sign: %w", err)
+	}
+
+	if err := tcpWriteHandshake(clt, tcpHello{PeerID: a.id, V: v, R: r, S: s}); err != nil {
+		return common.Address{}, err
+	}
+
+	return srvHello.PeerID, nil
+}
+
+// accept performs the server's side of the handshake and returns the identity
+// of the dialer and the user it speaks for. The user has to have signed the
+// grant the dialer speaks for them with.
+func (a *TCPAuth) accept(clt *tcp.Client) (common.Address, common.Address, error) {
+	var hello tcpHello
+	if err := tcpReadHandshake(clt, &hello); err != nil {
+		return common.Address{}, common.Address{}, err
+	}
+
+	if hello.Nonce == "" || hello.UserID == (common.Address{}) {
+		return common.Address{}, common.Address{}, fmt.Errorf("%w: invalid hello", ErrPeerHandshake)
+	}
+
+	if !a.trusted(hello.PeerID) {
+		return common.Address{}, common.Address{}, fmt.Errorf("%w: %s", ErrPeerNotTrusted, hello.PeerID)
+	}
+
+	if hello.Grant == nil {
+		return common.Address{}, common.Address{}, fmt.Errorf("%w: missing grant", ErrPeerGrant)
+	}
+
+	if err := hello.Grant.verify(hello.UserID, time.Now()); err != nil {
+		return common.Address{}, common.Address{}, err
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return common.Address{}, common.Address{}, err
+	}
+
+	proof := tcpProof{
+		Nonce:  hello.Nonce,
+		FromID: a.id,
+		ToID:   hello.PeerID,
+		UserID: hello.UserID,
+	}
+
+	v, r, s, err := signature.Sign(proof, a.key)
+	if err != nil {
+		return common.Address{}, common.Address{}, fmt.Errorf("sign: %w", err)
+	}
+
+	srvHello := tcpHello{
+		PeerID: a.id,
+		Nonce:  nonce,
+		V:      v,
+		R:      r,
+		S:      s,
+	}
+
+	if err := tcpWriteHandshake(clt, srvHello); err != nil {
+		return common.Address{}, common.Address{}, err
+	}
+
+	// -------------------------------------------------------------------------
+
+	var reply tcpHello
+	if err := tcpReadHandshake(clt, &reply); err != nil {
+		return common.Address{}, common.Address{}, err
+	}
+
+	proof = tcpProof{
+		Nonce:  nonce,
+		FromID: hello.PeerID,
+		ToID:   a.id,
+		UserID: hello.UserID,
+	}
+
+	if err := a.verify(proof, reply.V, reply.R, reply.S); err != nil {
+		return common.Address{}, common.Address{}, err
+	}
+
+	return hello.PeerID, hello.UserID, nil
+}
+
+// verify checks the proof was signed by the peer it claims to be from and
+// the peer is trusted.
+func (a *TCPAuth) verify(proof tcpProof, v, r, s *big.Int) error {
+	if v == nil || r == nil || s == nil {
+		return ErrPeerMissingProof
+	}
+
+	if err := signature.VerifySignature(v, r, s); err != nil {
+		return fmt.Errorf("%w: %w", ErrPeerHandshake, err)
+	}
+
+	id, err := signature.FromAddress(proof, v, r, s)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPeerHandshake, err)
+	}
+
+	if id != proof.FromID.Hex() {
+		return fmt.Errorf("%w: signature does not match: got: %s exp: %s", ErrPeerHandshake, id, proof.FromID)
+	}
+
+	if !a.trusted(proof.FromID) {
+		return fmt.Errorf("%w: %s", ErrPeerNotTrusted, proof.FromID)
+	}
+
+	return nil
+}
+
+func (a *TCPAuth) trusted(peerID common.Address) bool {
+	if peerID == (common.Address{}) || peerID == a.id {
+		return false
+	}
+
+	return slices.Contains(a.peers, peerID)
+}
+
+// =============================================================================
+
+func newNonce() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("nonce: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func tcpReadHandshake(clt *tcp.Client, v any) error {
+	clt.Conn.SetReadDeadline(time.Now().Add(tcpHandshakeTimeout))
+	defer clt.Conn.SetReadDeadline(time.Time{})
+
+	frame, err := clt.Framer.ReadFrame()
+	if err != nil {
+		return fmt.Errorf("handshake read: %w", err)
+	}
+
+	if err := json.Unmarshal(frame, v); err != nil {
+		return fmt.Errorf("%w: unmarshal: %w", ErrPeerHandshake, err)
+	}
+
+	return nil
+}
+
+func tcpWriteHandshake(clt *tcp.Client, v any) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("handshake marshal: %w", err)
+	}
+
+	clt.Conn.SetWriteDeadline(time.Now().Add(tcpHandshakeTimeout))
+	defer clt.Conn.SetWriteDeadline(time.Time{})
+
+	if err := clt.Send(d); err != nil {
+		return fmt.Errorf("handshake write: %w", err)
+	}
+
+	return nil
+}
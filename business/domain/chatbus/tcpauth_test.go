@@ -0,0 +1,239 @@
+package chatbus
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/foundation/signature"
+	"github.com/PeterLee0620/GoIM/foundation/tcp"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// errAnyFailure is expected by a side of the handshake that fails because the
+// other side gave up on it.
+var errAnyFailure = errors.New("any failure")
+
+// TestTCPAuth provides a test of the handshake the CAPs use to prove who they
+// are on a TCP link.
+func TestTCPAuth(t *testing.T) {
+	t.Log("Given the need to prove the identity of the CAPs on a TCP link.")
+	{
+		dialerKey := newTestKey(t)
+		serverKey := newTestKey(t)
+
+		dialerID := crypto.PubkeyToAddress(dialerKey.PublicKey)
+		serverID := crypto.PubkeyToAddress(serverKey.PublicKey)
+		otherID := crypto.PubkeyToAddress(newTestKey(t).PublicKey)
+
+		dialer := NewTCPAuth(dialerKey, []common.Address{serverID})
+		server := NewTCPAuth(serverKey, []common.Address{dialerID})
+
+		// The impostors claim the identity of another CAP without its key.
+		dialerImpostor := NewTCPAuth(newTestKey(t), []common.Address{serverID})
+		dialerImpostor.id = dialerID
+
+		serverImpostor := NewTCPAuth(newTestKey(t), []common.Address{dialerID})
+		serverImpostor.id = serverID
+
+		userKey := newTestKey(t)
+		userID := crypto.PubkeyToAddress(userKey.PublicKey)
+
+		grant := newTestGrant(t, userKey, userID, time.Now().Add(time.Minute))
+
+		tests := []struct {
+			name      string
+			dialer    *TCPAuth
+			server    *TCPAuth
+			userID    common.Address
+			grant     TCPGrant
+			dialErr   error
+			acceptErr error
+		}{
+			{
+				name:   "accept a trusted peer",
+				dialer: dialer,
+				server: server,
+				userID: userID,
+				grant:  grant,
+			},
+			{
+				name:      "reject every dialer without trusted peers",
+				dialer:    dialer,
+				server:    NewTCPAuth(serverKey, nil),
+				userID:    userID,
+				grant:     grant,
+				dialErr:   errAnyFailure,
+				acceptErr: ErrPeerNotTrusted,
+			},
+			{
+				name:      "reject every server without trusted peers",
+				dialer:    NewTCPAuth(dialerKey, nil),
+				server:    server,
+				userID:    userID,
+				grant:     grant,
+				dialErr:   ErrPeerNotTrusted,
+				acceptErr: errAnyFailure,
+			},
+			{
+				name:      "reject a dialer that isn't trusted",
+				dialer:    dialer,
+				server:    NewTCPAuth(serverKey, []common.Address{otherID}),
+				userID:    userID,
+				grant:     grant,
+				dialErr:   errAnyFailure,
+				acceptErr: ErrPeerNotTrusted,
+			},
+			{
+				name:      "reject a server that isn't trusted",
+				dialer:    NewTCPAuth(dialerKey, []common.Address{otherID}),
+				server:    server,
+				userID:    userID,
+				grant:     grant,
+				dialErr:   ErrPeerNotTrusted,
+				acceptErr: errAnyFailure,
+			},
+			{
+				name:      "reject a dialer that doesn't speak for a user",
+				dialer:    dialer,
+				server:    server,
+				grant:     grant,
+				dialErr:   errAnyFailure,
+				acceptErr: ErrPeerHandshake,
+			},
+			{
+				name:      "reject a dialer without a grant from the user",
+				dialer:    dialer,
+				server:    server,
+				userID:    userID,
+				dialErr:   errAnyFailure,
+				acceptErr: ErrPeerGrant,
+			},
+			{
+				name:      "reject a dialer that claims another user",
+				dialer:    dialer,
+				server:    server,
+				userID:    otherID,
+				grant:     grant,
+				dialErr:   errAnyFailure,
+				acceptErr: ErrPeerGrant,
+			},
+			{
+				name:      "reject a grant that expired",
+				dialer:    dialer,
+				server:    server,
+				userID:    userID,
+				grant:     newTestGrant(t, userKey, userID, time.Now().Add(-time.Minute)),
+				dialErr:   errAnyFailure,
+				acceptErr: ErrPeerGrant,
+			},
+			{
+				name:      "reject a grant that lasts too long",
+				dialer:    dialer,
+				server:    server,
+				userID:    userID,
+				grant:     newTestGrant(t, userKey, userID, time.Now().Add(TCPGrantMaxAge+time.Minute)),
+				dialErr:   errAnyFailure,
+				acceptErr: ErrPeerGrant,
+			},
+			{
+				name:      "reject a dialer that claims to be another peer",
+				dialer:    dialerImpostor,
+				server:    server,
+				userID:    userID,
+				grant:     grant,
+				acceptErr: ErrPeerHandshake,
+			},
+			{
+				name:      "reject a server that claims to be another peer",
+				dialer:    dialer,
+				server:    serverImpostor,
+				userID:    userID,
+				grant:     grant,
+				dialErr:   ErrPeerHandshake,
+				acceptErr: errAnyFailure,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Logf("\tWhen the handshake should %s.", tt.name)
+			{
+				dialConn, acceptConn := net.Pipe()
+
+				type accepted struct {
+					peerID common.Address
+					userID common.Address
+					err    error
+				}
+				ch := make(chan accepted, 1)
+
+				go func() {
+					defer acceptConn.Close()
+
+					peerID, userID, err := tt.server.accept(testTCPClient(acceptConn))
+					ch <- accepted{peerID, userID, err}
+				}()
+
+				peerID, dialErr := tt.dialer.dial(testTCPClient(dialConn), tt.userID, tt.grant)
+				dialConn.Close()
+
+				acc := <-ch
+
+				if !expectedErr(dialErr, tt.dialErr) || !expectedErr(acc.err, tt.acceptErr) {
+					t.Errorf("\t\tShould %s. %s dial[%v] accept[%v]", tt.name, "X", dialErr, acc.err)
+					continue
+				}
+
+				if tt.dialErr == nil && peerID != tt.server.id {
+					t.Errorf("\t\tShould identify the server to the dialer. %s %s", "X", peerID)
+					continue
+				}
+
+				if tt.acceptErr == nil && (acc.peerID != tt.dialer.id || acc.userID != tt.userID) {
+					t.Errorf("\t\tShould identify the dialer and user to the server. %s %s %s", "X", acc.peerID, acc.userID)
+					continue
+				}
+
+				t.Logf("\t\tShould %s. %s", tt.name, "OK")
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+// newTestGrant returns a grant signed by the user that expires at the time.
+func newTestGrant(t *testing.T, key *ecdsa.PrivateKey, userID common.Address, expires time.Time) TCPGrant {
+	grant := TCPGrant{
+		Expires: expires.Unix(),
+	}
+
+	var err error
+	grant.V, grant.R, grant.S, err = signature.Sign(grant.signedData(userID), key)
+	if err != nil {
+		t.Fatal("\tShould be able to sign the grant.", "X", err)
+	}
+
+	return grant
+}
+
+func testTCPClient(conn net.Conn) *tcp.Client {
+	return &tcp.Client{
+		Conn:   conn,
+		Framer: tcp.NewLineFramer(conn, tcpMaxFrameSize),
+	}
+}
+
+func expectedErr(err error, exp error) bool {
+	switch exp {
+	case nil:
+		return err == nil
+	case errAnyFailure:
+		return err != nil
+	}
+
+	return errors.Is(err, exp)
+}
@@ -2,11 +2,14 @@ package chatbus
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/PeterLee0620/GoIM/foundation/signature"
@@ -17,20 +20,28 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
-// UIHandshake performs the connection handshake protocol.
-func (b *Business) UIHandshake(ctx context.Context, w http.ResponseWriter, r *http.Request) (UIUser, error) {
+// uiAddTimeout is how long adding a session can take. It includes the
+// round trip to register the user in the presence directory.
+const uiAddTimeout = 5 * time.Second
+
+// UIHandshake performs the connection handshake protocol. The user must sign
+// the challenge sent by the CAP with the key for the subject of their token.
+func (b *Business) UIHandshake(ctx context.Context, w http.ResponseWriter, r *http.Request, subjectID common.Address) (UIUser, error) {
 	var ws websocket.Upgrader
 	conn, err := ws.Upgrade(w, r, nil)
 	if err != nil {
 		return UIUser{}, fmt.Errorf("upgrade: %w", err)
 	}
 
-	if err := conn.WriteMessage(websocket.TextMessage, []byte("HELLO")); err != nil {
-		return UIUser{}, fmt.Errorf("write message: %w", err)
+	challenge, err := newChallenge()
+	if err != nil {
+		conn.Close()
+		return UIUser{}, fmt.Errorf("challenge: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
-	defer cancel()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("CHALLENGE "+challenge)); err != nil {
+		return UIUser{}, fmt.Errorf("write message: %w", err)
+	}
 
 	usr := UIUser{
 		UIConn:   conn,
@@ -38,15 +49,34 @@ func (b *Business) UIHandshake(ctx context.Context, w http.ResponseWriter, r *ht
 		LastPong: time.Now(),
 	}
 
-	msg, err := b.uiReadMessage(ctx, usr)
+	readCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	msg, err := b.uiReadMessage(readCtx, usr)
 	if err != nil {
 		return UIUser{}, fmt.Errorf("read message: %w", err)
 	}
 
-	if err := json.Unmarshal(msg, &usr); err != nil {
+	var hsMsg uiHandshakeMessage
+	if err := json.Unmarshal(msg, &hsMsg); err != nil {
 		return UIUser{}, fmt.Errorf("unmarshal message: %w", err)
 	}
 
+	if hsMsg.Version != ProtocolVersion {
+		defer conn.Close()
+		v := fmt.Sprintf("Unsupported Protocol Version %d, Expecting %d", hsMsg.Version, ProtocolVersion)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(v)); err != nil {
+			return UIUser{}, fmt.Errorf("write message: %w", err)
+		}
+		return UIUser{}, fmt.Errorf("unsupported protocol version: %d", hsMsg.Version)
+	}
+
+	usr.ID = hsMsg.ID
+	usr.Name = hsMsg.Name
+	usr.Device = hsMsg.Device
+	usr.Cursor = hsMsg.Cursor
+	usr.SessionID = uuid.New()
+
 	// Check that we have a valid user ID and Name.
 	if usr.ID == (common.Address{}) || usr.Name == "" {
 		defer conn.Close()
@@ -56,22 +86,62 @@ func (b *Business) UIHandshake(ctx context.Context, w http.ResponseWriter, r *ht
 		return UIUser{}, fmt.Errorf("invalid user ID or name")
 	}
 
+	// Each device has its own nonce sequence so we need to know the device.
+	if usr.Device == "" {
+		defer conn.Close()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("Invalid Device")); err != nil {
+			return UIUser{}, fmt.Errorf("write message: %w", err)
+		}
+		return UIUser{}, fmt.Errorf("invalid device")
+	}
+
 	// -------------------------------------------------------------------------
 
-	if err := b.uiCltMgr.Add(ctx, usr); err != nil {
+	// The user must prove they own the key for the ID they claim and that ID
+	// must be the one their token was issued for.
+	id, err := signature.FromAddress(challenge, hsMsg.V, hsMsg.R, hsMsg.S)
+	if err != nil || id != usr.ID.Hex() || id != subjectID.Hex() {
 		defer conn.Close()
-		if err := conn.WriteMessage(websocket.TextMessage, []byte("Already Connected")); err != nil {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("Invalid Signature")); err != nil {
+			return UIUser{}, fmt.Errorf("write message: %w", err)
+		}
+		return UIUser{}, fmt.Errorf("signature check: id[%s] subject[%s] signer[%s]: %w", usr.ID, subjectID, id, ErrInvalidSignature)
+	}
+
+	// -------------------------------------------------------------------------
+
+	// Once the user is added, other goroutines can send messages to the user
+	// so from here on all writes must go through the writer.
+	usr.UIWriter = newUIWriter(conn, b.uiQueueDepth, b.uiSlowCons)
+
+	// New messages are held for the session until it has replayed what it
+	// missed since the cursor.
+	b.uiDeliverer.hold(usr)
+
+	addCtx, addCancel := context.WithTimeout(ctx, uiAddTimeout)
+	defer addCancel()
+
+	if err := b.uiCltMgr.Add(addCtx, usr); err != nil {
+		b.uiDeliverer.release(usr)
+		defer usr.UIWriter.Close()
+
+		v := "Unable To Connect"
+		if errors.Is(err, ErrExists) {
+			v = "Already Connected"
+		}
+
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(v)); err != nil {
 			return UIUser{}, fmt.Errorf("write message: %w", err)
 		}
 		return UIUser{}, fmt.Errorf("add user: %w", err)
 	}
 
-	usr.UIConn.SetPongHandler(b.uiPong(usr.ID))
+	usr.UIConn.SetPongHandler(b.uiPong(usr.ID, usr.SessionID))
 
 	// -------------------------------------------------------------------------
 
 	v := fmt.Sprintf("WELCOME %s", usr.Name)
-	if err := conn.WriteMessage(websocket.TextMessage, []byte(v)); err != nil {
+	if err := usr.UIWriter.WriteMessage(websocket.TextMessage, []byte(v)); err != nil {
 		return UIUser{}, fmt.Errorf("write message: %w", err)
 	}
 
@@ -80,6 +150,12 @@ func (b *Business) UIHandshake(ctx context.Context, w http.ResponseWriter, r *ht
 	return usr, nil
 }
 
+// UIReplay sends the user the messages they missed since the cursor they
+// presented in the handshake.
+func (b *Business) UIReplay(ctx context.Context, usr UIUser) error {
+	return b.uiDeliverer.Replay(ctx, usr)
+}
+
 // UIListen waits for messages from users.
 func (b *Business) UIListen(ctx context.Context, from UIUser) {
 	for {
@@ -99,17 +175,18 @@ func (b *Business) UIListen(ctx context.Context, from UIUser) {
 
 		b.log.Info(ctx, "uilisten: msg recv", "fromNonce", inMsg.FromNonce, "from", from.ID, "to", inMsg.ToID, "encrypted", inMsg.Encrypted, "message", inMsg.Msg)
 
-		dataThatWasSign := struct {
-			ToID      common.Address
-			Msg       [][]byte
-			FromNonce uint64
-		}{
-			ToID:      inMsg.ToID,
-			Msg:       inMsg.Msg,
-			FromNonce: inMsg.FromNonce,
+		if err := inMsg.validate(); err != nil {
+			b.log.Info(ctx, "uilisten: validate", "ERROR", err)
+			continue
+		}
+
+		// A message to a group is signed with the group as its ID.
+		if inMsg.GroupID != (common.Address{}) && inMsg.GroupID != inMsg.ToID {
+			b.log.Info(ctx, "uilisten: group check", "status", "group id does not match the recipient", "groupID", inMsg.GroupID, "to", inMsg.ToID)
+			continue
 		}
 
-		id, err := signature.FromAddress(dataThatWasSign, inMsg.V, inMsg.R, inMsg.S)
+		id, err := signature.FromAddress(inMsg.signedData(), inMsg.V, inMsg.R, inMsg.S)
 		if err != nil {
 			b.log.Info(ctx, "uilisten: fromAddress", "ERROR", err)
 			continue
@@ -120,53 +197,150 @@ func (b *Business) UIListen(ctx context.Context, from UIUser) {
 			continue
 		}
 
-		// BILL: We want the logic to match the order of precedence in the order
-		// we think about sending a message: websocket, peer-to-peer, nats.
+		if inMsg.FromDevice != from.Device {
+			b.log.Info(ctx, "uilisten: device check", "status", "device does not match", "device", inMsg.FromDevice, "session", from.Device)
+			continue
+		}
 
-		// ---------------------------------------------------------------------
-		// Web Socket
+		// The group is looked up once for the mirror and the fan out.
+		grp, isGroup := b.groupFor(ctx, inMsg)
 
-		// If the user is found, send the message directly to the user.
-		uiTo, err := b.uiCltMgr.Retrieve(ctx, inMsg.ToID)
-		if err == nil {
-			b.log.Info(ctx, "uilisten: msg sent over web socket", "from", from.ID, "to", inMsg.ToID)
+		if isGroup != (inMsg.GroupID != common.Address{}) {
+			b.log.Info(ctx, "uilisten: group check", "status", "group id not signed for the recipient", "groupID", inMsg.GroupID, "to", inMsg.ToID)
+			continue
+		}
+
+		// The user's other devices get a copy of what was sent. The copy for
+		// them isn't needed by anyone else.
+		b.uiMirrorMessage(ctx, from, inMsg, isGroup)
+		inMsg.Mirror = nil
 
-			if err := uiSendMessage(from, uiTo, inMsg.FromNonce, inMsg.Encrypted, inMsg.Msg); err != nil {
-				b.log.Info(ctx, "uilisten: send", "ERROR", err)
+		// Messages addressed to a group are fanned out to the members.
+		if isGroup {
+			if err := b.uiGroupMessage(ctx, from, inMsg, grp); err != nil {
+				b.log.Info(ctx, "uilisten: group", "ERROR", err, "groupID", inMsg.ToID)
 			}
 
 			continue
 		}
 
-		if !errors.Is(err, ErrNotExists) {
-			b.log.Info(ctx, "uilisten: retrieve", "ERROR", err)
-		}
+		b.uiRouteMessage(ctx, from, inMsg)
+	}
+}
 
-		// ---------------------------------------------------------------------
-		// TCP
+// uiRouteMessage delivers the message to the user identified by ToID. The
+// user may have sessions on this CAP and on other CAPs at the same time, so
+// the message is delivered to the local sessions and sent to every other CAP
+// that holds a session.
+func (b *Business) uiRouteMessage(ctx context.Context, from UIUser, inMsg uiIncomingMessage) {
+	// BILL: We want the logic to match the order of precedence in the order
+	// we think about sending a message: websocket, peer-to-peer, nats.
 
-		clt, err := b.tcpCltMgr.Retrieve(ctx, inMsg.ToID.String())
-		if err == nil {
-			b.log.Info(ctx, "uilisten: msg sent over tcp", "from", from.ID, "to", inMsg.ToID)
+	// -------------------------------------------------------------------------
+	// Web Socket
 
-			if err := b.tcpSendMessage(clt, from, inMsg); err != nil {
-				b.log.Info(ctx, "uilisten: tcp-send", "ERROR", err)
-			}
+	// If the user is found, send the message directly to the user.
+	var local bool
 
-			continue
+	err := b.uiDeliverer.Deliver(ctx, from, inMsg.ToID, inMsg)
+	switch {
+	case err == nil:
+		b.log.Info(ctx, "uiroutemessage: msg sent over web socket", "from", from.ID, "to", inMsg.ToID)
+		local = true
+
+	case !errors.Is(err, ErrNotExists):
+		b.log.Info(ctx, "uiroutemessage: send", "ERROR", err)
+		return
+	}
+
+	// -------------------------------------------------------------------------
+	// TCP
+
+	// The link to the user's CAP may have been dialed by us or by the peer.
+	// A user with a session here isn't reached over a peer link.
+	if !local {
+		err = b.tcpSendMessage(from, inMsg)
+		switch {
+		case err == nil:
+			b.log.Info(ctx, "uiroutemessage: msg sent over tcp", "from", from.ID, "to", inMsg.ToID)
+			return
+
+		case !errors.Is(err, ErrNotExists):
+			b.log.Info(ctx, "uiroutemessage: tcp-send", "ERROR", err)
+			return
 		}
+	}
+
+	// -------------------------------------------------------------------------
+	// NATS
+
+	// Look up the other CAPs that hold a session for the user and send the
+	// message over nats to each of them.
+	capIDs, err := b.presenceMgr.Lookup(ctx, inMsg.ToID)
+	if err != nil && !errors.Is(err, ErrNotExists) {
+		b.log.Info(ctx, "uiroutemessage: presence lookup", "ERROR", err)
+	}
 
-		// ---------------------------------------------------------------------
-		// NATS
+	capIDs = slices.DeleteFunc(capIDs, func(capID uuid.UUID) bool {
+		return capID == b.capID
+	})
 
-		// We don't have a web socket connection for the user then send the
-		// message over nats to find a CAP that can deliver the message.
-		b.log.Info(ctx, "uilisten: retrieve", "status", "user not found, sending over nats")
+	for _, capID := range capIDs {
+		b.log.Info(ctx, "uiroutemessage: msg sent over nats", "from", from.ID, "to", inMsg.ToID, "capID", capID)
 
-		if err := b.natsSendMessage(ctx, from, inMsg); err != nil {
-			b.log.Info(ctx, "uilisten: nats-send", "ERROR", err)
+		if err := b.natsSendMessage(ctx, capID, from, inMsg); err != nil {
+			b.log.Info(ctx, "uiroutemessage: nats-send", "ERROR", err, "capID", capID)
 		}
 	}
+
+	if local || len(capIDs) > 0 {
+		return
+	}
+
+	// -------------------------------------------------------------------------
+	// Inbox
+
+	// If no CAP has a web socket connection for the user, hold the
+	// message until the user connects again and let the sender know.
+	b.log.Info(ctx, "uiroutemessage: retrieve", "status", "user offline, queuing message", "to", inMsg.ToID)
+
+	if err := b.inboxPush(ctx, from, inMsg); err != nil {
+		b.log.Info(ctx, "uiroutemessage: inbox-push", "ERROR", err)
+		return
+	}
+
+	// The sender of a receipt doesn't need to know it was queued.
+	if inMsg.Type == msgTypeReceipt {
+		return
+	}
+
+	evt := UIUser{
+		ID: inMsg.ToID,
+	}
+
+	if err := uiSendEvent(evt, from, eventQueued); err != nil {
+		b.log.Info(ctx, "uiroutemessage: send", "ERROR", err)
+	}
+}
+
+// uiMirrorMessage sends a copy of what the user sent to their other sessions
+// so the conversation history stays the same on every device. The copy keeps
+// the signed message along with the mirror the other devices can decrypt.
+func (b *Business) uiMirrorMessage(ctx context.Context, from UIUser, inMsg uiIncomingMessage, isGroup bool) {
+	switch inMsg.Type {
+	case msgTypeChat, msgTypeGroup, msgTypeEdit, msgTypeDelete, msgTypeReaction:
+	default:
+		return
+	}
+
+	mirrorMsg := inMsg
+	if isGroup {
+		mirrorMsg.GroupID = inMsg.ToID
+	}
+
+	if err := b.uiDeliverer.Mirror(ctx, from, mirrorMsg); err != nil {
+		b.log.Info(ctx, "uimirrormessage: send", "ERROR", err)
+	}
 }
 
 // =============================================================================
@@ -191,13 +365,13 @@ func (b *Business) uiReadMessage(ctx context.Context, usr UIUser) ([]byte, error
 
 	select {
 	case <-ctx.Done():
-		b.uiCltMgr.Remove(ctx, usr.ID)
-		usr.UIConn.Close()
+		b.uiCltMgr.Remove(ctx, usr.ID, usr.SessionID)
+		uiClose(usr)
 		return nil, ctx.Err()
 
 	case resp = <-ch:
 		if resp.err != nil {
-			b.uiCltMgr.Remove(ctx, usr.ID)
+			b.uiCltMgr.Remove(ctx, usr.ID, usr.SessionID)
 			usr.UIConn.Close()
 			return nil, resp.err
 		}
@@ -217,22 +391,25 @@ func (b *Business) uiPing(maxWait time.Duration) {
 
 			b.log.Debug(ctx, "*** PING ***", "status", "started")
 
-			for id, conn := range b.uiCltMgr.Connections() {
+			for sessionID, conn := range b.uiCltMgr.Connections() {
+				id := conn.ID
+
 				sub := conn.LastPong.Sub(conn.LastPing)
 				if sub > maxWait {
 					b.log.Info(ctx, "*** PING ***", "ping", conn.LastPing.String(), "pong", conn.LastPong.Second(), "maxWait", maxWait, "sub", sub.String())
-					b.uiCltMgr.Remove(ctx, id)
+					b.uiCltMgr.Remove(ctx, id, sessionID)
 					continue
 				}
 
-				b.log.Debug(ctx, "*** PING ***", "status", "sending", "id", id)
+				stats := conn.Writer.Stats()
+				b.log.Debug(ctx, "*** PING ***", "status", "sending", "id", id, "sessionID", sessionID, "queueDepth", stats.Depth, "queueCap", stats.Capacity, "sent", stats.Sent, "dropped", stats.Dropped)
 
-				if err := conn.Conn.WriteMessage(websocket.PingMessage, []byte("ping")); err != nil {
-					b.log.Info(ctx, "*** PING ***", "status", "failed", "id", id, "ERROR", err)
+				if err := conn.Writer.Ping([]byte("ping")); err != nil {
+					b.log.Info(ctx, "*** PING ***", "status", "failed", "id", id, "sessionID", sessionID, "ERROR", err)
 				}
 
-				if err := b.uiCltMgr.UpdateLastPing(ctx, id); err != nil {
-					b.log.Info(ctx, "*** PING ***", "status", "failed", "id", id, "ERROR", err)
+				if err := b.uiCltMgr.UpdateLastPing(ctx, id, sessionID); err != nil {
+					b.log.Info(ctx, "*** PING ***", "status", "failed", "id", id, "sessionID", sessionID, "ERROR", err)
 				}
 			}
 
@@ -241,14 +418,14 @@ func (b *Business) uiPing(maxWait time.Duration) {
 	}()
 }
 
-func (b *Business) uiPong(id common.Address) func(appData string) error {
+func (b *Business) uiPong(id common.Address, sessionID uuid.UUID) func(appData string) error {
 	f := func(appData string) error {
 		ctx := web.SetTraceID(context.Background(), uuid.New())
 
 		b.log.Debug(ctx, "*** PONG ***", "id", id, "status", "started")
 		defer b.log.Debug(ctx, "*** PONG ***", "id", id, "status", "completed")
 
-		usr, err := b.uiCltMgr.UpdateLastPong(ctx, id)
+		usr, err := b.uiCltMgr.UpdateLastPong(ctx, id, sessionID)
 		if err != nil {
 			b.log.Info(ctx, "*** PONG ***", "id", id, "ERROR", err)
 			return nil
@@ -294,20 +471,54 @@ func (b *Business) isUICriticalError(ctx context.Context, err error) bool {
 
 // =============================================================================
 
-func uiSendMessage(from UIUser, to UIUser, fromNonce uint64, encrypted bool, msg [][]byte) error {
+// newChallenge returns a random value a user must sign to connect.
+func newChallenge() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b[:]), nil
+}
+
+// uiClose closes the user's connection, stopping the writer if the handshake
+// got far enough to start one.
+func uiClose(usr UIUser) {
+	if usr.UIWriter != nil {
+		usr.UIWriter.Close()
+		return
+	}
+
+	usr.UIConn.Close()
+}
+
+func uiSendMessage(from UIUser, to UIUser, inMsg uiIncomingMessage, seq uint64) error {
 	m := uiOutgoingMessage{
+		envelope: inMsg.envelope,
+		Seq:      seq,
 		From: uiOutgoingUser{
-			ID:    from.ID,
-			Name:  from.Name,
-			Nonce: fromNonce,
+			ID:     from.ID,
+			Name:   from.Name,
+			Nonce:  inMsg.FromNonce,
+			Device: inMsg.FromDevice,
 		},
-		Encrypted: encrypted,
-		Msg:       msg,
+		ToID:      inMsg.ToID,
+		GroupID:   inMsg.GroupID,
+		Encrypted: inMsg.Encrypted,
+		Msg:       inMsg.Msg,
+		Mirror:    inMsg.Mirror,
+		V:         inMsg.V,
+		R:         inMsg.R,
+		S:         inMsg.S,
 	}
 
-	if err := to.UIConn.WriteJSON(m); err != nil {
+	if err := to.UIWriter.WriteJSON(m); err != nil {
 		return fmt.Errorf("write message: %w", err)
 	}
 
 	return nil
 }
+
+func uiSendEvent(from UIUser, to UIUser, event string) error {
+	return uiSendMessage(from, to, newEventMessage(to.ID, event), 0)
+}
@@ -0,0 +1,547 @@
+package chatbus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PeterLee0620/GoIM/business/domain/chatbus/managers/managerstest"
+	"github.com/PeterLee0620/GoIM/foundation/signature"
+	"github.com/PeterLee0620/GoIM/foundation/tcp"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// TestUIHandshakeAdd provides a test of adding the session at the end of the
+// handshake.
+func TestUIHandshakeAdd(t *testing.T) {
+	t.Log("Given the need to add a session once the user is verified.")
+	{
+		key := newTestKey(t)
+		userID := crypto.PubkeyToAddress(key.PublicKey)
+
+		tests := []struct {
+			name  string
+			delay time.Duration
+			err   error
+			exp   string
+		}{
+			{
+				name: "welcome the user",
+				exp:  "WELCOME",
+			},
+			{
+				name:  "welcome the user when registering the presence is slow",
+				delay: 300 * time.Millisecond,
+				exp:   "WELCOME",
+			},
+			{
+				name: "tell the user the device is already connected",
+				err:  ErrExists,
+				exp:  "Already Connected",
+			},
+			{
+				name: "tell the user the session couldn't be added",
+				err:  errors.New("presence register: nats timeout"),
+				exp:  "Unable To Connect",
+			},
+		}
+
+		for _, tt := range tests {
+			b := Business{
+				log: managerstest.Logger(),
+				uiCltMgr: testAddUsers{
+					testUsers: testUsers{users: make(map[common.Address][]UIUser)},
+					delay:     tt.delay,
+					err:       tt.err,
+				},
+				uiDeliverer:  &UIDeliverer{},
+				uiQueueDepth: 1,
+				uiSlowCons:   SlowConsumerDisconnect,
+			}
+
+			resp, err := uiHandshake(t, &b, userID, key, uiHandshakeMessage{
+				Version: ProtocolVersion,
+				ID:      userID,
+				Name:    "user",
+				Device:  "device",
+			})
+
+			switch {
+			case !strings.HasPrefix(resp, tt.exp):
+				t.Errorf("\tShould %s. %s %q", tt.name, "X", resp)
+			case tt.err != nil && !errors.Is(err, tt.err):
+				t.Errorf("\tShould return the error adding the session. %s %v", "X", err)
+			default:
+				t.Logf("\tShould %s. %s", tt.name, "OK")
+			}
+		}
+	}
+}
+
+// TestUIHandshakeBinding provides a test that the user can only connect as
+// the address their token was issued for and signed the challenge with.
+func TestUIHandshakeBinding(t *testing.T) {
+	t.Log("Given the need to bind the session to the token subject.")
+	{
+		key := newTestKey(t)
+		userID := crypto.PubkeyToAddress(key.PublicKey)
+
+		otherKey := newTestKey(t)
+		otherID := crypto.PubkeyToAddress(otherKey.PublicKey)
+
+		tests := []struct {
+			name    string
+			subject common.Address
+			key     *ecdsa.PrivateKey
+			change  func(hs *uiHandshakeMessage)
+			exp     string
+			expErr  error
+		}{
+			{
+				name:    "welcome the token subject signing with its key",
+				subject: userID,
+				key:     key,
+				change:  func(hs *uiHandshakeMessage) {},
+				exp:     "WELCOME",
+			},
+			{
+				name:    "reject a challenge signed by another key",
+				subject: userID,
+				key:     otherKey,
+				change:  func(hs *uiHandshakeMessage) {},
+				exp:     "Invalid Signature",
+				expErr:  ErrInvalidSignature,
+			},
+			{
+				name:    "reject an id other than the token subject",
+				subject: userID,
+				key:     otherKey,
+				change:  func(hs *uiHandshakeMessage) { hs.ID = otherID },
+				exp:     "Invalid Signature",
+				expErr:  ErrInvalidSignature,
+			},
+			{
+				name:    "reject a token for another subject",
+				subject: otherID,
+				key:     key,
+				change:  func(hs *uiHandshakeMessage) {},
+				exp:     "Invalid Signature",
+				expErr:  ErrInvalidSignature,
+			},
+			{
+				name:    "reject a missing id",
+				subject: userID,
+				key:     key,
+				change:  func(hs *uiHandshakeMessage) { hs.ID = common.Address{} },
+				exp:     "Invalid User ID or Name",
+			},
+			{
+				name:    "reject a missing device",
+				subject: userID,
+				key:     key,
+				change:  func(hs *uiHandshakeMessage) { hs.Device = "" },
+				exp:     "Invalid Device",
+			},
+			{
+				name:    "reject an unknown protocol version",
+				subject: userID,
+				key:     key,
+				change:  func(hs *uiHandshakeMessage) { hs.Version = ProtocolVersion + 1 },
+				exp:     "Unsupported Protocol Version",
+			},
+		}
+
+		for _, tt := range tests {
+			users := testUsers{users: make(map[common.Address][]UIUser)}
+
+			b := Business{
+				log:          managerstest.Logger(),
+				uiCltMgr:     users,
+				uiDeliverer:  &UIDeliverer{},
+				uiQueueDepth: 1,
+				uiSlowCons:   SlowConsumerDisconnect,
+			}
+
+			hsMsg := uiHandshakeMessage{
+				Version: ProtocolVersion,
+				ID:      userID,
+				Name:    "user",
+				Device:  "device",
+			}
+			tt.change(&hsMsg)
+
+			resp, err := uiHandshake(t, &b, tt.subject, tt.key, hsMsg)
+
+			added := len(users.users) > 0
+
+			switch {
+			case !strings.HasPrefix(resp, tt.exp):
+				t.Errorf("\tShould %s. %s %q", tt.name, "X", resp)
+			case tt.expErr != nil && !errors.Is(err, tt.expErr):
+				t.Errorf("\tShould %s. %s %v", tt.name, "X", err)
+			case added != (tt.exp == "WELCOME"):
+				t.Errorf("\tShould %s. %s added[%t]", tt.name, "X", added)
+			default:
+				t.Logf("\tShould %s. %s", tt.name, "OK")
+			}
+		}
+	}
+}
+
+// TestUIRouteCAPs provides a test of routing a message to a user with
+// sessions on more than one CAP.
+func TestUIRouteCAPs(t *testing.T) {
+	t.Log("Given the need to reach every session of a user spread across CAPs.")
+	{
+		ctx := context.Background()
+		log := managerstest.Logger()
+		nc := managerstest.StartNATS(t)
+
+		js, err := jetstream.New(nc)
+		if err != nil {
+			t.Fatal("\tShould be able to create the jetstream.", "X", err)
+		}
+
+		stream, err := js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     "test",
+			Subjects: []string{natsCAPSubject("test", "*")},
+		})
+		if err != nil {
+			t.Fatal("\tShould be able to create the stream.", "X", err)
+		}
+		t.Log("\tShould be able to create the stream.", "OK")
+
+		capID := uuid.New()
+		fromW, _ := newTestUIWriter(t, 10, SlowConsumerDisconnect)
+		from := UIUser{ID: common.HexToAddress("0x00000000000000000000000000000000000000a1"), UIWriter: fromW}
+
+		tests := []struct {
+			name   string
+			local  bool
+			remote int
+			ours   bool
+			queued int
+		}{
+			{name: "deliver to the local session only", local: true, ours: true},
+			{name: "deliver to the local session and the other CAP", local: true, remote: 1, ours: true},
+			{name: "send to both CAPs without a local session", remote: 2},
+			{name: "not send to this CAP when its entry is stale", remote: 1, ours: true},
+			{name: "queue the message when no CAP has a session", queued: 1},
+		}
+
+		for _, tt := range tests {
+			toID := crypto.PubkeyToAddress(newTestKey(t).PublicKey)
+
+			users := testUsers{users: make(map[common.Address][]UIUser)}
+			toW, _ := newTestUIWriter(t, 10, SlowConsumerDisconnect)
+			if tt.local {
+				users.users[toID] = []UIUser{{ID: toID, SessionID: uuid.New(), UIWriter: toW}}
+			}
+
+			presence := testPresence{caps: make(map[common.Address][]uuid.UUID)}
+			if tt.ours {
+				presence.caps[toID] = append(presence.caps[toID], capID)
+			}
+
+			var remotes []uuid.UUID
+			for range tt.remote {
+				remotes = append(remotes, uuid.New())
+			}
+			presence.caps[toID] = append(presence.caps[toID], remotes...)
+
+			if len(presence.caps[toID]) == 0 {
+				delete(presence.caps, toID)
+			}
+
+			deliverer := NewUIDeliverer(log, users, &testLog{})
+			inbox := testInbox{}
+
+			b := Business{
+				log:         log,
+				js:          js,
+				capID:       capID,
+				natsSubject: "test",
+				uiCltMgr:    users,
+				presenceMgr: presence,
+				inboxMgr:    &inbox,
+				tcpCltMgr:   testTCPClients{},
+				tcpServer:   newTestTCPServer(t, users, deliverer, &inbox),
+				uiDeliverer: deliverer,
+			}
+
+			b.uiRouteMessage(ctx, from, uiIncomingMessage{
+				envelope: envelope{Version: ProtocolVersion, ID: uuid.New(), Type: msgTypeChat},
+				ToID:     toID,
+				Msg:      [][]byte{[]byte("hello")},
+			})
+
+			var sent int
+			for _, id := range append(remotes, capID) {
+				if _, err := stream.GetLastMsgForSubject(ctx, natsCAPSubject("test", id.String())); err == nil {
+					if id == capID {
+						t.Errorf("\tShould %s: %s: sent to this CAP", tt.name, "X")
+					}
+					sent++
+				}
+			}
+
+			var local int
+			if tt.local {
+				local = toW.Stats().Depth
+			}
+
+			switch {
+			case (local > 0) != tt.local:
+				t.Errorf("\tShould %s: %s: local[%d]", tt.name, "X", local)
+			case sent != tt.remote:
+				t.Errorf("\tShould %s: %s: sent[%d]", tt.name, "X", sent)
+			case len(inbox.queued()) != tt.queued:
+				t.Errorf("\tShould %s: %s: queued[%d]", tt.name, "X", len(inbox.queued()))
+			default:
+				t.Logf("\tShould %s: %s", tt.name, "OK")
+			}
+		}
+	}
+}
+
+// TestUIRouteReceipt provides a test that the sender of a receipt isn't told
+// it was queued for a user that isn't connected.
+func TestUIRouteReceipt(t *testing.T) {
+	t.Log("Given the need to queue receipts quietly.")
+	{
+		log := managerstest.Logger()
+		toID := common.HexToAddress("0x00000000000000000000000000000000000000b1")
+
+		tests := []struct {
+			name  string
+			typ   msgType
+			event bool
+		}{
+			{name: "tell the sender a chat message was queued", typ: msgTypeChat, event: true},
+			{name: "not tell the sender a receipt was queued", typ: msgTypeReceipt},
+		}
+
+		for _, tt := range tests {
+			users := testUsers{users: make(map[common.Address][]UIUser)}
+			deliverer := NewUIDeliverer(log, users, &testLog{})
+			inbox := testInbox{}
+
+			b := Business{
+				log:         log,
+				capID:       uuid.New(),
+				uiCltMgr:    users,
+				presenceMgr: testPresence{caps: make(map[common.Address][]uuid.UUID)},
+				inboxMgr:    &inbox,
+				tcpCltMgr:   testTCPClients{},
+				tcpServer:   newTestTCPServer(t, users, deliverer, &inbox),
+				uiDeliverer: deliverer,
+			}
+
+			fromW, _ := newTestUIWriter(t, 10, SlowConsumerDisconnect)
+			from := UIUser{ID: common.HexToAddress("0x00000000000000000000000000000000000000a1"), UIWriter: fromW}
+
+			b.uiRouteMessage(context.Background(), from, uiIncomingMessage{
+				envelope: envelope{Version: ProtocolVersion, ID: uuid.New(), Type: tt.typ},
+				ToID:     toID,
+				Msg:      [][]byte{[]byte("DELIVERED"), []byte("device"), []byte("1")},
+			})
+
+			event := fromW.Stats().Depth > 0
+
+			switch {
+			case len(inbox.queued()) != 1:
+				t.Errorf("\tShould %s: %s: queued[%d]", tt.name, "X", len(inbox.queued()))
+			case event != tt.event:
+				t.Errorf("\tShould %s: %s: event[%t]", tt.name, "X", event)
+			default:
+				t.Logf("\tShould %s: %s", tt.name, "OK")
+			}
+		}
+	}
+}
+
+// TestUIMirrorMessage provides a test of the messages copied to the other
+// sessions of the sender.
+func TestUIMirrorMessage(t *testing.T) {
+	t.Log("Given the need to keep the sessions of a user in step.")
+	{
+		log := managerstest.Logger()
+		fromID := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+		toID := common.HexToAddress("0x00000000000000000000000000000000000000b1")
+
+		tests := []struct {
+			name     string
+			typ      msgType
+			mirrored bool
+		}{
+			{name: "copy a chat message", typ: msgTypeChat, mirrored: true},
+			{name: "copy a reaction", typ: msgTypeReaction, mirrored: true},
+			{name: "copy an edit", typ: msgTypeEdit, mirrored: true},
+			{name: "not copy a receipt", typ: msgTypeReceipt},
+			{name: "not copy a command", typ: msgTypeCommand},
+		}
+
+		for _, tt := range tests {
+			sendW, _ := newTestUIWriter(t, 10, SlowConsumerDisconnect)
+			otherW, _ := newTestUIWriter(t, 10, SlowConsumerDisconnect)
+
+			from := UIUser{ID: fromID, SessionID: uuid.New(), UIWriter: sendW}
+			users := testUsers{users: map[common.Address][]UIUser{
+				fromID: {from, {ID: fromID, SessionID: uuid.New(), UIWriter: otherW}},
+			}}
+
+			b := Business{
+				log:         log,
+				uiDeliverer: NewUIDeliverer(log, users, &testLog{}),
+			}
+
+			b.uiMirrorMessage(context.Background(), from, uiIncomingMessage{
+				envelope: envelope{Version: ProtocolVersion, ID: uuid.New(), Type: tt.typ},
+				ToID:     toID,
+				Msg:      [][]byte{[]byte("ADD"), []byte(uuid.NewString()), []byte("👍")},
+			}, false)
+
+			mirrored := otherW.Stats().Depth > 0
+
+			switch {
+			case sendW.Stats().Depth > 0:
+				t.Errorf("\tShould %s: %s: sent to the sending session", tt.name, "X")
+			case mirrored != tt.mirrored:
+				t.Errorf("\tShould %s: %s: mirrored[%t]", tt.name, "X", mirrored)
+			default:
+				t.Logf("\tShould %s: %s", tt.name, "OK")
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+// testAddUsers is a UIClientManager that takes a while to add a session,
+// like registering the user in the presence directory does.
+type testAddUsers struct {
+	testUsers
+	delay time.Duration
+	err   error
+}
+
+func (tu testAddUsers) Add(ctx context.Context, usr UIUser) error {
+	select {
+	case <-time.After(tu.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if tu.err != nil {
+		return tu.err
+	}
+
+	return tu.testUsers.Add(ctx, usr)
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal("\tShould be able to generate a key.", "X", err)
+	}
+
+	return key
+}
+
+// uiHandshake runs the handshake for the token subject with the message
+// signed by the key. It returns what the CAP answered with and the error
+// from the handshake.
+func uiHandshake(t *testing.T, b *Business, subjectID common.Address, key *ecdsa.PrivateKey, hsMsg uiHandshakeMessage) (string, error) {
+	errs := make(chan error, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usr, err := b.UIHandshake(context.Background(), w, r, subjectID)
+		if err == nil {
+			t.Cleanup(func() { uiClose(usr) })
+		}
+		errs <- err
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("\tShould be able to connect the web socket.", "X", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal("\tShould receive the challenge.", "X", err)
+	}
+
+	challenge := strings.TrimPrefix(string(msg), "CHALLENGE ")
+
+	hsMsg.V, hsMsg.R, hsMsg.S, err = signature.Sign(challenge, key)
+	if err != nil {
+		t.Fatal("\tShould be able to sign the challenge.", "X", err)
+	}
+
+	data, err := json.Marshal(hsMsg)
+	if err != nil {
+		t.Fatal("\tShould be able to marshal the handshake.", "X", err)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal("\tShould be able to send the handshake.", "X", err)
+	}
+
+	_, msg, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatal("\tShould receive the answer to the handshake.", "X", err)
+	}
+
+	return string(msg), <-errs
+}
+
+// newTestTCPServer returns a tcp server that isn't listening, so it has no
+// peer links.
+func newTestTCPServer(t *testing.T, users UIClientManager, deliverer *UIDeliverer, inbox InboxManager) *tcp.Server {
+	log := managerstest.Logger()
+
+	srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+		NetType:  "tcp",
+		Addr:     "127.0.0.1:0",
+		Handlers: NewServerHandlers(log, users, deliverer, inbox, newTestGroups(), nil, false),
+	})
+	if err != nil {
+		t.Fatal("\tShould be able to create the tcp server.", "X", err)
+	}
+
+	return srv
+}
+
+// testTCPClients is a TCPClientManager without any peer links.
+type testTCPClients struct{}
+
+func (tc testTCPClients) DialUserContext(ctx context.Context, key string, userID string, network string, address string) (*tcp.Client, error) {
+	return nil, tcp.ErrUserNotConnected
+}
+
+func (tc testTCPClients) Retrieve(ctx context.Context, userID string) (*tcp.Client, error) {
+	return nil, tcp.ErrUserNotConnected
+}
+
+func (tc testTCPClients) SendTo(userID string, data []byte) error {
+	return tcp.ErrUserNotConnected
+}
+
+func (tc testTCPClients) CloseByUserID(userID string) error {
+	return nil
+}
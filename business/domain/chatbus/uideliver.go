@@ -0,0 +1,191 @@
+package chatbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/PeterLee0620/GoIM/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// UIDeliverer delivers messages to the web socket sessions of users. Every
+// message is added to the user's delivery log first, so a session that drops
+// can replay what it missed using the delivery sequence it last saw.
+type UIDeliverer struct {
+	log         *logger.Logger
+	uiCltMgr    UIClientManager
+	deliveryMgr DeliveryManager
+	locks       [64]sync.Mutex
+	replaying   sync.Map
+}
+
+// NewUIDeliverer creates a new deliverer for web socket sessions.
+func NewUIDeliverer(log *logger.Logger, uiCltMgr UIClientManager, deliveryMgr DeliveryManager) *UIDeliverer {
+	return &UIDeliverer{
+		log:         log,
+		uiCltMgr:    uiCltMgr,
+		deliveryMgr: deliveryMgr,
+	}
+}
+
+// Deliver sends the message to every session of the specified user. The
+// ErrNotExists error is returned when the user has no sessions on this CAP.
+func (d *UIDeliverer) Deliver(ctx context.Context, from UIUser, toID common.Address, inMsg uiIncomingMessage) error {
+	mu := d.lock(toID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	sessions, err := d.uiCltMgr.Retrieve(ctx, toID)
+	if err != nil {
+		return err
+	}
+
+	seq, err := d.append(ctx, from, toID, inMsg)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, to := range sessions {
+		if _, replaying := d.replaying.Load(to.SessionID); replaying {
+			continue
+		}
+
+		if err := uiSendMessage(from, to, inMsg, seq); err != nil {
+			errs = append(errs, fmt.Errorf("session[%s]: %w", to.SessionID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Mirror sends a copy of what the user sent to their other sessions. The
+// copy is kept in the delivery log so devices that aren't connected get it
+// when they replay.
+func (d *UIDeliverer) Mirror(ctx context.Context, from UIUser, inMsg uiIncomingMessage) error {
+	mu := d.lock(from.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	seq, err := d.append(ctx, from, from.ID, inMsg)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := d.uiCltMgr.Retrieve(ctx, from.ID)
+	if err != nil {
+		return nil
+	}
+
+	var errs []error
+	for _, to := range sessions {
+		if to.SessionID == from.SessionID {
+			continue
+		}
+
+		if _, replaying := d.replaying.Load(to.SessionID); replaying {
+			continue
+		}
+
+		if err := uiSendMessage(from, to, inMsg, seq); err != nil {
+			errs = append(errs, fmt.Errorf("session[%s]: %w", to.SessionID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Replay sends the session everything in the delivery log after the cursor
+// it presented in the handshake. The session doesn't receive new messages
+// until the replay is complete, so messages are always received in delivery
+// order.
+func (d *UIDeliverer) Replay(ctx context.Context, usr UIUser) error {
+	send := func(seq uint64, data []byte) error {
+		var natsMsg natsInOutMessage
+		if err := json.Unmarshal(data, &natsMsg); err != nil {
+			d.log.Info(ctx, "uireplay: unmarshal", "ERROR", err, "seq", seq)
+			return nil
+		}
+
+		// The device doesn't need a copy of what it sent itself.
+		if natsMsg.FromID == usr.ID && natsMsg.FromDevice == usr.Device {
+			return nil
+		}
+
+		from := UIUser{
+			ID:   natsMsg.FromID,
+			Name: natsMsg.FromName,
+		}
+
+		return uiSendMessage(from, usr, natsMsg.uiIncomingMessage, seq)
+	}
+
+	// Most of the replay happens while other messages are being delivered,
+	// the last part happens while deliveries to the user are held.
+
+	last, err := d.deliveryMgr.Replay(ctx, usr.ID, usr.Cursor, send)
+	if err != nil {
+		d.release(usr)
+		return fmt.Errorf("replay: %w", err)
+	}
+
+	mu := d.lock(usr.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	d.release(usr)
+
+	if _, err := d.deliveryMgr.Replay(ctx, usr.ID, last, send); err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// hold keeps new messages from being sent to the session until it has been
+// replayed.
+func (d *UIDeliverer) hold(usr UIUser) {
+	d.replaying.Store(usr.SessionID, struct{}{})
+}
+
+// release lets new messages be sent to the session.
+func (d *UIDeliverer) release(usr UIUser) {
+	d.replaying.Delete(usr.SessionID)
+}
+
+func (d *UIDeliverer) lock(userID common.Address) *sync.Mutex {
+	return &d.locks[int(userID[len(userID)-1])%len(d.locks)]
+}
+
+func (d *UIDeliverer) append(ctx context.Context, from UIUser, toID common.Address, inMsg uiIncomingMessage) (uint64, error) {
+
+	// Events only matter to the session that is connected at the time.
+	if inMsg.Type == msgTypeEvent {
+		return 0, nil
+	}
+
+	natsMsg := natsInOutMessage{
+		FromID:            from.ID,
+		FromName:          from.Name,
+		uiIncomingMessage: inMsg,
+	}
+
+	data, err := json.Marshal(natsMsg)
+	if err != nil {
+		return 0, fmt.Errorf("delivery marshal message: %w", err)
+	}
+
+	// A message the inbox hands back after a failed send is already in the
+	// log, the ID keeps it from being added twice.
+	seq, err := d.deliveryMgr.Append(ctx, toID, inMsg.ID, data)
+	if err != nil {
+		return 0, fmt.Errorf("delivery append: %w", err)
+	}
+
+	return seq, nil
+}
@@ -0,0 +1,196 @@
+package chatbus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrSlowConsumer is returned when a user can't keep up with the messages
+// being sent to them.
+var ErrSlowConsumer = errors.New("slow consumer")
+
+// uiWriteWait is how long a single write to a user can take.
+const uiWriteWait = 10 * time.Second
+
+// SlowConsumerPolicy defines what happens when the outbound queue for a user
+// is full.
+type SlowConsumerPolicy int
+
+// Set of slow consumer policies.
+const (
+	SlowConsumerDropOldest SlowConsumerPolicy = iota + 1
+	SlowConsumerDisconnect
+)
+
+// ParseSlowConsumerPolicy parses the string value of a policy.
+func ParseSlowConsumerPolicy(value string) (SlowConsumerPolicy, error) {
+	switch value {
+	case "drop-oldest":
+		return SlowConsumerDropOldest, nil
+	case "disconnect":
+		return SlowConsumerDisconnect, nil
+	}
+
+	return 0, fmt.Errorf("invalid slow consumer policy %q", value)
+}
+
+// String implements the fmt.Stringer interface.
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case SlowConsumerDropOldest:
+		return "drop-oldest"
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	}
+
+	return "unknown"
+}
+
+// UIWriterStats provides the state of the outbound queue for a user.
+type UIWriterStats struct {
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Sent     uint64 `json:"sent"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// =============================================================================
+
+type uiFrame struct {
+	messageType int
+	data        []byte
+}
+
+// UIWriter owns all the writes to a user's web socket connection. The web
+// socket package doesn't support concurrent writers, so messages are queued
+// and written by a single goroutine.
+type UIWriter struct {
+	conn      *websocket.Conn
+	policy    SlowConsumerPolicy
+	queue     chan uiFrame
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+func newUIWriter(conn *websocket.Conn, depth int, policy SlowConsumerPolicy) *UIWriter {
+	// Dropping the oldest message needs a queue to drop it from.
+	if depth < 1 {
+		depth = 1
+	}
+
+	w := UIWriter{
+		conn:   conn,
+		policy: policy,
+		queue:  make(chan uiFrame, depth),
+		done:   make(chan struct{}),
+	}
+
+	go w.writer()
+
+	return &w
+}
+
+// WriteMessage queues the data to be written to the user.
+func (w *UIWriter) WriteMessage(messageType int, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return websocket.ErrCloseSent
+	default:
+	}
+
+	frame := uiFrame{
+		messageType: messageType,
+		data:        data,
+	}
+
+	for {
+		select {
+		case w.queue <- frame:
+			return nil
+		default:
+		}
+
+		if w.policy == SlowConsumerDisconnect {
+			w.Close()
+			return ErrSlowConsumer
+		}
+
+		// Make room by dropping the oldest message in the queue.
+		select {
+		case <-w.queue:
+			w.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// WriteJSON queues the JSON encoding of the value to be written to the user.
+func (w *UIWriter) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	return w.WriteMessage(websocket.TextMessage, data)
+}
+
+// Ping sends a ping to the user. Control messages are allowed to be written
+// concurrently with the writer goroutine.
+func (w *UIWriter) Ping(data []byte) error {
+	return w.conn.WriteControl(websocket.PingMessage, data, time.Now().Add(uiWriteWait))
+}
+
+// Stats returns the current state of the outbound queue.
+func (w *UIWriter) Stats() UIWriterStats {
+	return UIWriterStats{
+		Depth:    len(w.queue),
+		Capacity: cap(w.queue),
+		Sent:     w.sent.Load(),
+		Dropped:  w.dropped.Load(),
+	}
+}
+
+// Close stops the writer and closes the connection. Messages still in the
+// queue are not written.
+func (w *UIWriter) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.conn.Close()
+	})
+
+	return err
+}
+
+// =============================================================================
+
+func (w *UIWriter) writer() {
+	for {
+		select {
+		case <-w.done:
+			return
+
+		case frame := <-w.queue:
+			w.conn.SetWriteDeadline(time.Now().Add(uiWriteWait))
+
+			if err := w.conn.WriteMessage(frame.messageType, frame.data); err != nil {
+				w.Close()
+				return
+			}
+
+			w.sent.Add(1)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package chatbus
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestUIWriterPolicy provides a test of what happens to the messages for a
+// user that can't keep up.
+func TestUIWriterPolicy(t *testing.T) {
+	t.Log("Given the need to handle users that can't keep up with their messages.")
+	{
+		tests := []struct {
+			name    string
+			policy  SlowConsumerPolicy
+			depth   int
+			writes  int
+			errAt   int
+			dropped uint64
+			exp     []string
+		}{
+			{
+				name:    "drop the oldest messages",
+				policy:  SlowConsumerDropOldest,
+				depth:   2,
+				writes:  4,
+				errAt:   -1,
+				dropped: 2,
+				exp:     []string{"m2", "m3"},
+			},
+			{
+				name:   "disconnect the user",
+				policy: SlowConsumerDisconnect,
+				depth:  2,
+				writes: 3,
+				errAt:  2,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Logf("\tWhen the policy is %s.", tt.policy)
+			{
+				w, client := newTestUIWriter(t, tt.depth, tt.policy)
+
+				// Nothing is written until the queue has been filled.
+				for i := range tt.writes {
+					err := w.WriteMessage(websocket.TextMessage, fmt.Appendf(nil, "m%d", i))
+
+					switch {
+					case i == tt.errAt && !errors.Is(err, ErrSlowConsumer):
+						t.Fatalf("\t\tShould %s when the queue is full. %s %v", tt.name, "X", err)
+					case i != tt.errAt && err != nil:
+						t.Fatalf("\t\tShould be able to queue message %d. %s %v", i, "X", err)
+					}
+				}
+
+				if stats := w.Stats(); stats.Dropped != tt.dropped {
+					t.Errorf("\t\tShould count %d dropped messages. %s %d", tt.dropped, "X", stats.Dropped)
+				} else {
+					t.Logf("\t\tShould count %d dropped messages. %s", tt.dropped, "OK")
+				}
+
+				go w.writer()
+
+				if tt.errAt >= 0 {
+					if err := w.WriteMessage(websocket.TextMessage, []byte("after")); !errors.Is(err, websocket.ErrCloseSent) {
+						t.Errorf("\t\tShould not queue messages once disconnected. %s %v", "X", err)
+					} else {
+						t.Logf("\t\tShould not queue messages once disconnected. %s", "OK")
+					}
+
+					if _, _, err := client.ReadMessage(); err == nil {
+						t.Errorf("\t\tShould close the connection. %s", "X")
+					} else {
+						t.Logf("\t\tShould %s when the queue is full. %s", tt.name, "OK")
+					}
+					continue
+				}
+
+				var got []string
+				for range tt.exp {
+					_, data, err := client.ReadMessage()
+					if err != nil {
+						t.Fatalf("\t\tShould be able to read a message. %s %v", "X", err)
+					}
+					got = append(got, string(data))
+				}
+
+				if !slices.Equal(got, tt.exp) {
+					t.Errorf("\t\tShould %s when the queue is full. %s %v", tt.name, "X", got)
+				} else {
+					t.Logf("\t\tShould %s when the queue is full. %s", tt.name, "OK")
+				}
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+// newTestUIWriter returns a writer for a connected web socket without its
+// writer goroutine, so the test can fill the queue before anything is sent.
+func newTestUIWriter(t *testing.T, depth int, policy SlowConsumerPolicy) (*UIWriter, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("\tShould be able to connect the web socket.", "X", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	w := UIWriter{
+		conn:   <-conns,
+		policy: policy,
+		queue:  make(chan uiFrame, depth),
+		done:   make(chan struct{}),
+	}
+	t.Cleanup(func() { w.Close() })
+
+	return &w, client
+}
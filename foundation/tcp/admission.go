@@ -0,0 +1,217 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultBindTimeout is how long a new connection has to complete the TLS
+// handshake and be bound when the configuration doesn't say.
+const defaultBindTimeout = 10 * time.Second
+
+// Set of errors for admitting connections.
+var (
+	ErrInvalidAdmission = errors.New("invalid admission configuration")
+	ErrNotAdmitted      = errors.New("connection not admitted")
+	ErrBindTimeout      = errors.New("bind timeout")
+)
+
+// Admission provides the limits on the connections the server accepts. All
+// the limits are optional. Connections still being bound count towards the
+// limits on clients.
+type Admission struct {
+	MaxClients  int           // Max connections in total.
+	MaxPerIP    int           // Max connections from a single IP.
+	AcceptRate  rate.Limit    // Connections accepted per second.
+	AcceptBurst int           // Connections accepted at once over the rate.
+	Allow       []string      // IPs or CIDRs allowed to connect, any when empty.
+	Deny        []string      // IPs or CIDRs refused, checked before Allow.
+	BindTimeout time.Duration // How long a connection has to be bound.
+}
+
+func (adm Admission) validate() error {
+	if adm.MaxClients < 0 || adm.MaxPerIP < 0 || adm.AcceptRate < 0 || adm.AcceptBurst < 0 || adm.BindTimeout < 0 {
+		return fmt.Errorf("%w: limits can't be negative", ErrInvalidAdmission)
+	}
+
+	if _, err := parsePrefixes(adm.Allow); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidAdmission, err)
+	}
+
+	if _, err := parsePrefixes(adm.Deny); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidAdmission, err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// admission tracks the connections from admission until they are closed.
+type admission struct {
+	maxClients  int
+	maxPerIP    int
+	allow       []netip.Prefix
+	deny        []netip.Prefix
+	limiter     *rate.Limiter
+	bindTimeout time.Duration
+	mu          sync.Mutex
+	total       int
+	perIP       map[netip.Addr]int
+}
+
+func newAdmission(adm Admission) *admission {
+	allow, _ := parsePrefixes(adm.Allow)
+	deny, _ := parsePrefixes(adm.Deny)
+
+	var limiter *rate.Limiter
+	if adm.AcceptRate > 0 {
+		limiter = rate.NewLimiter(adm.AcceptRate, max(adm.AcceptBurst, 1))
+	}
+
+	bindTimeout := adm.BindTimeout
+	if bindTimeout == 0 {
+		bindTimeout = defaultBindTimeout
+	}
+
+	return &admission{
+		maxClients:  adm.MaxClients,
+		maxPerIP:    adm.MaxPerIP,
+		allow:       allow,
+		deny:        deny,
+		limiter:     limiter,
+		bindTimeout: bindTimeout,
+		perIP:       make(map[netip.Addr]int),
+	}
+}
+
+// admit checks the accept rate and the total number of connections, and
+// counts the connection when it's admitted. It's called on the accept loop
+// before anything is read from the connection, so a flood of connections is
+// refused without starting a goroutine for each. Every admitted connection
+// must be released.
+func (a *admission) admit() error {
+	if a.limiter != nil && !a.limiter.Allow() {
+		return fmt.Errorf("%w: accept rate exceeded", ErrNotAdmitted)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxClients > 0 && a.total >= a.maxClients {
+		return fmt.Errorf("%w: max clients[ %d ]", ErrNotAdmitted, a.maxClients)
+	}
+
+	a.total++
+
+	return nil
+}
+
+// release stops counting a connection that was admitted.
+func (a *admission) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.total--
+}
+
+// admitIP checks the IP the connection came from against the lists and the
+// connections from that IP, and counts the connection when it's admitted.
+// It's called once the address of the source is known, after any PROXY
+// header is read. Every connection admitted for an IP must be released.
+func (a *admission) admitIP(conn net.Conn) error {
+	ip := connIP(conn)
+
+	switch {
+	case matchPrefixes(a.deny, ip):
+		return fmt.Errorf("%w: %s denied", ErrNotAdmitted, ip)
+
+	case len(a.allow) > 0 && !matchPrefixes(a.allow, ip):
+		return fmt.Errorf("%w: %s not allowed", ErrNotAdmitted, ip)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxPerIP > 0 && a.perIP[ip] >= a.maxPerIP {
+		return fmt.Errorf("%w: max clients[ %d ] for %s", ErrNotAdmitted, a.maxPerIP, ip)
+	}
+
+	a.perIP[ip]++
+
+	return nil
+}
+
+// releaseIP stops counting a connection that was admitted for its IP.
+func (a *admission) releaseIP(conn net.Conn) {
+	ip := connIP(conn)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.perIP[ip]--
+	if a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
+
+// =============================================================================
+
+// connIP returns the IP the connection came from. IPv4 addresses mapped to
+// IPv6 are unmapped so they match IPv4 prefixes.
+func connIP(conn net.Conn) netip.Addr {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}
+	}
+
+	ip, _ := netip.AddrFromSlice(tcpAddr.IP)
+
+	return ip.Unmap()
+}
+
+// parsePrefixes accepts CIDRs along with single IPs, which match only that IP.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+
+		if !strings.Contains(s, "/") {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+
+			ip = ip.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func matchPrefixes(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
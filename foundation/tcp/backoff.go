@@ -0,0 +1,81 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrInvalidBackoff is returned when the backoff configuration can't be used.
+var ErrInvalidBackoff = errors.New("invalid backoff configuration")
+
+// Backoff provides the delays between attempts. The delay starts at Min and
+// doubles with each attempt up to Max. Jitter is the fraction of each delay,
+// between 0 and 1, that's random so peers don't retry in lockstep.
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+func (bo Backoff) validate() error {
+	if bo.Min < 0 || bo.Max < 0 || bo.Jitter < 0 || bo.Jitter > 1 {
+		return ErrInvalidBackoff
+	}
+
+	if bo.Max > 0 && bo.Min > bo.Max {
+		return ErrInvalidBackoff
+	}
+
+	return nil
+}
+
+// withDefaults fills in the delays that are not set.
+func (bo Backoff) withDefaults(minDelay time.Duration, maxDelay time.Duration) Backoff {
+	if bo.Min == 0 {
+		bo.Min = minDelay
+	}
+
+	if bo.Max == 0 {
+		bo.Max = max(maxDelay, bo.Min)
+	}
+
+	return bo
+}
+
+// delay returns how long to wait before the attempt, starting at 0.
+func (bo Backoff) delay(attempt int) time.Duration {
+	d := bo.Min
+	for range attempt {
+		if d >= bo.Max/2 {
+			d = bo.Max
+			break
+		}
+		d *= 2
+	}
+
+	d = min(d, bo.Max)
+
+	if bo.Jitter > 0 {
+		spread := time.Duration(float64(d) * bo.Jitter)
+		d = d - spread + time.Duration(rand.Int64N(int64(2*spread)+1))
+	}
+
+	return d
+}
+
+// sleep waits for the delay before the attempt. It reports false when the
+// context is canceled first.
+func (bo Backoff) sleep(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(bo.delay(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+
+	case <-ctx.Done():
+		return false
+	}
+}
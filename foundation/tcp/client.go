@@ -1,10 +1,14 @@
 package tcp
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -29,26 +33,41 @@ func GetTraceID(ctx context.Context) uuid.UUID {
 
 // =============================================================================
 
-// Client represents a single networked connection.
+// Client represents a single networked connection. The handlers either use
+// the Reader and Writer directly or set a Framer in Bind. Messages should be
+// written with Send, writing to the Writer directly isn't safe for concurrent
+// use and isn't counted in the stats.
 type Client struct {
 	Conn      net.Conn
 	Reader    io.Reader
 	Writer    io.Writer
+	Framer    Framer
 	ctx       context.Context
 	key       string
 	userID    string
+	userMu    sync.RWMutex
+	identity  string
 	name      string
 	log       internalLogger
 	tcpAddr   *net.TCPAddr
 	clients   *clients
 	handlers  Handlers
+	process   ProcessFunc
+	onDrop    []func()
 	ipAddress string
 	isIPv6    bool
+	tlsState  *tls.ConnectionState
+	conn      *statsConn
+	sendMu    sync.Mutex
+	bufWriter *bufio.Writer
 	wg        sync.WaitGroup
+	stopped   atomic.Bool
 	timeConn  time.Time
-	lastAct   time.Time
-	nReads    int
-	nWrites   int
+	lastAct   atomic.Int64
+	missed    atomic.Int32
+	msgsIn    atomic.Int64
+	msgsOut   atomic.Int64
+	nErrors   atomic.Int64
 }
 
 // Key returns the key for the client.
@@ -58,12 +77,35 @@ func (clt *Client) Key() string {
 
 // UserID returns the user ID for the client.
 func (clt *Client) UserID() string {
+	clt.userMu.RLock()
+	defer clt.userMu.RUnlock()
+
 	return clt.userID
 }
 
-// SetUserID sets the user ID for the client.
+// SetUserID sets the user ID for the client. The client can then be reached
+// by user ID through the server or client manager.
 func (clt *Client) SetUserID(userID string) {
-	clt.userID = userID
+	if clt.clients == nil {
+		clt.userMu.Lock()
+		clt.userID = userID
+		clt.userMu.Unlock()
+		return
+	}
+
+	clt.clients.setUserID(clt, userID)
+}
+
+// Identity returns the identity the peer proved when the connection was
+// bound. It's empty until the handlers verify the peer.
+func (clt *Client) Identity() string {
+	return clt.identity
+}
+
+// SetIdentity records the identity the peer proved when the connection was
+// bound.
+func (clt *Client) SetIdentity(identity string) {
+	clt.identity = identity
 }
 
 // Context returns the context for the client.
@@ -76,30 +118,45 @@ func (clt *Client) TraceID() uuid.UUID {
 	return GetTraceID(clt.ctx)
 }
 
-// newClient creates a new client for an incoming connection.
-func newClient(key string, name string, log internalLogger, clients *clients, handlers Handlers, conn net.Conn) (*Client, error) {
+// newClient creates a new client for a connection. The context carries
+// values for the handlers to use when the client is bound.
+func newClient(ctx context.Context, key string, name string, log internalLogger, clients *clients, handlers Handlers, process ProcessFunc, conn net.Conn) (*Client, error) {
 	now := time.Now().UTC()
 
 	// This will be a TCPAddr 100% of the time.
 	raddr := conn.RemoteAddr().(*net.TCPAddr)
 
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	// Every byte that goes over the connection is counted, including what the
+	// handlers read and write in Bind.
+	sc := statsConn{Conn: conn}
+
 	clt := Client{
-		Conn:      conn,
-		Reader:    conn,
-		Writer:    conn,
-		ctx:       setTraceID(context.Background(), uuid.New()),
+		Conn:      &sc,
+		Reader:    &sc,
+		Writer:    &sc,
+		ctx:       setTraceID(ctx, uuid.New()),
 		key:       key,
 		name:      name,
 		log:       log,
 		tcpAddr:   raddr,
 		clients:   clients,
 		handlers:  handlers,
+		process:   process,
 		ipAddress: ipAddress(conn),
 		isIPv6:    raddr.IP.To4() == nil,
+		tlsState:  tlsState,
+		conn:      &sc,
 		timeConn:  now,
-		lastAct:   now,
 	}
 
+	clt.lastAct.Store(now.UnixNano())
+
 	// Inform the user we have a socket connection for a new client.
 	if err := handlers.Bind(&clt); err != nil {
 		return nil, err
@@ -108,11 +165,64 @@ func newClient(key string, name string, log internalLogger, clients *clients, ha
 	return &clt, nil
 }
 
+// TLS returns the state of the TLS connection. It reports false when the
+// connection doesn't use TLS.
+func (clt *Client) TLS() (tls.ConnectionState, bool) {
+	if clt.tlsState == nil {
+		return tls.ConnectionState{}, false
+	}
+
+	return *clt.tlsState, true
+}
+
+// Send writes the data to the peer as a single frame with the Framer set in
+// Bind, or as is when there is no framer. It's safe for concurrent use and
+// the data is flushed to the connection before it returns.
+func (clt *Client) Send(data []byte) error {
+	clt.sendMu.Lock()
+	defer clt.sendMu.Unlock()
+
+	var err error
+	switch {
+	case clt.Framer != nil:
+		err = clt.Framer.WriteFrame(data)
+
+	default:
+		if clt.bufWriter == nil {
+			clt.bufWriter = bufio.NewWriter(clt.Writer)
+		}
+
+		if _, err = clt.bufWriter.Write(data); err == nil {
+			err = clt.bufWriter.Flush()
+		}
+	}
+
+	if err != nil {
+		clt.nErrors.Add(1)
+		return err
+	}
+
+	clt.msgsOut.Add(1)
+
+	return nil
+}
+
 // SetContext sets the context for the client.
 func (clt *Client) SetContext(ctx context.Context) {
 	clt.ctx = ctx
 }
 
+// lastActivity returns when data was last read from the peer.
+func (clt *Client) lastActivity() time.Time {
+	return time.Unix(0, clt.lastAct.Load()).UTC()
+}
+
+// addDrop adds a function to call when the connection is dropped. It's only
+// called before the client is started or on the client's own goroutine.
+func (clt *Client) addDrop(fn func()) {
+	clt.onDrop = append(clt.onDrop, fn)
+}
+
 func (clt *Client) start() {
 	clt.wg.Add(1)
 	go clt.read()
@@ -125,16 +235,28 @@ func (clt *Client) close() {
 	clt.log(clt.ctx, clt.name, EvtDrop, TypInfo, clt.ipAddress, "connection closed")
 }
 
+// stop closes the connection on purpose, so the connection is not dialed
+// again when the client manager has a redial policy.
+func (clt *Client) stop() {
+	clt.stopped.Store(true)
+	clt.close()
+}
+
 func (clt *Client) read() {
 	clt.log(clt.ctx, clt.name, EvtRead, TypInfo, clt.ipAddress, "client G started")
 
 	defer func() {
+		clt.Conn.Close()
 		clt.handlers.Drop(clt)
 
 		if err := clt.clients.close(clt.key); err != nil {
 			clt.log(clt.ctx, clt.name, EvtDrop, TypError, clt.ipAddress, "error closing client: %s", err)
 		}
 
+		for _, fn := range clt.onDrop {
+			fn()
+		}
+
 		clt.log(clt.ctx, clt.name, EvtDrop, TypInfo, clt.ipAddress, "client G disconnected")
 
 		clt.wg.Done()
@@ -144,8 +266,7 @@ close:
 	for {
 		// Wait for a message to arrive.
 		data, length, err := clt.handlers.Read(clt)
-		clt.lastAct = time.Now().UTC()
-		clt.nReads++
+		readAt := time.Now().UTC()
 
 		if err != nil {
 			// temporary is declared to test for the existence of
@@ -164,9 +285,22 @@ close:
 				break close
 			}
 
+			clt.nErrors.Add(1)
+
+			// The stream can't be trusted after a bad frame.
+			if errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrInvalidFrame) {
+				clt.log(clt.ctx, clt.name, EvtRead, TypError, clt.ipAddress, "bad frame: %s", err)
+				break close
+			}
+
 			continue
 		}
 
+		// Anything read from the peer shows it's alive.
+		clt.lastAct.Store(readAt.UnixNano())
+		clt.missed.Store(0)
+		clt.msgsIn.Add(1)
+
 		// Create the request.
 		r := Request{
 			TCPAddr: &net.TCPAddr{
@@ -175,14 +309,14 @@ close:
 				Zone: clt.tcpAddr.Zone,
 			},
 			IsIPv6:  clt.isIPv6,
-			ReadAt:  clt.lastAct,
-			Context: context.Background(),
+			ReadAt:  readAt,
+			Context: setTraceID(clt.ctx, uuid.New()),
 			Data:    data,
 			Length:  length,
 		}
 
-		// Process the request on this goroutine that is
-		// handling the socket connection.
-		clt.handlers.Process(&r, clt)
+		// Process the request through the middleware on this
+		// goroutine that is handling the socket connection.
+		clt.process(&r, clt)
 	}
 }
@@ -7,9 +7,15 @@ import (
 	"sync"
 )
 
+// ErrUserNotConnected is returned when there is no connection for a user.
+var ErrUserNotConnected = errors.New("user not connected")
+
+// clients holds the connections by key along with an index of the
+// connections by user ID. A user can have more than one connection.
 type clients struct {
 	log       internalLogger
 	clients   map[string]*Client
+	users     map[string]map[string]*Client
 	clientsMu sync.RWMutex
 }
 
@@ -17,6 +23,7 @@ func newClients(log internalLogger) *clients {
 	return &clients{
 		log:     log,
 		clients: make(map[string]*Client),
+		users:   make(map[string]map[string]*Client),
 	}
 }
 
@@ -37,23 +44,36 @@ func (clt *clients) copy() map[string]*Client {
 	return clients
 }
 
+func (clt *clients) stats() []Stat {
+	clients := clt.copy()
+
+	stats := make([]Stat, 0, len(clients))
+	for _, c := range clients {
+		stats = append(stats, c.Stats())
+	}
+
+	return stats
+}
+
 func (clt *clients) add(key string, client *Client) {
 	clt.clientsMu.Lock()
 	defer clt.clientsMu.Unlock()
 
 	clt.clients[key] = client
+	clt.index(client)
 }
 
 func (clt *clients) close(key string) error {
 	clt.clientsMu.Lock()
 	defer clt.clientsMu.Unlock()
 
-	_, exists := clt.clients[key]
+	client, exists := clt.clients[key]
 	if !exists {
 		return errors.New("already removed")
 	}
 
 	delete(clt.clients, key)
+	clt.unindex(client)
 
 	return nil
 }
@@ -69,3 +89,123 @@ func (clt *clients) find(key string) (*Client, error) {
 
 	return c, nil
 }
+
+// =============================================================================
+
+// setUserID changes the user ID for the client and moves it in the index if
+// the client has been added.
+func (clt *clients) setUserID(client *Client, userID string) {
+	clt.clientsMu.Lock()
+	defer clt.clientsMu.Unlock()
+
+	added := clt.clients[client.key] == client
+	if added {
+		clt.unindex(client)
+	}
+
+	client.userMu.Lock()
+	client.userID = userID
+	client.userMu.Unlock()
+
+	if added {
+		clt.index(client)
+	}
+}
+
+func (clt *clients) findByUserID(userID string) ([]*Client, error) {
+	clt.clientsMu.RLock()
+	defer clt.clientsMu.RUnlock()
+
+	conns := clt.users[userID]
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("userID[ %s ] : %w", userID, ErrUserNotConnected)
+	}
+
+	clients := make([]*Client, 0, len(conns))
+	for _, c := range conns {
+		clients = append(clients, c)
+	}
+
+	return clients, nil
+}
+
+// sendTo sends the data to every connection for the user.
+func (clt *clients) sendTo(userID string, data []byte) error {
+	clients, err := clt.findByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	return send(clients, data)
+}
+
+// broadcast sends the data to every connection.
+func (clt *clients) broadcast(data []byte) error {
+	clients := make([]*Client, 0, clt.count())
+	for _, c := range clt.copy() {
+		clients = append(clients, c)
+	}
+
+	return send(clients, data)
+}
+
+// closeByUserID closes every connection for the user.
+func (clt *clients) closeByUserID(userID string) error {
+	clients, err := clt.findByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	// Drop the connections using a goroutine since we are on the
+	// socket goroutine most likely. They are closed on purpose so they
+	// are not dialed again.
+	for _, c := range clients {
+		go c.stop()
+	}
+
+	return nil
+}
+
+// index and unindex must be called with the lock held.
+func (clt *clients) index(client *Client) {
+	if client.userID == "" {
+		return
+	}
+
+	conns, exists := clt.users[client.userID]
+	if !exists {
+		conns = make(map[string]*Client)
+		clt.users[client.userID] = conns
+	}
+
+	conns[client.key] = client
+}
+
+func (clt *clients) unindex(client *Client) {
+	conns := clt.users[client.userID]
+	if conns[client.key] != client {
+		return
+	}
+
+	delete(conns, client.key)
+	if len(conns) == 0 {
+		delete(clt.users, client.userID)
+	}
+}
+
+// =============================================================================
+
+func send(clients []*Client, data []byte) error {
+	var errs Errors
+	for _, c := range clients {
+		if err := c.Send(data); err != nil {
+			errs = append(errs, fmt.Errorf("key[ %s ] : %w", c.key, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
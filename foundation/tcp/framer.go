@@ -0,0 +1,222 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultMaxFrameSize is the largest frame accepted when a framer is created
+// without a max frame size.
+const DefaultMaxFrameSize = 1 << 20
+
+// Set of errors for reading and writing frames.
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrInvalidFrame  = errors.New("invalid frame")
+)
+
+// Framer reads and writes whole frames on a connection so the handlers don't
+// have to know how messages are delimited on the wire. A framer is usually
+// created in Bind and stored in the client. ReadFrame is called from the
+// client's goroutine, WriteFrame is safe for concurrent use. Frames are
+// buffered and flushed so a frame is written to the peer as a whole.
+type Framer interface {
+
+	// ReadFrame blocks until a whole frame is read and returns it without
+	// any delimiter or prefix. A frame larger than the max frame size
+	// returns ErrFrameTooLarge and the connection is dropped.
+	ReadFrame() ([]byte, error)
+
+	// WriteFrame writes the data as a single frame.
+	WriteFrame(data []byte) error
+}
+
+// LengthPrefix is the encoding of the length that comes before each frame.
+type LengthPrefix int
+
+// Set of length prefix encodings.
+const (
+	Uvarint LengthPrefix = iota + 1
+	Uint32
+)
+
+// =============================================================================
+
+// lineFramer delimits frames with a newline.
+type lineFramer struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	wMu     sync.Mutex
+	maxSize int
+}
+
+// NewLineFramer creates a framer that delimits frames with a newline. The data
+// in a frame can't contain a newline.
+func NewLineFramer(rw io.ReadWriter, maxSize int) Framer {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+
+	return &lineFramer{
+		r:       bufio.NewReader(rw),
+		w:       bufio.NewWriter(rw),
+		maxSize: maxSize,
+	}
+}
+
+// ReadFrame implements the Framer interface.
+func (f *lineFramer) ReadFrame() ([]byte, error) {
+	var frame []byte
+
+	for {
+		chunk, err := f.r.ReadSlice('\n')
+
+		// The delimiter isn't part of the frame.
+		size := len(frame) + len(chunk)
+		if err == nil {
+			size--
+		}
+
+		if size > f.maxSize {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrFrameTooLarge, f.maxSize)
+		}
+
+		frame = append(frame, chunk...)
+
+		switch {
+		case err == nil:
+			return frame[:len(frame)-1], nil
+
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+
+		case errors.Is(err, io.EOF) && len(frame) > 0:
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+}
+
+// WriteFrame implements the Framer interface.
+func (f *lineFramer) WriteFrame(data []byte) error {
+	if len(data) > f.maxSize {
+		return fmt.Errorf("%w: %d bytes, max %d", ErrFrameTooLarge, len(data), f.maxSize)
+	}
+
+	if bytes.IndexByte(data, '\n') != -1 {
+		return fmt.Errorf("%w: data contains a newline", ErrInvalidFrame)
+	}
+
+	f.wMu.Lock()
+	defer f.wMu.Unlock()
+
+	f.w.Write(data)
+	f.w.WriteByte('\n')
+
+	return f.w.Flush()
+}
+
+// =============================================================================
+
+// lengthFramer prefixes frames with their length.
+type lengthFramer struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	wMu     sync.Mutex
+	prefix  LengthPrefix
+	maxSize int
+}
+
+// NewLengthFramer creates a framer that prefixes each frame with its length,
+// as an unsigned varint or a big endian uint32. The data in a frame can be
+// anything.
+func NewLengthFramer(rw io.ReadWriter, prefix LengthPrefix, maxSize int) (Framer, error) {
+	if prefix != Uvarint && prefix != Uint32 {
+		return nil, fmt.Errorf("%w: unknown length prefix %d", ErrInvalidFrame, prefix)
+	}
+
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+
+	f := lengthFramer{
+		r:       bufio.NewReader(rw),
+		w:       bufio.NewWriter(rw),
+		prefix:  prefix,
+		maxSize: maxSize,
+	}
+
+	return &f, nil
+}
+
+// ReadFrame implements the Framer interface.
+func (f *lengthFramer) ReadFrame() ([]byte, error) {
+	size, err := f.readSize()
+	if err != nil {
+		return nil, err
+	}
+
+	// The size is checked before any memory is allocated for the frame.
+	if size > uint64(f.maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes, max %d", ErrFrameTooLarge, size, f.maxSize)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(f.r, frame); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// WriteFrame implements the Framer interface.
+func (f *lengthFramer) WriteFrame(data []byte) error {
+	if len(data) > f.maxSize {
+		return fmt.Errorf("%w: %d bytes, max %d", ErrFrameTooLarge, len(data), f.maxSize)
+	}
+
+	var prefix []byte
+	switch f.prefix {
+	case Uvarint:
+		prefix = binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64), uint64(len(data)))
+	case Uint32:
+		prefix = binary.BigEndian.AppendUint32(make([]byte, 0, 4), uint32(len(data)))
+	}
+
+	f.wMu.Lock()
+	defer f.wMu.Unlock()
+
+	f.w.Write(prefix)
+	f.w.Write(data)
+
+	return f.w.Flush()
+}
+
+func (f *lengthFramer) readSize() (uint64, error) {
+	if f.prefix == Uvarint {
+		size, err := binary.ReadUvarint(f.r)
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+				return 0, err
+			}
+			return 0, fmt.Errorf("%w: %w", ErrInvalidFrame, err)
+		}
+		return size, nil
+	}
+
+	var b [4]byte
+	if _, err := io.ReadFull(f.r, b[:]); err != nil {
+		return 0, err
+	}
+
+	return uint64(binary.BigEndian.Uint32(b[:])), nil
+}
@@ -0,0 +1,187 @@
+package tcp_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/PeterLee0620/GoIM/foundation/tcp"
+)
+
+// readWriter joins a reader and a writer for a framer.
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// newFramers returns one of each kind of framer reading from the reader and
+// writing to the buffer.
+func newFramers(t *testing.T, r io.Reader, w io.Writer, maxSize int) map[string]tcp.Framer {
+	rw := readWriter{Reader: r, Writer: w}
+
+	uvarint, err := tcp.NewLengthFramer(rw, tcp.Uvarint, maxSize)
+	if err != nil {
+		t.Fatal("\tShould be able to create a uvarint framer.", "X", err)
+	}
+
+	uint32Framer, err := tcp.NewLengthFramer(rw, tcp.Uint32, maxSize)
+	if err != nil {
+		t.Fatal("\tShould be able to create a uint32 framer.", "X", err)
+	}
+
+	return map[string]tcp.Framer{
+		"line":    tcp.NewLineFramer(rw, maxSize),
+		"uvarint": uvarint,
+		"uint32":  uint32Framer,
+	}
+}
+
+// TestFramerPartialReads provides a test of frames written by each framer
+// being read back whole when the connection returns a byte at a time.
+func TestFramerPartialReads(t *testing.T) {
+	t.Log("Given the need to read whole frames from partial reads.")
+	{
+		frames := [][]byte{
+			[]byte("hello"),
+			{},
+			bytes.Repeat([]byte("x"), 10_000),
+			[]byte(`{"msg":"world"}`),
+		}
+
+		for _, name := range []string{"line", "uvarint", "uint32"} {
+			t.Logf("\tWhen using the %s framer.", name)
+			{
+				var buf bytes.Buffer
+				w := newFramers(t, nil, &buf, 0)[name]
+
+				for _, frame := range frames {
+					if err := w.WriteFrame(frame); err != nil {
+						t.Fatal("\t\tShould be able to write the frames.", "X", err)
+					}
+				}
+				t.Log("\t\tShould be able to write the frames.", "OK")
+
+				r := newFramers(t, iotest.OneByteReader(&buf), io.Discard, 0)[name]
+
+				for i, exp := range frames {
+					got, err := r.ReadFrame()
+					if err != nil {
+						t.Fatalf("\t\tShould be able to read frame %d. %s %v", i, "X", err)
+					}
+
+					if !bytes.Equal(got, exp) {
+						t.Fatalf("\t\tShould read back frame %d. %s got %d bytes, exp %d", i, "X", len(got), len(exp))
+					}
+				}
+				t.Log("\t\tShould read back every frame whole.", "OK")
+
+				if _, err := r.ReadFrame(); !errors.Is(err, io.EOF) {
+					t.Error("\t\tShould get EOF after the last frame.", "X", err)
+				} else {
+					t.Log("\t\tShould get EOF after the last frame.", "OK")
+				}
+			}
+		}
+	}
+}
+
+// TestFramerTruncated provides a test of a connection closing in the middle
+// of a frame.
+func TestFramerTruncated(t *testing.T) {
+	t.Log("Given the need to detect a frame cut short.")
+	{
+		for _, name := range []string{"line", "uvarint", "uint32"} {
+			t.Logf("\tWhen using the %s framer.", name)
+			{
+				var buf bytes.Buffer
+				if err := newFramers(t, nil, &buf, 0)[name].WriteFrame([]byte("hello world")); err != nil {
+					t.Fatal("\t\tShould be able to write the frame.", "X", err)
+				}
+
+				data := buf.Bytes()[:buf.Len()-3]
+
+				_, err := newFramers(t, bytes.NewReader(data), io.Discard, 0)[name].ReadFrame()
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Error("\t\tShould get an unexpected EOF.", "X", err)
+				} else {
+					t.Log("\t\tShould get an unexpected EOF.", "OK")
+				}
+			}
+		}
+	}
+}
+
+// TestFramerMaxSize provides a test of frames larger than the max frame size
+// being refused when they are read and written.
+func TestFramerMaxSize(t *testing.T) {
+	t.Log("Given the need to limit the size of a frame.")
+	{
+		const maxSize = 64
+
+		for _, name := range []string{"line", "uvarint", "uint32"} {
+			t.Logf("\tWhen using the %s framer.", name)
+			{
+				var buf bytes.Buffer
+				large := newFramers(t, nil, &buf, 1024)[name]
+
+				if err := large.WriteFrame(bytes.Repeat([]byte("x"), maxSize)); err != nil {
+					t.Fatal("\t\tShould be able to write a frame at the max size.", "X", err)
+				}
+
+				if err := large.WriteFrame(bytes.Repeat([]byte("x"), maxSize+1)); err != nil {
+					t.Fatal("\t\tShould be able to write a frame over the max size.", "X", err)
+				}
+
+				small := newFramers(t, &buf, io.Discard, maxSize)[name]
+
+				if frame, err := small.ReadFrame(); err != nil || len(frame) != maxSize {
+					t.Error("\t\tShould read a frame at the max size.", "X", err)
+				} else {
+					t.Log("\t\tShould read a frame at the max size.", "OK")
+				}
+
+				if _, err := small.ReadFrame(); !errors.Is(err, tcp.ErrFrameTooLarge) {
+					t.Error("\t\tShould refuse to read a frame over the max size.", "X", err)
+				} else {
+					t.Log("\t\tShould refuse to read a frame over the max size.", "OK")
+				}
+
+				if err := small.WriteFrame(bytes.Repeat([]byte("x"), maxSize+1)); !errors.Is(err, tcp.ErrFrameTooLarge) {
+					t.Error("\t\tShould refuse to write a frame over the max size.", "X", err)
+				} else {
+					t.Log("\t\tShould refuse to write a frame over the max size.", "OK")
+				}
+			}
+		}
+
+		t.Log("\tWhen a length prefix claims a huge frame.")
+		{
+			data := []byte{0xff, 0xff, 0xff, 0xff}
+
+			f, _ := tcp.NewLengthFramer(readWriter{Reader: bytes.NewReader(data), Writer: io.Discard}, tcp.Uint32, maxSize)
+			if _, err := f.ReadFrame(); !errors.Is(err, tcp.ErrFrameTooLarge) {
+				t.Error("\t\tShould refuse the frame before reading it.", "X", err)
+			} else {
+				t.Log("\t\tShould refuse the frame before reading it.", "OK")
+			}
+		}
+	}
+}
+
+// TestLineFramerNewline provides a test of the line framer refusing data that
+// would split into two frames.
+func TestLineFramerNewline(t *testing.T) {
+	t.Log("Given the need to keep newlines out of line delimited frames.")
+	{
+		f := tcp.NewLineFramer(readWriter{Reader: strings.NewReader(""), Writer: io.Discard}, 0)
+
+		if err := f.WriteFrame([]byte("hello\nworld")); !errors.Is(err, tcp.ErrInvalidFrame) {
+			t.Error("\tShould refuse data with a newline.", "X", err)
+		} else {
+			t.Log("\tShould refuse data with a newline.", "OK")
+		}
+	}
+}
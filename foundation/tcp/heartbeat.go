@@ -0,0 +1,173 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultMaxMissed is the number of heartbeats a peer can miss before it's
+// dropped when the configuration doesn't say.
+const defaultMaxMissed = 3
+
+// ErrInvalidHeartbeat is returned when the heartbeat configuration can't be
+// used.
+var ErrInvalidHeartbeat = errors.New("invalid heartbeat configuration")
+
+// HeartbeatHandler is implemented by the user to send a heartbeat to a peer
+// that has gone quiet. The peer is expected to answer with anything that is
+// read off the connection, usually a pong.
+type HeartbeatHandler interface {
+
+	// Heartbeat is called to write a heartbeat to the peer.
+	Heartbeat(clt *Client) error
+}
+
+// Heartbeat provides the settings for keeping connections alive and dropping
+// the ones that go quiet. Both are optional.
+type Heartbeat struct {
+
+	// Interval is how long a peer can be quiet before it's sent a heartbeat.
+	// The peer is dropped after MaxMissed heartbeats go unanswered. The
+	// handlers must implement HeartbeatHandler.
+	Interval  time.Duration
+	MaxMissed int
+
+	// IdleTimeout is how long a peer can be quiet before it's dropped,
+	// regardless of heartbeats.
+	IdleTimeout time.Duration
+}
+
+func (hb Heartbeat) validate(handlers Handlers) error {
+	if hb.Interval < 0 || hb.IdleTimeout < 0 || hb.MaxMissed < 0 {
+		return ErrInvalidHeartbeat
+	}
+
+	if hb.Interval > 0 {
+		if _, ok := handlers.(HeartbeatHandler); !ok {
+			return ErrInvalidHeartbeat
+		}
+	}
+
+	return nil
+}
+
+// enabled reports if connections need to be groomed.
+func (hb Heartbeat) enabled() bool {
+	return hb.Interval > 0 || hb.IdleTimeout > 0
+}
+
+// tick returns how often the connections are checked.
+func (hb Heartbeat) tick() time.Duration {
+	switch {
+	case hb.Interval == 0:
+		return hb.IdleTimeout / 2
+	case hb.IdleTimeout == 0:
+		return hb.Interval
+	}
+
+	return min(hb.Interval, hb.IdleTimeout/2)
+}
+
+// =============================================================================
+
+// groomer runs in the background to send heartbeats to quiet peers and drop
+// the ones that stop answering or stay idle too long.
+type groomer struct {
+	name     string
+	log      internalLogger
+	clients  *clients
+	handlers Handlers
+	hb       Heartbeat
+	shutdown chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+func newGroomer(name string, log internalLogger, clients *clients, handlers Handlers, hb Heartbeat) *groomer {
+	if hb.Interval > 0 && hb.MaxMissed == 0 {
+		hb.MaxMissed = defaultMaxMissed
+	}
+
+	return &groomer{
+		name:     name,
+		log:      log,
+		clients:  clients,
+		handlers: handlers,
+		hb:       hb,
+		shutdown: make(chan struct{}),
+	}
+}
+
+// start starts the background goroutine when grooming is enabled.
+func (g *groomer) start(ctx context.Context) {
+	if !g.hb.enabled() {
+		return
+	}
+
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+
+		g.log(ctx, g.name, EvtGroom, TypInfo, "", "groomer started: heartbeat[ %v ] missed[ %d ] idle[ %v ]", g.hb.Interval, g.hb.MaxMissed, g.hb.IdleTimeout)
+		defer g.log(ctx, g.name, EvtGroom, TypInfo, "", "groomer stopped")
+
+		ticker := time.NewTicker(g.hb.tick())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				g.groom(ctx)
+
+			case <-g.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the background goroutine and waits for it to finish.
+func (g *groomer) stop() {
+	g.once.Do(func() {
+		close(g.shutdown)
+	})
+
+	g.wg.Wait()
+}
+
+func (g *groomer) groom(ctx context.Context) {
+	now := time.Now().UTC()
+
+	for _, c := range g.clients.copy() {
+		lastAct := c.lastActivity()
+		quiet := now.Sub(lastAct)
+
+		if g.hb.IdleTimeout > 0 && quiet >= g.hb.IdleTimeout {
+			g.log(ctx, g.name, EvtGroom, TypInfo, c.ipAddress, "idle: Last[ %v ] Dur[ %v ]", lastAct.Format(time.RFC3339), quiet)
+
+			// An idle connection isn't needed so it's not dialed again.
+			go c.stop()
+			continue
+		}
+
+		if g.hb.Interval == 0 || quiet < g.hb.Interval {
+			continue
+		}
+
+		// A heartbeat is missed when the peer stays quiet for an interval
+		// after it was sent. Anything read from the peer resets the count.
+		missed := int(c.missed.Add(1)) - 1
+		if missed >= g.hb.MaxMissed {
+			g.log(ctx, g.name, EvtDrop, TypInfo, c.ipAddress, "missed heartbeats: Missed[ %d ] Last[ %v ]", missed, lastAct.Format(time.RFC3339))
+			go c.close()
+			continue
+		}
+
+		if err := g.handlers.(HeartbeatHandler).Heartbeat(c); err != nil {
+			g.log(ctx, g.name, EvtGroom, TypError, c.ipAddress, "heartbeat: %s", err)
+		}
+	}
+}
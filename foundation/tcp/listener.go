@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"context"
 	"net"
 	"sync"
 )
@@ -29,15 +30,17 @@ func (l *listener) reset() {
 	l.listener = nil
 }
 
-func (l *listener) start(network string, laddr *net.TCPAddr) (*net.TCPListener, error) {
+func (l *listener) start(ctx context.Context, network string, laddr *net.TCPAddr) (*net.TCPListener, error) {
 	l.listenerMu.Lock()
 	defer l.listenerMu.Unlock()
 
-	listener, err := net.ListenTCP(network, laddr)
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, network, laddr.String())
 	if err != nil {
 		return nil, err
 	}
 
+	listener := ln.(*net.TCPListener)
 	l.listener = listener
 
 	return listener, nil
@@ -2,9 +2,12 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 )
 
 // Set of errors for the TCP client manager.
@@ -12,10 +15,50 @@ var (
 	ErrClientAlreadyConnected = errors.New("client already connected")
 )
 
+// Redial provides the policy for dialing a peer again when its connection
+// drops. Connections closed on purpose, like on shutdown or when closed by
+// user ID, are not dialed again. It's disabled when MaxAttempts is 0.
+type Redial struct {
+	MaxAttempts int     // Attempts before giving up on the peer.
+	Backoff     Backoff // Delay before each attempt, from 1s up to 1m when not set.
+}
+
+func (rd Redial) validate() error {
+	if rd.MaxAttempts < 0 {
+		return fmt.Errorf("%w: max attempts can't be negative", ErrInvalidBackoff)
+	}
+
+	return rd.Backoff.validate()
+}
+
+// =============================================================================
+
 // ClientConfig provides a data structure of required configuration parameters.
 type ClientConfig struct {
 	Handlers Handlers // Support for binding and handling requests.
 	Logger   Logger   // Support for logging events that occur in the TCP listener.
+
+	// TLS is optional. When set, every connection is dialed with a mutually
+	// authenticated TLS handshake.
+	TLS *TLSConfig
+
+	// Heartbeat is optional. When set, quiet connections are sent heartbeats
+	// and dropped when they stop answering or stay idle too long.
+	Heartbeat Heartbeat
+
+	// Middleware is optional. It wraps the processing of every request, the
+	// first middleware is executed first.
+	Middleware []MidFunc
+
+	// DialTimeout and BindTimeout are optional. They limit how long it takes
+	// to connect to the peer and then to complete the TLS handshake and
+	// Bind. The bind timeout is 10s when not set.
+	DialTimeout time.Duration
+	BindTimeout time.Duration
+
+	// Redial is optional. When set, peers whose connection drops are dialed
+	// again.
+	Redial Redial
 }
 
 func (cfg ClientConfig) validate() error {
@@ -27,15 +70,43 @@ func (cfg ClientConfig) validate() error {
 		return ErrInvalidLoggerHandler
 	}
 
+	if cfg.TLS != nil {
+		if err := cfg.TLS.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.Heartbeat.validate(cfg.Handlers); err != nil {
+		return err
+	}
+
+	if cfg.DialTimeout < 0 || cfg.BindTimeout < 0 {
+		return errors.New("invalid timeout configuration")
+	}
+
+	if err := cfg.Redial.validate(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // ClientManager manages a collection of TCP client connections.
 type ClientManager struct {
-	name     string
-	log      internalLogger
-	handlers Handlers
-	clients  *clients
+	ctx         context.Context
+	cancel      context.CancelFunc
+	name        string
+	log         internalLogger
+	handlers    Handlers
+	process     ProcessFunc
+	clients     *clients
+	tlsConfig   *tls.Config
+	groomer     *groomer
+	dialTimeout time.Duration
+	bindTimeout time.Duration
+	redial      Redial
+	redialMu    sync.Mutex
+	wg          sync.WaitGroup
 }
 
 // NewClientManager creates a new ClientManager.
@@ -44,17 +115,50 @@ func NewClientManager(name string, cfg ClientConfig) (*ClientManager, error) {
 		return nil, err
 	}
 
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		tlsConfig, err = cfg.TLS.clientTLS()
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+
 	l := func(ctx context.Context, name string, evt int, typ int, ipAddress string, format string, a ...any) {
 		cfg.Logger(ctx, name, eventTypes[evt], eventSubTypes[typ], ipAddress, fmt.Sprintf(format, a...))
 	}
 
+	clients := newClients(l)
+
+	bindTimeout := cfg.BindTimeout
+	if bindTimeout == 0 {
+		bindTimeout = defaultBindTimeout
+	}
+
+	redial := cfg.Redial
+	redial.Backoff = redial.Backoff.withDefaults(time.Second, time.Minute)
+
+	// Redialing peers is canceled through this context on shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+
 	cm := ClientManager{
-		name:     name,
-		log:      l,
-		handlers: cfg.Handlers,
-		clients:  newClients(l),
+		ctx:         ctx,
+		cancel:      cancel,
+		name:        name,
+		log:         l,
+		handlers:    cfg.Handlers,
+		process:     wrapMiddleware(cfg.Middleware, cfg.Handlers.Process),
+		clients:     clients,
+		tlsConfig:   tlsConfig,
+		groomer:     newGroomer(name, l, clients, cfg.Handlers, cfg.Heartbeat),
+		dialTimeout: cfg.DialTimeout,
+		bindTimeout: bindTimeout,
+		redial:      redial,
 	}
 
+	// The dialed connections are groomed for as long as the manager runs.
+	cm.groomer.start(context.Background())
+
 	return &cm, nil
 }
 
@@ -63,14 +167,22 @@ func (cm *ClientManager) Shutdown(ctx context.Context) error {
 	cm.log(ctx, cm.name, EvtStop, TypInfo, "", "client manager started shutdown")
 	defer cm.log(ctx, cm.name, EvtStop, TypInfo, "", "client manager completed shutdown")
 
+	cm.redialMu.Lock()
+	cm.cancel()
+	cm.redialMu.Unlock()
+
+	cm.groomer.stop()
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	go func() {
 		defer cancel()
 
 		for _, c := range cm.clients.copy() {
-			go c.close()
+			go c.stop()
 		}
+
+		cm.wg.Wait()
 	}()
 
 	<-ctx.Done()
@@ -83,22 +195,126 @@ func (cm *ClientManager) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-// Dial establishes a new TCP connection to the specified address.
+// Dial establishes a new TCP connection to the specified address. It's the
+// same as DialContext.
 func (cm *ClientManager) Dial(ctx context.Context, key string, network string, address string) (*Client, error) {
+	return cm.DialContext(ctx, key, network, address)
+}
+
+// DialContext establishes a new TCP connection to the specified address.
+// Canceling the context stops the dial, TLS handshake and Bind, once the
+// client is returned the context no longer affects it. Values in the context
+// are available to the handlers through the client's context.
+func (cm *ClientManager) DialContext(ctx context.Context, key string, network string, address string) (*Client, error) {
+	return cm.dial(ctx, key, network, address, "")
+}
+
+// DialUserContext is the same as DialContext but sets the user ID for the
+// client before it starts reading, unless the handlers set one in Bind. The
+// requests from the peer are never processed without the user ID.
+func (cm *ClientManager) DialUserContext(ctx context.Context, key string, userID string, network string, address string) (*Client, error) {
+	return cm.dial(ctx, key, network, address, userID)
+}
+
+// Retrieve retrieves a client by user ID.
+func (cm *ClientManager) Retrieve(ctx context.Context, key string) (*Client, error) {
+	clt, err := cm.clients.find(key)
+	if err != nil {
+		return nil, fmt.Errorf("find: %w", err)
+	}
+
+	return clt, nil
+}
+
+// SendTo sends the data to every connection for the user.
+func (cm *ClientManager) SendTo(userID string, data []byte) error {
+	return cm.clients.sendTo(userID, data)
+}
+
+// Broadcast sends the data to every connection.
+func (cm *ClientManager) Broadcast(data []byte) error {
+	return cm.clients.broadcast(data)
+}
+
+// CloseByUserID closes every connection for the user.
+func (cm *ClientManager) CloseByUserID(userID string) error {
+	return cm.clients.closeByUserID(userID)
+}
+
+// =============================================================================
+
+// dial establishes the connection and adds the client. The user ID is set
+// when the handlers don't set one in Bind, which keeps the user ID of a peer
+// that is dialed again.
+func (cm *ClientManager) dial(ctx context.Context, key string, network string, address string, userID string) (*Client, error) {
 	if _, err := cm.clients.find(key); err == nil {
 		return nil, ErrClientAlreadyConnected
 	}
 
-	conn, err := net.Dial(network, address)
+	dialer := net.Dialer{
+		Timeout: cm.dialTimeout,
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, fmt.Errorf("dial: %w", err)
 	}
 
-	clt, err := newClient(key, cm.name, cm.log, cm.clients, cm.handlers, conn)
+	// The connection is closed if the TLS handshake and Bind don't complete
+	// within the bind timeout or the context is canceled.
+	bindCtx, cancel := context.WithTimeoutCause(ctx, cm.bindTimeout, ErrBindTimeout)
+	defer cancel()
+
+	rawConn := conn
+	stop := context.AfterFunc(bindCtx, func() {
+		rawConn.Close()
+	})
+
+	if cm.tlsConfig != nil {
+		tlsConfig := cm.tlsConfig
+
+		// The server's certificate is verified against the host we dialed
+		// unless a name was configured.
+		if tlsConfig.ServerName == "" {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				tlsConfig = tlsConfig.Clone()
+				tlsConfig.ServerName = host
+			}
+		}
+
+		tlsConn, err := tlsHandshake(bindCtx, tls.Client(conn, tlsConfig))
+		if err != nil {
+			stop()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	// The client outlives the call to dial but keeps the values in the
+	// context for the handlers.
+	clt, err := newClient(context.WithoutCancel(ctx), key, cm.name, cm.log, cm.clients, cm.handlers, cm.process, conn)
+
+	if !stop() {
+		conn.Close()
+		return nil, fmt.Errorf("newClient: %w", context.Cause(bindCtx))
+	}
+
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("newClient: %w", err)
 	}
 
+	if userID != "" && clt.UserID() == "" {
+		clt.SetUserID(userID)
+	}
+
+	clt.addDrop(func() {
+		if !clt.stopped.Load() {
+			cm.redialPeer(context.WithoutCancel(ctx), key, network, address, clt.UserID())
+		}
+	})
+
 	cm.clients.add(key, clt)
 
 	clt.start()
@@ -106,12 +322,51 @@ func (cm *ClientManager) Dial(ctx context.Context, key string, network string, a
 	return clt, nil
 }
 
-// Retrieve retrieves a client by user ID.
-func (cm *ClientManager) Retrieve(ctx context.Context, key string) (*Client, error) {
-	clt, err := cm.clients.find(key)
-	if err != nil {
-		return nil, fmt.Errorf("find: %w", err)
+// redialPeer dials a peer again after its connection dropped. It backs off
+// before each attempt until the peer is connected, the attempts run out or
+// the manager shuts down.
+func (cm *ClientManager) redialPeer(ctx context.Context, key string, network string, address string, userID string) {
+	cm.redialMu.Lock()
+	defer cm.redialMu.Unlock()
+
+	if cm.redial.MaxAttempts == 0 || cm.ctx.Err() != nil {
+		return
 	}
 
-	return clt, nil
+	cm.wg.Add(1)
+
+	go func() {
+		defer cm.wg.Done()
+
+		// The attempts are canceled when the manager shuts down.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		stopShutdown := context.AfterFunc(cm.ctx, cancel)
+		defer stopShutdown()
+
+		for attempt := range cm.redial.MaxAttempts {
+			if !cm.redial.Backoff.sleep(ctx, attempt) {
+				return
+			}
+
+			_, err := cm.dial(ctx, key, network, address, userID)
+			switch {
+			case err == nil:
+				cm.log(ctx, cm.name, EvtRedial, TypInfo, address, "connected: Key[ %s ] Attempt[ %d ]", key, attempt+1)
+				return
+
+			case errors.Is(err, ErrClientAlreadyConnected):
+				cm.log(ctx, cm.name, EvtRedial, TypInfo, address, "already connected: Key[ %s ]", key)
+				return
+
+			case ctx.Err() != nil:
+				return
+			}
+
+			cm.log(ctx, cm.name, EvtRedial, TypError, address, "Key[ %s ] Attempt[ %d ] : %s", key, attempt+1, err)
+		}
+
+		cm.log(ctx, cm.name, EvtRedial, TypError, address, "giving up: Key[ %s ] Attempts[ %d ]", key, cm.redial.MaxAttempts)
+	}()
 }
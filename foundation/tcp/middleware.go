@@ -0,0 +1,119 @@
+package tcp
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ProcessFunc is the signature of the function that processes a request. It
+// matches the Process method of the ReqHandler interface.
+type ProcessFunc func(r *Request, clt *Client)
+
+// MidFunc is a handler function designed to run code before and/or after
+// processing a request. It is designed to remove boilerplate or other
+// concerns not direct to any given ReqHandler.
+type MidFunc func(next ProcessFunc) ProcessFunc
+
+// wrapMiddleware creates a new process function by wrapping middleware around
+// the handlers' Process. The middlewares will be executed by requests in the
+// order they are provided.
+func wrapMiddleware(mw []MidFunc, process ProcessFunc) ProcessFunc {
+
+	// Loop backwards through the middleware invoking each one. Replace the
+	// process function with the new wrapped one. Looping backwards ensures
+	// that the first middleware of the slice is the first to be executed by
+	// requests.
+	for i := len(mw) - 1; i >= 0; i-- {
+		mwFunc := mw[i]
+		if mwFunc != nil {
+			process = mwFunc(process)
+		}
+	}
+
+	return process
+}
+
+// =============================================================================
+
+// Panics recovers from a panic while processing a request so it doesn't take
+// down the process. The panic is reported as an error event along with the
+// stack trace and the connection keeps reading.
+func Panics() MidFunc {
+	m := func(next ProcessFunc) ProcessFunc {
+		p := func(r *Request, clt *Client) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					clt.nErrors.Add(1)
+					clt.log(r.Context, clt.name, EvtProcess, TypError, clt.ipAddress, "PANIC[ %v ] TRACE[ %s ]", rec, debug.Stack())
+				}
+			}()
+
+			next(r, clt)
+		}
+
+		return p
+	}
+
+	return m
+}
+
+// Timing reports an event when a request takes at least the threshold to
+// process, with how long it took. A threshold of 0 reports every request.
+func Timing(threshold time.Duration) MidFunc {
+	m := func(next ProcessFunc) ProcessFunc {
+		p := func(r *Request, clt *Client) {
+			now := time.Now()
+
+			next(r, clt)
+
+			if since := time.Since(now); since >= threshold {
+				clt.log(r.Context, clt.name, EvtProcess, TypInfo, clt.ipAddress, "request completed: Length[ %d ] Since[ %v ]", r.Length, since)
+			}
+		}
+
+		return p
+	}
+
+	return m
+}
+
+// RateLimit limits the number of requests processed for each connection to
+// the rate, allowing bursts of requests up to the burst size. A connection
+// that goes over the limit is closed and reported as an error event, rather
+// than dropping requests the peer is counting on, like heartbeats.
+func RateLimit(limit rate.Limit, burst int) MidFunc {
+
+	// Each use of the middleware keeps its own limiter for every client, so
+	// more than one rate limit can be used in a chain.
+	var limiters sync.Map
+
+	m := func(next ProcessFunc) ProcessFunc {
+		p := func(r *Request, clt *Client) {
+
+			// Requests for a client are processed on its own goroutine so
+			// the limiter is only created and used from there.
+			v, ok := limiters.Load(clt)
+			if !ok {
+				v = rate.NewLimiter(limit, burst)
+				limiters.Store(clt, v)
+				clt.addDrop(func() { limiters.Delete(clt) })
+			}
+
+			if !v.(*rate.Limiter).AllowN(r.ReadAt, 1) {
+				clt.nErrors.Add(1)
+				clt.log(r.Context, clt.name, EvtProcess, TypError, clt.ipAddress, "rate limited, closing connection: Limit[ %v ] Burst[ %d ]", limit, burst)
+				clt.Conn.Close()
+				return
+			}
+
+			next(r, clt)
+		}
+
+		return p
+	}
+
+	return m
+}
@@ -0,0 +1,297 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Set of errors for the PROXY protocol.
+var (
+	ErrInvalidProxy   = errors.New("invalid proxy configuration")
+	ErrProxyHeader    = errors.New("invalid PROXY header")
+	ErrProxyUntrusted = errors.New("PROXY header from untrusted source")
+)
+
+// The signatures every v1 and v2 header starts with.
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Sizes from the PROXY protocol specification.
+const (
+	proxyV1MaxLength   = 107
+	proxyV2HeaderSize  = 16
+	proxyV2AddrLength4 = 12
+	proxyV2AddrLength6 = 36
+)
+
+// ProxyProtocol provides the load balancers the server accepts PROXY protocol
+// v1 and v2 headers from. A connection from a trusted proxy must start with a
+// header and is given the address of the source the header reports before it
+// is bound. A connection from any other source that starts with a header is
+// rejected. It's disabled when there are no trusted proxies.
+type ProxyProtocol struct {
+	Trusted []string // IPs or CIDRs of the trusted proxies.
+}
+
+func (pp ProxyProtocol) validate() error {
+	if _, err := parsePrefixes(pp.Trusted); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProxy, err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// proxy reads the PROXY protocol headers for the server.
+type proxy struct {
+	trusted []netip.Prefix
+}
+
+func newProxy(pp ProxyProtocol) *proxy {
+	if len(pp.Trusted) == 0 {
+		return nil
+	}
+
+	trusted, _ := parsePrefixes(pp.Trusted)
+
+	return &proxy{
+		trusted: trusted,
+	}
+}
+
+// accept reads the header from a connection from a trusted proxy and returns
+// the connection with the addresses from the header. Connections from other
+// sources are checked for a header when they are first read.
+func (p *proxy) accept(conn net.Conn) (net.Conn, error) {
+	pc := proxyConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+
+	if !matchPrefixes(p.trusted, connIP(conn)) {
+		pc.check = true
+		return &pc, nil
+	}
+
+	if err := pc.readHeader(); err != nil {
+		return nil, err
+	}
+
+	return &pc, nil
+}
+
+// =============================================================================
+
+// proxyConn is a connection that had its addresses set by a PROXY header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	check  bool
+}
+
+// Read implements the io.Reader interface. A connection from an untrusted
+// source is closed when it starts with a PROXY header. Reads happen on one
+// goroutine at a time, first in Bind and then in the read loop, so the check
+// doesn't need to be protected.
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	if pc.check {
+		pc.check = false
+
+		if hasProxySignature(pc.r) {
+			pc.Conn.Close()
+			return 0, fmt.Errorf("%w: %s", ErrProxyUntrusted, pc.remote)
+		}
+	}
+
+	return pc.r.Read(b)
+}
+
+// RemoteAddr returns the address of the source reported by the header.
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// LocalAddr returns the address of the destination reported by the header.
+func (pc *proxyConn) LocalAddr() net.Addr {
+	return pc.local
+}
+
+// readHeader reads a v1 or v2 header from the connection. The version is
+// told from the first byte so a connection without a header is rejected
+// without waiting for more data.
+func (pc *proxyConn) readHeader() error {
+	b, err := pc.r.Peek(1)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	switch b[0] {
+	case proxyV1Signature[0]:
+		return pc.readV1()
+
+	case proxyV2Signature[0]:
+		return pc.readV2()
+	}
+
+	return fmt.Errorf("%w: missing", ErrProxyHeader)
+}
+
+// readV1 reads the text header.
+//
+//	PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func (pc *proxyConn) readV1() error {
+	line, err := pc.r.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLength || !bytes.HasPrefix(line, proxyV1Signature) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("%w: v1 line", ErrProxyHeader)
+	}
+
+	fields := strings.Fields(string(line))
+
+	// The proxy doesn't know the source, the connection keeps its addresses.
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("%w: v1 fields %q", ErrProxyHeader, line)
+	}
+
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	pc.remote = src
+	pc.local = dst
+
+	return nil
+}
+
+// readV2 reads the binary header. Only the addresses for TCP over IPv4 and
+// IPv6 are used, the TLVs after them are skipped.
+func (pc *proxyConn) readV2() error {
+	hdr := make([]byte, proxyV2HeaderSize)
+	if _, err := io.ReadFull(pc.r, hdr); err != nil {
+		return fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	if !bytes.Equal(hdr[:len(proxyV2Signature)], proxyV2Signature) {
+		return fmt.Errorf("%w: missing", ErrProxyHeader)
+	}
+
+	verCmd := hdr[12]
+	famProto := hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	if verCmd>>4 != 2 {
+		return fmt.Errorf("%w: v2 version[ %d ]", ErrProxyHeader, verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(pc.r, payload); err != nil {
+		return fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	// LOCAL is used by the proxy for its own connections, like health
+	// checks, so the connection keeps its addresses.
+	cmd := verCmd & 0x0F
+	if cmd == 0x0 {
+		return nil
+	}
+
+	if cmd != 0x1 {
+		return fmt.Errorf("%w: v2 command[ %d ]", ErrProxyHeader, cmd)
+	}
+
+	// Only TCP over IPv4 and IPv6 have addresses the server can use.
+	var ipLen int
+	switch famProto {
+	case 0x11:
+		ipLen = net.IPv4len
+		if length < proxyV2AddrLength4 {
+			return fmt.Errorf("%w: v2 length[ %d ]", ErrProxyHeader, length)
+		}
+
+	case 0x21:
+		ipLen = net.IPv6len
+		if length < proxyV2AddrLength6 {
+			return fmt.Errorf("%w: v2 length[ %d ]", ErrProxyHeader, length)
+		}
+
+	default:
+		return nil
+	}
+
+	ports := payload[2*ipLen:]
+
+	pc.remote = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(ports[0:2])),
+	}
+
+	pc.local = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(ports[2:4])),
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// hasProxySignature reports if the data starts with a header. Only as many
+// bytes as still match a signature are waited for, so a peer that doesn't
+// send a header isn't held up.
+func hasProxySignature(r *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return false
+		}
+
+		v1 := bytes.HasPrefix(proxyV1Signature, b)
+		v2 := bytes.HasPrefix(proxyV2Signature, b)
+
+		switch {
+		case !v1 && !v2:
+			return false
+
+		case v1 && n == len(proxyV1Signature), v2 && n == len(proxyV2Signature):
+			return true
+		}
+	}
+}
+
+func parseV1Addr(family string, ip string, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != (family == "TCP4") {
+		return nil, fmt.Errorf("%w: v1 address %q", ErrProxyHeader, ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: v1 port %q", ErrProxyHeader, port)
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
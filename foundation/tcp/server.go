@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -13,12 +14,39 @@ import (
 	"github.com/google/uuid"
 )
 
+// addrBindWait is how long Addr waits for a listener that is being started.
+const addrBindWait = 250 * time.Millisecond
+
 // ServerConfig provides a data structure of required configuration parameters.
 type ServerConfig struct {
 	NetType  string   // "tcp", tcp4" or "tcp6"
 	Addr     string   // "host:port" or "[ipv6-host%zone]:port"
 	Handlers Handlers // Support for binding and handling requests.
-	Logger   Logger   // Support for logging events that occur in the TCP listener.
+	Logger   Logger   // Support for logging events that occur in the TCP listener. Events are discarded when not set.
+
+	// TLS is optional. When set, every connection must complete a mutually
+	// authenticated TLS handshake before it is bound.
+	TLS *TLSConfig
+
+	// Heartbeat is optional. When set, quiet connections are sent heartbeats
+	// and dropped when they stop answering or stay idle too long.
+	Heartbeat Heartbeat
+
+	// Middleware is optional. It wraps the processing of every request, the
+	// first middleware is executed first.
+	Middleware []MidFunc
+
+	// Admission is optional. It limits the connections that are accepted
+	// and how long they have to be bound.
+	Admission Admission
+
+	// Restart is optional. It's the backoff between attempts to start the
+	// listener after it fails, from 100ms up to 10s when not set.
+	Restart Backoff
+
+	// Proxy is optional. When set, connections from the trusted proxies
+	// have the address of the source from their PROXY protocol header.
+	Proxy ProxyProtocol
 }
 
 func (cfg ServerConfig) validate() error {
@@ -30,8 +58,26 @@ func (cfg ServerConfig) validate() error {
 		return ErrInvalidHandlers
 	}
 
-	if cfg.Logger == nil {
-		return ErrInvalidLoggerHandler
+	if cfg.TLS != nil {
+		if err := cfg.TLS.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.Heartbeat.validate(cfg.Handlers); err != nil {
+		return err
+	}
+
+	if err := cfg.Admission.validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Restart.validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Proxy.validate(); err != nil {
+		return err
 	}
 
 	return nil
@@ -45,11 +91,19 @@ type Server struct {
 	netType                string
 	addr                   string
 	handlers               Handlers
+	process                ProcessFunc
 	ipAddress              string
 	port                   int
 	tcpAddr                *net.TCPAddr
 	listener               *listener
 	clients                *clients
+	tlsConfig              *tls.Config
+	groomer                *groomer
+	admission              *admission
+	proxy                  *proxy
+	restart                Backoff
+	stopCtx                context.Context
+	stopCancel             context.CancelFunc
 	wgStartG               sync.WaitGroup
 	shuttingDown           atomic.Bool
 	lastAcceptedConnection time.Time
@@ -66,22 +120,45 @@ func NewServer(name string, cfg ServerConfig) (*Server, error) {
 		return nil, err
 	}
 
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		tlsConfig, err = cfg.TLS.serverTLS()
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+
 	l := func(ctx context.Context, name string, evt int, typ int, ipAddress string, format string, a ...any) {
-		cfg.Logger(ctx, name, eventTypes[evt], eventSubTypes[typ], ipAddress, fmt.Sprintf(format, a...))
+		if cfg.Logger != nil {
+			cfg.Logger(ctx, name, eventTypes[evt], eventSubTypes[typ], ipAddress, fmt.Sprintf(format, a...))
+		}
 	}
 
+	clients := newClients(l)
+
+	// The listener is stopped through this context on shutdown.
+	stopCtx, stopCancel := context.WithCancel(context.Background())
+
 	t := Server{
-		ctx:       setTraceID(context.Background(), uuid.New()),
-		name:      name,
-		log:       l,
-		netType:   cfg.NetType,
-		addr:      cfg.Addr,
-		handlers:  cfg.Handlers,
-		ipAddress: tcpAddr.IP.String(),
-		port:      tcpAddr.Port,
-		tcpAddr:   tcpAddr,
-		listener:  newListener(),
-		clients:   newClients(l),
+		ctx:        setTraceID(context.Background(), uuid.New()),
+		name:       name,
+		log:        l,
+		netType:    cfg.NetType,
+		addr:       cfg.Addr,
+		handlers:   cfg.Handlers,
+		process:    wrapMiddleware(cfg.Middleware, cfg.Handlers.Process),
+		ipAddress:  tcpAddr.IP.String(),
+		port:       tcpAddr.Port,
+		tcpAddr:    tcpAddr,
+		listener:   newListener(),
+		clients:    clients,
+		tlsConfig:  tlsConfig,
+		groomer:    newGroomer(name, l, clients, cfg.Handlers, cfg.Heartbeat),
+		admission:  newAdmission(cfg.Admission),
+		proxy:      newProxy(cfg.Proxy),
+		restart:    cfg.Restart.withDefaults(100*time.Millisecond, 10*time.Second),
+		stopCtx:    stopCtx,
+		stopCancel: stopCancel,
 	}
 
 	return &t, nil
@@ -93,8 +170,10 @@ func (srv *Server) Shutdown(ctx context.Context) error {
 	defer srv.log(ctx, srv.name, EvtStop, TypInfo, "", "server completed shutdown")
 
 	srv.shuttingDown.Store(true)
+	srv.stopCancel()
 
 	srv.listener.reset()
+	srv.groomer.stop()
 
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -102,7 +181,7 @@ func (srv *Server) Shutdown(ctx context.Context) error {
 		defer cancel()
 
 		for _, c := range srv.clients.copy() {
-			go c.close()
+			go c.stop()
 		}
 	}()
 
@@ -123,48 +202,80 @@ func (srv *Server) Name() string {
 	return srv.name
 }
 
-// Listen creates the accept routine and begins to accept connections.
+// Listen creates the accept routine and begins to accept connections. It
+// blocks until the server is shut down.
 func (srv *Server) Listen() error {
+	return srv.ListenContext(context.Background())
+}
+
+// ListenContext creates the accept routine and begins to accept connections.
+// It blocks until the context is canceled or the server is shut down. Once
+// the context is canceled no more connections are accepted, the clients that
+// are connected stay until Shutdown is called. When the listener fails it's
+// started again after the restart backoff.
+func (srv *Server) ListenContext(ctx context.Context) error {
 	if srv.listener.tcpListener() != nil {
 		return errors.New("this TCP has already been started")
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Shutdown stops the listener the same as canceling the context.
+	stopShutdown := context.AfterFunc(srv.stopCtx, cancel)
+	defer stopShutdown()
+
+	// A blocked Accept only returns once the listener is closed.
+	stopAccept := context.AfterFunc(ctx, func() {
+		srv.shuttingDown.Store(true)
+		srv.listener.reset()
+	})
+	defer stopAccept()
+
+	srv.groomer.start(srv.ctx)
+
 	srv.wgStartG.Add(1)
 
 	go func() {
+		addr := net.JoinHostPort(srv.ipAddress, strconv.Itoa(srv.port))
+
 		defer func() {
-			srv.log(srv.ctx, srv.name, EvtAccept, TypInfo, net.JoinHostPort(srv.ipAddress, strconv.Itoa(srv.port)), "completed listener shutdown")
+			srv.log(srv.ctx, srv.name, EvtAccept, TypInfo, addr, "completed listener shutdown")
 			srv.wgStartG.Done()
 		}()
 
+		// The attempt counts the failures since the last connection was
+		// accepted so the backoff grows while the listener keeps failing.
+		var attempt int
+
 	startlistener:
 		for {
-			if srv.shuttingDown.Load() {
-				srv.log(srv.ctx, srv.name, EvtAccept, TypInfo, net.JoinHostPort(srv.ipAddress, strconv.Itoa(srv.port)), "started listener shutdown")
+			if ctx.Err() != nil || srv.shuttingDown.Load() {
+				srv.log(srv.ctx, srv.name, EvtAccept, TypInfo, addr, "started listener shutdown")
 				srv.listener.reset()
 				break
 			}
 
-			listener, err := srv.listener.start(srv.netType, srv.tcpAddr)
+			listener, err := srv.listener.start(ctx, srv.netType, srv.tcpAddr)
 			if err != nil {
-				// TODO: Use Context to control the retry / cancel.
-				srv.log(srv.ctx, srv.name, EvtAccept, TypError, "", err.Error())
-				time.Sleep(200 * time.Millisecond)
+				srv.log(srv.ctx, srv.name, EvtAccept, TypError, "", "start listener: Attempt[ %d ] : %s", attempt+1, err)
+				srv.restart.sleep(ctx, attempt)
+				attempt++
 				continue
 			}
 
 			for {
-				srv.log(srv.ctx, srv.name, EvtAccept, TypInfo, net.JoinHostPort(srv.ipAddress, strconv.Itoa(srv.port)), "waiting")
+				srv.log(srv.ctx, srv.name, EvtAccept, TypInfo, addr, "waiting")
 
 				conn, err := listener.Accept()
 				if err != nil {
-					if srv.shuttingDown.Load() {
-						srv.log(srv.ctx, srv.name, EvtAccept, TypInfo, net.JoinHostPort(srv.ipAddress, strconv.Itoa(srv.port)), "started listener shutdown")
+					if ctx.Err() != nil || srv.shuttingDown.Load() {
+						srv.log(srv.ctx, srv.name, EvtAccept, TypInfo, addr, "started listener shutdown")
 						srv.listener.reset()
 						break startlistener
 					}
 
-					srv.log(srv.ctx, srv.name, EvtAccept, TypError, conn.RemoteAddr().String(), err.Error())
+					srv.log(srv.ctx, srv.name, EvtAccept, TypError, "", err.Error())
 
 					type temporary interface {
 						Temporary() bool
@@ -172,18 +283,44 @@ func (srv *Server) Listen() error {
 
 					if e, ok := err.(temporary); ok && !e.Temporary() {
 						srv.listener.reset()
+						srv.restart.sleep(ctx, attempt)
+						attempt++
 						continue startlistener
 					}
 
+					// Errors like running out of file descriptors won't
+					// clear up straight away.
+					srv.restart.sleep(ctx, attempt)
+					attempt++
 					continue
 				}
 
-				// Add this new connection to the manager map and
-				// start the client goroutine.
-				if err := srv.startNewClient(conn); err != nil {
-					srv.log(srv.ctx, srv.name, EvtAccept, TypError, conn.RemoteAddr().String(), err.Error())
+				attempt = 0
+
+				// The limits that don't depend on who connected are
+				// checked before a goroutine is started for the
+				// connection.
+				if err := srv.admission.admit(); err != nil {
+					srv.log(srv.ctx, srv.name, EvtAccept, TypError, conn.RemoteAddr().String(), "rejected: %s", err)
 					conn.Close()
+					continue
 				}
+
+				// Add this new connection to the manager map and
+				// start the client goroutine. Binding can take a while
+				// so it's done on its own goroutine to keep accepting.
+				go func() {
+					err := srv.startNewClient(conn)
+					switch {
+					case errors.Is(err, ErrNotAdmitted):
+						srv.log(srv.ctx, srv.name, EvtAccept, TypError, conn.RemoteAddr().String(), "rejected: %s", err)
+						conn.Close()
+
+					case err != nil:
+						srv.log(srv.ctx, srv.name, EvtAccept, TypError, conn.RemoteAddr().String(), err.Error())
+						conn.Close()
+					}
+				}()
 			}
 		}
 	}()
@@ -195,7 +332,7 @@ func (srv *Server) Listen() error {
 
 // CloseClient will close the client socket connection.
 func (srv *Server) CloseClient(tcpAddr *net.TCPAddr) error {
-	c, err := srv.clients.find(tcpAddr.IP.String())
+	c, err := srv.clients.find(addrKey(tcpAddr))
 	if err != nil {
 		return fmt.Errorf("IP[ %s ] : disconnected", tcpAddr.String())
 	}
@@ -207,10 +344,40 @@ func (srv *Server) CloseClient(tcpAddr *net.TCPAddr) error {
 	return nil
 }
 
+// SendTo sends the data to every connection for the user.
+func (srv *Server) SendTo(userID string, data []byte) error {
+	return srv.clients.sendTo(userID, data)
+}
+
+// Broadcast sends the data to every connection.
+func (srv *Server) Broadcast(data []byte) error {
+	return srv.clients.broadcast(data)
+}
+
+// CloseByUserID closes every connection for the user.
+func (srv *Server) CloseByUserID(userID string) error {
+	return srv.clients.closeByUserID(userID)
+}
+
 // Addr returns the listener's network address. This may be different than the values
 // provided in the configuration, for example if configuration port value is 0.
+// Listen is usually started on its own goroutine, so Addr waits up to
+// addrBindWait for the listener to be bound. It returns nil when the server
+// is not listening.
 func (srv *Server) Addr() net.Addr {
-	return srv.tcpAddr
+	deadline := time.Now().Add(addrBindWait)
+
+	for {
+		if l := srv.listener.tcpListener(); l != nil {
+			return l.Addr()
+		}
+
+		if time.Now().After(deadline) {
+			return nil
+		}
+
+		time.Sleep(time.Millisecond)
+	}
 }
 
 // Clients returns the number of active clients connected by user ID.
@@ -231,13 +398,14 @@ func (srv *Server) Groom(d time.Duration) {
 
 	now := time.Now().UTC()
 	for _, c := range client {
-		sub := now.Sub(c.lastAct)
+		lastAct := c.lastActivity()
+		sub := now.Sub(lastAct)
 		if sub >= d {
 			// TODO
 			// This is a blocking call that waits for the socket goroutine
 			// to report its done. This parallel call should work well since
 			// there is no error handling needed.
-			srv.log(srv.ctx, srv.name, EvtGroom, TypInfo, c.ipAddress, "Last[ %v ] Dur[ %v ]", c.lastAct.Format(time.RFC3339), sub)
+			srv.log(srv.ctx, srv.name, EvtGroom, TypInfo, c.ipAddress, "Last[ %v ] Dur[ %v ]", lastAct.Format(time.RFC3339), sub)
 			go c.close()
 		}
 	}
@@ -245,15 +413,76 @@ func (srv *Server) Groom(d time.Duration) {
 
 // =============================================================================
 
-// startNewClient takes a new connection and adds it to the manager.
-func (srv *Server) startNewClient(conn net.Conn) error {
+// startNewClient takes a new connection that was admitted by the accept loop
+// and adds it to the manager once it's admitted for its IP. The connection is
+// closed if the PROXY header, TLS handshake and Bind don't complete within the
+// bind timeout.
+func (srv *Server) startNewClient(conn net.Conn) (err error) {
+	defer func() {
+		if err != nil {
+			srv.admission.release()
+		}
+	}()
+
+	rawConn := conn
+
+	timer := time.AfterFunc(srv.admission.bindTimeout, func() {
+		rawConn.Close()
+	})
+
+	// A connection through a trusted proxy has the address of the source
+	// from the header, the limits for an IP apply to that address.
+	if srv.proxy != nil {
+		if conn, err = srv.proxy.accept(conn); err != nil {
+			timer.Stop()
+			return err
+		}
+	}
+
+	if err := srv.admission.admitIP(conn); err != nil {
+		timer.Stop()
+		return err
+	}
+
+	admitted := conn
+	defer func() {
+		if err != nil {
+			srv.admission.releaseIP(admitted)
+		}
+	}()
+
 	key := ipAddress(conn)
 
-	c, err := newClient(key, srv.name, srv.log, srv.clients, srv.handlers, conn)
+	if srv.tlsConfig != nil {
+		tlsConn, err := tlsHandshake(context.Background(), tls.Server(conn, srv.tlsConfig))
+		if err != nil {
+			timer.Stop()
+			return err
+		}
+
+		conn = tlsConn
+	}
+
+	c, err := newClient(context.Background(), key, srv.name, srv.log, srv.clients, srv.handlers, srv.process, conn)
+
+	if !timer.Stop() {
+		return fmt.Errorf("%w: %v", ErrBindTimeout, srv.admission.bindTimeout)
+	}
+
 	if err != nil {
 		return err
 	}
 
+	// The server may have started to shut down while the client was bound.
+	if srv.shuttingDown.Load() {
+		return errors.New("server shutting down")
+	}
+
+	c.addDrop(func() {
+		srv.admission.releaseIP(admitted)
+		srv.admission.release()
+	})
+
 	srv.clients.add(key, c)
 
 	c.start()
@@ -1,33 +1,73 @@
 package tcp
 
-import "time"
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
 
-// Stat represents a client statistic.
+// Stat represents a client statistic. Bytes are counted as they go over the
+// connection, including any framing, messages as they are read and sent.
 type Stat struct {
 	IP       string
-	Reads    int
-	Writes   int
+	Key      string
+	UserID   string
+	MsgsIn   int64
+	MsgsOut  int64
+	BytesIn  int64
+	BytesOut int64
+	Errors   int64
 	TimeConn time.Time
 	LastAct  time.Time
 }
 
 // ClientStats return details for all active clients.
 func (srv *Server) ClientStats() []Stat {
-	clients := srv.clients.copy()
-
-	stats := make([]Stat, 0, len(clients))
+	return srv.clients.stats()
+}
 
-	for _, c := range clients {
-		stat := Stat{
-			IP:       c.ipAddress,
-			Reads:    c.nReads,
-			Writes:   c.nWrites,
-			TimeConn: c.timeConn,
-			LastAct:  c.lastAct,
-		}
+// ClientStats return details for all active clients.
+func (cm *ClientManager) ClientStats() []Stat {
+	return cm.clients.stats()
+}
 
-		stats = append(stats, stat)
+// Stats returns the details for the client.
+func (clt *Client) Stats() Stat {
+	return Stat{
+		IP:       clt.ipAddress,
+		Key:      clt.key,
+		UserID:   clt.UserID(),
+		MsgsIn:   clt.msgsIn.Load(),
+		MsgsOut:  clt.msgsOut.Load(),
+		BytesIn:  clt.conn.bytesIn.Load(),
+		BytesOut: clt.conn.bytesOut.Load(),
+		Errors:   clt.nErrors.Load(),
+		TimeConn: clt.timeConn,
+		LastAct:  clt.lastActivity(),
 	}
+}
+
+// =============================================================================
+
+// statsConn counts the bytes read and written on the connection.
+type statsConn struct {
+	net.Conn
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// Read implements the io.Reader interface.
+func (sc *statsConn) Read(b []byte) (int, error) {
+	n, err := sc.Conn.Read(b)
+	sc.bytesIn.Add(int64(n))
+
+	return n, err
+}
+
+// Write implements the io.Writer interface.
+func (sc *statsConn) Write(b []byte) (int, error) {
+	n, err := sc.Conn.Write(b)
+	sc.bytesOut.Add(int64(n))
 
-	return stats
+	return n, err
 }
@@ -18,6 +18,8 @@ const (
 	EvtDrop
 	EvtGroom
 	EvtStop
+	EvtProcess
+	EvtRedial
 )
 
 // Set of event sub types.
@@ -27,13 +29,15 @@ const (
 )
 
 var eventTypes = map[int]string{
-	EvtAccept: "accept",
-	EvtJoin:   "join",
-	EvtRead:   "read",
-	EvtRemove: "remove",
-	EvtDrop:   "drop",
-	EvtGroom:  "groom",
-	EvtStop:   "stop",
+	EvtAccept:  "accept",
+	EvtJoin:    "join",
+	EvtRead:    "read",
+	EvtRemove:  "remove",
+	EvtDrop:    "drop",
+	EvtGroom:   "groom",
+	EvtStop:    "stop",
+	EvtProcess: "process",
+	EvtRedial:  "redial",
 }
 
 var eventSubTypes = map[int]string{
@@ -130,6 +134,10 @@ type DropHandler interface {
 // =============================================================================
 
 func ipAddress(conn net.Conn) string {
-	tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
+	return addrKey(conn.RemoteAddr().(*net.TCPAddr))
+}
+
+// addrKey returns the key the server uses for a connection from the address.
+func addrKey(tcpAddr *net.TCPAddr) string {
 	return fmt.Sprintf("%s:%d", tcpAddr.IP.String(), tcpAddr.Port)
 }
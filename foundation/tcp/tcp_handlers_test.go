@@ -2,11 +2,25 @@ package tcp_test
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync/atomic"
+	"testing"
 	"time"
 
 	"github.com/PeterLee0620/GoIM/foundation/tcp"
+	"github.com/google/uuid"
 )
 
 // tcpConnHandler is required to process data.
@@ -37,7 +51,7 @@ var dur int64
 
 // Process is used to handle the processing of the message.
 func (tcpHandlers) Process(r *tcp.Request, clt *tcp.Client) {
-	if _, err := clt.Writer.Write([]byte("GOT IT\n")); err != nil {
+	if err := clt.Send([]byte("GOT IT\n")); err != nil {
 		fmt.Println("***> SERVER: ERROR SENDING RESPONSE:", err)
 		return
 	}
@@ -49,3 +63,186 @@ func (tcpHandlers) Process(r *tcp.Request, clt *tcp.Client) {
 func (tcpHandlers) Drop(clt *tcp.Client) {
 	fmt.Println("***> SERVER: CONNECTION CLOSED")
 }
+
+// =============================================================================
+
+// tcpLogger discards the events from the TCP values. Connections can still be
+// closing after a test completes, so they can't go to the test log.
+func tcpLogger(ctx context.Context, name string, evt string, typ string, ipAddress string, format string, a ...any) {
+}
+
+// waitAddr waits for the server to start listening since Listen is called on
+// its own goroutine.
+func waitAddr(t *testing.T, srv *tcp.Server) net.Addr {
+	for range 100 {
+		if addr := srv.Addr(); addr != nil {
+			return addr
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// hasEvent waits for an event that starts with the prefix.
+func hasEvent(events chan string, prefix string) bool {
+	timeout := time.After(time.Second)
+
+	for {
+		select {
+		case evt := <-events:
+			if strings.HasPrefix(evt, prefix) {
+				return true
+			}
+
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+// =============================================================================
+
+// tcpClientHandlers is used by a client manager to receive the responses.
+type tcpClientHandlers struct {
+	recv chan string
+}
+
+// Bind is called to init to reader and writer.
+func (tcpClientHandlers) Bind(clt *tcp.Client) error {
+	clt.Reader = bufio.NewReader(clt.Conn)
+
+	return nil
+}
+
+// Read reads a line from the connection.
+func (tcpClientHandlers) Read(clt *tcp.Client) ([]byte, int, error) {
+	line, err := clt.Reader.(*bufio.Reader).ReadString('\n')
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return []byte(line), len(line), nil
+}
+
+// Process sends the response to the test.
+func (h tcpClientHandlers) Process(r *tcp.Request, clt *tcp.Client) {
+	h.recv <- string(r.Data)
+}
+
+func (tcpClientHandlers) Drop(clt *tcp.Client) {}
+
+// =============================================================================
+
+// tcpHeartbeatHandlers adds heartbeats to the handlers used by the server.
+type tcpHeartbeatHandlers struct {
+	tcpHandlers
+}
+
+// Heartbeat sends a ping to the peer.
+func (tcpHeartbeatHandlers) Heartbeat(clt *tcp.Client) error {
+	return clt.Send([]byte("PING\n"))
+}
+
+// eventLogger sends the events from the TCP values to the channel so a test
+// can look for them. Events are discarded when the channel is full.
+func eventLogger(events chan string) tcp.Logger {
+	return func(ctx context.Context, name string, evt string, typ string, ipAddress string, format string, a ...any) {
+		select {
+		case events <- evt + ": " + format:
+		default:
+		}
+	}
+}
+
+// =============================================================================
+
+// tcpUserHandlers reads the user ID as the first line from the connection.
+type tcpUserHandlers struct {
+	tcpHandlers
+}
+
+// Bind reads the user ID the connection is for.
+func (tcpUserHandlers) Bind(clt *tcp.Client) error {
+	bufReader := bufio.NewReader(clt.Conn)
+
+	userID, err := bufReader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	clt.Reader = bufReader
+	clt.SetUserID(strings.TrimSpace(userID))
+
+	return nil
+}
+
+// =============================================================================
+
+// tcpMidHandlers panics on request to test the middleware and sends the trace
+// ID of each request it processes to the test.
+type tcpMidHandlers struct {
+	tcpHandlers
+	traceIDs chan uuid.UUID
+}
+
+// Process panics when asked to, otherwise it responds.
+func (h tcpMidHandlers) Process(r *tcp.Request, clt *tcp.Client) {
+	if string(r.Data) == "PANIC\n" {
+		panic("asked to panic")
+	}
+
+	h.traceIDs <- tcp.GetTraceID(r.Context)
+
+	clt.Send([]byte("GOT IT\n"))
+}
+
+// =============================================================================
+
+// certFiles writes a new self-signed certificate and key to the directory and
+// returns the files along with the fingerprint of the certificate.
+func certFiles(t *testing.T, dir string, name string) (string, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("\tShould be able to generate a key: %s", err)
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("\tShould be able to create a certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("\tShould be able to marshal the key: %s", err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("\tShould be able to write the certificate: %s", err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("\tShould be able to write the key: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("\tShould be able to parse the certificate: %s", err)
+	}
+
+	return certFile, keyFile, tcp.Fingerprint(cert)
+}
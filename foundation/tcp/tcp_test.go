@@ -3,12 +3,20 @@ package tcp_test
 import (
 	"bufio"
 	"context"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/PeterLee0620/GoIM/foundation/tcp"
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
 )
 
 // TestTCP provide a test of listening for a connection and
@@ -134,3 +142,1308 @@ func TestTCPAddr(t *testing.T) {
 		u.Shutdown(context.Background())
 	}
 }
+
+// TestTCPAddrShutdown provides a test that Addr follows the listener from
+// Listen through Shutdown.
+func TestTCPAddrShutdown(t *testing.T) {
+	t.Log("Given the need to know the bound address only while listening.")
+	{
+		cfg := tcp.ServerConfig{
+			NetType:  "tcp4",
+			Addr:     ":0",
+			Handlers: tcpHandlers{},
+			Logger:   tcpLogger,
+		}
+
+		u, err := tcp.NewServer("TEST", cfg)
+		if err != nil {
+			t.Fatal("\tShould be able to create a new TCP listener.", "X", err)
+		}
+		t.Log("\tShould be able to create a new TCP listener.", "OK")
+
+		listenErr := make(chan error, 1)
+		go func() {
+			listenErr <- u.Listen()
+		}()
+
+		addr := u.Addr()
+		if addr == nil {
+			t.Fatal("\tShould report the address once Listen has bound it.", "X")
+		}
+		t.Log("\tShould report the address once Listen has bound it.", "OK")
+
+		conn, err := net.Dial("tcp4", addr.String())
+		if err != nil {
+			t.Fatal("\tShould be able to dial the reported address.", "X", err)
+		}
+		conn.Close()
+		t.Log("\tShould be able to dial the reported address.", "OK")
+
+		u.Shutdown(context.Background())
+
+		if err := <-listenErr; err != nil {
+			t.Error("\tShould stop listening on shutdown.", "X", err)
+		} else {
+			t.Log("\tShould stop listening on shutdown.", "OK")
+		}
+
+		if addr := u.Addr(); addr != nil {
+			t.Errorf("\tShould report no address after shutdown. %s %s", "X", addr)
+		} else {
+			t.Log("\tShould report no address after shutdown.", "OK")
+		}
+	}
+}
+
+// TestTLS provides a test of peers connecting over mutually authenticated TLS.
+func TestTLS(t *testing.T) {
+	t.Log("Given the need to secure peer connections with TLS.")
+	{
+		dir := t.TempDir()
+
+		srvCert, srvKey, srvFP := certFiles(t, dir, "server")
+		cltCert, cltKey, cltFP := certFiles(t, dir, "client")
+		badCert, badKey, _ := certFiles(t, dir, "stranger")
+
+		cfg := tcp.ServerConfig{
+			NetType:  "tcp4",
+			Addr:     ":0",
+			Handlers: tcpHandlers{},
+			Logger:   tcpLogger,
+			TLS: &tcp.TLSConfig{
+				CertFile:     srvCert,
+				KeyFile:      srvKey,
+				Fingerprints: []string{cltFP},
+			},
+		}
+
+		srv, err := tcp.NewServer("TEST", cfg)
+		if err != nil {
+			t.Fatal("\tShould be able to create a new TCP listener.", "X", err)
+		}
+		t.Log("\tShould be able to create a new TCP listener.", "OK")
+		defer srv.Shutdown(context.Background())
+
+		go srv.Listen()
+
+		addr := waitAddr(t, srv)
+		if addr == nil {
+			t.Fatal("\tShould be able to start the TCP listener.", "X")
+		}
+		t.Log("\tShould be able to start the TCP listener.", "OK")
+
+		t.Log("\tWhen dialing with a pinned certificate.")
+		{
+			recv := make(chan string, 1)
+
+			cm, err := tcp.NewClientManager("TEST", tcp.ClientConfig{
+				Handlers: tcpClientHandlers{recv: recv},
+				Logger:   tcpLogger,
+				TLS: &tcp.TLSConfig{
+					CertFile:     cltCert,
+					KeyFile:      cltKey,
+					Fingerprints: []string{srvFP},
+				},
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a client manager.", "X", err)
+			}
+			t.Log("\t\tShould be able to create a client manager.", "OK")
+			defer cm.Shutdown(context.Background())
+
+			clt, err := cm.Dial(context.Background(), "peer", "tcp4", addr.String())
+			if err != nil {
+				t.Fatal("\t\tShould be able to dial the server.", "X", err)
+			}
+			t.Log("\t\tShould be able to dial the server.", "OK")
+
+			if _, ok := clt.TLS(); !ok {
+				t.Error("\t\tShould have a TLS connection.", "X")
+			} else {
+				t.Log("\t\tShould have a TLS connection.", "OK")
+			}
+
+			if err := clt.Send([]byte("Hello\n")); err != nil {
+				t.Fatal("\t\tShould be able to send data to the connection.", "X", err)
+			}
+			t.Log("\t\tShould be able to send data to the connection.", "OK")
+
+			select {
+			case response := <-recv:
+				if response != "GOT IT\n" {
+					t.Error("\t\tShould receive the string \"GOT IT\".", "X", response)
+				} else {
+					t.Log("\t\tShould receive the string \"GOT IT\".", "OK")
+				}
+
+			case <-time.After(2 * time.Second):
+				t.Error("\t\tShould receive the string \"GOT IT\".", "X", "timeout")
+			}
+		}
+
+		t.Log("\tWhen dialing with a certificate that isn't pinned.")
+		{
+			cm, err := tcp.NewClientManager("TEST", tcp.ClientConfig{
+				Handlers: tcpClientHandlers{recv: make(chan string, 1)},
+				Logger:   tcpLogger,
+				TLS: &tcp.TLSConfig{
+					CertFile:     badCert,
+					KeyFile:      badKey,
+					Fingerprints: []string{srvFP},
+				},
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a client manager.", "X", err)
+			}
+			defer cm.Shutdown(context.Background())
+
+			clt, err := cm.Dial(context.Background(), "stranger", "tcp4", addr.String())
+			if err == nil {
+				// With TLS 1.3 the server rejects the certificate after the
+				// client considers the handshake complete.
+				clt.Conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				_, err = clt.Conn.Read(make([]byte, 1))
+			}
+
+			if err == nil {
+				t.Error("\t\tShould be rejected by the server.", "X")
+			} else {
+				t.Log("\t\tShould be rejected by the server.", "OK", err)
+			}
+		}
+
+		t.Log("\tWhen dialing without TLS.")
+		{
+			conn, err := net.Dial("tcp4", addr.String())
+			if err != nil {
+				t.Fatal("\t\tShould be able to dial a new TCP connection.", "X", err)
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			if _, err := conn.Write([]byte("Hello\n")); err != nil {
+				t.Fatal("\t\tShould be able to send data to the connection.", "X", err)
+			}
+
+			if response, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+				t.Error("\t\tShould be rejected by the server.", "X", response)
+			} else {
+				t.Log("\t\tShould be rejected by the server.", "OK")
+			}
+		}
+	}
+}
+
+// TestHeartbeat provides a test of quiet peers being sent heartbeats and
+// dropped when they stop answering or stay idle.
+func TestHeartbeat(t *testing.T) {
+	t.Log("Given the need to keep peer connections alive and groom quiet ones.")
+	{
+		t.Log("\tWhen the handlers can't send heartbeats.")
+		{
+			_, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:   "tcp4",
+				Addr:      ":0",
+				Handlers:  tcpHandlers{},
+				Logger:    tcpLogger,
+				Heartbeat: tcp.Heartbeat{Interval: time.Second},
+			})
+			if !errors.Is(err, tcp.ErrInvalidHeartbeat) {
+				t.Error("\t\tShould refuse the configuration.", "X", err)
+			} else {
+				t.Log("\t\tShould refuse the configuration.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the peer answers and then stops answering heartbeats.")
+		{
+			events := make(chan string, 1000)
+
+			srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:   "tcp4",
+				Addr:      ":0",
+				Handlers:  tcpHeartbeatHandlers{},
+				Logger:    eventLogger(events),
+				Heartbeat: tcp.Heartbeat{Interval: 50 * time.Millisecond, MaxMissed: 2},
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a new TCP listener.", "X", err)
+			}
+			defer srv.Shutdown(context.Background())
+
+			go srv.Listen()
+
+			conn, err := net.Dial("tcp4", waitAddr(t, srv).String())
+			if err != nil {
+				t.Fatal("\t\tShould be able to dial a new TCP connection.", "X", err)
+			}
+			defer conn.Close()
+
+			bufReader := bufio.NewReader(conn)
+
+			var pings int
+			conn.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+			for {
+				line, err := bufReader.ReadString('\n')
+				if err != nil {
+					var netErr net.Error
+					if !errors.As(err, &netErr) || !netErr.Timeout() {
+						t.Fatal("\t\tShould stay connected while answering heartbeats.", "X", err)
+					}
+					break
+				}
+
+				if line == "PING\n" {
+					pings++
+					conn.Write([]byte("PONG\n"))
+				}
+			}
+
+			if pings == 0 {
+				t.Fatal("\t\tShould receive heartbeats while quiet.", "X")
+			}
+			t.Log("\t\tShould receive heartbeats while quiet.", "OK", pings)
+			t.Log("\t\tShould stay connected while answering heartbeats.", "OK")
+
+			pings = 0
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for {
+				line, err := bufReader.ReadString('\n')
+				if err != nil {
+					if !errors.Is(err, io.EOF) {
+						t.Fatal("\t\tShould be dropped after missing heartbeats.", "X", err)
+					}
+					break
+				}
+
+				if line == "PING\n" {
+					pings++
+				}
+			}
+			t.Log("\t\tShould be dropped after missing heartbeats.", "OK")
+
+			if pings != 2 {
+				t.Error("\t\tShould receive the max missed heartbeats before the drop.", "X", pings)
+			} else {
+				t.Log("\t\tShould receive the max missed heartbeats before the drop.", "OK")
+			}
+
+			var dropped bool
+			for len(events) > 0 {
+				if evt := <-events; strings.HasPrefix(evt, "drop: missed heartbeats") {
+					dropped = true
+				}
+			}
+
+			if !dropped {
+				t.Error("\t\tShould report a drop event for the missed heartbeats.", "X")
+			} else {
+				t.Log("\t\tShould report a drop event for the missed heartbeats.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the peer stays idle.")
+		{
+			srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:   "tcp4",
+				Addr:      ":0",
+				Handlers:  tcpHandlers{},
+				Logger:    tcpLogger,
+				Heartbeat: tcp.Heartbeat{IdleTimeout: 100 * time.Millisecond},
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a new TCP listener.", "X", err)
+			}
+			defer srv.Shutdown(context.Background())
+
+			go srv.Listen()
+
+			conn, err := net.Dial("tcp4", waitAddr(t, srv).String())
+			if err != nil {
+				t.Fatal("\t\tShould be able to dial a new TCP connection.", "X", err)
+			}
+			defer conn.Close()
+
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+			if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Error("\t\tShould be dropped after the idle timeout.", "X", err)
+			} else {
+				t.Log("\t\tShould be dropped after the idle timeout.", "OK")
+			}
+		}
+	}
+}
+
+// TestClientStats provides a test of messages sent concurrently being
+// counted on both sides of the connection.
+func TestClientStats(t *testing.T) {
+	t.Log("Given the need to send concurrently and track the I/O on a connection.")
+	{
+		srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+			NetType:  "tcp4",
+			Addr:     ":0",
+			Handlers: tcpHandlers{},
+			Logger:   tcpLogger,
+		})
+		if err != nil {
+			t.Fatal("\tShould be able to create a new TCP listener.", "X", err)
+		}
+		defer srv.Shutdown(context.Background())
+
+		go srv.Listen()
+
+		recv := make(chan string, 100)
+
+		cm, err := tcp.NewClientManager("TEST", tcp.ClientConfig{
+			Handlers: tcpClientHandlers{recv: recv},
+			Logger:   tcpLogger,
+		})
+		if err != nil {
+			t.Fatal("\tShould be able to create a client manager.", "X", err)
+		}
+		defer cm.Shutdown(context.Background())
+
+		clt, err := cm.Dial(context.Background(), "peer", "tcp4", waitAddr(t, srv).String())
+		if err != nil {
+			t.Fatal("\tShould be able to dial the server.", "X", err)
+		}
+		t.Log("\tShould be able to dial the server.", "OK")
+
+		const sends = 50
+
+		var wg sync.WaitGroup
+		for range sends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := clt.Send([]byte("Hello\n")); err != nil {
+					t.Error("\tShould be able to send concurrently.", "X", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		for i := range sends {
+			select {
+			case response := <-recv:
+				if response != "GOT IT\n" {
+					t.Fatalf("\tShould receive whole responses. %s %q", "X", response)
+				}
+
+			case <-time.After(2 * time.Second):
+				t.Fatalf("\tShould receive a response for every send. %s got %d", "X", i)
+			}
+		}
+		t.Log("\tShould receive a whole response for every send.", "OK")
+
+		// The server counts a response after it's written, which can be
+		// after the client read it.
+		var srvStat tcp.Stat
+		for range 100 {
+			if stats := srv.ClientStats(); len(stats) == 1 && stats[0].MsgsOut == sends {
+				srvStat = stats[0]
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		exp := tcp.Stat{MsgsIn: sends, MsgsOut: sends, BytesIn: sends * 6, BytesOut: sends * 7}
+		if srvStat.MsgsIn != exp.MsgsIn || srvStat.MsgsOut != exp.MsgsOut || srvStat.BytesIn != exp.BytesIn || srvStat.BytesOut != exp.BytesOut || srvStat.Errors != 0 {
+			t.Errorf("\tShould have the server stats. %s %+v", "X", srvStat)
+		} else {
+			t.Log("\tShould have the server stats.", "OK")
+		}
+
+		stats := cm.ClientStats()
+		if len(stats) != 1 {
+			t.Fatalf("\tShould have stats for the dialed connection. %s %d", "X", len(stats))
+		}
+
+		cltStat := stats[0]
+		exp = tcp.Stat{MsgsIn: sends, MsgsOut: sends, BytesIn: sends * 7, BytesOut: sends * 6}
+		if cltStat.Key != "peer" || cltStat.MsgsIn != exp.MsgsIn || cltStat.MsgsOut != exp.MsgsOut || cltStat.BytesIn != exp.BytesIn || cltStat.BytesOut != exp.BytesOut || cltStat.Errors != 0 {
+			t.Errorf("\tShould have the client manager stats. %s %+v", "X", cltStat)
+		} else {
+			t.Log("\tShould have the client manager stats.", "OK")
+		}
+	}
+}
+
+// TestUserIndex provides a test of reaching connections by user ID.
+func TestUserIndex(t *testing.T) {
+	t.Log("Given the need to reach connections by user ID.")
+	{
+		srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+			NetType:  "tcp4",
+			Addr:     ":0",
+			Handlers: tcpUserHandlers{},
+			Logger:   tcpLogger,
+		})
+		if err != nil {
+			t.Fatal("\tShould be able to create a new TCP listener.", "X", err)
+		}
+		defer srv.Shutdown(context.Background())
+
+		go srv.Listen()
+
+		addr := waitAddr(t, srv).String()
+
+		type peer struct {
+			conn      net.Conn
+			bufReader *bufio.Reader
+		}
+
+		connect := func(userID string) peer {
+			conn, err := net.Dial("tcp4", addr)
+			if err != nil {
+				t.Fatal("\tShould be able to dial a new TCP connection.", "X", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+
+			if _, err := conn.Write([]byte(userID + "\n")); err != nil {
+				t.Fatal("\tShould be able to send the user ID.", "X", err)
+			}
+
+			return peer{conn: conn, bufReader: bufio.NewReader(conn)}
+		}
+
+		alice1 := connect("alice")
+		alice2 := connect("alice")
+		bob := connect("bob")
+
+		for range 100 {
+			if len(srv.Clients()) == 3 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		recv := func(p peer) (string, error) {
+			p.conn.SetReadDeadline(time.Now().Add(time.Second))
+			return p.bufReader.ReadString('\n')
+		}
+
+		t.Log("\tWhen sending to a user.")
+		{
+			if err := srv.SendTo("alice", []byte("to alice\n")); err != nil {
+				t.Fatal("\t\tShould be able to send to the user.", "X", err)
+			}
+
+			for _, p := range []peer{alice1, alice2} {
+				if line, err := recv(p); err != nil || line != "to alice\n" {
+					t.Error("\t\tShould receive the data on every connection for the user.", "X", line, err)
+				} else {
+					t.Log("\t\tShould receive the data on every connection for the user.", "OK")
+				}
+			}
+
+			if err := srv.SendTo("nobody", []byte("lost\n")); !errors.Is(err, tcp.ErrUserNotConnected) {
+				t.Error("\t\tShould get an error for a user that isn't connected.", "X", err)
+			} else {
+				t.Log("\t\tShould get an error for a user that isn't connected.", "OK")
+			}
+		}
+
+		t.Log("\tWhen broadcasting.")
+		{
+			if err := srv.Broadcast([]byte("to all\n")); err != nil {
+				t.Fatal("\t\tShould be able to broadcast.", "X", err)
+			}
+
+			for _, p := range []peer{alice1, alice2, bob} {
+				if line, err := recv(p); err != nil || line != "to all\n" {
+					t.Error("\t\tShould receive the data on every connection.", "X", line, err)
+				} else {
+					t.Log("\t\tShould receive the data on every connection.", "OK")
+				}
+			}
+		}
+
+		t.Log("\tWhen closing a user's connections.")
+		{
+			if err := srv.CloseByUserID("alice"); err != nil {
+				t.Fatal("\t\tShould be able to close the user's connections.", "X", err)
+			}
+
+			for _, p := range []peer{alice1, alice2} {
+				if _, err := recv(p); !errors.Is(err, io.EOF) {
+					t.Error("\t\tShould close every connection for the user.", "X", err)
+				} else {
+					t.Log("\t\tShould close every connection for the user.", "OK")
+				}
+			}
+
+			if err := srv.SendTo("bob", []byte("to bob\n")); err != nil {
+				t.Fatal("\t\tShould still be able to send to other users.", "X", err)
+			}
+
+			if line, err := recv(bob); err != nil || line != "to bob\n" {
+				t.Error("\t\tShould still be able to send to other users.", "X", line, err)
+			} else {
+				t.Log("\t\tShould still be able to send to other users.", "OK")
+			}
+		}
+
+		t.Log("\tWhen closing a client by address.")
+		{
+			if err := srv.CloseClient(bob.conn.LocalAddr().(*net.TCPAddr)); err != nil {
+				t.Fatal("\t\tShould find the client by address.", "X", err)
+			}
+
+			if _, err := recv(bob); !errors.Is(err, io.EOF) {
+				t.Error("\t\tShould close the client.", "X", err)
+			} else {
+				t.Log("\t\tShould close the client.", "OK")
+			}
+		}
+
+		t.Log("\tWhen sending to a user from the client manager.")
+		{
+			recv := make(chan string, 1)
+
+			cm, err := tcp.NewClientManager("TEST", tcp.ClientConfig{
+				Handlers: tcpClientHandlers{recv: recv},
+				Logger:   tcpLogger,
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a client manager.", "X", err)
+			}
+			defer cm.Shutdown(context.Background())
+
+			clt, err := cm.Dial(context.Background(), "key", "tcp4", addr)
+			if err != nil {
+				t.Fatal("\t\tShould be able to dial the server.", "X", err)
+			}
+
+			if err := cm.SendTo("carol", []byte("carol\n")); !errors.Is(err, tcp.ErrUserNotConnected) {
+				t.Error("\t\tShould not find the user before the user ID is set.", "X", err)
+			} else {
+				t.Log("\t\tShould not find the user before the user ID is set.", "OK")
+			}
+
+			clt.SetUserID("carol")
+
+			// The first line sent is the user ID for the server and the
+			// second is echoed.
+			if err := cm.SendTo("carol", []byte("carol\n")); err != nil {
+				t.Fatal("\t\tShould be able to send to the user.", "X", err)
+			}
+
+			if err := cm.SendTo("carol", []byte("hello\n")); err != nil {
+				t.Fatal("\t\tShould be able to send to the user.", "X", err)
+			}
+
+			select {
+			case response := <-recv:
+				if response != "GOT IT\n" {
+					t.Error("\t\tShould receive the response.", "X", response)
+				} else {
+					t.Log("\t\tShould receive the response.", "OK")
+				}
+
+			case <-time.After(2 * time.Second):
+				t.Error("\t\tShould receive the response.", "X", "timeout")
+			}
+		}
+	}
+}
+
+// TestMiddleware provides a test of the middleware wrapped around the
+// processing of requests.
+func TestMiddleware(t *testing.T) {
+	t.Log("Given the need to wrap the processing of requests with middleware.")
+	{
+		events := make(chan string, 1000)
+		traceIDs := make(chan uuid.UUID, 100)
+
+		order := make(chan string, 100)
+		record := func(name string) tcp.MidFunc {
+			return func(next tcp.ProcessFunc) tcp.ProcessFunc {
+				return func(r *tcp.Request, clt *tcp.Client) {
+					order <- name
+					next(r, clt)
+				}
+			}
+		}
+
+		srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+			NetType:  "tcp4",
+			Addr:     ":0",
+			Handlers: tcpMidHandlers{traceIDs: traceIDs},
+			Logger:   eventLogger(events),
+			Middleware: []tcp.MidFunc{
+				record("first"),
+				tcp.Timing(0),
+				tcp.Panics(),
+				tcp.RateLimit(rate.Every(time.Hour), 100),
+				tcp.RateLimit(rate.Every(time.Hour), 3),
+				record("last"),
+			},
+		})
+		if err != nil {
+			t.Fatal("\tShould be able to create a new TCP listener.", "X", err)
+		}
+		defer srv.Shutdown(context.Background())
+
+		go srv.Listen()
+
+		conn, err := net.Dial("tcp4", waitAddr(t, srv).String())
+		if err != nil {
+			t.Fatal("\tShould be able to dial a new TCP connection.", "X", err)
+		}
+		defer conn.Close()
+
+		bufReader := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		t.Log("\tWhen processing a request panics.")
+		{
+			if _, err := conn.Write([]byte("PANIC\nHello\n")); err != nil {
+				t.Fatal("\t\tShould be able to send data to the connection.", "X", err)
+			}
+
+			if response, err := bufReader.ReadString('\n'); err != nil || response != "GOT IT\n" {
+				t.Fatal("\t\tShould keep processing requests after the panic.", "X", response, err)
+			}
+			t.Log("\t\tShould keep processing requests after the panic.", "OK")
+
+			if !hasEvent(events, "process: PANIC[ asked to panic ]") {
+				t.Error("\t\tShould report the panic as an event.", "X")
+			} else {
+				t.Log("\t\tShould report the panic as an event.", "OK")
+			}
+		}
+
+		t.Log("\tWhen requests are processed.")
+		{
+			if _, err := conn.Write([]byte("Hello\n")); err != nil {
+				t.Fatal("\t\tShould be able to send data to the connection.", "X", err)
+			}
+
+			if response, err := bufReader.ReadString('\n'); err != nil || response != "GOT IT\n" {
+				t.Fatal("\t\tShould receive the response.", "X", response, err)
+			}
+
+			id1, id2 := <-traceIDs, <-traceIDs
+			if id1 == uuid.Nil || id2 == uuid.Nil || id1 == id2 {
+				t.Error("\t\tShould have a trace ID for each request.", "X", id1, id2)
+			} else {
+				t.Log("\t\tShould have a trace ID for each request.", "OK")
+			}
+
+			if !hasEvent(events, "process: request completed") {
+				t.Error("\t\tShould report the timing of the request.", "X")
+			} else {
+				t.Log("\t\tShould report the timing of the request.", "OK")
+			}
+
+			var got []string
+			for range 6 {
+				got = append(got, <-order)
+			}
+
+			if exp := []string{"first", "last", "first", "last", "first", "last"}; !slices.Equal(got, exp) {
+				t.Error("\t\tShould execute the middleware in order.", "X", got)
+			} else {
+				t.Log("\t\tShould execute the middleware in order.", "OK")
+			}
+		}
+
+		t.Log("\tWhen requests go over the rate limit.")
+		{
+			if _, err := conn.Write([]byte("Hello\nHello\n")); err != nil {
+				t.Fatal("\t\tShould be able to send data to the connection.", "X", err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if response, err := bufReader.ReadString('\n'); !errors.Is(err, io.EOF) {
+				t.Error("\t\tShould close the connection over the limit.", "X", response, err)
+			} else {
+				t.Log("\t\tShould close the connection over the limit.", "OK")
+			}
+
+			if !hasEvent(events, "process: rate limited") {
+				t.Error("\t\tShould report the requests over the limit.", "X")
+			} else {
+				t.Log("\t\tShould report the requests over the limit.", "OK")
+			}
+		}
+	}
+}
+
+// TestAdmission provides a test of the limits on the connections the server
+// accepts.
+func TestAdmission(t *testing.T) {
+	t.Log("Given the need to limit the connections the server accepts.")
+	{
+		start := func(handlers tcp.Handlers, adm tcp.Admission, events chan string) string {
+			srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:   "tcp4",
+				Addr:      ":0",
+				Handlers:  handlers,
+				Logger:    eventLogger(events),
+				Admission: adm,
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a new TCP listener.", "X", err)
+			}
+			t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+			go srv.Listen()
+
+			return waitAddr(t, srv).String()
+		}
+
+		dial := func(addr string) net.Conn {
+			conn, err := net.Dial("tcp4", addr)
+			if err != nil {
+				t.Fatal("\t\tShould be able to dial a new TCP connection.", "X", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+
+			return conn
+		}
+
+		// rejected reports if the server closed the connection without
+		// anything being sent.
+		rejected := func(conn net.Conn) bool {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err := conn.Read(make([]byte, 1))
+			return errors.Is(err, io.EOF)
+		}
+
+		t.Log("\tWhen the configuration has an invalid CIDR.")
+		{
+			_, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:   "tcp4",
+				Addr:      ":0",
+				Handlers:  tcpHandlers{},
+				Logger:    tcpLogger,
+				Admission: tcp.Admission{Allow: []string{"10.0.0.0/33"}},
+			})
+			if !errors.Is(err, tcp.ErrInvalidAdmission) {
+				t.Error("\t\tShould refuse the configuration.", "X", err)
+			} else {
+				t.Log("\t\tShould refuse the configuration.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the IP is denied or not allowed.")
+		{
+			for _, adm := range []tcp.Admission{
+				{Deny: []string{"127.0.0.0/8"}},
+				{Allow: []string{"10.0.0.0/8", "::1"}},
+				{Allow: []string{"127.0.0.1"}, Deny: []string{"127.0.0.1"}},
+			} {
+				events := make(chan string, 100)
+				conn := dial(start(tcpHandlers{}, adm, events))
+
+				if !rejected(conn) {
+					t.Error("\t\tShould reject the connection.", "X", adm)
+				} else {
+					t.Log("\t\tShould reject the connection.", "OK")
+				}
+
+				if !hasEvent(events, "accept: rejected") {
+					t.Error("\t\tShould report the rejection.", "X")
+				} else {
+					t.Log("\t\tShould report the rejection.", "OK")
+				}
+			}
+
+			conn := dial(start(tcpHandlers{}, tcp.Admission{Allow: []string{"127.0.0.1"}}, make(chan string, 100)))
+			if rejected(conn) {
+				t.Error("\t\tShould accept an allowed IP.", "X")
+			} else {
+				t.Log("\t\tShould accept an allowed IP.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the max clients are connected.")
+		{
+			for _, adm := range []tcp.Admission{{MaxClients: 2}, {MaxPerIP: 2}} {
+				addr := start(tcpHandlers{}, adm, make(chan string, 100))
+
+				conn1 := dial(addr)
+				conn2 := dial(addr)
+
+				if rejected(conn1) || rejected(conn2) {
+					t.Fatal("\t\tShould accept connections up to the max.", "X", adm)
+				}
+				t.Log("\t\tShould accept connections up to the max.", "OK")
+
+				if !rejected(dial(addr)) {
+					t.Error("\t\tShould reject connections over the max.", "X", adm)
+				} else {
+					t.Log("\t\tShould reject connections over the max.", "OK")
+				}
+
+				// Closing a connection makes room for another once the
+				// server sees it's gone.
+				conn1.Close()
+
+				var accepted bool
+				for range 20 {
+					if !rejected(dial(addr)) {
+						accepted = true
+						break
+					}
+				}
+
+				if !accepted {
+					t.Error("\t\tShould accept a connection once one is closed.", "X", adm)
+				} else {
+					t.Log("\t\tShould accept a connection once one is closed.", "OK")
+				}
+			}
+		}
+
+		t.Log("\tWhen connections come in faster than the accept rate.")
+		{
+			addr := start(tcpHandlers{}, tcp.Admission{AcceptRate: rate.Every(time.Hour), AcceptBurst: 1}, make(chan string, 100))
+
+			if rejected(dial(addr)) {
+				t.Error("\t\tShould accept the burst.", "X")
+			} else {
+				t.Log("\t\tShould accept the burst.", "OK")
+			}
+
+			if !rejected(dial(addr)) {
+				t.Error("\t\tShould reject connections over the rate.", "X")
+			} else {
+				t.Log("\t\tShould reject connections over the rate.", "OK")
+			}
+		}
+
+		t.Log("\tWhen a connection doesn't complete Bind.")
+		{
+			events := make(chan string, 100)
+			addr := start(tcpUserHandlers{}, tcp.Admission{BindTimeout: 500 * time.Millisecond}, events)
+
+			stalled := dial(addr)
+
+			// The stalled connection doesn't hold up other connections.
+			conn := dial(addr)
+			conn.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+
+			if _, err := conn.Write([]byte("bill\nHello\n")); err != nil {
+				t.Fatal("\t\tShould be able to send data to the connection.", "X", err)
+			}
+
+			if response, err := bufio.NewReader(conn).ReadString('\n'); err != nil || response != "GOT IT\n" {
+				t.Error("\t\tShould bind other connections while one is stalled.", "X", response, err)
+			} else {
+				t.Log("\t\tShould bind other connections while one is stalled.", "OK")
+			}
+
+			stalled.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := stalled.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Error("\t\tShould close the connection after the bind timeout.", "X", err)
+			} else {
+				t.Log("\t\tShould close the connection after the bind timeout.", "OK")
+			}
+
+			if !hasEvent(events, "accept: bind timeout") {
+				t.Error("\t\tShould report the bind timeout.", "X")
+			} else {
+				t.Log("\t\tShould report the bind timeout.", "OK")
+			}
+		}
+	}
+}
+
+// TestLifecycle tests that listening and dialing are controlled through the
+// context and that dropped peers are dialed again.
+func TestLifecycle(t *testing.T) {
+	t.Log("Given the need to control the lifecycle of connections.")
+	{
+		t.Log("\tWhen the context for listening is canceled.")
+		{
+			srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:  "tcp4",
+				Addr:     ":0",
+				Handlers: tcpHandlers{},
+				Logger:   tcpLogger,
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a new TCP listener.", "X", err)
+			}
+			defer srv.Shutdown(context.Background())
+
+			ctx, cancel := context.WithCancel(context.Background())
+
+			listenErr := make(chan error, 1)
+			go func() {
+				listenErr <- srv.ListenContext(ctx)
+			}()
+
+			addr := waitAddr(t, srv).String()
+
+			cancel()
+
+			select {
+			case err := <-listenErr:
+				if err != nil {
+					t.Fatal("\t\tShould stop listening without an error.", "X", err)
+				}
+				t.Log("\t\tShould stop listening without an error.", "OK")
+
+			case <-time.After(time.Second):
+				t.Fatal("\t\tShould stop listening.", "X")
+			}
+
+			if conn, err := net.Dial("tcp4", addr); err == nil {
+				conn.Close()
+				t.Error("\t\tShould not accept new connections.", "X")
+			} else {
+				t.Log("\t\tShould not accept new connections.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the dial is canceled or times out.")
+		{
+			cm, err := tcp.NewClientManager("TEST", tcp.ClientConfig{
+				Handlers:    tcpUserHandlers{},
+				Logger:      tcpLogger,
+				BindTimeout: 100 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a client manager.", "X", err)
+			}
+			defer cm.Shutdown(context.Background())
+
+			// The listener accepts connections but never sends the line
+			// the handlers need to bind.
+			ln, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("\t\tShould be able to listen.", "X", err)
+			}
+			defer ln.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			if _, err := cm.DialContext(ctx, "canceled", "tcp4", ln.Addr().String()); !errors.Is(err, context.Canceled) {
+				t.Error("\t\tShould not dial with a canceled context.", "X", err)
+			} else {
+				t.Log("\t\tShould not dial with a canceled context.", "OK")
+			}
+
+			if _, err := cm.DialContext(context.Background(), "stalled", "tcp4", ln.Addr().String()); !errors.Is(err, tcp.ErrBindTimeout) {
+				t.Error("\t\tShould stop a dial that doesn't bind in time.", "X", err)
+			} else {
+				t.Log("\t\tShould stop a dial that doesn't bind in time.", "OK")
+			}
+		}
+
+		t.Log("\tWhen a dialed peer drops with a redial policy.")
+		{
+			srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:  "tcp4",
+				Addr:     ":0",
+				Handlers: tcpHandlers{},
+				Logger:   tcpLogger,
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a new TCP listener.", "X", err)
+			}
+			defer srv.Shutdown(context.Background())
+
+			go srv.Listen()
+
+			addr := waitAddr(t, srv).String()
+
+			events := make(chan string, 1000)
+
+			cm, err := tcp.NewClientManager("TEST", tcp.ClientConfig{
+				Handlers: tcpClientHandlers{recv: make(chan string, 100)},
+				Logger:   eventLogger(events),
+				Redial: tcp.Redial{
+					MaxAttempts: 3,
+					Backoff:     tcp.Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond, Jitter: 0.5},
+				},
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a client manager.", "X", err)
+			}
+			defer cm.Shutdown(context.Background())
+
+			clt, err := cm.DialContext(context.Background(), "peer", "tcp4", addr)
+			if err != nil {
+				t.Fatal("\t\tShould be able to dial the server.", "X", err)
+			}
+			clt.SetUserID("bob")
+
+			// The server closes its side of the connection.
+			for range 100 {
+				if err = srv.CloseClient(clt.Conn.LocalAddr().(*net.TCPAddr)); err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal("\t\tShould be able to close the connection on the server.", "X", err)
+			}
+
+			if !hasEvent(events, "redial: connected") {
+				t.Fatal("\t\tShould dial the peer again.", "X")
+			}
+			t.Log("\t\tShould dial the peer again.", "OK")
+
+			redialed, err := cm.Retrieve(context.Background(), "peer")
+			if err != nil || redialed == clt || redialed.UserID() != "bob" {
+				t.Error("\t\tShould replace the connection and keep the user ID.", "X", err)
+			} else {
+				t.Log("\t\tShould replace the connection and keep the user ID.", "OK")
+			}
+
+			if err := cm.CloseByUserID("bob"); err != nil {
+				t.Fatal("\t\tShould be able to close the connection by user ID.", "X", err)
+			}
+
+			if hasEvent(events, "redial:") {
+				t.Error("\t\tShould not dial a peer closed on purpose.", "X")
+			} else {
+				t.Log("\t\tShould not dial a peer closed on purpose.", "OK")
+			}
+
+			if _, err := cm.DialContext(context.Background(), "peer", "tcp4", addr); err != nil {
+				t.Fatal("\t\tShould be able to dial the server.", "X", err)
+			}
+
+			// Without the server every attempt fails.
+			srv.Shutdown(context.Background())
+
+			if !hasEvent(events, "redial: giving up") {
+				t.Error("\t\tShould give up after the max attempts.", "X")
+			} else {
+				t.Log("\t\tShould give up after the max attempts.", "OK")
+			}
+		}
+
+		t.Log("\tWhen a peer is dialed for a user.")
+		{
+			srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:  "tcp4",
+				Addr:     ":0",
+				Handlers: tcpHandlers{},
+				Logger:   tcpLogger,
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a new TCP listener.", "X", err)
+			}
+			defer srv.Shutdown(context.Background())
+
+			go srv.Listen()
+
+			cm, err := tcp.NewClientManager("TEST", tcp.ClientConfig{
+				Handlers: tcpClientHandlers{recv: make(chan string, 100)},
+				Logger:   tcpLogger,
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a client manager.", "X", err)
+			}
+			defer cm.Shutdown(context.Background())
+
+			clt, err := cm.DialUserContext(context.Background(), "peer", "carol", "tcp4", waitAddr(t, srv).String())
+			if err != nil {
+				t.Fatal("\t\tShould be able to dial the server.", "X", err)
+			}
+
+			if clt.UserID() != "carol" {
+				t.Error("\t\tShould set the user ID when the peer is dialed.", "X", clt.UserID())
+			} else {
+				t.Log("\t\tShould set the user ID when the peer is dialed.", "OK")
+			}
+
+			if err := cm.SendTo("carol", []byte("hello\n")); err != nil {
+				t.Error("\t\tShould be able to reach the peer by user ID.", "X", err)
+			} else {
+				t.Log("\t\tShould be able to reach the peer by user ID.", "OK")
+			}
+		}
+	}
+}
+
+// TestProxyProtocol tests that connections through a trusted proxy have the
+// address of the source from the PROXY header.
+func TestProxyProtocol(t *testing.T) {
+	t.Log("Given the need to accept connections through a load balancer.")
+	{
+		start := func(trusted []string, adm tcp.Admission, events chan string) (*tcp.Server, string) {
+			srv, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:   "tcp4",
+				Addr:      ":0",
+				Handlers:  tcpUserHandlers{},
+				Logger:    eventLogger(events),
+				Admission: adm,
+				Proxy:     tcp.ProxyProtocol{Trusted: trusted},
+			})
+			if err != nil {
+				t.Fatal("\t\tShould be able to create a new TCP listener.", "X", err)
+			}
+			t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+			go srv.Listen()
+
+			return srv, waitAddr(t, srv).String()
+		}
+
+		// send dials the server, writes the data and returns the response.
+		send := func(addr string, data []byte) (string, error) {
+			conn, err := net.Dial("tcp4", addr)
+			if err != nil {
+				t.Fatal("\t\tShould be able to dial a new TCP connection.", "X", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+
+			if _, err := conn.Write(data); err != nil {
+				return "", err
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			return bufio.NewReader(conn).ReadString('\n')
+		}
+
+		// sourceIP waits for a client from the source to be bound.
+		sourceIP := func(srv *tcp.Server, ip string) bool {
+			for range 100 {
+				for _, stat := range srv.ClientStats() {
+					if stat.IP == ip {
+						return true
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			return false
+		}
+
+		v2Header := func(src net.IP, dst net.IP, srcPort uint16, dstPort uint16) []byte {
+			fam := byte(0x11)
+			if src.To4() == nil {
+				fam = 0x21
+			} else {
+				src, dst = src.To4(), dst.To4()
+			}
+
+			hdr := []byte("\r\n\r\n\x00\r\nQUIT\n")
+			hdr = append(hdr, 0x21, fam)
+			hdr = binary.BigEndian.AppendUint16(hdr, uint16(2*len(src)+4))
+			hdr = append(hdr, src...)
+			hdr = append(hdr, dst...)
+			hdr = binary.BigEndian.AppendUint16(hdr, srcPort)
+			hdr = binary.BigEndian.AppendUint16(hdr, dstPort)
+
+			return hdr
+		}
+
+		t.Log("\tWhen the configuration has an invalid CIDR.")
+		{
+			_, err := tcp.NewServer("TEST", tcp.ServerConfig{
+				NetType:  "tcp4",
+				Addr:     ":0",
+				Handlers: tcpHandlers{},
+				Logger:   tcpLogger,
+				Proxy:    tcp.ProxyProtocol{Trusted: []string{"lb"}},
+			})
+			if !errors.Is(err, tcp.ErrInvalidProxy) {
+				t.Error("\t\tShould refuse the configuration.", "X", err)
+			} else {
+				t.Log("\t\tShould refuse the configuration.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the connection is from a trusted proxy.")
+		{
+			events := make(chan string, 100)
+			srv, addr := start([]string{"127.0.0.0/8"}, tcp.Admission{}, events)
+
+			headers := []struct {
+				name string
+				ip   string
+				data []byte
+			}{
+				{"v1", "203.0.113.7:4242", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 4000\r\n")},
+				{"v2 IPv4", "198.51.100.9:5151", v2Header(net.ParseIP("198.51.100.9"), net.ParseIP("10.0.0.1"), 5151, 4000)},
+				{"v2 IPv6", "2001:db8::1:6262", v2Header(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 6262, 4000)},
+			}
+
+			for _, hdr := range headers {
+				data := append(hdr.data, []byte("bill\nHello\n")...)
+
+				if response, err := send(addr, data); err != nil || response != "GOT IT\n" {
+					t.Error("\t\tShould process requests after the header.", "X", hdr.name, response, err)
+				} else {
+					t.Log("\t\tShould process requests after the header.", "OK", hdr.name)
+				}
+
+				if !sourceIP(srv, hdr.ip) {
+					t.Error("\t\tShould have the address of the source.", "X", hdr.name, srv.ClientStats())
+				} else {
+					t.Log("\t\tShould have the address of the source.", "OK", hdr.name)
+				}
+			}
+
+			if _, err := send(addr, []byte("bill\nHello\n")); err == nil {
+				t.Error("\t\tShould reject a connection without a header.", "X")
+			} else {
+				t.Log("\t\tShould reject a connection without a header.", "OK")
+			}
+
+			if !hasEvent(events, "accept: invalid PROXY header") {
+				t.Error("\t\tShould report the missing header.", "X")
+			} else {
+				t.Log("\t\tShould report the missing header.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the limits apply to the source.")
+		{
+			_, addr := start([]string{"127.0.0.1"}, tcp.Admission{MaxPerIP: 1}, make(chan string, 100))
+
+			if response, err := send(addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 4000\r\nbill\nHello\n")); err != nil || response != "GOT IT\n" {
+				t.Fatal("\t\tShould accept the first connection from the source.", "X", response, err)
+			}
+			t.Log("\t\tShould accept the first connection from the source.", "OK")
+
+			if response, err := send(addr, []byte("PROXY TCP4 203.0.113.8 10.0.0.1 4242 4000\r\nbill\nHello\n")); err != nil || response != "GOT IT\n" {
+				t.Error("\t\tShould accept a connection from another source.", "X", response, err)
+			} else {
+				t.Log("\t\tShould accept a connection from another source.", "OK")
+			}
+
+			if _, err := send(addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4343 4000\r\nbill\nHello\n")); err == nil {
+				t.Error("\t\tShould reject connections over the max for the source.", "X")
+			} else {
+				t.Log("\t\tShould reject connections over the max for the source.", "OK")
+			}
+		}
+
+		t.Log("\tWhen the connection is not from a trusted proxy.")
+		{
+			events := make(chan string, 100)
+			_, addr := start([]string{"10.0.0.0/8"}, tcp.Admission{}, events)
+
+			if response, err := send(addr, []byte("bill\nHello\n")); err != nil || response != "GOT IT\n" {
+				t.Error("\t\tShould accept a connection without a header.", "X", response, err)
+			} else {
+				t.Log("\t\tShould accept a connection without a header.", "OK")
+			}
+
+			if _, err := send(addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 4000\r\nbill\nHello\n")); err == nil {
+				t.Error("\t\tShould reject a connection with a header.", "X")
+			} else {
+				t.Log("\t\tShould reject a connection with a header.", "OK")
+			}
+
+			if !hasEvent(events, "accept: PROXY header from untrusted source") {
+				t.Error("\t\tShould report the untrusted header.", "X")
+			} else {
+				t.Log("\t\tShould report the untrusted header.", "OK")
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsHandshakeTimeout is how long a peer has to complete the TLS handshake.
+const tlsHandshakeTimeout = 5 * time.Second
+
+// Set of errors for TLS configuration and connections.
+var (
+	ErrInvalidTLSConfig = errors.New("invalid tls configuration")
+	ErrPeerNotPinned    = errors.New("peer certificate not pinned")
+)
+
+// TLSConfig provides the settings for mutually authenticated TLS connections.
+// Both sides present a certificate. The peer's certificate is verified against
+// the CAs in CAFile, pinned by the SHA-256 fingerprints of the certificates
+// in Fingerprints, or both. Without a CAFile the pins are the only check,
+// which allows self-signed certificates.
+type TLSConfig struct {
+	CertFile     string   // PEM encoded certificate for this side.
+	KeyFile      string   // PEM encoded private key for the certificate.
+	CAFile       string   // PEM encoded CAs trusted to sign peer certificates.
+	ServerName   string   // Name expected in the server's certificate when dialing.
+	Fingerprints []string // Hex SHA-256 fingerprints of the allowed peer certificates.
+}
+
+func (cfg TLSConfig) validate() error {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return fmt.Errorf("%w: missing certificate or key", ErrInvalidTLSConfig)
+	}
+
+	if cfg.CAFile == "" && len(cfg.Fingerprints) == 0 {
+		return fmt.Errorf("%w: peers must be verified by a CA or pinned", ErrInvalidTLSConfig)
+	}
+
+	for _, fp := range cfg.Fingerprints {
+		if _, err := parseFingerprint(fp); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidTLSConfig, err)
+		}
+	}
+
+	return nil
+}
+
+// Fingerprint returns the hex encoded SHA-256 fingerprint of the certificate
+// used to pin a peer.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// =============================================================================
+
+// serverTLS builds the TLS configuration for accepting connections.
+func (cfg TLSConfig) serverTLS() (*tls.Config, error) {
+	tlsCfg, pool, err := cfg.load()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg.ClientAuth = tls.RequireAnyClientCert
+	if pool != nil {
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsCfg.ClientCAs = pool
+	}
+
+	return tlsCfg, nil
+}
+
+// clientTLS builds the TLS configuration for dialing connections. Without a
+// CA the standard verification is replaced by the pins.
+func (cfg TLSConfig) clientTLS() (*tls.Config, error) {
+	tlsCfg, pool, err := cfg.load()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg.ServerName = cfg.ServerName
+	tlsCfg.RootCAs = pool
+	tlsCfg.InsecureSkipVerify = pool == nil
+
+	return tlsCfg, nil
+}
+
+func (cfg TLSConfig) load() (*tls.Config, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load key pair: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read ca file: %w", err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("%w: no certificates in %s", ErrInvalidTLSConfig, cfg.CAFile)
+		}
+	}
+
+	pins := make([][]byte, len(cfg.Fingerprints))
+	for i, fp := range cfg.Fingerprints {
+		pins[i], _ = parseFingerprint(fp)
+	}
+
+	tlsCfg := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		},
+	}
+
+	return &tlsCfg, pool, nil
+}
+
+// verifyPins checks the peer's certificate is one of the pinned certificates.
+// It runs after the standard verification, if any, so both have to pass.
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	if len(pins) == 0 {
+		return nil
+	}
+
+	if len(cs.PeerCertificates) == 0 {
+		return ErrPeerNotPinned
+	}
+
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	for _, pin := range pins {
+		if bytes.Equal(sum[:], pin) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrPeerNotPinned, hex.EncodeToString(sum[:]))
+}
+
+// tlsHandshake completes the handshake on the connection so the peer is
+// verified before the connection is bound. The connection is closed when the
+// handshake fails.
+func tlsHandshake(ctx context.Context, conn *tls.Conn) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+
+	return conn, nil
+}
+
+// parseFingerprint accepts a fingerprint in hex with or without colons.
+func parseFingerprint(fp string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(fp, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint: %q", fp)
+	}
+
+	return b, nil
+}